@@ -1,14 +1,22 @@
 package cache
 
 import (
+	"bytes"
+	"compress/flate"
 	"container/list"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -35,9 +43,35 @@ type Cache struct {
 	capacity int
 	entries  map[uint32]*list.Element
 	values   *list.List
-	mu       sync.RWMutex
-	now      func() time.Time
-	queue    *queue
+	// negatives contains the NXDOMAIN values, when they are stored in their own partition of size negativeCapacity
+	negatives        *list.List
+	negativeCapacity int
+	mu               sync.RWMutex
+	now              func() time.Time
+	queue            *queue
+	stats            counters
+	done             chan bool
+	once             sync.Once
+	// ctx is done when the cache is closed, which cancels refreshes in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	prefetchThreshold uint64
+	servfailTTL       time.Duration
+	zeroTTL           time.Duration
+	persistNegative   bool
+
+	refreshMu  sync.Mutex
+	refreshing map[uint32]bool
+}
+
+type counters struct {
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	expirations   atomic.Uint64
+	refreshes     atomic.Uint64
+	refreshErrors atomic.Uint64
 }
 
 // Value wraps a DNS message stored in the cache.
@@ -45,15 +79,31 @@ type Value struct {
 	Key       uint32
 	CreatedAt time.Time
 	msg       *dns.Msg
+	hits      *atomic.Uint64
+	setHits   uint64 // Hits when the value was set, which tells whether it has been read since it was last refreshed
+	// ttl overrides the TTL of msg when non-zero. This is used for failures, which have no records to derive a TTL from.
+	ttl time.Duration
 }
 
 // Stats contains cache statistics.
 type Stats struct {
-	Size         int
-	Capacity     int
-	PendingTasks int
+	Size                int
+	Capacity            int
+	NegativeSize        int // Size of the partition for NXDOMAIN values, if any
+	NegativeCapacity    int
+	PendingTasks        int
+	Hits                uint64
+	Misses              uint64
+	Evictions           uint64 // Values evicted because the cache was full
+	Expirations         uint64 // Values evicted because their TTL passed
+	Refreshes           uint64 // Successful prefetch refreshes
+	RefreshErrors       uint64 // Failed prefetch refreshes
+	RecommendedCapacity int
 }
 
+// minMissRatio is the miss ratio at which a larger capacity is recommended.
+const minMissRatio = 0.5
+
 // Rcode returns the response code of the cached value v.
 func (v *Value) Rcode() int { return v.msg.Rcode }
 
@@ -67,10 +117,60 @@ func (v *Value) Qtype() uint16 { return v.msg.Question[0].Qtype }
 func (v *Value) Answers() []string { return dnsutil.Answers(v.msg) }
 
 // TTL returns the time to live of the cached value v.
-func (v *Value) TTL() time.Duration { return dnsutil.MinTTL(v.msg) }
+func (v *Value) TTL() time.Duration {
+	if v.ttl > 0 {
+		return v.ttl
+	}
+	return dnsutil.MinTTL(v.msg)
+}
+
+// Stale returns whether the TTL of cached value v has passed at time now.
+func (v *Value) Stale(now time.Time) bool { return now.After(v.CreatedAt.Add(v.TTL())) }
+
+// MsgAt returns a copy of the DNS message of cached value v, where the TTL of each record is decremented by the time
+// elapsed between the creation of v and now. TTLs are never decremented below 1 second.
+func (v *Value) MsgAt(now time.Time) *dns.Msg {
+	msg := v.msg.Copy()
+	elapsed := now.Sub(v.CreatedAt) / time.Second
+	if elapsed <= 0 {
+		return msg
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue // TTL field contains flags
+			}
+			if int64(h.Ttl) > int64(elapsed) {
+				h.Ttl -= uint32(elapsed)
+			} else {
+				h.Ttl = 1
+			}
+		}
+	}
+	return msg
+}
+
+// Hits returns the number of times the cached value v has been read.
+func (v *Value) Hits() uint64 {
+	if v.hits == nil {
+		return 0
+	}
+	return v.hits.Load()
+}
+
+// compressedPrefix is the prefix of the message in a packed Value whose message is compressed. The prefix is not
+// hexadecimal, which distinguishes compressed messages from uncompressed ones.
+const compressedPrefix = "z1:"
 
 // Pack returns a string representation of Value v.
-func (v *Value) Pack() (string, error) {
+func (v *Value) Pack() (string, error) { return v.pack(false) }
+
+// PackCompressed returns a string representation of Value v, where the message is compressed with DEFLATE. This is
+// smaller than the representation returned by Pack for all but the smallest messages.
+func (v *Value) PackCompressed() (string, error) { return v.pack(true) }
+
+func (v *Value) pack(compress bool) (string, error) {
 	var sb strings.Builder
 	sb.WriteString(strconv.FormatUint(uint64(v.Key), 10))
 	sb.WriteString(" ")
@@ -80,11 +180,26 @@ func (v *Value) Pack() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if compress {
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write(data); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		data = buf.Bytes()
+		sb.WriteString(compressedPrefix)
+	}
 	sb.WriteString(hex.EncodeToString(data))
 	return sb.String(), nil
 }
 
-// Unpack converts a string value into a Value type.
+// Unpack converts a string value into a Value type. The message of the value may be compressed.
 func Unpack(value string) (Value, error) {
 	fields := strings.Fields(value)
 	if len(fields) < 3 {
@@ -98,10 +213,18 @@ func Unpack(value string) (Value, error) {
 	if err != nil {
 		return Value{}, err
 	}
-	data, err := hex.DecodeString(fields[2])
+	compressed := strings.HasPrefix(fields[2], compressedPrefix)
+	data, err := hex.DecodeString(strings.TrimPrefix(fields[2], compressedPrefix))
 	if err != nil {
 		return Value{}, err
 	}
+	if compressed {
+		r := flate.NewReader(bytes.NewReader(data))
+		data, err = ioutil.ReadAll(io.LimitReader(r, dns.MaxMsgSize))
+		if err != nil {
+			return Value{}, err
+		}
+	}
 	msg := &dns.Msg{}
 	if err := msg.Unpack(data); err != nil {
 		return Value{}, err
@@ -137,13 +260,21 @@ func newCache(capacity int, client dnsutil.Client, backend Backend, now func() t
 		capacity = 0
 	}
 	c := &Cache{
-		client:   client,
-		now:      now,
-		capacity: capacity,
-		entries:  make(map[uint32]*list.Element, capacity),
-		values:   list.New(),
-		queue:    newQueue(1024),
+		client:    client,
+		now:       now,
+		capacity:  capacity,
+		entries:   make(map[uint32]*list.Element, capacity),
+		values:    list.New(),
+		negatives: list.New(),
+		queue:     newQueue(1024),
+		done:      make(chan bool),
+
+		prefetchThreshold: 1,
+		persistNegative:   true,
+
+		refreshing: make(map[uint32]bool),
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	if backend != nil {
 		c.load(backend)
 	}
@@ -153,10 +284,31 @@ func newCache(capacity int, client dnsutil.Client, backend Backend, now func() t
 
 // NewKey creates a new cache key for the DNS name, qtype and qclass
 func NewKey(name string, qtype, qclass uint16) uint32 {
+	return newKey(name, qtype, qclass, 0)
+}
+
+// NewMsgKey creates a new cache key for the question of DNS message msg. Messages having the DNSSEC OK (DO) or
+// Checking Disabled (CD) bits set get a different key than messages without them, as their answers differ.
+func NewMsgKey(msg *dns.Msg) uint32 {
+	q := msg.Question[0]
+	var flags uint8
+	if opt := msg.IsEdns0(); opt != nil && opt.Do() {
+		flags |= 1
+	}
+	if msg.CheckingDisabled {
+		flags |= 2
+	}
+	return newKey(q.Name, q.Qtype, q.Qclass, flags)
+}
+
+func newKey(name string, qtype, qclass uint16, flags uint8) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(name))
 	binary.Write(h, binary.BigEndian, qtype)
 	binary.Write(h, binary.BigEndian, qclass)
+	if flags != 0 {
+		h.Write([]byte{flags}) // Keys of messages without flags are unchanged
+	}
 	return h.Sum32()
 }
 
@@ -183,21 +335,165 @@ func (c *Cache) load(backend Backend) {
 	c.backend = backend
 }
 
-// Close consumes any outstanding cache operations.
+// SetPrefetchThreshold sets the number of times an entry must have been read before it is prefetched. Expired entries
+// read fewer times than threshold are evicted as if prefetching was disabled. This must be called before the cache is
+// used.
+func (c *Cache) SetPrefetchThreshold(threshold int) {
+	if threshold < 1 {
+		threshold = 1
+	}
+	c.prefetchThreshold = uint64(threshold)
+}
+
+// SetServfailTTL sets the duration SERVFAIL and REFUSED responses are cached for. Such responses are never prefetched,
+// nor written to the backend. Caching of these responses is disabled if ttl is zero, which is the default. This must be
+// called before the cache is used.
+func (c *Cache) SetServfailTTL(ttl time.Duration) {
+	c.servfailTTL = ttl
+}
+
+// SetZeroTTL sets the duration answers having a TTL of zero are cached for. The zero TTLs of such answers are replaced
+// by ttl when stored. Answers having a TTL of zero are not cached if ttl is zero, which is the default. This must be
+// called before the cache is used.
+func (c *Cache) SetZeroTTL(ttl time.Duration) {
+	c.zeroTTL = ttl
+}
+
+// SetPersistNegative sets whether NXDOMAIN responses are written to the backend. Such responses are only kept in memory
+// if persist is false. NXDOMAIN responses are written to the backend by default. This must be called before the cache
+// is used.
+func (c *Cache) SetPersistNegative(persist bool) {
+	c.persistNegative = persist
+}
+
+// SetNegativeCapacity reserves a separate partition of given capacity for NXDOMAIN responses. Values in each partition
+// are only evicted to make room for values in the same partition, which prevents a large number of NXDOMAIN responses
+// from evicting other values. NXDOMAIN responses share the capacity of the cache if capacity is zero, which is the
+// default. This must be called before the cache is used.
+func (c *Cache) SetNegativeCapacity(capacity int) {
+	if capacity < 0 {
+		capacity = 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.negativeCapacity = capacity
+	if capacity == 0 {
+		return
+	}
+	// Move any values loaded from the backend to their partition
+	for el := c.values.Front(); el != nil; {
+		next := el.Next()
+		if v := el.Value.(Value); isNegative(v.msg) {
+			c.values.Remove(el)
+			c.entries[v.Key] = c.negatives.PushBack(v)
+		}
+		el = next
+	}
+	for c.negatives.Len() > capacity {
+		first := c.negatives.Front()
+		c.evict(first.Value.(Value).Key, first)
+	}
+}
+
+// Close consumes any outstanding cache operations and stops logging of capacity hints. Refreshes in progress are
+// cancelled, and refreshes that are queued or requested after closing are not sent.
 func (c *Cache) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.cancel()
+	})
 	c.queue.wg.Wait()
 	return nil
 }
 
+// LogHints periodically logs a hint when the capacity of cache c appears to be too small for the number of distinct
+// names being queried. Hints are logged at given interval until the cache is closed.
+func (c *Cache) LogHints(interval time.Duration) {
+	go func() {
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(interval):
+				if stats := c.Stats(); stats.RecommendedCapacity > 0 {
+					log.Printf("cache misses %d of %d requests after %d evictions: consider increasing cache_size from %d to %d",
+						stats.Misses, stats.Hits+stats.Misses, stats.Evictions, stats.Capacity, stats.RecommendedCapacity)
+				}
+			}
+		}
+	}()
+}
+
+// Sweep periodically evicts expired values that would not be refreshed by prefetching, or that have not been read since
+// they were last refreshed, instead of waiting for them to be read. Values are swept at given interval until the cache is closed.
+func (c *Cache) Sweep(interval time.Duration) {
+	go func() {
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(interval):
+				c.sweep()
+			}
+		}
+	}()
+}
+
+// sweep evicts all expired values in cache c that would not be refreshed by prefetching, and returns the number of
+// evicted values. Values that have not been read since they were last refreshed are idle, and are evicted even if
+// prefetching would refresh them.
+func (c *Cache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		v := el.Value.(Value)
+		if !c.isExpired(&v) {
+			continue
+		}
+		if c.prefetch() && v.Hits() >= c.prefetchThreshold && v.Hits() > v.setHits && !isFailure(v.msg) {
+			continue // Refreshed on next read
+		}
+		c.evict(key, el)
+		c.stats.expirations.Add(1)
+		n++
+	}
+	return n
+}
+
 // Get returns the DNS message associated with key.
 func (c *Cache) Get(key uint32) (*dns.Msg, bool) {
-	v, ok := c.getValue(key)
+	v, ok := c.Lookup(key)
 	if !ok {
 		return nil, false
 	}
 	return v.msg, true
 }
 
+// Lookup returns the value associated with key. The returned value may be stale, in which case it's served while it's
+// being refreshed by prefetching.
+func (c *Cache) Lookup(key uint32) (*Value, bool) {
+	v, ok := c.getValue(key)
+	if !ok {
+		c.stats.misses.Add(1)
+		return nil, false
+	}
+	c.stats.hits.Add(1)
+	return v, true
+}
+
+// GetValue returns the value associated with key, including a value whose TTL has passed. Unlike Lookup, this does not
+// count as a hit, nor does it expire or prefetch the value.
+func (c *Cache) GetValue(key uint32) (Value, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.entries[key]
+	if !ok {
+		return Value{}, false
+	}
+	return v.Value.(Value), true
+}
+
 func (c *Cache) getValue(key uint32) (*Value, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -206,27 +502,48 @@ func (c *Cache) getValue(key uint32) (*Value, bool) {
 		return nil, false
 	}
 	value := v.Value.(Value)
+	hits := value.hits.Add(1)
 	if c.isExpired(&value) {
-		if !c.prefetch() {
-			c.queue.add(func() { c.evictWithLock(key) })
+		if !c.prefetch() || hits < c.prefetchThreshold || isFailure(value.msg) {
+			c.queue.add(func() { c.expire(key) })
 			return nil, false
 		}
-		c.queue.add(func() { c.refresh(key, value.msg) })
+		c.scheduleRefresh(key, value.msg)
 	}
 	return &value, true
 }
 
+// scheduleRefresh queues a refresh of key, unless a refresh of the same key is already pending. If the queue is full,
+// the refresh is dropped and the stale value continues to be served until a later read schedules it again.
+func (c *Cache) scheduleRefresh(key uint32, old *dns.Msg) {
+	if c.ctx.Err() != nil {
+		return // Cache is closed
+	}
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	if c.refreshing[key] {
+		return
+	}
+	if c.queue.tryAdd(func() { c.refresh(key, old) }) {
+		c.refreshing[key] = true
+	}
+}
+
 // List returns the n most recent values in cache c.
 func (c *Cache) List(n int) []Value {
 	values := make([]Value, 0, n)
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	for el := c.values.Back(); el != nil; el = el.Prev() {
-		if len(values) == n {
-			break
+	el, negEl := c.values.Back(), c.negatives.Back()
+	for len(values) < n && (el != nil || negEl != nil) {
+		// Merge partitions, most recent first
+		if el == nil || (negEl != nil && negEl.Value.(Value).CreatedAt.After(el.Value.(Value).CreatedAt)) {
+			values = append(values, negEl.Value.(Value))
+			negEl = negEl.Prev()
+			continue
 		}
-		v := el.Value.(Value)
-		values = append(values, v)
+		values = append(values, el.Value.(Value))
+		el = el.Prev()
 	}
 	return values
 }
@@ -249,70 +566,183 @@ func (c *Cache) Stats() Stats {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return Stats{
-		Capacity:     c.capacity,
-		Size:         len(c.entries),
-		PendingTasks: len(c.queue.tasks),
+		Capacity:            c.capacity,
+		Size:                c.values.Len(),
+		NegativeCapacity:    c.negativeCapacity,
+		NegativeSize:        c.negatives.Len(),
+		PendingTasks:        len(c.queue.tasks),
+		Hits:                c.stats.hits.Load(),
+		Misses:              c.stats.misses.Load(),
+		Evictions:           c.stats.evictions.Load(),
+		Expirations:         c.stats.expirations.Load(),
+		Refreshes:           c.stats.refreshes.Load(),
+		RefreshErrors:       c.stats.refreshErrors.Load(),
+		RecommendedCapacity: c.recommendedCapacity(),
 	}
 }
 
+// recommendedCapacity estimates the capacity needed to hold the working set of cache c. Each eviction caused by the
+// cache being full is a value that did not fit, and the miss ratio discounts values that were never requested again.
+// The estimate is rounded up to the nearest power of two. Zero is returned if the current capacity is sufficient.
+func (c *Cache) recommendedCapacity() int {
+	hits := c.stats.hits.Load()
+	misses := c.stats.misses.Load()
+	evictions := c.stats.evictions.Load()
+	if evictions == 0 || hits+misses == 0 {
+		return 0
+	}
+	missRatio := float64(misses) / float64(hits+misses)
+	if missRatio < minMissRatio {
+		return 0
+	}
+	want := c.capacity + int(float64(evictions)*missRatio)
+	n := 1
+	for n < want {
+		n <<= 1
+	}
+	return n
+}
+
 func (c *Cache) set(key uint32, msg *dns.Msg) bool {
-	return c.setValue(Value{Key: key, CreatedAt: c.now(), msg: msg})
+	if c.zeroTTL > 0 && !isFailure(msg) && dnsutil.MinTTL(msg) == 0 {
+		msg = withTTL(msg, c.zeroTTL)
+	}
+	value := Value{Key: key, CreatedAt: c.now(), msg: msg}
+	if isFailure(msg) {
+		value.ttl = c.servfailTTL
+	}
+	return c.setValue(value)
+}
+
+// partition returns the list holding value, and its capacity.
+func (c *Cache) partition(value Value) (*list.List, int) {
+	if c.negativeCapacity > 0 && isNegative(value.msg) {
+		return c.negatives, c.negativeCapacity
+	}
+	return c.values, c.capacity
 }
 
 func (c *Cache) setValue(value Value) bool {
-	if c.capacity == 0 || !canCache(value.msg) {
+	values, capacity := c.partition(value)
+	if capacity == 0 || !c.canCache(value.msg) {
 		return false
 	}
-	if len(c.entries) == c.capacity {
-		first := c.values.Front()
+	if values.Len() == capacity {
+		first := values.Front()
 		key := first.Value.(Value).Key
 		c.evict(key, first)
+		c.stats.evictions.Add(1)
 	}
 	current, ok := c.entries[value.Key]
 	if ok {
-		c.values.Remove(current)
+		c.remove(current)
+	}
+	if value.hits == nil {
+		if ok {
+			// Keep hits of a refreshed value
+			value.hits = current.Value.(Value).hits
+		} else {
+			value.hits = &atomic.Uint64{}
+		}
 	}
-	c.entries[value.Key] = c.values.PushBack(value)
+	value.setHits = value.hits.Load()
+	c.entries[value.Key] = values.PushBack(value)
 	if c.hasBackend() {
-		c.backend.Set(value.Key, value)
+		if c.persist(value) {
+			c.backend.Set(value.Key, value)
+		} else if ok {
+			c.backend.Evict(value.Key) // Replaced value may have been written
+		}
 	}
 	return true
 }
 
+// persist returns whether value should be written to the backend.
+func (c *Cache) persist(value Value) bool {
+	if isFailure(value.msg) {
+		return false
+	}
+	return c.persistNegative || !isNegative(value.msg)
+}
+
 // Reset removes all values contained in cache c.
 func (c *Cache) Reset() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.entries = make(map[uint32]*list.Element, c.capacity)
 	c.values = c.values.Init()
+	c.negatives = c.negatives.Init()
 	if c.hasBackend() {
 		c.backend.Reset()
 	}
 }
 
+// EvictSuffix removes all values in cache c whose question is suffix or a subdomain of suffix, and returns the number
+// of removed values. Names are compared case-insensitively.
+func (c *Cache) EvictSuffix(suffix string) int {
+	suffix = dns.Fqdn(suffix)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		v := el.Value.(Value)
+		if dns.IsSubDomain(suffix, v.Question()) {
+			c.evict(key, el)
+			n++
+		}
+	}
+	return n
+}
+
 func (c *Cache) prefetch() bool { return c.client != nil }
 
 func (c *Cache) hasBackend() bool { return c.backend != nil }
 
 func (c *Cache) refresh(key uint32, old *dns.Msg) {
+	defer func() {
+		c.refreshMu.Lock()
+		defer c.refreshMu.Unlock()
+		delete(c.refreshing, key)
+	}()
+	if c.ctx.Err() != nil {
+		return // Cache is closed
+	}
 	q := old.Question[0]
 	msg := dns.Msg{}
 	msg.SetQuestion(q.Name, q.Qtype)
-	r, err := c.client.Exchange(&msg)
-	if err != nil {
+	// Preserve the flags that are part of the key
+	msg.CheckingDisabled = old.CheckingDisabled
+	if opt := old.IsEdns0(); opt != nil && opt.Do() {
+		msg.SetEdns0(opt.UDPSize(), true)
+	}
+	r, err := c.client.ExchangeContext(c.ctx, &msg)
+	if errors.Is(err, context.Canceled) && c.ctx.Err() != nil {
+		return // Cache is closed
+	}
+	if err != nil || !dnsutil.SameQuestion(&msg, r.Msg) {
+		c.stats.refreshErrors.Add(1)
 		return // Retry on next request
 	}
+	c.stats.refreshes.Add(1)
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if !c.set(key, r) {
-		c.evict(key, c.entries[key])
+	if !c.set(key, dnsutil.DedupAnswers(r.Msg)) {
+		c.expireLocked(key)
 	}
 }
 
-func (c *Cache) evictWithLock(key uint32) {
+// expire evicts the expired value associated with key.
+func (c *Cache) expire(key uint32) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.evict(key, c.entries[key])
+	c.expireLocked(key)
+}
+
+func (c *Cache) expireLocked(key uint32) {
+	if el, ok := c.entries[key]; ok {
+		c.evict(key, el)
+		c.stats.expirations.Add(1)
+	}
 }
 
 func (c *Cache) evict(key uint32, element *list.Element) {
@@ -320,22 +750,38 @@ func (c *Cache) evict(key uint32, element *list.Element) {
 		return
 	}
 	delete(c.entries, key)
-	c.values.Remove(element)
+	c.remove(element)
 	if c.hasBackend() {
 		c.backend.Evict(key)
 	}
 }
 
-func (c *Cache) isExpired(v *Value) bool {
-	expiresAt := v.CreatedAt.Add(dnsutil.MinTTL(v.msg))
-	return c.now().After(expiresAt)
+// remove removes element from the partition containing it.
+func (c *Cache) remove(element *list.Element) {
+	// Removing an element from a list not containing it is a no-op
+	c.values.Remove(element)
+	c.negatives.Remove(element)
 }
 
+func (c *Cache) isExpired(v *Value) bool { return v.Stale(c.now()) }
+
 func (q *queue) add(task func()) {
 	q.wg.Add(1)
 	q.tasks <- task
 }
 
+// tryAdd adds task to the queue without blocking. It returns false if the queue is full.
+func (q *queue) tryAdd(task func()) bool {
+	q.wg.Add(1)
+	select {
+	case q.tasks <- task:
+		return true
+	default:
+		q.wg.Done()
+		return false
+	}
+}
+
 func (q *queue) consume() {
 	for task := range q.tasks {
 		task()
@@ -343,9 +789,34 @@ func (q *queue) consume() {
 	}
 }
 
-func canCache(msg *dns.Msg) bool {
+func (c *Cache) canCache(msg *dns.Msg) bool {
+	if isFailure(msg) {
+		return c.servfailTTL > 0
+	}
 	if dnsutil.MinTTL(msg) == 0 {
 		return false
 	}
 	return msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError
 }
+
+// withTTL returns a copy of msg where records having a TTL of zero have their TTL set to ttl.
+func withTTL(msg *dns.Msg, ttl time.Duration) *dns.Msg {
+	msg = msg.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype != dns.TypeOPT && h.Ttl == 0 {
+				h.Ttl = uint32(ttl / time.Second)
+			}
+		}
+	}
+	return msg
+}
+
+// isFailure returns whether msg is a SERVFAIL or REFUSED response.
+func isFailure(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeRefused
+}
+
+// isNegative returns whether msg is a response stating that the name does not exist.
+func isNegative(msg *dns.Msg) bool { return msg.Rcode == dns.RcodeNameError }
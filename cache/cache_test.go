@@ -1,9 +1,12 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -19,6 +22,9 @@ type testClient struct {
 	answers chan *dns.Msg
 }
 
+// flush waits for the queued operations of cache c to complete.
+func flush(c *Cache) { c.queue.wg.Wait() }
+
 func newTestClient() *testClient { return &testClient{answers: make(chan *dns.Msg, 100)} }
 
 func (e *testClient) setAnswer(answer *dns.Msg) {
@@ -33,13 +39,17 @@ func (e *testClient) reset() {
 	e.answers = make(chan *dns.Msg, 100)
 }
 
-func (e *testClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+func (e *testClient) Exchange(msg *dns.Msg) (*dnsutil.Response, error) {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 	if len(e.answers) == 0 {
 		return nil, fmt.Errorf("no answer pending")
 	}
-	return <-e.answers, nil
+	return &dnsutil.Response{Msg: <-e.answers}, nil
+}
+
+func (e *testClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dnsutil.Response, error) {
+	return e.Exchange(msg)
 }
 
 type testBackend struct {
@@ -107,6 +117,50 @@ func TestNewKey(t *testing.T) {
 	}
 }
 
+func TestNewMsgKey(t *testing.T) {
+	msg := &dns.Msg{}
+	msg.SetQuestion("foo.", dns.TypeA)
+	if got, want := NewMsgKey(msg), NewKey("foo.", dns.TypeA, dns.ClassINET); got != want {
+		t.Errorf("NewMsgKey(%s) = %d, want %d", msg.Question[0].String(), got, want)
+	}
+
+	keys := make(map[uint32]bool)
+	for _, do := range []bool{false, true} {
+		for _, cd := range []bool{false, true} {
+			msg := &dns.Msg{}
+			msg.SetQuestion("foo.", dns.TypeA)
+			msg.SetEdns0(4096, do)
+			msg.CheckingDisabled = cd
+			keys[NewMsgKey(msg)] = true
+		}
+	}
+	if got, want := len(keys), 4; got != want {
+		t.Errorf("got %d distinct keys, want %d", got, want)
+	}
+}
+
+func TestCachePrefetchDNSSEC(t *testing.T) {
+	client := &blockingClient{release: make(chan bool), answer: testMsg}
+	close(client.release)
+	now := time.Now()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	defer c.Close()
+	msg := testMsg.Copy()
+	msg.CheckingDisabled = true
+	msg.SetEdns0(4096, true)
+	key := NewMsgKey(msg)
+	c.Set(key, msg)
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.Get(key)
+	flush(c)
+	if !client.last.CheckingDisabled {
+		t.Errorf("CheckingDisabled = %t, want %t", client.last.CheckingDisabled, true)
+	}
+	if opt := client.last.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("expected DO bit to be set in prefetch query")
+	}
+}
+
 func TestCache(t *testing.T) {
 	msg := newA("1.example.com.", 60, net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"))
 	msgWithZeroTTL := newA("2.example.com.", 0, net.ParseIP("192.0.2.2"))
@@ -141,7 +195,11 @@ func TestCache(t *testing.T) {
 		if msg, ok := c.Get(k); ok != tt.ok {
 			t.Errorf("#%d: Get(%d) = (%+v, %t), want (_, %t)", i, k, msg, ok, tt.ok)
 		}
-		if v, ok := c.getValue(k); ok != tt.ok || !reflect.DeepEqual(v, tt.value) {
+		v, ok := c.getValue(k)
+		if v != nil {
+			v.hits, v.setHits = nil, 0 // Not compared
+		}
+		if ok != tt.ok || !reflect.DeepEqual(v, tt.value) {
 			t.Errorf("#%d: getValue(%d) = (%+v, %t), want (%+v, %t)", i, k, v, ok, tt.value, tt.ok)
 		}
 		c.Close()
@@ -163,6 +221,120 @@ func TestCache(t *testing.T) {
 	}
 }
 
+func TestCacheDS(t *testing.T) {
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeDS)
+	msg.Answer = []dns.RR{&dns.DS{
+		Hdr:        dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 86400},
+		KeyTag:     12345,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "ABCDEF",
+	}}
+	msg.Ns = []dns.RR{&dns.NS{
+		Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 172800},
+		Ns:  "a.gtld-servers.net.",
+	}}
+	c := New(10, nil)
+	k := NewKey(msg.Question[0].Name, msg.Question[0].Qtype, msg.Question[0].Qclass)
+	c.Set(k, msg)
+	v, ok := c.getValue(k)
+	if !ok {
+		t.Fatalf("getValue(%d) = (_, %t), want (_, %t)", k, ok, !ok)
+	}
+	if got, want := v.TTL(), 86400*time.Second; got != want {
+		t.Errorf("TTL() = %s, want %s", got, want)
+	}
+	if got, want := v.Answers(), []string{"12345 8 2 ABCDEF"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Answers() = %q, want %q", got, want)
+	}
+}
+
+func TestCacheFailures(t *testing.T) {
+	var tests = []struct {
+		rcode       int
+		servfailTTL time.Duration
+		ok          bool
+	}{
+		{dns.RcodeServerFailure, 5 * time.Second, true},
+		{dns.RcodeRefused, 5 * time.Second, true},
+		{dns.RcodeServerFailure, 0, false},
+		{dns.RcodeRefused, 0, false},
+		{dns.RcodeFormatError, 5 * time.Second, false},
+	}
+	for i, tt := range tests {
+		client := newTestClient()
+		backend := &testBackend{}
+		now := time.Now()
+		c := newCache(10, client, nil, func() time.Time { return now })
+		c.backend = backend
+		c.SetServfailTTL(tt.servfailTTL)
+		msg := &dns.Msg{}
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Rcode = tt.rcode
+		var key uint32 = 1
+		c.Set(key, msg)
+
+		v, ok := c.getValue(key)
+		if ok != tt.ok {
+			t.Errorf("#%d: getValue(%d) = (_, %t), want (_, %t)", i, key, ok, tt.ok)
+		}
+		if len(backend.values) != 0 {
+			t.Errorf("#%d: got %d values in backend, want 0", i, len(backend.values))
+		}
+		if !ok {
+			continue
+		}
+		if got := v.TTL(); got != tt.servfailTTL {
+			t.Errorf("#%d: TTL() = %s, want %s", i, got, tt.servfailTTL)
+		}
+
+		// Expired failure is evicted instead of being prefetched
+		c.now = func() time.Time { return now.Add(tt.servfailTTL + time.Second) }
+		if _, ok := c.getValue(key); ok {
+			t.Errorf("#%d: getValue(%d) = (_, %t), want (_, %t)", i, key, ok, false)
+		}
+		c.Close()
+		if got := len(c.entries); got != 0 {
+			t.Errorf("#%d: got %d entries, want 0", i, got)
+		}
+	}
+}
+
+func TestCacheZeroTTL(t *testing.T) {
+	var tests = []struct {
+		zeroTTL time.Duration
+		ok      bool
+		ttl     time.Duration
+	}{
+		{0, false, 0},
+		{30 * time.Second, true, 30 * time.Second},
+	}
+	for i, tt := range tests {
+		c := New(10, nil)
+		c.SetZeroTTL(tt.zeroTTL)
+		msg := newA("example.com.", 0, net.ParseIP("192.0.2.1"))
+		var key uint32 = 1
+		c.Set(key, msg)
+		v, ok := c.getValue(key)
+		if ok != tt.ok {
+			t.Fatalf("#%d: getValue(%d) = (_, %t), want (_, %t)", i, key, ok, tt.ok)
+		}
+		if !ok {
+			continue
+		}
+		if got := v.TTL(); got != tt.ttl {
+			t.Errorf("#%d: TTL() = %s, want %s", i, got, tt.ttl)
+		}
+		if got, want := v.msg.Answer[0].Header().Ttl, uint32(tt.ttl/time.Second); got != want {
+			t.Errorf("#%d: stored TTL = %d, want %d", i, got, want)
+		}
+		if got := msg.Answer[0].Header().Ttl; got != 0 {
+			t.Errorf("#%d: original TTL = %d, want 0", i, got)
+		}
+	}
+}
+
 func TestCacheCapacity(t *testing.T) {
 	var tests = []struct {
 		addCount, capacity, size int
@@ -199,6 +371,84 @@ func TestCacheCapacity(t *testing.T) {
 	}
 }
 
+func TestCacheNegativeCapacity(t *testing.T) {
+	newNXDOMAIN := func(name string) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+	set := func(c *Cache, msg *dns.Msg) uint32 {
+		k := NewMsgKey(msg)
+		c.Set(k, msg)
+		return k
+	}
+	now := time.Now()
+	c := New(2, nil)
+	c.now = func() time.Time { return now }
+	c.SetNegativeCapacity(3)
+
+	// Filling the negative partition does not evict positive values
+	a1 := set(c, newA("a1.", 60, net.ParseIP("192.0.2.1")))
+	a2 := set(c, newA("a2.", 60, net.ParseIP("192.0.2.2")))
+	var nx []uint32
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		nx = append(nx, set(c, newNXDOMAIN(fmt.Sprintf("nx%d.", i))))
+	}
+	for _, k := range []uint32{a1, a2, nx[2], nx[3], nx[4]} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("Get(%d) = (_, %t), want (_, %t)", k, ok, !ok)
+		}
+	}
+	for _, k := range nx[:2] {
+		if _, ok := c.Get(k); ok {
+			t.Errorf("Get(%d) = (_, %t), want (_, %t)", k, ok, !ok)
+		}
+	}
+	stats := c.Stats()
+	if got, want := stats.Size, 2; got != want {
+		t.Errorf("Size = %d, want %d", got, want)
+	}
+	if got, want := stats.NegativeSize, 3; got != want {
+		t.Errorf("NegativeSize = %d, want %d", got, want)
+	}
+	if got, want := stats.NegativeCapacity, 3; got != want {
+		t.Errorf("NegativeCapacity = %d, want %d", got, want)
+	}
+
+	// Filling the positive partition does not evict negative values
+	now = now.Add(time.Second)
+	a3 := set(c, newA("a3.", 60, net.ParseIP("192.0.2.3")))
+	if _, ok := c.Get(a1); ok {
+		t.Errorf("Get(%d) = (_, %t), want (_, %t)", a1, ok, !ok)
+	}
+	for _, k := range []uint32{a2, a3, nx[2], nx[3], nx[4]} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("Get(%d) = (_, %t), want (_, %t)", k, ok, !ok)
+		}
+	}
+
+	// Values of both partitions are listed, most recent first
+	var questions []string
+	for _, v := range c.List(10) {
+		questions = append(questions, v.Question())
+	}
+	if got, want := questions, []string{"a3.", "nx4.", "nx3.", "nx2.", "a2."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List(10) = %q, want %q", got, want)
+	}
+
+	// Value moves between partitions when its rcode changes
+	set(c, newA("nx4.", 60, net.ParseIP("192.0.2.4")))
+	stats = c.Stats()
+	if got, want := stats.Size, 2; got != want {
+		t.Errorf("Size = %d, want %d", got, want)
+	}
+	if got, want := stats.NegativeSize, 2; got != want {
+		t.Errorf("NegativeSize = %d, want %d", got, want)
+	}
+}
+
 func TestCacheList(t *testing.T) {
 	var tests = []struct {
 		addCount, listCount, wantCount int
@@ -251,10 +501,103 @@ func TestReset(t *testing.T) {
 	}
 }
 
+func TestEvictSuffix(t *testing.T) {
+	c := New(10, nil)
+	names := []string{"example.com.", "1.example.com.", "2.EXAMPLE.com.", "notexample.com.", "example.org."}
+	for i, name := range names {
+		msg := &dns.Msg{}
+		msg.SetQuestion(name, dns.TypeA)
+		c.Set(uint32(i), msg)
+	}
+	if got, want := c.EvictSuffix("example.com"), 3; got != want {
+		t.Errorf("EvictSuffix(%q) = %d, want %d", "example.com", got, want)
+	}
+	var got []string
+	for _, v := range c.List(10) {
+		got = append(got, v.Question())
+	}
+	if want := []string{"example.org.", "notexample.com."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := c.EvictSuffix("example.net."), 0; got != want {
+		t.Errorf("EvictSuffix(%q) = %d, want %d", "example.net.", got, want)
+	}
+}
+
+func TestCacheSweep(t *testing.T) {
+	var tests = []struct {
+		client dnsutil.Client
+		want   []uint32 // Keys remaining after sweep
+	}{
+		{nil, []uint32{3}},
+		{newTestClient(), []uint32{2, 3}}, // Expired value that has been read is refreshed instead
+	}
+	for i, tt := range tests {
+		now := time.Now()
+		c := newCache(10, tt.client, nil, func() time.Time { return now })
+		c.Set(1, newA("1.example.com.", 60, net.ParseIP("192.0.2.1")))
+		c.Set(2, newA("2.example.com.", 60, net.ParseIP("192.0.2.2")))
+		c.Set(3, newA("3.example.com.", 600, net.ParseIP("192.0.2.3")))
+		if _, ok := c.Lookup(2); !ok {
+			t.Fatalf("#%d: Lookup(2) = (_, false), want (_, true)", i)
+		}
+		if got, want := c.sweep(), 0; got != want {
+			t.Errorf("#%d: sweep() = %d, want %d", i, got, want)
+		}
+
+		now = now.Add(61 * time.Second)
+		if got, want := c.sweep(), 3-len(tt.want); got != want {
+			t.Errorf("#%d: sweep() = %d, want %d", i, got, want)
+		}
+		var keys []uint32
+		for _, v := range c.List(10) {
+			keys = append(keys, v.Key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		if !reflect.DeepEqual(keys, tt.want) {
+			t.Errorf("#%d: got keys %v, want %v", i, keys, tt.want)
+		}
+		if got, want := c.Stats().Expirations, uint64(3-len(tt.want)); got != want {
+			t.Errorf("#%d: Expirations = %d, want %d", i, got, want)
+		}
+		c.Close()
+	}
+}
+
+func TestCacheSweepIdle(t *testing.T) {
+	client := newTestClient()
+	now := time.Now()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	defer c.Close()
+	var key uint32 = 1
+	client.setAnswer(newA("example.com.", 60, net.ParseIP("192.0.2.42")))
+	c.Set(key, testMsg)
+
+	// Value read after expiry is refreshed
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	if _, ok := c.getValue(key); !ok {
+		t.Fatalf("getValue(%d) = (_, false), want (_, true)", key)
+	}
+	flush(c)
+	if got, want := c.Stats().Refreshes, uint64(1); got != want {
+		t.Fatalf("Refreshes = %d, want %d", got, want)
+	}
+
+	// Refreshed value which is not read again is swept
+	c.now = func() time.Time { return now.Add(122 * time.Second) }
+	if got, want := c.sweep(), 1; got != want {
+		t.Errorf("sweep() = %d, want %d", got, want)
+	}
+	if _, ok := c.GetValue(key); ok {
+		t.Errorf("GetValue(%d) = (_, true), want (_, false)", key)
+	}
+}
+
 func TestCachePrefetch(t *testing.T) {
 	client := newTestClient()
 	now := time.Now()
 	c := newCache(10, client, nil, func() time.Time { return now })
+	defer c.Close()
 	var tests = []struct {
 		initialAnswer string
 		refreshAnswer string
@@ -289,7 +632,7 @@ func TestCachePrefetch(t *testing.T) {
 		// Read value at some point in the future
 		c.now = func() time.Time { return now.Add(tt.readDelay) }
 		v, ok := c.getValue(key)
-		c.Close() // Flush queued operations
+		flush(c)
 
 		if tt.refetch {
 			v, ok = c.getValue(key)
@@ -306,10 +649,281 @@ func TestCachePrefetch(t *testing.T) {
 	}
 }
 
+func TestCachePrefetchVerifiesAnswer(t *testing.T) {
+	now := time.Now()
+	var key uint32 = 1
+
+	// Answer to a different question is discarded
+	client := newTestClient()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	defer c.Close()
+	client.setAnswer(newA("example.net.", 60, net.ParseIP("192.0.2.42")))
+	c.Set(key, testMsg)
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.getValue(key)
+	flush(c)
+	v, ok := c.GetValue(key)
+	if !ok {
+		t.Fatalf("GetValue(%d) = (_, %t), want (_, %t)", key, ok, true)
+	}
+	if got, want := dnsutil.Answers(v.msg), []string{"192.0.2.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue(%d) = (%q, _), want (%q, _)", key, got, want)
+	}
+	if got, want := c.Stats().RefreshErrors, uint64(1); got != want {
+		t.Errorf("RefreshErrors = %d, want %d", got, want)
+	}
+
+	// Duplicate answers are removed
+	client = newTestClient()
+	c = newCache(10, client, nil, func() time.Time { return now })
+	defer c.Close()
+	client.setAnswer(newA("example.com.", 60, net.ParseIP("192.0.2.42"), net.ParseIP("192.0.2.42")))
+	c.Set(key, testMsg)
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.getValue(key)
+	flush(c)
+	v, _ = c.GetValue(key)
+	if got, want := dnsutil.Answers(v.msg), []string{"192.0.2.42"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue(%d) = (%q, _), want (%q, _)", key, got, want)
+	}
+}
+
+type blockingClient struct {
+	mu        sync.Mutex
+	exchanges int
+	last      *dns.Msg
+	release   chan bool
+	answer    *dns.Msg
+}
+
+func (c *blockingClient) Exchange(msg *dns.Msg) (*dnsutil.Response, error) {
+	c.mu.Lock()
+	c.exchanges++
+	c.last = msg
+	c.mu.Unlock()
+	<-c.release
+	return &dnsutil.Response{Msg: c.answer}, nil
+}
+
+func (c *blockingClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dnsutil.Response, error) {
+	return c.Exchange(msg)
+}
+
+// cancellableClient blocks until the context of an exchange is done.
+type cancellableClient struct{ started chan bool }
+
+func (c *cancellableClient) Exchange(msg *dns.Msg) (*dnsutil.Response, error) {
+	return c.ExchangeContext(context.Background(), msg)
+}
+
+func (c *cancellableClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dnsutil.Response, error) {
+	c.started <- true
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCacheCloseCancelsRefresh(t *testing.T) {
+	client := &cancellableClient{started: make(chan bool, 1)}
+	now := time.Now()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	var key uint32 = 1
+	c.Set(key, testMsg)
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.getValue(key)
+	<-client.started
+
+	closed := make(chan bool)
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on refresh in progress")
+	}
+	if got, want := c.Stats().RefreshErrors, uint64(0); got != want {
+		t.Errorf("RefreshErrors = %d, want %d", got, want)
+	}
+}
+
+func TestCacheClosedRefresh(t *testing.T) {
+	client := newTestClient()
+	now := time.Now()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	var key uint32 = 1
+	c.Set(key, testMsg)
+	c.Close()
+
+	// Reading an expired value from a closed cache does not refresh it
+	client.setAnswer(testMsg)
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.getValue(key)
+	flush(c)
+	if got, want := len(client.answers), 1; got != want {
+		t.Errorf("got %d pending answers, want %d", got, want)
+	}
+}
+
+func TestCacheLookupStale(t *testing.T) {
+	client := &blockingClient{release: make(chan bool), answer: newA("example.com.", 60, net.ParseIP("192.0.2.42"))}
+	now := time.Now()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	var key uint32 = 1
+	c.Set(key, testMsg)
+	var tests = []struct {
+		readDelay time.Duration
+		stale     bool
+	}{
+		{30 * time.Second, false},
+		{61 * time.Second, true}, // Served while being refreshed
+	}
+	for i, tt := range tests {
+		readAt := now.Add(tt.readDelay)
+		c.now = func() time.Time { return readAt }
+		v, ok := c.Lookup(key)
+		if !ok {
+			t.Fatalf("#%d: Lookup(%d) = (_, %t), want (_, %t)", i, key, ok, true)
+		}
+		if got := v.Stale(readAt); got != tt.stale {
+			t.Errorf("#%d: Stale() = %t, want %t", i, got, tt.stale)
+		}
+	}
+	close(client.release)
+	c.Close()
+}
+
+func TestCacheGetValue(t *testing.T) {
+	now := time.Now()
+	c := newCache(10, nil, nil, func() time.Time { return now })
+	c.Set(1, testMsg)
+	if _, ok := c.GetValue(2); ok {
+		t.Errorf("GetValue(%d) = (_, %t), want (_, %t)", 2, ok, false)
+	}
+
+	// Expired value is returned as is
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	v, ok := c.GetValue(1)
+	if !ok {
+		t.Fatalf("GetValue(%d) = (_, %t), want (_, %t)", 1, ok, true)
+	}
+	if !v.Stale(c.now()) {
+		t.Error("want stale value")
+	}
+	c.Close()
+	stats := c.Stats()
+	if stats.Size != 1 || stats.Hits != 0 || stats.Expirations != 0 {
+		t.Errorf("got %+v, want value to be kept and no hits", stats)
+	}
+}
+
+func TestCachePrefetchDeduplicates(t *testing.T) {
+	client := &blockingClient{release: make(chan bool), answer: newA("example.com.", 60, net.ParseIP("192.0.2.42"))}
+	now := time.Now()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	var key uint32 = 1
+	c.Set(key, testMsg)
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := c.Get(key); !ok {
+				t.Errorf("Get(%d) = (_, %t), want (_, %t)", key, ok, true)
+			}
+		}()
+	}
+	wg.Wait()
+	close(client.release)
+	c.Close()
+
+	if got, want := client.exchanges, 1; got != want {
+		t.Errorf("got %d exchanges, want %d", got, want)
+	}
+	msg, _ := c.Get(key)
+	if got, want := dnsutil.Answers(msg)[0], "192.0.2.42"; got != want {
+		t.Errorf("Get(%d) = (%q, _), want (%q, _)", key, got, want)
+	}
+}
+
+func TestCachePrefetchQueueFull(t *testing.T) {
+	client := &blockingClient{release: make(chan bool), answer: testMsg}
+	now := time.Now()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	c.queue = newQueue(1)
+	go c.queue.consume()
+	for i := uint32(1); i <= 3; i++ {
+		c.Set(i, testMsg)
+	}
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+
+	// Reads do not block when the queue is full
+	for i := uint32(1); i <= 3; i++ {
+		if _, ok := c.Get(i); !ok {
+			t.Errorf("Get(%d) = (_, %t), want (_, %t)", i, ok, true)
+		}
+	}
+	close(client.release)
+	c.Close()
+	if client.exchanges > 2 {
+		t.Errorf("got %d exchanges, want at most %d", client.exchanges, 2)
+	}
+}
+
+func TestCachePrefetchThreshold(t *testing.T) {
+	client := newTestClient()
+	now := time.Now()
+	c := newCache(10, client, nil, func() time.Time { return now })
+	defer c.Close()
+	c.SetPrefetchThreshold(3)
+	var key uint32 = 1
+	c.Set(key, testMsg)
+	c.Get(key)
+	if got, want := c.List(1)[0].Hits(), uint64(1); got != want {
+		t.Errorf("Hits() = %d, want %d", got, want)
+	}
+
+	// Entry is not read often enough to be prefetched
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	client.setAnswer(testMsg)
+	if _, ok := c.Get(key); ok {
+		t.Errorf("Get(%d) = (_, %t), want (_, %t)", key, ok, false)
+	}
+	flush(c)
+	if got, want := len(client.answers), 1; got != want {
+		t.Errorf("got %d pending answers, want %d", got, want)
+	}
+	if _, ok := c.entries[key]; ok {
+		t.Errorf("expected cache keys to not contain %d", key)
+	}
+
+	// Entry is read often enough to be prefetched
+	c.now = func() time.Time { return now }
+	c.Set(key, testMsg)
+	c.Get(key)
+	c.Get(key)
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	if _, ok := c.Get(key); !ok {
+		t.Errorf("Get(%d) = (_, %t), want (_, %t)", key, ok, true)
+	}
+	flush(c)
+	if got, want := len(client.answers), 0; got != want {
+		t.Errorf("got %d pending answers, want %d", got, want)
+	}
+
+	// Hits are kept when entry is refreshed
+	if got, want := c.List(1)[0].Hits(), uint64(3); got != want {
+		t.Errorf("Hits() = %d, want %d", got, want)
+	}
+}
+
 func TestCacheEvictAndUpdate(t *testing.T) {
 	client := newTestClient()
 	now := time.Now()
 	c := newCache(10, client, nil, func() time.Time { return now })
+	defer c.Close()
 
 	var key uint32 = 1
 	c.Set(key, testMsg)
@@ -326,19 +940,16 @@ func TestCacheEvictAndUpdate(t *testing.T) {
 	c.now = func() time.Time { return now.Add(61 * time.Second) }
 	c.Get(key)
 
-	// Query again, causing another prefetch with a non-zero TTL
+	// Query again while prefetch is pending, which does not cause another prefetch
 	c.Get(key)
 
-	// Last query refreshes key
-	c.Close()
-	keyExists := false
-	for el := c.values.Front(); el != nil; el = el.Next() {
-		if el.Value.(Value).Key == key {
-			keyExists = true
-		}
+	// Refreshed answer cannot be cached and key is evicted
+	flush(c)
+	if _, ok := c.entries[key]; ok {
+		t.Errorf("expected cache keys to not contain %d", key)
 	}
-	if !keyExists {
-		t.Errorf("expected cache keys to contain %d", key)
+	if got, want := len(client.answers), 1; got != want {
+		t.Errorf("got %d pending answers, want %d", got, want)
 	}
 }
 
@@ -348,6 +959,46 @@ func TestPackValue(t *testing.T) {
 		CreatedAt: time.Now().Truncate(time.Second),
 		msg:       testMsg,
 	}
+	var tests = []struct {
+		pack       func() (string, error)
+		compressed bool
+	}{
+		{v.Pack, false},
+		{v.PackCompressed, true},
+	}
+	for i, tt := range tests {
+		packed, err := tt.pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(packed, compressedPrefix); got != tt.compressed {
+			t.Errorf("#%d: compressed = %t, want %t", i, got, tt.compressed)
+		}
+		unpacked, err := Unpack(packed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := unpacked.Key, v.Key; got != want {
+			t.Errorf("#%d: Key = %d, want %d", i, got, want)
+		}
+		if got, want := unpacked.CreatedAt, v.CreatedAt; !got.Equal(want) {
+			t.Errorf("#%d: CreatedAt = %s, want %s", i, got, want)
+		}
+		if got, want := unpacked.msg.String(), v.msg.String(); got != want {
+			t.Errorf("#%d: msg = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestPackValueHTTPS(t *testing.T) {
+	rr, err := dns.NewRR(`example.com. 300 IN HTTPS 1 . alpn="h3,h2" ipv4hint="192.0.2.1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeHTTPS)
+	msg.Answer = []dns.RR{rr}
+	v := Value{Key: 42, CreatedAt: time.Now().Truncate(time.Second), msg: msg}
 	packed, err := v.Pack()
 	if err != nil {
 		t.Fatal(err)
@@ -356,14 +1007,39 @@ func TestPackValue(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got, want := unpacked.Key, v.Key; got != want {
-		t.Errorf("Key = %d, want %d", got, want)
+	if got, want := unpacked.msg.String(), msg.String(); got != want {
+		t.Errorf("msg = %s, want %s", got, want)
 	}
-	if got, want := unpacked.CreatedAt, v.CreatedAt; !got.Equal(want) {
-		t.Errorf("CreatedAt = %s, want %s", got, want)
+	if got, want := unpacked.Answers(), []string{"1 . alpn=h3,h2 ipv4hint=192.0.2.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Answers() = %v, want %v", got, want)
 	}
-	if got, want := unpacked.msg.String(), v.msg.String(); got != want {
-		t.Errorf("msg = %s, want %s", got, want)
+}
+
+func TestUnpackValue(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		// Uncompressed, as written by Pack
+		{"42 1560636910 c7658180000100010000000003777777076578616d706c6503636f6d0000010001c00c000100010000012c00045db8d822",
+			"www.example.com.\t300\tIN\tA\t93.184.216.34"},
+		{"42 1560636910 z1:3a9edad8c0c0c8c0c8c0c0c0c05c5e5ece9e5a91985b9093ca9c9c9fcbc0c0c8c088559081815187812576c70d25c000",
+			"www.example.com.\t300\tIN\tA\t93.184.216.34"},
+	}
+	for i, tt := range tests {
+		v, err := Unpack(tt.in)
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if got, want := v.Key, uint32(42); got != want {
+			t.Errorf("#%d: Key = %d, want %d", i, got, want)
+		}
+		if got, want := v.msg.Answer[0].String(), tt.out; got != want {
+			t.Errorf("#%d: Answer = %q, want %q", i, got, want)
+		}
+	}
+	if _, err := Unpack("42 1560636910 z1:ff"); err == nil {
+		t.Error("want error for invalid compressed message")
 	}
 }
 
@@ -411,6 +1087,32 @@ func TestCacheWithBackend(t *testing.T) {
 	}
 }
 
+func TestCachePersistNegative(t *testing.T) {
+	backend := &testBackend{}
+	c := NewWithBackend(10, nil, backend)
+	c.SetPersistNegative(false)
+	nxdomain := newA("nxdomain.example.com.", 60)
+	nxdomain.Rcode = dns.RcodeNameError
+	c.Set(1, testMsg)
+	c.Set(2, nxdomain)
+	if _, ok := c.Get(2); !ok {
+		t.Errorf("Get(%d) = (_, %t), want (_, %t)", 2, ok, true)
+	}
+	var keys []uint32
+	for _, v := range backend.Read() {
+		keys = append(keys, v.Key)
+	}
+	if want := []uint32{1}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v in backend, want %v", keys, want)
+	}
+
+	// Persisted value is removed from backend when replaced by a negative one
+	c.Set(1, nxdomain)
+	if got := len(backend.Read()); got != 0 {
+		t.Errorf("got %d values in backend, want 0", got)
+	}
+}
+
 func TestCacheStats(t *testing.T) {
 	c := New(10, nil)
 	c.Set(1, testMsg)
@@ -422,6 +1124,91 @@ func TestCacheStats(t *testing.T) {
 	}
 }
 
+func TestCacheEvictionStats(t *testing.T) {
+	now := time.Now()
+	c := newCache(2, nil, nil, func() time.Time { return now })
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		c.Set(uint32(i), testMsg)
+	}
+	if got, want := c.Stats().Evictions, uint64(1); got != want {
+		t.Errorf("Evictions = %d, want %d", got, want)
+	}
+
+	// Expired values are counted separately
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.Get(2)
+	flush(c)
+	stats := c.Stats()
+	if got, want := stats.Evictions, uint64(1); got != want {
+		t.Errorf("Evictions = %d, want %d", got, want)
+	}
+	if got, want := stats.Expirations, uint64(1); got != want {
+		t.Errorf("Expirations = %d, want %d", got, want)
+	}
+
+	// Refreshes are counted by result
+	client := newTestClient()
+	c = newCache(2, client, nil, func() time.Time { return now })
+	defer c.Close()
+	c.Set(1, testMsg)
+	c.now = func() time.Time { return now.Add(61 * time.Second) }
+	c.Get(1)
+	flush(c)
+	client.setAnswer(testMsg)
+	c.Get(1)
+	flush(c)
+	stats = c.Stats()
+	if got, want := stats.RefreshErrors, uint64(1); got != want {
+		t.Errorf("RefreshErrors = %d, want %d", got, want)
+	}
+	if got, want := stats.Refreshes, uint64(1); got != want {
+		t.Errorf("Refreshes = %d, want %d", got, want)
+	}
+}
+
+func TestCacheRecommendedCapacity(t *testing.T) {
+	c := New(10, nil)
+	if got, want := c.Stats().RecommendedCapacity, 0; got != want {
+		t.Errorf("RecommendedCapacity = %d, want %d", got, want)
+	}
+	// Working set of 100 names does not fit in cache
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100; j++ {
+			m := newA(fmt.Sprintf("r%d", j), 60, net.ParseIP("192.0.2.1"))
+			k := NewKey(m.Question[0].Name, m.Question[0].Qtype, m.Question[0].Qclass)
+			if _, ok := c.Get(k); !ok {
+				c.Set(k, m)
+			}
+		}
+	}
+	stats := c.Stats()
+	if got, want := stats.Misses, uint64(200); got != want {
+		t.Errorf("Misses = %d, want %d", got, want)
+	}
+	if got, want := stats.Evictions, uint64(190); got != want {
+		t.Errorf("Evictions = %d, want %d", got, want)
+	}
+	if got, want := stats.RecommendedCapacity, 256; got != want {
+		t.Errorf("RecommendedCapacity = %d, want %d", got, want)
+	}
+
+	// Working set fits in cache
+	c = New(100, nil)
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100; j++ {
+			m := newA(fmt.Sprintf("r%d", j), 60, net.ParseIP("192.0.2.1"))
+			k := NewKey(m.Question[0].Name, m.Question[0].Qtype, m.Question[0].Qclass)
+			if _, ok := c.Get(k); !ok {
+				c.Set(k, m)
+			}
+		}
+	}
+	if got, want := c.Stats().RecommendedCapacity, 0; got != want {
+		t.Errorf("RecommendedCapacity = %d, want %d", got, want)
+	}
+}
+
 func BenchmarkNewKey(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		NewKey("key", 1, 1)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -18,6 +19,9 @@ import (
 	"github.com/mpolden/zdns/sql"
 )
 
+// version is the version of zdns, which is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 const (
 	name       = "zdns"
 	logPrefix  = name + ": "
@@ -48,6 +52,15 @@ func readConfig(file string) (zdns.Config, error) {
 	return zdns.ReadConfig(f)
 }
 
+// checkConfig reads and validates the config file, without starting any servers.
+func checkConfig(out io.Writer, file string) error {
+	if _, err := readConfig(file); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	fmt.Fprintf(out, "%s: config ok\n", file)
+	return nil
+}
+
 func fatal(err error) {
 	if err == nil {
 		return
@@ -70,12 +83,26 @@ func newCli(out io.Writer, args []string, configFile string, sig chan os.Signal)
 	cl.SetOutput(out)
 	log.SetOutput(out)
 	confFile := cl.String("f", configFile, "config file `path`")
+	test := cl.Bool("t", false, "test config file and exit")
 	cl.Parse(args)
 
+	if *test {
+		fatal(checkConfig(out, *confFile))
+		os.Exit(0)
+	}
+
 	// Config
 	config, err := readConfig(*confFile)
 	fatal(err)
 
+	// Syslog
+	if config.DNS.LogSyslog {
+		w, err := zdns.NewSyslogWriter(name)
+		fatal(err)
+		log.SetOutput(w)
+		log.SetPrefix("") // Syslog includes the tag
+	}
+
 	// Signal handler
 	sigHandler := signal.NewHandler(sig)
 
@@ -86,26 +113,50 @@ func newCli(out io.Writer, args []string, configFile string, sig chan os.Signal)
 		sqlCache  *sql.Cache
 	)
 	if config.DNS.Database != "" {
-		sqlClient, err = sql.New(config.DNS.Database)
+		sqlClient, err = sql.NewWithConfig(config.DNS.Database, sql.Config{
+			BusyTimeout: config.DNS.DatabaseBusyTimeout,
+			Synchronous: config.DNS.DatabaseSync,
+		})
 		fatal(err)
 
 		// Logger
-		sqlLogger = sql.NewLogger(sqlClient, config.DNS.LogMode, config.DNS.LogTTL)
+		loggerConfig := sql.LoggerConfig{
+			BatchSize:      config.DNS.LogBatchSize,
+			BatchInterval:  config.DNS.LogBatchInterval,
+			VacuumInterval: config.DNS.LogVacuumInterval,
+			ExcludeSubnets: config.DNS.LogExclude,
+		}
+		sqlLogger = sql.NewLoggerWithConfig(sqlClient, config.DNS.LogMode, config.DNS.LogTTL, loggerConfig)
 
 		// Cache
-		sqlCache = sql.NewCache(sqlClient)
+		sqlCache = sql.NewCacheWithConfig(sqlClient, sql.CacheConfig{Compress: config.DNS.CachePersistCompress})
 	}
 
 	// DNS client
-	dnsConfig := dnsutil.Config{
-		Network: config.Resolver.Protocol,
-		Timeout: config.Resolver.Timeout,
+	var limiter *dnsutil.Limiter
+	if config.DNS.MaxConcurrentQueries > 0 {
+		limiter = dnsutil.NewLimiter(config.DNS.MaxConcurrentQueries)
 	}
-	dnsClients := make([]dnsutil.Client, 0, len(config.DNS.Resolvers))
-	for _, addr := range config.DNS.Resolvers {
-		dnsClients = append(dnsClients, dnsutil.NewClient(addr, dnsConfig))
+	dnsClients := make([]dnsutil.Client, 0, len(config.Resolver.Upstreams))
+	for _, upstream := range config.Resolver.Upstreams {
+		client := zdns.NewResolverClient(upstream, config)
+		if limiter != nil {
+			client = limiter.Limit(client)
+		}
+		if config.DNS.ResolverFailures > 0 {
+			client = dnsutil.NewBreaker(client, config.DNS.ResolverFailures, config.DNS.ResolverWindow, config.DNS.ResolverCooldown)
+		}
+		dnsClients = append(dnsClients, client)
+	}
+	var dnsClient dnsutil.Client
+	if config.DNS.ResolverStrategy == "latency" {
+		dnsClient = dnsutil.NewLatencyMux(dnsClients...)
+	} else {
+		dnsClient = dnsutil.NewMux(dnsClients...)
+	}
+	if config.DNS.QNAMEMinimization {
+		dnsClient = dnsutil.NewMinimizer(dnsClient)
 	}
-	dnsClient := dnsutil.NewMux(dnsClients...)
 
 	// Cache
 	var dnsCache *cache.Cache
@@ -119,20 +170,60 @@ func newCli(out io.Writer, args []string, configFile string, sig chan os.Signal)
 	} else {
 		dnsCache = cache.New(config.DNS.CacheSize, cacheDNS)
 	}
+	dnsCache.SetPrefetchThreshold(config.DNS.CachePrefetchThreshold)
+	dnsCache.SetServfailTTL(config.DNS.CacheServfailTTL)
+	dnsCache.SetZeroTTL(config.DNS.CacheZeroTTL)
+	dnsCache.SetNegativeCapacity(config.DNS.CacheNegativeSize)
+	dnsCache.SetPersistNegative(config.DNS.CachePersistNegative)
+	if config.DNS.CacheHint > 0 {
+		dnsCache.LogHints(config.DNS.CacheHint)
+	}
+	if config.DNS.CacheSweep > 0 {
+		dnsCache.Sweep(config.DNS.CacheSweep)
+	}
 
 	// DNS server
-	proxy, err := dns.NewProxy(dnsCache, dnsClient, sqlLogger)
+	proxyConfig := dns.Config{
+		LogWildcard:        config.DNS.LogWildcard,
+		LogEDNS:            config.DNS.LogEDNS,
+		LogFormat:          config.DNS.LogFormat,
+		RefuseNonRecursive: config.DNS.RefuseNonRecursive,
+		RefuseANY:          config.DNS.RefuseANY,
+		LocalOnly:          config.DNS.LocalOnly,
+		RotateAnswers:      config.DNS.RotateAnswers,
+		MinimalResponses:   config.DNS.MinimalResponses,
+		MaxAnswers:         config.DNS.MaxAnswers,
+		EDNSUDPSize:        uint16(config.DNS.EDNSUDPSize),
+		ShutdownGrace:      config.DNS.ShutdownGrace,
+	}
+	proxy, err := dns.NewProxy(dnsCache, dnsClient, sqlLogger, proxyConfig)
 	fatal(err)
+	proxy.TypeCounter = dnsutil.NewTypeCounter()
+	proxy.Latency = dnsutil.NewLatencyReservoir(1024)
 
 	dnsSrv, err := zdns.NewServer(proxy, config)
 	fatal(err)
 	sigHandler.OnReload(dnsSrv)
+	sigHandler.OnReload(proxy)
+	sigHandler.OnFlush(dnsCache.Reset)
 	servers := []server{dnsSrv}
 
 	// HTTP server
 	var httpSrv *http.Server
 	if config.DNS.ListenHTTP != "" {
-		httpSrv = http.NewServer(dnsCache, sqlLogger, sqlCache, config.DNS.ListenHTTP)
+		httpConfig := http.Config{
+			Token:       config.DNS.HTTPToken,
+			DNSHandler:  proxy,
+			TypeCounter: proxy.TypeCounter,
+			Latency:     proxy.Latency,
+			Resolver:    dnsClient,
+			Pprof:       config.DNS.HTTPPprof,
+			Ready:       dnsSrv.Ready,
+			Hosts:       dnsSrv.HostsStatus,
+			Version:     version,
+			Settings:    func() interface{} { return config.Redacted() },
+		}
+		httpSrv = http.NewServer(dnsCache, sqlLogger, sqlCache, config.DNS.ListenHTTP, httpConfig)
 		servers = append(servers, httpSrv)
 	}
 
@@ -3,6 +3,7 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 )
@@ -43,3 +44,35 @@ hijack_mode = "zero"
 	sig <- syscall.SIGTERM
 	cli.sh.Close()
 }
+
+func TestCheckConfig(t *testing.T) {
+	var tests = []struct {
+		conf string
+		err  string
+	}{
+		{"[dns]\nlisten = \"127.0.0.1:0\"\n", ""},
+		{"[dns]\ncache_size = -1\n", "cache size must be >= 0"},
+		{"[dns\n", "expected"},
+	}
+	for i, tt := range tests {
+		f, err := tempFile(t, tt.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f)
+		var sb strings.Builder
+		err = checkConfig(&sb, f)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("#%d: got err = %q, want nil", i, err)
+			}
+			if got, want := sb.String(), f+": config ok\n"; got != want {
+				t.Errorf("#%d: got %q, want %q", i, got, want)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("#%d: got err = %v, want error containing %q", i, err, tt.err)
+		}
+	}
+}
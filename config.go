@@ -1,98 +1,449 @@
 package zdns
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"runtime"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/mpolden/zdns/dns"
 	"github.com/mpolden/zdns/hosts"
 	"github.com/mpolden/zdns/sql"
 )
 
 // Config specifies is the zdns configuration parameters.
 type Config struct {
-	DNS      DNSOptions
-	Resolver ResolverOptions
-	Hosts    []Hosts
+	DNS          DNSOptions
+	Resolver     ResolverOptions
+	Hosts        []Hosts
+	SplitHorizon []SplitHorizon `toml:"split_horizon"`
+	Zones        []Zone         `toml:"zone"`
 }
 
 // DNSOptions controlers the behaviour of the DNS server.
 type DNSOptions struct {
-	Listen          string
-	Protocol        string `toml:"protocol"`
-	CacheSize       int    `toml:"cache_size"`
-	CachePrefetch   bool   `toml:"cache_prefetch"`
-	CachePersist    bool   `toml:"cache_persist"`
-	HijackMode      string `toml:"hijack_mode"`
-	hijackMode      int
-	RefreshInterval string `toml:"hosts_refresh_interval"`
-	refreshInterval time.Duration
-	Resolvers       []string
-	Database        string `toml:"database"`
-	LogModeString   string `toml:"log_mode"`
-	LogMode         int
-	LogTTLString    string `toml:"log_ttl"`
-	LogTTL          time.Duration
-	ListenHTTP      string `toml:"listen_http"`
+	Listen                 Addrs
+	Protocol               string `toml:"protocol"`
+	TLSCert                string `toml:"tls_cert"`
+	TLSKey                 string `toml:"tls_key"`
+	CacheSize              int    `toml:"cache_size"`
+	CacheNegativeSize      int    `toml:"cache_negative_size"`
+	CachePrefetch          bool   `toml:"cache_prefetch"`
+	CachePrefetchThreshold int    `toml:"cache_prefetch_threshold"`
+	CachePersist           bool   `toml:"cache_persist"`
+	CachePersistCompress   bool   `toml:"cache_persist_compress"`
+	CachePersistNegative   bool   `toml:"cache_persist_negative"`
+	CacheHintString        string `toml:"cache_hint_interval"`
+	CacheHint              time.Duration
+	CacheServfailString    string `toml:"cache_servfail_ttl"`
+	CacheServfailTTL       time.Duration
+	CacheZeroTTLString     string `toml:"cache_zero_ttl_as"`
+	CacheZeroTTL           time.Duration
+	CacheSweepString       string `toml:"cache_sweep_interval"`
+	CacheSweep             time.Duration
+	EDNSUDPSize            int    `toml:"edns_udp_size"`
+	HijackMode             string `toml:"hijack_mode"`
+	hijackMode             int
+	HijackAddress          string `toml:"hijack_address"`
+	hijackAddress          net.IP
+	HijackAddressV6        string `toml:"hijack_address_v6"`
+	hijackAddressV6        net.IP
+	HijackNegativeTTL      string `toml:"hijack_negative_ttl"`
+	hijackNegativeTTL      time.Duration
+	RefuseNonRecursive     bool   `toml:"refuse_non_recursive"`
+	RefuseANY              bool   `toml:"refuse_any"`
+	LocalOnly              bool   `toml:"local_only"`
+	RotateAnswers          bool   `toml:"rotate_answers"`
+	MinimalResponses       bool   `toml:"minimal_responses"`
+	MaxAnswers             int    `toml:"max_answers"`
+	ChaosVersion           string `toml:"chaos_version"`
+	ChaosHostname          string `toml:"chaos_hostname"`
+	ShutdownGraceString    string `toml:"shutdown_grace"`
+	ShutdownGrace          time.Duration
+	RefreshInterval        string `toml:"hosts_refresh_interval"`
+	refreshInterval        time.Duration
+	HostsStaleString       string `toml:"hosts_stale_threshold"`
+	hostsStaleThreshold    time.Duration
+	HostsFetchElapsed      string `toml:"hosts_fetch_max_elapsed"`
+	hostsFetchElapsed      time.Duration
+	HostsFetchInterval     string `toml:"hosts_fetch_max_interval"`
+	hostsFetchInterval     time.Duration
+	HostsStalePolicy       string `toml:"hosts_stale_policy"`
+	hostsStalePolicy       int
+	DefaultAction          string `toml:"default_action"`
+	defaultAction          int
+	Resolvers              []string
+	ResolverFailures       int    `toml:"resolver_failure_threshold"`
+	ResolverWindowString   string `toml:"resolver_failure_window"`
+	ResolverWindow         time.Duration
+	ResolverCooldownString string `toml:"resolver_cooldown"`
+	ResolverCooldown       time.Duration
+	ResolverHealthcheck    bool   `toml:"resolver_healthcheck"`
+	ResolverProbeName      string `toml:"resolver_probe_name"`
+	ResolverStrategy       string `toml:"resolver_strategy"`
+	MaxConcurrentQueries   int    `toml:"max_concurrent_queries"`
+	QNAMEMinimization      bool   `toml:"qname_minimization"`
+	Database               string `toml:"database"`
+	DatabaseBusyString     string `toml:"database_busy_timeout"`
+	DatabaseBusyTimeout    time.Duration
+	DatabaseSync           string `toml:"database_synchronous"`
+	LogModeString          string `toml:"log_mode"`
+	LogMode                int
+	LogTTLString           string `toml:"log_ttl"`
+	LogTTL                 time.Duration
+	LogBatchSize           int    `toml:"log_batch_size"`
+	LogBatchString         string `toml:"log_batch_interval"`
+	LogBatchInterval       time.Duration
+	LogVacuumString        string `toml:"log_vacuum_interval"`
+	LogVacuumInterval      time.Duration
+	LogWildcard            bool     `toml:"log_wildcard"`
+	LogEDNS                bool     `toml:"log_edns"`
+	LogFormatString        string   `toml:"log_format"`
+	LogSyslog              bool     `toml:"log_syslog"`
+	LogExcludeSubnets      []string `toml:"log_exclude_subnets"`
+	LogExclude             []*net.IPNet
+	LogFormat              int
+	ListenHTTP             string `toml:"listen_http"`
+	HTTPToken              string `toml:"http_token"`
+	HTTPPprof              bool   `toml:"http_pprof"`
 }
 
 // ResolverOptions controls the behaviour of resolvers.
 type ResolverOptions struct {
-	Protocol      string `toml:"protocol"`
-	TimeoutString string `toml:"timeout"`
-	Timeout       time.Duration
+	Protocol           string `toml:"protocol"`
+	Upstreams          []Upstream
+	TimeoutString      string `toml:"timeout"`
+	Timeout            time.Duration
+	DialTimeoutString  string `toml:"dial_timeout"`
+	DialTimeout        time.Duration
+	ReadTimeoutString  string `toml:"read_timeout"`
+	ReadTimeout        time.Duration
+	EDNSFallback       bool   `toml:"edns_fallback"`
+	HTTPMethod         string `toml:"https_method"`
+	HTTPLegacy         bool   `toml:"https_legacy_media_type"`
+	HTTPMaxIdle        int    `toml:"https_max_idle_conns"`
+	HTTPIdleString     string `toml:"https_idle_timeout"`
+	HTTPIdleTimeout    time.Duration
+	HTTPRequestString  string `toml:"https_request_timeout"`
+	HTTPRequestTimeout time.Duration
 }
 
 // Hosts controls how a hosts file should be retrieved.
 type Hosts struct {
-	URL     string
+	URL      string
+	Hosts    []string `toml:"entries"`
+	hosts    hosts.Hosts
+	Hijack   bool
+	Allow    bool
+	Timeout  string
+	timeout  time.Duration
+	Format   string `toml:"format"`
+	format   int
+	SHA256   string `toml:"sha256"`
+	TTL      string `toml:"ttl"`
+	ttl      time.Duration
+	patterns hosts.Patterns
+}
+
+const (
+	formatHosts = iota
+	formatDomains
+	formatRegex
+)
+
+// parse parses hosts from reader r in the format of hosts entry h. Regular expressions are returned as patterns.
+func (h Hosts) parse(r io.Reader) (hosts.Hosts, hosts.Patterns, error) {
+	switch h.format {
+	case formatDomains:
+		hs, err := hosts.ParseDomains(r)
+		return hs, nil, err
+	case formatRegex:
+		patterns, err := hosts.ParsePatterns(r)
+		return nil, patterns, err
+	}
+	hs, err := hosts.Parse(r)
+	return hs, nil, err
+}
+
+// Addrs is a list of network addresses. In the config file it can be set to either a single address or a list of
+// addresses.
+type Addrs []string
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (a *Addrs) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*a = Addrs{v}
+	case []interface{}:
+		addrs := make(Addrs, 0, len(v))
+		for _, addr := range v {
+			s, ok := addr.(string)
+			if !ok {
+				return fmt.Errorf("invalid address: %v", addr)
+			}
+			addrs = append(addrs, s)
+		}
+		*a = addrs
+	default:
+		return fmt.Errorf("invalid address: %v", v)
+	}
+	return nil
+}
+
+// SplitHorizon controls how names should be answered for clients in particular subnets.
+type SplitHorizon struct {
+	Subnets []string `toml:"subnets"`
+	subnets []*net.IPNet
 	Hosts   []string `toml:"entries"`
 	hosts   hosts.Hosts
-	Hijack  bool
-	Timeout string
-	timeout time.Duration
+}
+
+// Upstream is an upstream resolver and the protocol used to query it.
+type Upstream struct {
+	Address  string
+	Protocol string
+}
+
+// parseUpstream parses the resolver r. The protocol of r is determined by its scheme, and defaults to protocol if r
+// has no scheme.
+func parseUpstream(r, protocol string) (Upstream, error) {
+	scheme, addr, ok := strings.Cut(r, "://")
+	if !ok {
+		if protocol == "https" {
+			return Upstream{}, fmt.Errorf("protocol %s requires https scheme for resolver %s", protocol, r)
+		}
+		if _, _, err := net.SplitHostPort(r); err != nil {
+			return Upstream{}, fmt.Errorf("invalid resolver: %w", err)
+		}
+		return Upstream{Address: r, Protocol: protocol}, nil
+	}
+	switch scheme {
+	case "https":
+		if _, err := url.Parse(r); err != nil {
+			return Upstream{}, fmt.Errorf("invalid resolver %s: %w", r, err)
+		}
+		return Upstream{Address: r, Protocol: "https"}, nil
+	case "udp":
+		protocol = ""
+	case "tcp":
+		protocol = "tcp"
+	case "tls":
+		protocol = "tcp-tls"
+	default:
+		if protocol == "https" {
+			return Upstream{}, fmt.Errorf("protocol %s requires https scheme for resolver %s", protocol, r)
+		}
+		return Upstream{}, fmt.Errorf("invalid resolver %s: unsupported scheme: %s", r, scheme)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return Upstream{}, fmt.Errorf("invalid resolver: %w", err)
+	}
+	return Upstream{Address: addr, Protocol: protocol}, nil
+}
+
+// parseTimeout parses the timeout s, which defaults to fallback if it is empty or zero.
+func parseTimeout(s string, fallback time.Duration) (time.Duration, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative timeout: %s", s)
+	}
+	if d == 0 {
+		return fallback, nil
+	}
+	return d, nil
+}
+
+// Zone controls how an authoritative zone should be loaded.
+type Zone struct {
+	Origin string `toml:"origin"`
+	File   string `toml:"file"`
+}
+
+func (sh *SplitHorizon) contains(ip net.IP) bool {
+	for _, subnet := range sh.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func newConfig() Config {
 	c := Config{}
 	// Default values
-	c.DNS.Listen = "127.0.0.1:53000"
+	c.DNS.Listen = Addrs{"127.0.0.1:53000"}
 	c.DNS.ListenHTTP = "127.0.0.1:8053"
 	c.DNS.Protocol = "udp"
 	c.DNS.CacheSize = 4096
 	c.DNS.CachePrefetch = true
+	c.DNS.CachePrefetchThreshold = 1
+	c.DNS.CacheHintString = "24h"
+	c.DNS.CacheServfailString = "5s"
+	c.DNS.EDNSUDPSize = 1232
 	c.DNS.RefreshInterval = "48h"
+	c.DNS.HostsFetchElapsed = "30s"
+	c.DNS.HostsFetchInterval = "2s"
+	c.DNS.ShutdownGraceString = "5s"
+	c.DNS.HijackNegativeTTL = "1h"
 	c.DNS.Resolvers = []string{
 		"1.1.1.1:853",
 		"1.0.0.1:853",
 	}
+	c.DNS.ResolverWindowString = "1m"
+	c.DNS.ResolverCooldownString = "30s"
+	c.DNS.ResolverProbeName = "."
+	c.DNS.DatabaseBusyString = "5s"
 	c.DNS.LogTTLString = "168h"
+	c.DNS.LogBatchSize = 100
+	c.DNS.LogBatchString = "1s"
+	c.DNS.LogVacuumString = "24h"
 	c.Resolver.TimeoutString = "2s"
 	c.Resolver.Protocol = "tcp-tls"
+	c.Resolver.EDNSFallback = true
+	c.Resolver.HTTPMaxIdle = 8
+	c.Resolver.HTTPIdleString = "90s"
 	return c
 }
 
 func (c *Config) load() error {
 	var err error
-	if c.DNS.Listen == "" {
-		return fmt.Errorf("invalid listening address: %s", c.DNS.Listen)
+	if len(c.DNS.Listen) == 0 {
+		return fmt.Errorf("at least one listening address must be set")
+	}
+	for _, addr := range c.DNS.Listen {
+		if addr == "" {
+			return fmt.Errorf("invalid listening address: %s", addr)
+		}
 	}
 	if c.DNS.Protocol == "" {
 		c.DNS.Protocol = "udp"
 	}
-	if c.DNS.Protocol != "udp" {
+	switch c.DNS.Protocol {
+	case "udp", "udp+tcp":
+	case "tcp-tls":
+		if c.DNS.TLSCert == "" || c.DNS.TLSKey == "" {
+			return fmt.Errorf("protocol %s requires 'tls_cert' and 'tls_key' to be set", c.DNS.Protocol)
+		}
+	default:
 		return fmt.Errorf("unsupported protocol: %s", c.DNS.Protocol)
 	}
 	if c.DNS.CacheSize < 0 {
 		return fmt.Errorf("cache size must be >= 0")
 	}
+	if c.DNS.CacheNegativeSize < 0 {
+		return fmt.Errorf("cache negative size must be >= 0")
+	}
+	if c.DNS.CachePrefetchThreshold < 0 {
+		return fmt.Errorf("cache prefetch threshold must be >= 0")
+	}
+	if c.DNS.EDNSUDPSize != 0 && (c.DNS.EDNSUDPSize < 512 || c.DNS.EDNSUDPSize > 65535) {
+		return fmt.Errorf("edns udp size must be 0 or between 512 and 65535")
+	}
 	if c.DNS.CachePersist && c.DNS.Database == "" {
 		return fmt.Errorf("cache_persist = %t requires 'database' to be set", c.DNS.CachePersist)
 	}
+	if c.DNS.CacheHintString == "" {
+		c.DNS.CacheHintString = "0"
+	}
+	c.DNS.CacheHint, err = time.ParseDuration(c.DNS.CacheHintString)
+	if err != nil {
+		return fmt.Errorf("invalid cache hint interval: %s", c.DNS.CacheHintString)
+	}
+	if c.DNS.CacheHint < 0 {
+		return fmt.Errorf("cache hint interval must be >= 0")
+	}
+	if c.DNS.CacheServfailString == "" {
+		c.DNS.CacheServfailString = "0"
+	}
+	c.DNS.CacheServfailTTL, err = time.ParseDuration(c.DNS.CacheServfailString)
+	if err != nil {
+		return fmt.Errorf("invalid cache servfail ttl: %s", c.DNS.CacheServfailString)
+	}
+	if c.DNS.CacheServfailTTL < 0 {
+		return fmt.Errorf("cache servfail ttl must be >= 0")
+	}
+	if c.DNS.CacheZeroTTLString == "" {
+		c.DNS.CacheZeroTTLString = "0"
+	}
+	c.DNS.CacheZeroTTL, err = time.ParseDuration(c.DNS.CacheZeroTTLString)
+	if err != nil {
+		return fmt.Errorf("invalid cache zero ttl: %s", c.DNS.CacheZeroTTLString)
+	}
+	if c.DNS.CacheZeroTTL < 0 {
+		return fmt.Errorf("cache zero ttl must be >= 0")
+	}
+	if c.DNS.CacheZeroTTL > 0 && c.DNS.CacheZeroTTL < time.Second {
+		return fmt.Errorf("cache zero ttl must be at least 1s")
+	}
+	if c.DNS.CacheSweepString == "" {
+		c.DNS.CacheSweepString = "0"
+	}
+	c.DNS.CacheSweep, err = time.ParseDuration(c.DNS.CacheSweepString)
+	if err != nil {
+		return fmt.Errorf("invalid cache sweep interval: %s", c.DNS.CacheSweepString)
+	}
+	if c.DNS.CacheSweep < 0 {
+		return fmt.Errorf("cache sweep interval must be >= 0")
+	}
+	if c.DNS.ShutdownGraceString == "" {
+		c.DNS.ShutdownGraceString = "0"
+	}
+	c.DNS.ShutdownGrace, err = time.ParseDuration(c.DNS.ShutdownGraceString)
+	if err != nil {
+		return fmt.Errorf("invalid shutdown grace: %s", c.DNS.ShutdownGraceString)
+	}
+	if c.DNS.ShutdownGrace < 0 {
+		return fmt.Errorf("shutdown grace must be >= 0")
+	}
+	if c.DNS.MaxAnswers < 0 {
+		return fmt.Errorf("max answers must be >= 0")
+	}
+	if c.DNS.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("max concurrent queries must be >= 0")
+	}
+	if c.DNS.ResolverFailures < 0 {
+		return fmt.Errorf("resolver failure threshold must be >= 0")
+	}
+	if c.DNS.ResolverWindowString == "" {
+		c.DNS.ResolverWindowString = "0"
+	}
+	c.DNS.ResolverWindow, err = time.ParseDuration(c.DNS.ResolverWindowString)
+	if err != nil {
+		return fmt.Errorf("invalid resolver failure window: %s", c.DNS.ResolverWindowString)
+	}
+	if c.DNS.ResolverWindow < 0 {
+		return fmt.Errorf("resolver failure window must be >= 0")
+	}
+	if c.DNS.ResolverCooldownString == "" {
+		c.DNS.ResolverCooldownString = "0"
+	}
+	c.DNS.ResolverCooldown, err = time.ParseDuration(c.DNS.ResolverCooldownString)
+	if err != nil {
+		return fmt.Errorf("invalid resolver cooldown: %s", c.DNS.ResolverCooldownString)
+	}
+	if c.DNS.ResolverCooldown < 0 {
+		return fmt.Errorf("resolver cooldown must be >= 0")
+	}
+	if c.DNS.ResolverProbeName == "" {
+		c.DNS.ResolverProbeName = "."
+	}
+	switch c.DNS.ResolverStrategy {
+	case "", "parallel", "latency":
+	default:
+		return fmt.Errorf("invalid resolver strategy: %s", c.DNS.ResolverStrategy)
+	}
 	switch c.DNS.HijackMode {
 	case "", "zero":
 		c.DNS.hijackMode = HijackZero
@@ -100,9 +451,35 @@ func (c *Config) load() error {
 		c.DNS.hijackMode = HijackEmpty
 	case "hosts":
 		c.DNS.hijackMode = HijackHosts
+	case "nxdomain":
+		c.DNS.hijackMode = HijackNXDOMAIN
 	default:
 		return fmt.Errorf("invalid hijack mode: %s", c.DNS.HijackMode)
 	}
+	if c.DNS.HijackAddress != "" {
+		ip := net.ParseIP(c.DNS.HijackAddress)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid hijack address: %s", c.DNS.HijackAddress)
+		}
+		c.DNS.hijackAddress = ip.To4()
+	}
+	if c.DNS.HijackAddressV6 != "" {
+		ip := net.ParseIP(c.DNS.HijackAddressV6)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid hijack address v6: %s", c.DNS.HijackAddressV6)
+		}
+		c.DNS.hijackAddressV6 = ip
+	}
+	if c.DNS.HijackNegativeTTL == "" {
+		c.DNS.HijackNegativeTTL = "0"
+	}
+	c.DNS.hijackNegativeTTL, err = time.ParseDuration(c.DNS.HijackNegativeTTL)
+	if err != nil {
+		return fmt.Errorf("invalid hijack negative ttl: %s", c.DNS.HijackNegativeTTL)
+	}
+	if c.DNS.hijackNegativeTTL < 0 {
+		return fmt.Errorf("hijack negative ttl must be >= 0")
+	}
 	if c.DNS.RefreshInterval == "" {
 		c.DNS.RefreshInterval = "0"
 	}
@@ -113,10 +490,94 @@ func (c *Config) load() error {
 	if c.DNS.refreshInterval < 0 {
 		return fmt.Errorf("refresh interval must be >= 0")
 	}
+	if c.DNS.HostsStaleString == "" {
+		c.DNS.HostsStaleString = "0"
+	}
+	c.DNS.hostsStaleThreshold, err = time.ParseDuration(c.DNS.HostsStaleString)
+	if err != nil {
+		return fmt.Errorf("invalid hosts stale threshold: %s", c.DNS.HostsStaleString)
+	}
+	if c.DNS.hostsStaleThreshold < 0 {
+		return fmt.Errorf("hosts stale threshold must be >= 0")
+	}
+	if c.DNS.HostsFetchElapsed == "" {
+		c.DNS.HostsFetchElapsed = "0"
+	}
+	c.DNS.hostsFetchElapsed, err = time.ParseDuration(c.DNS.HostsFetchElapsed)
+	if err != nil {
+		return fmt.Errorf("invalid hosts fetch max elapsed: %s", c.DNS.HostsFetchElapsed)
+	}
+	if c.DNS.hostsFetchElapsed < 0 {
+		return fmt.Errorf("hosts fetch max elapsed must be >= 0")
+	}
+	if c.DNS.HostsFetchInterval == "" {
+		c.DNS.HostsFetchInterval = "0"
+	}
+	c.DNS.hostsFetchInterval, err = time.ParseDuration(c.DNS.HostsFetchInterval)
+	if err != nil {
+		return fmt.Errorf("invalid hosts fetch max interval: %s", c.DNS.HostsFetchInterval)
+	}
+	if c.DNS.hostsFetchInterval < 0 {
+		return fmt.Errorf("hosts fetch max interval must be >= 0")
+	}
+	switch c.DNS.HostsStalePolicy {
+	case "", "open":
+		c.DNS.hostsStalePolicy = StaleOpen
+	case "closed":
+		c.DNS.hostsStalePolicy = StaleClosed
+	default:
+		return fmt.Errorf("invalid hosts stale policy: %s", c.DNS.HostsStalePolicy)
+	}
+	switch c.DNS.DefaultAction {
+	case "", "allow":
+		c.DNS.defaultAction = DefaultAllow
+	case "reject":
+		c.DNS.defaultAction = DefaultReject
+	default:
+		return fmt.Errorf("invalid default action: %s", c.DNS.DefaultAction)
+	}
+	if c.DNS.DatabaseBusyString == "" {
+		c.DNS.DatabaseBusyString = "0"
+	}
+	c.DNS.DatabaseBusyTimeout, err = time.ParseDuration(c.DNS.DatabaseBusyString)
+	if err != nil {
+		return fmt.Errorf("invalid database busy timeout: %s", c.DNS.DatabaseBusyString)
+	}
+	if c.DNS.DatabaseBusyTimeout < 0 {
+		return fmt.Errorf("database busy timeout must be >= 0")
+	}
+	switch strings.ToLower(c.DNS.DatabaseSync) {
+	case "", "off", "normal", "full", "extra":
+	default:
+		return fmt.Errorf("invalid database synchronous mode: %s", c.DNS.DatabaseSync)
+	}
 	for i, hs := range c.Hosts {
 		if (hs.URL == "") == (hs.Hosts == nil) {
 			return fmt.Errorf("exactly one of url or hosts must be set")
 		}
+		if hs.Allow && hs.Hijack {
+			return fmt.Errorf("at most one of allow or hijack can be set")
+		}
+		switch hs.Format {
+		case "", "hosts":
+			c.Hosts[i].format = formatHosts
+		case "domains":
+			c.Hosts[i].format = formatDomains
+		case "regex":
+			if !hs.Hijack {
+				return fmt.Errorf("format %s requires hijack to be set", hs.Format)
+			}
+			c.Hosts[i].format = formatRegex
+		default:
+			return fmt.Errorf("invalid hosts format: %s", hs.Format)
+		}
+		if hs.TTL != "" {
+			ttl, err := time.ParseDuration(hs.TTL)
+			if err != nil || ttl < 0 {
+				return fmt.Errorf("invalid hosts ttl: %s", hs.TTL)
+			}
+			c.Hosts[i].ttl = ttl
+		}
 		if hs.URL != "" {
 			url, err := url.Parse(hs.URL)
 			if err != nil {
@@ -137,32 +598,50 @@ func (c *Config) load() error {
 			if err != nil {
 				return fmt.Errorf("%s: invalid timeout: %s", hs.URL, hs.Timeout)
 			}
+			if hs.SHA256 != "" {
+				if b, err := hex.DecodeString(hs.SHA256); err != nil || len(b) != sha256.Size {
+					return fmt.Errorf("%s: invalid sha256 checksum: %s", hs.URL, hs.SHA256)
+				}
+			}
 		}
 		if hs.Hosts != nil {
 			if hs.Timeout != "" {
 				return fmt.Errorf("%s: timeout cannot be set for inline hosts", hs.Hosts)
 			}
+			if hs.SHA256 != "" {
+				return fmt.Errorf("%s: sha256 cannot be set for inline hosts", hs.Hosts)
+			}
 			var err error
 			r := strings.NewReader(strings.Join(hs.Hosts, "\n"))
-			c.Hosts[i].hosts, err = hosts.Parse(r)
+			c.Hosts[i].hosts, c.Hosts[i].patterns, err = c.Hosts[i].parse(r)
 			if err != nil {
 				return err
 			}
 		}
 	}
-	for _, r := range c.DNS.Resolvers {
-		if c.Resolver.Protocol == "https" {
-			u, err := url.Parse(r)
+	for i, sh := range c.SplitHorizon {
+		if len(sh.Subnets) == 0 {
+			return fmt.Errorf("split horizon entry %d: at least one subnet must be set", i)
+		}
+		for _, subnet := range sh.Subnets {
+			_, ipNet, err := net.ParseCIDR(subnet)
 			if err != nil {
-				return fmt.Errorf("invalid resolver %s: %w", r, err)
-			}
-			if u.Scheme != "https" {
-				return fmt.Errorf("protocol %s requires https scheme for resolver %s", c.Resolver.Protocol, r)
-			}
-		} else {
-			if _, _, err := net.SplitHostPort(r); err != nil {
-				return fmt.Errorf("invalid resolver: %w", err)
+				return fmt.Errorf("split horizon entry %d: invalid subnet: %s", i, subnet)
 			}
+			c.SplitHorizon[i].subnets = append(c.SplitHorizon[i].subnets, ipNet)
+		}
+		r := strings.NewReader(strings.Join(sh.Hosts, "\n"))
+		c.SplitHorizon[i].hosts, err = hosts.Parse(r)
+		if err != nil {
+			return fmt.Errorf("split horizon entry %d: %w", i, err)
+		}
+	}
+	for i, z := range c.Zones {
+		if z.Origin == "" {
+			return fmt.Errorf("zone entry %d: origin must be set", i)
+		}
+		if z.File == "" {
+			return fmt.Errorf("zone entry %d: file must be set", i)
 		}
 	}
 	if c.Resolver.Protocol == "udp" {
@@ -173,6 +652,33 @@ func (c *Config) load() error {
 	default:
 		return fmt.Errorf("invalid resolver protocol: %s", c.Resolver.Protocol)
 	}
+	c.Resolver.Upstreams = nil
+	for _, r := range c.DNS.Resolvers {
+		upstream, err := parseUpstream(r, c.Resolver.Protocol)
+		if err != nil {
+			return err
+		}
+		c.Resolver.Upstreams = append(c.Resolver.Upstreams, upstream)
+	}
+	c.Resolver.HTTPMethod = strings.ToUpper(c.Resolver.HTTPMethod)
+	switch c.Resolver.HTTPMethod {
+	case "", "GET", "POST":
+	default:
+		return fmt.Errorf("invalid resolver https method: %s", c.Resolver.HTTPMethod)
+	}
+	if c.Resolver.HTTPMaxIdle < 0 {
+		return fmt.Errorf("resolver https max idle connections must be >= 0")
+	}
+	if c.Resolver.HTTPIdleString == "" {
+		c.Resolver.HTTPIdleString = "0"
+	}
+	c.Resolver.HTTPIdleTimeout, err = time.ParseDuration(c.Resolver.HTTPIdleString)
+	if err != nil {
+		return fmt.Errorf("invalid resolver https idle timeout: %s", c.Resolver.HTTPIdleString)
+	}
+	if c.Resolver.HTTPIdleTimeout < 0 {
+		return fmt.Errorf("resolver https idle timeout must be >= 0")
+	}
 	c.Resolver.Timeout, err = time.ParseDuration(c.Resolver.TimeoutString)
 	if err != nil {
 		return fmt.Errorf("invalid resolver timeout: %s", c.Resolver.TimeoutString)
@@ -183,6 +689,18 @@ func (c *Config) load() error {
 	if c.Resolver.Timeout == 0 {
 		c.Resolver.Timeout = 5 * time.Second
 	}
+	c.Resolver.DialTimeout, err = parseTimeout(c.Resolver.DialTimeoutString, c.Resolver.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid resolver dial timeout: %s", c.Resolver.DialTimeoutString)
+	}
+	c.Resolver.ReadTimeout, err = parseTimeout(c.Resolver.ReadTimeoutString, c.Resolver.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid resolver read timeout: %s", c.Resolver.ReadTimeoutString)
+	}
+	c.Resolver.HTTPRequestTimeout, err = parseTimeout(c.Resolver.HTTPRequestString, c.Resolver.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid resolver https request timeout: %s", c.Resolver.HTTPRequestString)
+	}
 	switch c.DNS.LogModeString {
 	case "":
 		c.DNS.LogMode = sql.LogDiscard
@@ -193,6 +711,17 @@ func (c *Config) load() error {
 	default:
 		return fmt.Errorf("invalid log mode: %s", c.DNS.LogModeString)
 	}
+	switch c.DNS.LogFormatString {
+	case "", "text":
+		c.DNS.LogFormat = dns.LogText
+	case "json":
+		c.DNS.LogFormat = dns.LogJSON
+	default:
+		return fmt.Errorf("invalid log format: %s", c.DNS.LogFormatString)
+	}
+	if c.DNS.LogSyslog && !syslogSupported {
+		return fmt.Errorf("log_syslog = %t is not supported on %s", c.DNS.LogSyslog, runtime.GOOS)
+	}
 	if c.DNS.LogModeString != "" && c.DNS.Database == "" {
 		return fmt.Errorf("log_mode = %q requires 'database' to be set", c.DNS.LogModeString)
 	}
@@ -203,9 +732,53 @@ func (c *Config) load() error {
 	if err != nil {
 		return fmt.Errorf("invalid log TTL: %s", c.DNS.LogTTLString)
 	}
+	if c.DNS.LogBatchSize < 0 {
+		return fmt.Errorf("log batch size must be >= 0")
+	}
+	if c.DNS.LogBatchString == "" {
+		c.DNS.LogBatchString = "0"
+	}
+	c.DNS.LogBatchInterval, err = time.ParseDuration(c.DNS.LogBatchString)
+	if err != nil {
+		return fmt.Errorf("invalid log batch interval: %s", c.DNS.LogBatchString)
+	}
+	if c.DNS.LogBatchInterval < 0 {
+		return fmt.Errorf("log batch interval must be >= 0")
+	}
+	if c.DNS.LogVacuumString == "" {
+		c.DNS.LogVacuumString = "0"
+	}
+	c.DNS.LogVacuumInterval, err = time.ParseDuration(c.DNS.LogVacuumString)
+	if err != nil {
+		return fmt.Errorf("invalid log vacuum interval: %s", c.DNS.LogVacuumString)
+	}
+	if c.DNS.LogVacuumInterval < 0 {
+		return fmt.Errorf("log vacuum interval must be >= 0")
+	}
+	for _, subnet := range c.DNS.LogExcludeSubnets {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("invalid log exclude subnet: %s", subnet)
+		}
+		c.DNS.LogExclude = append(c.DNS.LogExclude, ipNet)
+	}
 	return nil
 }
 
+// redacted replaces the value of sensitive options in the config returned by Config.Redacted.
+const redacted = "<redacted>"
+
+// Redacted returns a copy of config c where the values of sensitive options, such as the HTTP token, are redacted.
+func (c Config) Redacted() Config {
+	if c.DNS.TLSKey != "" {
+		c.DNS.TLSKey = redacted
+	}
+	if c.DNS.HTTPToken != "" {
+		c.DNS.HTTPToken = redacted
+	}
+	return c
+}
+
 // ReadConfig reads a zdns configuration from reader r.
 func ReadConfig(r io.Reader) (Config, error) {
 	conf := newConfig()
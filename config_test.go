@@ -1,10 +1,15 @@
 package zdns
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/mpolden/zdns/dns"
 )
 
 func TestConfig(t *testing.T) {
@@ -13,19 +18,48 @@ func TestConfig(t *testing.T) {
 listen = "0.0.0.0:53"
 protocol = "udp"
 cache_size = 2048
+cache_negative_size = 512
+cache_hint_interval = "1h"
+cache_prefetch_threshold = 3
+edns_udp_size = 4096
+cache_servfail_ttl = "10s"
+cache_zero_ttl_as = "30s"
+cache_sweep_interval = "5m"
 resolvers = [
   "192.0.2.1:53",
   "192.0.2.2:53=example.com",
 ]
-hijack_mode = "zero" # or: empty, hosts
+resolver_failure_threshold = 5
+resolver_failure_window = "10s"
+resolver_cooldown = "1m"
+hijack_mode = "zero" # or: empty, hosts, nxdomain
+hijack_address = "192.168.1.2"
+hijack_address_v6 = "fd00::2"
 hosts_refresh_interval = "48h"
+hosts_stale_threshold = "168h"
+hosts_fetch_max_elapsed = "1m"
+hosts_stale_policy = "closed"
+refuse_any = true
+qname_minimization = true
+cache_persist_negative = true
+shutdown_grace = "10s"
 database = "/tmp/log.db"
 log_mode = "all"
 log_ttl = "72h"
+log_batch_size = 50
+log_batch_interval = "500ms"
+log_vacuum_interval = "12h"
+log_exclude_subnets = ["192.168.0.0/16", "fd00::/8"]
+log_format = "json"
 
 [resolver]
 protocol = "tcp-tls" # or: "", "udp", "tcp"
 timeout = "1s"
+dial_timeout = "500ms"
+https_method = "get"
+https_legacy_media_type = true
+https_max_idle_conns = 4
+https_idle_timeout = "30s"
 
 [[hosts]]
 url = "file:///home/foo/hosts-good"
@@ -42,6 +76,15 @@ entries = [
   "0.0.0.0 goodhost2",
 ]
 hijack = false
+
+[[hosts]]
+entries = ["baddomain1"]
+format = "domains"
+hijack = true
+
+[[split_horizon]]
+subnets = ["192.168.0.0/16", "10.0.0.0/8"]
+entries = ["192.168.1.10 nas.example.com"]
 `
 	r := strings.NewReader(text)
 	conf, err := ReadConfig(r)
@@ -55,11 +98,35 @@ hijack = false
 		want  int
 	}{
 		{"DNS.CacheSize", conf.DNS.CacheSize, 2048},
+		{"DNS.CacheNegativeSize", conf.DNS.CacheNegativeSize, 512},
+		{"DNS.CacheHint", int(conf.DNS.CacheHint), int(time.Hour)},
+		{"DNS.CachePrefetchThreshold", conf.DNS.CachePrefetchThreshold, 3},
+		{"DNS.EDNSUDPSize", conf.DNS.EDNSUDPSize, 4096},
+		{"DNS.CacheServfailTTL", int(conf.DNS.CacheServfailTTL), int(10 * time.Second)},
+		{"DNS.CacheZeroTTL", int(conf.DNS.CacheZeroTTL), int(30 * time.Second)},
+		{"DNS.CacheSweep", int(conf.DNS.CacheSweep), int(5 * time.Minute)},
 		{"len(DNS.Resolvers)", len(conf.DNS.Resolvers), 2},
+		{"DNS.ResolverFailures", conf.DNS.ResolverFailures, 5},
+		{"DNS.ResolverWindow", int(conf.DNS.ResolverWindow), int(10 * time.Second)},
+		{"DNS.ResolverCooldown", int(conf.DNS.ResolverCooldown), int(time.Minute)},
 		{"Resolver.Timeout", int(conf.Resolver.Timeout), int(time.Second)},
+		{"Resolver.DialTimeout", int(conf.Resolver.DialTimeout), int(500 * time.Millisecond)},
+		{"Resolver.ReadTimeout", int(conf.Resolver.ReadTimeout), int(time.Second)},
+		{"Resolver.HTTPRequestTimeout", int(conf.Resolver.HTTPRequestTimeout), int(time.Second)},
+		{"Resolver.HTTPMaxIdle", conf.Resolver.HTTPMaxIdle, 4},
+		{"Resolver.HTTPIdleTimeout", int(conf.Resolver.HTTPIdleTimeout), int(30 * time.Second)},
 		{"DNS.RefreshInterval", int(conf.DNS.refreshInterval), int(48 * time.Hour)},
-		{"len(Hosts)", len(conf.Hosts), 3},
+		{"DNS.hostsStaleThreshold", int(conf.DNS.hostsStaleThreshold), int(168 * time.Hour)},
+		{"DNS.hostsFetchElapsed", int(conf.DNS.hostsFetchElapsed), int(time.Minute)},
+		{"DNS.hostsFetchInterval", int(conf.DNS.hostsFetchInterval), int(2 * time.Second)},
+		{"DNS.hostsStalePolicy", conf.DNS.hostsStalePolicy, StaleClosed},
+		{"len(Hosts)", len(conf.Hosts), 4},
 		{"DNS.LogTTL", int(conf.DNS.LogTTL), int(72 * time.Hour)},
+		{"DNS.LogBatchSize", conf.DNS.LogBatchSize, 50},
+		{"DNS.LogBatchInterval", int(conf.DNS.LogBatchInterval), int(500 * time.Millisecond)},
+		{"DNS.LogVacuumInterval", int(conf.DNS.LogVacuumInterval), int(12 * time.Hour)},
+		{"DNS.LogFormat", conf.DNS.LogFormat, dns.LogJSON},
+		{"DNS.ShutdownGrace", int(conf.DNS.ShutdownGrace), int(10 * time.Second)},
 	}
 	for i, tt := range intTests {
 		if tt.got != tt.want {
@@ -72,19 +139,26 @@ hijack = false
 		got   string
 		want  string
 	}{
-		{"DNS.Listen", conf.DNS.Listen, "0.0.0.0:53"},
+		{"DNS.Listen", conf.DNS.Listen[0], "0.0.0.0:53"},
 		{"DNS.Protocol", conf.DNS.Protocol, "udp"},
 		{"DNS.Resolvers[0]", conf.DNS.Resolvers[0], "192.0.2.1:53"},
 		{"DNS.Resolvers[1]", conf.DNS.Resolvers[1], "192.0.2.2:53=example.com"},
 		{"DNS.HijackMode", conf.DNS.HijackMode, "zero"},
+		{"DNS.hijackAddress", conf.DNS.hijackAddress.String(), "192.168.1.2"},
+		{"DNS.hijackAddressV6", conf.DNS.hijackAddressV6.String(), "fd00::2"},
 		{"DNS.Database", conf.DNS.Database, "/tmp/log.db"},
 		{"DNS.LogMode", conf.DNS.LogModeString, "all"},
 		{"DNS.LogTTL", conf.DNS.LogTTLString, "72h"},
 		{"Resolver.Protocol", conf.Resolver.Protocol, "tcp-tls"},
+		{"Resolver.HTTPMethod", conf.Resolver.HTTPMethod, "GET"},
 		{"Hosts[0].Source", conf.Hosts[0].URL, "file:///home/foo/hosts-good"},
 		{"Hosts[1].Source", conf.Hosts[1].URL, "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts"},
 		{"Hosts[1].Timeout", conf.Hosts[1].Timeout, "10s"},
-		{"Hosts[2].hosts", fmt.Sprintf("%+v", conf.Hosts[2].hosts), "map[goodhost1:[{IP:0.0.0.0 Zone:}] goodhost2:[{IP:0.0.0.0 Zone:}]]"},
+		{"Hosts[2].hosts", fmt.Sprintf("%+v", conf.Hosts[2].hosts), "map[goodhost1:{IPAddrs:[{IP:0.0.0.0 Zone:}] Target: TTL:0s} goodhost2:{IPAddrs:[{IP:0.0.0.0 Zone:}] Target: TTL:0s}]"},
+		{"Hosts[3].hosts", fmt.Sprintf("%+v", conf.Hosts[3].hosts), "map[baddomain1:{IPAddrs:[{IP:0.0.0.0 Zone:} {IP::: Zone:}] Target: TTL:0s}]"},
+		{"SplitHorizon[0].subnets", fmt.Sprintf("%s", conf.SplitHorizon[0].subnets), "[192.168.0.0/16 10.0.0.0/8]"},
+		{"DNS.LogExclude", fmt.Sprintf("%s", conf.DNS.LogExclude), "[192.168.0.0/16 fd00::/8]"},
+		{"SplitHorizon[0].hosts", fmt.Sprintf("%+v", conf.SplitHorizon[0].hosts), "map[nas.example.com:{IPAddrs:[{IP:192.168.1.10 Zone:}] Target: TTL:0s}]"},
 	}
 	for i, tt := range stringTests {
 		if tt.got != tt.want {
@@ -99,6 +173,11 @@ hijack = false
 	}{
 		{"Hosts[0].Hijack", conf.Hosts[0].Hijack, false},
 		{"Hosts[1].Hijack", conf.Hosts[1].Hijack, true},
+		{"DNS.RefuseANY", conf.DNS.RefuseANY, true},
+		{"DNS.QNAMEMinimization", conf.DNS.QNAMEMinimization, true},
+		{"DNS.CachePersistNegative", conf.DNS.CachePersistNegative, true},
+		{"Resolver.EDNSFallback", conf.Resolver.EDNSFallback, true},
+		{"Resolver.HTTPLegacy", conf.Resolver.HTTPLegacy, true},
 	}
 	for i, tt := range boolTests {
 		if tt.got != tt.want {
@@ -107,6 +186,84 @@ hijack = false
 	}
 }
 
+func TestConfigUpstreams(t *testing.T) {
+	text := `
+[dns]
+listen = "0.0.0.0:53"
+resolvers = [
+  "192.0.2.1:853=example.com",
+  "udp://192.168.1.1:53",
+  "tcp://192.168.1.1:53",
+  "tls://192.0.2.2:853",
+  "https://dns.example.com/dns-query",
+]
+[resolver]
+protocol = "tcp-tls"
+`
+	conf, err := ReadConfig(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Upstream{
+		{Address: "192.0.2.1:853=example.com", Protocol: "tcp-tls"},
+		{Address: "192.168.1.1:53", Protocol: ""},
+		{Address: "192.168.1.1:53", Protocol: "tcp"},
+		{Address: "192.0.2.2:853", Protocol: "tcp-tls"},
+		{Address: "https://dns.example.com/dns-query", Protocol: "https"},
+	}
+	if got := conf.Resolver.Upstreams; !reflect.DeepEqual(got, want) {
+		t.Errorf("Upstreams = %+v, want %+v", got, want)
+	}
+}
+
+func TestConfigListen(t *testing.T) {
+	text := `
+[dns]
+listen = ["0.0.0.0:53", "[::]:53"]
+`
+	conf, err := ReadConfig(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := conf.DNS.Listen, (Addrs{"0.0.0.0:53", "[::]:53"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Listen = %q, want %q", got, want)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	text := `
+[dns]
+listen = "0.0.0.0:853"
+protocol = "tcp-tls"
+tls_cert = "/etc/zdns/cert.pem"
+tls_key = "/etc/zdns/key.pem"
+resolvers = ["192.0.2.1:53"]
+http_token = "secret"
+`
+	conf, err := ReadConfig(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(conf.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	for _, want := range []string{`"0.0.0.0:853"`, `"192.0.2.1:53"`, `"/etc/zdns/cert.pem"`, `"HTTPToken":"\u003credacted\u003e"`} {
+		if !strings.Contains(s, want) {
+			t.Errorf("want %s in %s", want, s)
+		}
+	}
+	for _, secret := range []string{"secret", "key.pem"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("want %s to be redacted in %s", secret, s)
+		}
+	}
+	if got, want := conf.DNS.HTTPToken, "secret"; got != want {
+		t.Errorf("HTTPToken = %q, want %q", got, want)
+	}
+}
+
 func TestConfigErrors(t *testing.T) {
 	baseConf := "[dns]\nlisten = \"0.0.0.0:53\"\n"
 	conf0 := baseConf + "cache_size = -1"
@@ -171,6 +328,241 @@ protocol = "https"
 `
 	conf15 := baseConf + `
 cache_persist = true
+`
+	conf16 := baseConf + `
+cache_hint_interval = "foo"
+`
+	conf17 := baseConf + `
+cache_hint_interval = "-1h"
+`
+	conf18 := baseConf + `
+log_batch_size = -1
+`
+	conf19 := baseConf + `
+log_batch_interval = "foo"
+`
+	conf20 := baseConf + `
+log_batch_interval = "-1s"
+`
+	conf21 := baseConf + `
+log_vacuum_interval = "foo"
+`
+	conf22 := baseConf + `
+log_vacuum_interval = "-1h"
+`
+	conf23 := baseConf + `
+[[split_horizon]]
+entries = ["192.168.1.10 nas.example.com"]
+`
+	conf24 := baseConf + `
+[[split_horizon]]
+subnets = ["192.168.0.0"]
+entries = ["192.168.1.10 nas.example.com"]
+`
+	conf25 := baseConf + `
+protocol = "tcp"
+`
+	conf26 := baseConf + `
+protocol = "tcp-tls"
+tls_cert = "/etc/zdns/cert.pem"
+`
+	conf27 := baseConf + `
+[resolver]
+https_method = "put"
+`
+	conf28 := baseConf + `
+hosts_stale_threshold = "foo"
+`
+	conf29 := baseConf + `
+hosts_stale_threshold = "-1h"
+`
+	conf30 := baseConf + `
+hosts_stale_policy = "foo"
+`
+	conf31 := baseConf + `
+[resolver]
+https_max_idle_conns = -1
+`
+	conf32 := baseConf + `
+[resolver]
+https_idle_timeout = "foo"
+`
+	conf33 := baseConf + `
+[resolver]
+https_idle_timeout = "-1s"
+`
+	conf34 := baseConf + `
+log_format = "foo"
+`
+	conf46 := baseConf + `
+[[hosts]]
+url = "file:///tmp/allowed"
+allow = true
+hijack = true
+`
+	conf47 := baseConf + `
+[[hosts]]
+entries = ["^ads\\."]
+format = "regex"
+`
+	conf48 := baseConf + `
+[[hosts]]
+entries = ["^ad["]
+format = "regex"
+hijack = true
+`
+	conf49 := baseConf + `
+edns_udp_size = 256
+`
+	conf50 := baseConf + `
+cache_servfail_ttl = "foo"
+`
+	conf51 := baseConf + `
+cache_servfail_ttl = "-1s"
+`
+	conf52 := baseConf + `
+[[hosts]]
+url = "file:///tmp/hosts"
+sha256 = "foo"
+`
+	conf53 := baseConf + `
+[[hosts]]
+entries = ["0.0.0.0 badhost1"]
+sha256 = "foo"
+`
+	conf54 := baseConf + `
+database_busy_timeout = "-1s"
+`
+	conf55 := baseConf + `
+database_synchronous = "sometimes"
+`
+	conf56 := baseConf + `
+log_exclude_subnets = ["192.168.0.0"]
+`
+	conf57 := "[dns]\nlisten = []\n"
+	conf58 := "[dns]\nlisten = [\"0.0.0.0:53\", \"\"]\n"
+	conf59 := baseConf + `
+resolver_strategy = "random"
+`
+	conf60 := baseConf + `
+cache_zero_ttl_as = "foo"
+`
+	conf61 := baseConf + `
+cache_zero_ttl_as = "-1s"
+`
+	conf62 := baseConf + `
+cache_zero_ttl_as = "500ms"
+`
+	conf63 := baseConf + `
+[resolver]
+dial_timeout = "foo"
+`
+	conf64 := baseConf + `
+[resolver]
+read_timeout = "-1s"
+`
+	conf65 := baseConf + `
+[resolver]
+https_request_timeout = "bar"
+`
+	conf66 := baseConf + `
+hosts_fetch_max_elapsed = "foo"
+`
+	conf67 := baseConf + `
+hosts_fetch_max_elapsed = "-1s"
+`
+	conf68 := baseConf + `
+hosts_fetch_max_interval = "foo"
+`
+	conf69 := baseConf + `
+hosts_fetch_max_interval = "-1s"
+`
+	conf70 := baseConf + `
+cache_negative_size = -1
+`
+	conf71 := baseConf + `
+hijack_address = "foo"
+`
+	conf72 := baseConf + `
+hijack_address = "2001:db8::1"
+`
+	conf73 := baseConf + `
+hijack_address_v6 = "192.0.2.1"
+`
+	conf74 := baseConf + `
+hijack_negative_ttl = "foo"
+`
+	conf75 := baseConf + `
+hijack_negative_ttl = "-1s"
+`
+	conf76 := baseConf + `
+max_concurrent_queries = -1
+`
+	conf77 := baseConf + `
+[[hosts]]
+entries = ["0.0.0.0 badhost1"]
+hijack = true
+ttl = "foo"
+`
+	conf78 := baseConf + `
+[[hosts]]
+entries = ["0.0.0.0 badhost1 ttl=foo"]
+hijack = true
+`
+	conf79 := baseConf + `
+max_answers = -1
+`
+	conf80 := baseConf + `
+cache_sweep_interval = "foo"
+`
+	conf81 := baseConf + `
+cache_sweep_interval = "-1m"
+`
+	conf82 := baseConf + `
+default_action = "foo"
+`
+	conf83 := baseConf + `
+resolver_failure_window = "foo"
+`
+	conf84 := baseConf + `
+resolver_failure_window = "-1s"
+`
+	conf35 := baseConf + `
+cache_prefetch_threshold = -1
+`
+	conf36 := baseConf + `
+[[zone]]
+file = "/tmp/example.zone"
+`
+	conf37 := baseConf + `
+[[zone]]
+origin = "example.internal"
+`
+	conf38 := baseConf + `
+resolvers = ["ftp://192.0.2.1:53"]
+`
+	conf39 := baseConf + `
+resolvers = ["tls://192.0.2.1"]
+`
+	conf40 := baseConf + `
+shutdown_grace = "foo"
+`
+	conf41 := baseConf + `
+shutdown_grace = "-1s"
+`
+	conf42 := baseConf + `
+resolver_failure_threshold = -1
+`
+	conf43 := baseConf + `
+resolver_cooldown = "foo"
+`
+	conf44 := baseConf + `
+resolver_cooldown = "-1s"
+`
+	conf45 := baseConf + `
+[[hosts]]
+url = "file:///tmp/domains"
+format = "foo"
 `
 	var tests = []struct {
 		in  string
@@ -193,6 +585,75 @@ cache_persist = true
 		{conf13, `log_mode = "hijacked" requires 'database' to be set`},
 		{conf14, "protocol https requires https scheme for resolver http://example.com"},
 		{conf15, "cache_persist = true requires 'database' to be set"},
+		{conf16, "invalid cache hint interval: foo"},
+		{conf17, "cache hint interval must be >= 0"},
+		{conf18, "log batch size must be >= 0"},
+		{conf19, "invalid log batch interval: foo"},
+		{conf20, "log batch interval must be >= 0"},
+		{conf21, "invalid log vacuum interval: foo"},
+		{conf22, "log vacuum interval must be >= 0"},
+		{conf23, "split horizon entry 0: at least one subnet must be set"},
+		{conf24, "split horizon entry 0: invalid subnet: 192.168.0.0"},
+		{conf25, "unsupported protocol: tcp"},
+		{conf26, "protocol tcp-tls requires 'tls_cert' and 'tls_key' to be set"},
+		{conf27, "invalid resolver https method: PUT"},
+		{conf28, "invalid hosts stale threshold: foo"},
+		{conf29, "hosts stale threshold must be >= 0"},
+		{conf30, "invalid hosts stale policy: foo"},
+		{conf31, "resolver https max idle connections must be >= 0"},
+		{conf32, "invalid resolver https idle timeout: foo"},
+		{conf33, "resolver https idle timeout must be >= 0"},
+		{conf34, "invalid log format: foo"},
+		{conf35, "cache prefetch threshold must be >= 0"},
+		{conf36, "zone entry 0: origin must be set"},
+		{conf37, "zone entry 0: file must be set"},
+		{conf38, "invalid resolver ftp://192.0.2.1:53: unsupported scheme: ftp"},
+		{conf39, "invalid resolver: address 192.0.2.1: missing port in address"},
+		{conf40, "invalid shutdown grace: foo"},
+		{conf41, "shutdown grace must be >= 0"},
+		{conf42, "resolver failure threshold must be >= 0"},
+		{conf43, "invalid resolver cooldown: foo"},
+		{conf44, "resolver cooldown must be >= 0"},
+		{conf45, "invalid hosts format: foo"},
+		{conf46, "at most one of allow or hijack can be set"},
+		{conf47, "format regex requires hijack to be set"},
+		{conf48, "line 1: invalid regular expression: error parsing regexp: missing closing ]: `[`"},
+		{conf49, "edns udp size must be 0 or between 512 and 65535"},
+		{conf50, "invalid cache servfail ttl: foo"},
+		{conf51, "cache servfail ttl must be >= 0"},
+		{conf52, "file:///tmp/hosts: invalid sha256 checksum: foo"},
+		{conf53, "[0.0.0.0 badhost1]: sha256 cannot be set for inline hosts"},
+		{conf54, "database busy timeout must be >= 0"},
+		{conf55, "invalid database synchronous mode: sometimes"},
+		{conf56, "invalid log exclude subnet: 192.168.0.0"},
+		{conf57, "at least one listening address must be set"},
+		{conf58, "invalid listening address: "},
+		{conf59, "invalid resolver strategy: random"},
+		{conf60, "invalid cache zero ttl: foo"},
+		{conf61, "cache zero ttl must be >= 0"},
+		{conf62, "cache zero ttl must be at least 1s"},
+		{conf63, "invalid resolver dial timeout: foo"},
+		{conf64, "invalid resolver read timeout: -1s"},
+		{conf65, "invalid resolver https request timeout: bar"},
+		{conf66, "invalid hosts fetch max elapsed: foo"},
+		{conf67, "hosts fetch max elapsed must be >= 0"},
+		{conf68, "invalid hosts fetch max interval: foo"},
+		{conf69, "hosts fetch max interval must be >= 0"},
+		{conf70, "cache negative size must be >= 0"},
+		{conf71, "invalid hijack address: foo"},
+		{conf72, "invalid hijack address: 2001:db8::1"},
+		{conf73, "invalid hijack address v6: 192.0.2.1"},
+		{conf74, "invalid hijack negative ttl: foo"},
+		{conf75, "hijack negative ttl must be >= 0"},
+		{conf76, "max concurrent queries must be >= 0"},
+		{conf77, "invalid hosts ttl: foo"},
+		{conf78, "line 1: invalid ttl: ttl=foo - 0.0.0.0 badhost1 ttl=foo"},
+		{conf79, "max answers must be >= 0"},
+		{conf80, "invalid cache sweep interval: foo"},
+		{conf81, "cache sweep interval must be >= 0"},
+		{conf82, "invalid default action: foo"},
+		{conf83, "invalid resolver failure window: foo"},
+		{conf84, "resolver failure window must be >= 0"},
 	}
 	for i, tt := range tests {
 		var got string
@@ -206,3 +667,21 @@ cache_persist = true
 	}
 
 }
+
+func TestConfigSyslog(t *testing.T) {
+	text := "[dns]\nlisten = \"0.0.0.0:53\"\nlog_syslog = true\n"
+	conf, err := ReadConfig(strings.NewReader(text))
+	if !syslogSupported {
+		want := fmt.Sprintf("log_syslog = true is not supported on %s", runtime.GOOS)
+		if err == nil || err.Error() != want {
+			t.Errorf("got %q, want %q", err, want)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.DNS.LogSyslog {
+		t.Errorf("LogSyslog = %t, want %t", conf.DNS.LogSyslog, true)
+	}
+}
@@ -0,0 +1,43 @@
+package dns
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// certificate is a TLS certificate read from a pair of files. The certificate can be reloaded from its files while it
+// is in use, which allows a renewed certificate to be served without restarting the proxy.
+type certificate struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// loadCertificate reads a certificate and its matching private key from certFile and keyFile.
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate from its files again. The current certificate is kept if reading fails.
+func (c *certificate) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// get returns the current certificate. It implements the GetCertificate callback of tls.Config.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
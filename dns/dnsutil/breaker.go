@@ -0,0 +1,126 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrBreakerOpen is returned by a Client wrapped by NewBreaker while its circuit is open.
+var ErrBreakerOpen = errors.New("resolver unavailable: too many failures")
+
+// breaker is a circuit breaker for a Client. After a number of consecutive failures within a time window the circuit
+// opens, and queries are rejected until a cooldown period has passed. The circuit is then half-open, and a single query is sent to probe the
+// client. The circuit closes if the probe succeeds, and opens again otherwise.
+type breaker struct {
+	client    Client
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	failingAt time.Time // Time of the first failure counted
+	openedAt  time.Time
+	probing   bool
+}
+
+// NewBreaker wraps client in a circuit breaker. The circuit opens after threshold consecutive failures occurring within
+// window, and stays open for the duration of cooldown. Failures are counted regardless of when they occur if window is
+// 0. A client wrapped in a breaker is skipped by a multiplexed client while its circuit is open.
+func NewBreaker(client Client, threshold int, window, cooldown time.Duration) Client {
+	return &breaker{client: client, threshold: threshold, window: window, cooldown: cooldown, now: time.Now}
+}
+
+func (b *breaker) Exchange(msg *dns.Msg) (*Response, error) {
+	return b.ExchangeContext(context.Background(), msg)
+}
+
+func (b *breaker) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	if !b.allow() {
+		return nil, ErrBreakerOpen
+	}
+	r, err := b.client.ExchangeContext(ctx, msg)
+	b.record(err)
+	return r, err
+}
+
+// statuses returns the statuses of the wrapped client, having the state and failures of breaker b.
+func (b *breaker) statuses() []Status {
+	statuses := Statuses(b.client)
+	state := b.state()
+	b.mu.Lock()
+	failures := b.failures
+	b.mu.Unlock()
+	for i := range statuses {
+		statuses[i].State = state
+		statuses[i].Failures = failures
+	}
+	return statuses
+}
+
+func (b *breaker) open() bool { return b.failures >= b.threshold }
+
+// ready returns whether a query would currently be allowed through the breaker.
+func (b *breaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open() || (!b.probing && b.now().Sub(b.openedAt) >= b.cooldown)
+}
+
+// allow returns whether a query is allowed through the breaker. When the circuit is half-open only the first query is
+// allowed, as a probe.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open() {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// state returns the state of the circuit of the breaker.
+func (b *breaker) state() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !b.open():
+		return StateClosed
+	case b.probing || b.now().Sub(b.openedAt) >= b.cooldown:
+		return StateHalfOpen
+	}
+	return StateOpen
+}
+
+// record records the result of a query allowed through the breaker.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if errors.Is(err, ErrLimitReached) || errors.Is(err, context.Canceled) {
+		return // Not a failure of the client
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	now := b.now()
+	if !b.open() && b.window > 0 && now.Sub(b.failingAt) >= b.window {
+		b.failures = 0 // Earlier failures are outside the window
+	}
+	if b.failures == 0 {
+		b.failingAt = now
+	}
+	b.failures++
+	if b.open() {
+		b.openedAt = now
+	}
+}
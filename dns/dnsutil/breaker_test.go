@@ -0,0 +1,149 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type countingClient struct {
+	exchanges int
+	fail      bool
+}
+
+func (c *countingClient) Exchange(msg *dns.Msg) (*Response, error) {
+	c.exchanges++
+	if c.fail {
+		return nil, errors.New("timeout")
+	}
+	return &Response{Msg: newA("example.com.", 60, "192.0.2.1")}, nil
+}
+
+func (c *countingClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	return c.Exchange(msg)
+}
+
+func TestBreaker(t *testing.T) {
+	c := &countingClient{fail: true}
+	b := NewBreaker(c, 3, 0, time.Minute).(*breaker)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	// Circuit opens after consecutive failures
+	for i := 0; i < 3; i++ {
+		if _, err := b.Exchange(&dns.Msg{}); err == nil || errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("#%d: got err = %v, want client error", i, err)
+		}
+	}
+	if _, err := b.Exchange(&dns.Msg{}); !errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("got err = %v, want %v", err, ErrBreakerOpen)
+	}
+	if got, want := c.exchanges, 3; got != want {
+		t.Errorf("got %d exchanges, want %d", got, want)
+	}
+
+	// Probe fails after cooldown and the circuit opens again
+	now = now.Add(time.Minute)
+	if !b.ready() {
+		t.Error("want breaker to be ready after cooldown")
+	}
+	if _, err := b.Exchange(&dns.Msg{}); err == nil || errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("got err = %v, want client error", err)
+	}
+	if _, err := b.Exchange(&dns.Msg{}); !errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("got err = %v, want %v", err, ErrBreakerOpen)
+	}
+	if got, want := c.exchanges, 4; got != want {
+		t.Errorf("got %d exchanges, want %d", got, want)
+	}
+
+	// Only one probe is sent while half-open
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("want probe to be allowed")
+	}
+	if b.ready() || b.allow() {
+		t.Error("want only one probe to be allowed")
+	}
+	b.record(errors.New("timeout"))
+
+	// Client recovers and the circuit closes
+	now = now.Add(time.Minute)
+	c.fail = false
+	for i := 0; i < 2; i++ {
+		if _, err := b.Exchange(&dns.Msg{}); err != nil {
+			t.Fatalf("#%d: got err = %v, want nil", i, err)
+		}
+	}
+	if got, want := b.failures, 0; got != want {
+		t.Errorf("got %d failures, want %d", got, want)
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	c := &countingClient{fail: true}
+	b := NewBreaker(c, 3, time.Minute, time.Minute).(*breaker)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	// Failures spread beyond the window do not open the circuit
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			now = now.Add(30 * time.Second)
+		}
+		if _, err := b.Exchange(&dns.Msg{}); errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("#%d: got err = %v, want client error", i, err)
+		}
+	}
+	if got, want := b.failures, 2; got != want {
+		t.Errorf("got %d failures, want %d", got, want)
+	}
+
+	// Failures within the window open the circuit
+	b.Exchange(&dns.Msg{})
+	if _, err := b.Exchange(&dns.Msg{}); !errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("got err = %v, want %v", err, ErrBreakerOpen)
+	}
+}
+
+func TestMuxBreaker(t *testing.T) {
+	c1 := &countingClient{fail: true}
+	c2 := &countingClient{}
+	b1 := NewBreaker(c1, 1, 0, time.Minute).(*breaker)
+	now := time.Now()
+	b1.now = func() time.Time { return now }
+	mux := NewMux(b1, NewBreaker(c2, 1, 0, time.Minute))
+
+	// Failing client is skipped once its circuit is open
+	b1.Exchange(&dns.Msg{})
+	for i := 0; i < 3; i++ {
+		if _, err := mux.Exchange(&dns.Msg{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := c1.exchanges, 1; got != want {
+		t.Errorf("got %d exchanges, want %d", got, want)
+	}
+	if got, want := c2.exchanges, 3; got != want {
+		t.Errorf("got %d exchanges, want %d", got, want)
+	}
+
+	// All circuits open
+	mux = NewMux(b1)
+	if _, err := mux.Exchange(&dns.Msg{}); !errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("got err = %v, want %v", err, ErrBreakerOpen)
+	}
+
+	// Recovered client is queried again after cooldown
+	c1.fail = false
+	now = now.Add(time.Minute)
+	if _, err := mux.Exchange(&dns.Msg{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c1.exchanges, 2; got != want {
+		t.Errorf("got %d exchanges, want %d", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+package dnsutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// OtherType is the type name used for query types not counted individually by a TypeCounter.
+const OtherType = "other"
+
+// AnswerBuckets contains the upper bounds of the answer count buckets used by a TypeCounter.
+var AnswerBuckets = []int{0, 1, 2, 4, 8, 16}
+
+// countedTypes contains the query types counted individually by a TypeCounter. Other types are counted together, to
+// bound the number of distinct types.
+var countedTypes = map[uint16]bool{
+	dns.TypeA:      true,
+	dns.TypeAAAA:   true,
+	dns.TypeANY:    true,
+	dns.TypeCAA:    true,
+	dns.TypeCNAME:  true,
+	dns.TypeDNSKEY: true,
+	dns.TypeDS:     true,
+	dns.TypeHTTPS:  true,
+	dns.TypeMX:     true,
+	dns.TypeNS:     true,
+	dns.TypePTR:    true,
+	dns.TypeSOA:    true,
+	dns.TypeSRV:    true,
+	dns.TypeSVCB:   true,
+	dns.TypeTXT:    true,
+}
+
+// TypeCounter counts requests and their number of answers per query type.
+type TypeCounter struct {
+	mu     sync.Mutex
+	counts map[string]*typeCount
+}
+
+type typeCount struct {
+	requests uint64
+	buckets  []uint64
+}
+
+// TypeStats contains the request statistics of a query type.
+type TypeStats struct {
+	Type     string
+	Requests uint64
+	// Answers contains the number of requests per answer count bucket. Counts are cumulative, i.e. the count of a
+	// bucket includes all requests having at most UpperBound answers.
+	Answers []AnswerBucket
+}
+
+// AnswerBucket is the number of requests having at most UpperBound answers.
+type AnswerBucket struct {
+	UpperBound int
+	Count      uint64
+}
+
+// NewTypeCounter creates a new TypeCounter.
+func NewTypeCounter() *TypeCounter {
+	return &TypeCounter{counts: make(map[string]*typeCount)}
+}
+
+// Record records a request of type qtype having given number of answers.
+func (c *TypeCounter) Record(qtype uint16, answers int) {
+	name := OtherType
+	if countedTypes[qtype] {
+		name = TypeToString[qtype]
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count, ok := c.counts[name]
+	if !ok {
+		count = &typeCount{buckets: make([]uint64, len(AnswerBuckets))}
+		c.counts[name] = count
+	}
+	count.requests++
+	for i, upperBound := range AnswerBuckets {
+		if answers <= upperBound {
+			count.buckets[i]++
+		}
+	}
+}
+
+// Stats returns the statistics of all recorded query types, sorted by type name.
+func (c *TypeCounter) Stats() []TypeStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make([]TypeStats, 0, len(c.counts))
+	for name, count := range c.counts {
+		answers := make([]AnswerBucket, 0, len(AnswerBuckets))
+		for i, upperBound := range AnswerBuckets {
+			answers = append(answers, AnswerBucket{UpperBound: upperBound, Count: count.buckets[i]})
+		}
+		stats = append(stats, TypeStats{Type: name, Requests: count.requests, Answers: answers})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Type < stats[j].Type })
+	return stats
+}
@@ -0,0 +1,33 @@
+package dnsutil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTypeCounter(t *testing.T) {
+	c := NewTypeCounter()
+	c.Record(dns.TypeA, 1)
+	c.Record(dns.TypeA, 3)
+	c.Record(dns.TypeAAAA, 0)
+	c.Record(dns.TypeNULL, 20)
+	c.Record(dns.TypeNAPTR, 1)
+
+	buckets := func(counts ...uint64) []AnswerBucket {
+		answers := make([]AnswerBucket, 0, len(counts))
+		for i, count := range counts {
+			answers = append(answers, AnswerBucket{UpperBound: AnswerBuckets[i], Count: count})
+		}
+		return answers
+	}
+	want := []TypeStats{
+		{Type: "A", Requests: 2, Answers: buckets(0, 1, 1, 2, 2, 2)},
+		{Type: "AAAA", Requests: 1, Answers: buckets(1, 1, 1, 1, 1, 1)},
+		{Type: "other", Requests: 2, Answers: buckets(0, 1, 1, 1, 1, 1)},
+	}
+	if got := c.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
@@ -1,10 +1,13 @@
 package dnsutil
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -21,42 +24,99 @@ var (
 
 // Client is the interface of a DNS client.
 type Client interface {
-	Exchange(*dns.Msg) (*dns.Msg, error)
+	Exchange(*dns.Msg) (*Response, error)
+	// ExchangeContext is like Exchange, but the exchange is abandoned when ctx is done.
+	ExchangeContext(context.Context, *dns.Msg) (*Response, error)
+}
+
+// Response is the response to a DNS query made by a Client.
+type Response struct {
+	Msg *dns.Msg
+	// RTT is the round-trip time of the query, as measured by the resolver that answered.
+	RTT time.Duration
+	// Resolver is the address of the resolver that answered.
+	Resolver string
 }
 
 // Config is a structure used to configure a DNS client.
 type Config struct {
 	Network string
+	// Timeout is the timeout used for each of DialTimeout, ReadTimeout and RequestTimeout that is not set. If neither
+	// DialTimeout nor ReadTimeout is set, Timeout also bounds the complete exchange with a DNS resolver.
 	Timeout time.Duration
+	// DialTimeout is the timeout for establishing a connection to the resolver, including any TLS handshake.
+	DialTimeout time.Duration
+	// ReadTimeout is the timeout for sending a query and reading its response on an established connection.
+	ReadTimeout time.Duration
+	// RequestTimeout is the timeout of a complete request made by DNS-over-HTTPS clients.
+	RequestTimeout time.Duration
+	// EDNSFallback controls whether a query is retried without EDNS options when the resolver responds with BADVERS.
+	EDNSFallback bool
+	// HTTPMethod is the HTTP method used by DNS-over-HTTPS clients. Either GET or POST. Defaults to POST.
+	HTTPMethod string
+	// HTTPLegacyMimeType controls whether DNS-over-HTTPS clients use the media type from older RFC drafts.
+	HTTPLegacyMimeType bool
+	// HTTPMaxIdleConns is the maximum number of idle connections kept by DNS-over-HTTPS clients.
+	HTTPMaxIdleConns int
+	// HTTPIdleTimeout is the duration idle connections are kept by DNS-over-HTTPS clients.
+	HTTPIdleTimeout time.Duration
 }
 
 type resolver interface {
-	Exchange(*dns.Msg, string) (*dns.Msg, time.Duration, error)
+	ExchangeContext(context.Context, *dns.Msg, string) (*dns.Msg, time.Duration, error)
 }
 
 type client struct {
-	resolver resolver
-	address  string
+	resolver     resolver
+	address      string
+	network      string
+	ednsFallback bool
+	// lastSuccess is the time of the last successful exchange, in nanoseconds since the Unix epoch.
+	lastSuccess atomic.Int64
 }
 
 type mux struct{ clients []Client }
 
 // NewMux creates a new multiplexed client which queries all clients in parallel and returns the first successful
-// response.
+// response. Clients wrapped by NewBreaker are not queried while their circuit is open.
 func NewMux(client ...Client) Client { return &mux{clients: client} }
 
-func (m *mux) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+// ready returns the clients that are ready to be queried.
+func ready(all []Client) []Client {
+	clients := make([]Client, 0, len(all))
+	for _, c := range all {
+		if b, ok := c.(*breaker); ok && !b.ready() {
+			continue
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (m *mux) Exchange(msg *dns.Msg) (*Response, error) {
+	return m.ExchangeContext(context.Background(), msg)
+}
+
+// ExchangeContext queries all clients in parallel. Exchanges still in progress are cancelled when the first successful
+// response is returned, or when ctx is done.
+func (m *mux) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
 	if len(m.clients) == 0 {
 		return nil, fmt.Errorf("no clients to query")
 	}
-	responses := make(chan *dns.Msg, len(m.clients))
-	errs := make(chan error, len(m.clients))
+	clients := ready(m.clients)
+	if len(clients) == 0 {
+		return nil, ErrBreakerOpen
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	responses := make(chan *Response, len(clients))
+	errs := make(chan error, len(clients))
 	var wg sync.WaitGroup
-	for _, c := range m.clients {
+	for _, c := range clients {
 		wg.Add(1)
 		go func(client Client) {
 			defer wg.Done()
-			r, err := client.Exchange(msg)
+			r, err := client.ExchangeContext(ctx, msg)
 			if err != nil {
 				errs <- err
 				return
@@ -75,11 +135,23 @@ func (m *mux) Exchange(msg *dns.Msg) (*dns.Msg, error) {
 	return nil, <-errs
 }
 
+func (m *mux) statuses() []Status { return statusesOf(m.clients) }
+
 // NewClient creates a new Client for addr using config.
 func NewClient(addr string, config Config) Client {
+	dialTimeout := orDefault(config.DialTimeout, config.Timeout)
+	readTimeout := orDefault(config.ReadTimeout, config.Timeout)
 	var r resolver
 	if config.Network == "https" {
-		r = http.NewClient(config.Timeout)
+		r = http.NewClientWithConfig(http.Config{
+			Timeout:        orDefault(config.RequestTimeout, config.Timeout),
+			DialTimeout:    dialTimeout,
+			ReadTimeout:    readTimeout,
+			Method:         config.HTTPMethod,
+			LegacyMimeType: config.HTTPLegacyMimeType,
+			MaxIdleConns:   config.HTTPMaxIdleConns,
+			IdleTimeout:    config.HTTPIdleTimeout,
+		})
 	} else {
 		var tlsConfig *tls.Config
 		parts := strings.SplitN(addr, "=", 2)
@@ -87,30 +159,223 @@ func NewClient(addr string, config Config) Client {
 			addr = parts[0]
 			tlsConfig = &tls.Config{ServerName: parts[1]}
 		}
-		r = &dns.Client{Net: config.Network, Timeout: config.Timeout, TLSConfig: tlsConfig}
+		dr := &dnsResolver{client: &dns.Client{
+			Net:          config.Network,
+			DialTimeout:  dialTimeout,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: readTimeout,
+			TLSConfig:    tlsConfig,
+		}}
+		if config.DialTimeout == 0 && config.ReadTimeout == 0 {
+			dr.timeout = config.Timeout
+		}
+		r = dr
 	}
-	return &client{resolver: r, address: addr}
+	return &client{resolver: r, address: addr, network: config.Network, ednsFallback: config.EDNSFallback}
 }
 
-func (c *client) Exchange(msg *dns.Msg) (*dns.Msg, error) {
-	r, _, err := c.resolver.Exchange(msg, c.address)
+func orDefault(d, fallback time.Duration) time.Duration {
+	if d == 0 {
+		return fallback
+	}
+	return d
+}
+
+func (c *client) Exchange(msg *dns.Msg) (*Response, error) {
+	return c.ExchangeContext(context.Background(), msg)
+}
+
+func (c *client) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	r, rtt, err := c.resolver.ExchangeContext(ctx, msg, c.address)
 	if err != nil {
 		return nil, fmt.Errorf("resolver %s failed: %w", c.address, err)
 	}
-	return r, err
+	if c.ednsFallback && r.Rcode == dns.RcodeBadVers && msg.IsEdns0() != nil {
+		var fallbackRTT time.Duration
+		r, fallbackRTT, err = c.resolver.ExchangeContext(ctx, withoutEDNS(msg), c.address)
+		if err != nil {
+			return nil, fmt.Errorf("resolver %s failed without edns: %w", c.address, err)
+		}
+		rtt += fallbackRTT
+	}
+	c.lastSuccess.Store(time.Now().UnixNano())
+	return &Response{Msg: r, RTT: rtt, Resolver: c.address}, nil
+}
+
+func (c *client) statuses() []Status {
+	protocol := c.network
+	if protocol == "" {
+		protocol = "udp"
+	}
+	status := Status{Address: c.address, Protocol: protocol}
+	if ns := c.lastSuccess.Load(); ns > 0 {
+		status.LastSuccess = time.Unix(0, ns)
+	}
+	return []Status{status}
+}
+
+// dnsResolver is a resolver using the DNS protocol over UDP, TCP or TLS.
+type dnsResolver struct {
+	client  *dns.Client
+	timeout time.Duration // Timeout of the complete exchange. The timeouts of client apply to each step if zero
+}
+
+// ExchangeContext sends msg to the resolver at addr. The connection is dialed using ctx, and it's closed when ctx is
+// done, which aborts an exchange in progress. The dns.Client only honours the deadline of ctx once connected.
+func (r *dnsResolver) ExchangeContext(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	conn, err := r.client.DialContext(ctx, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	reply, rtt, err := r.client.ExchangeWithConn(msg, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, 0, ctx.Err()
+	}
+	return reply, rtt, err
+}
+
+// Probe checks whether client is reachable by querying it for the NS records of name. Any response, regardless of its
+// response code, means the client is reachable.
+func Probe(client Client, name string) error {
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeNS)
+	_, err := client.Exchange(&msg)
+	return err
+}
+
+// withoutEDNS returns a copy of msg with the OPT pseudo record removed.
+func withoutEDNS(msg *dns.Msg) *dns.Msg {
+	plain := msg.Copy()
+	plain.Extra = plain.Extra[:0]
+	for _, extra := range msg.Extra {
+		if extra.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		plain.Extra = append(plain.Extra, dns.Copy(extra))
+	}
+	return plain
 }
 
-// Answers returns all values in the answer section of DNS message msg.
+// Answers returns all values in the answer section of DNS message msg. Records with multiple fields, such as DS and
+// DNSKEY, are returned as a single value with fields separated by space. Parameters of HTTPS and SVCB records are
+// returned as key=value pairs following the priority and target.
 func Answers(msg *dns.Msg) []string {
 	var answers []string
 	for _, answer := range msg.Answer {
+		switch rr := answer.(type) {
+		case *dns.HTTPS:
+			answers = append(answers, svcbValue(&rr.SVCB))
+			continue
+		case *dns.SVCB:
+			answers = append(answers, svcbValue(rr))
+			continue
+		}
+		fields := make([]string, 0, dns.NumField(answer))
 		for i := 1; i <= dns.NumField(answer); i++ {
-			answers = append(answers, dns.Field(answer, i))
+			fields = append(fields, dns.Field(answer, i))
 		}
+		answers = append(answers, strings.Join(fields, " "))
 	}
 	return answers
 }
 
+// svcbValue returns the priority, target and parameters of SVCB record rr, separated by space.
+func svcbValue(rr *dns.SVCB) string {
+	fields := make([]string, 0, 2+len(rr.Value))
+	fields = append(fields, strconv.Itoa(int(rr.Priority)), rr.Target)
+	for _, kv := range rr.Value {
+		fields = append(fields, kv.Key().String()+"="+kv.String())
+	}
+	return strings.Join(fields, " ")
+}
+
+// ExpandWildcard rewrites wildcard owner names in the answer section of msg to the name they were synthesized for. It
+// reports whether msg contains any answer synthesized from a wildcard.
+func ExpandWildcard(msg *dns.Msg) bool {
+	if len(msg.Question) == 0 {
+		return false
+	}
+	wildcard := false
+	name := msg.Question[0].Name
+	for i, answer := range msg.Answer {
+		owner := answer.Header().Name
+		if strings.HasPrefix(owner, "*.") && dns.IsSubDomain(owner[2:], name) && !strings.EqualFold(owner, name) {
+			answer = dns.Copy(answer)
+			answer.Header().Name = name
+			msg.Answer[i] = answer
+			wildcard = true
+		}
+		switch rr := answer.(type) {
+		case *dns.CNAME:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				name = rr.Target
+			}
+		case *dns.RRSIG:
+			// The signature of a synthesized answer covers fewer labels than its owner name (RFC 4035, section 5.3.4)
+			if int(rr.Labels) < dns.CountLabel(rr.Hdr.Name) {
+				wildcard = true
+			}
+		}
+	}
+	return wildcard
+}
+
+// SameQuestion returns whether the question of answer matches the question of msg. Names are compared
+// case-insensitively, as resolvers may not preserve the case of the question.
+func SameQuestion(msg, answer *dns.Msg) bool {
+	if len(answer.Question) != 1 {
+		return false
+	}
+	q1, q2 := msg.Question[0], answer.Question[0]
+	return q1.Qtype == q2.Qtype && q1.Qclass == q2.Qclass && strings.EqualFold(q1.Name, q2.Name)
+}
+
+// DedupAnswers returns a copy of msg where duplicate records in the answer section are removed, keeping the first
+// occurrence of each record. Records differing only by TTL are considered duplicates. If msg has no duplicate records,
+// msg is returned unchanged.
+func DedupAnswers(msg *dns.Msg) *dns.Msg {
+	var answers []dns.RR
+	for i, rr := range msg.Answer {
+		duplicate := false
+		for _, prev := range msg.Answer[:i] {
+			if dns.IsDuplicate(rr, prev) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			if answers == nil {
+				answers = append(make([]dns.RR, 0, len(msg.Answer)-1), msg.Answer[:i]...)
+			}
+			continue
+		}
+		if answers != nil {
+			answers = append(answers, rr)
+		}
+	}
+	if answers == nil {
+		return msg
+	}
+	dedup := *msg
+	dedup.Answer = answers
+	return &dedup
+}
+
 // MinTTL returns the lowest TTL of of answer, authority and additional sections.
 func MinTTL(msg *dns.Msg) time.Duration {
 	var ttl uint32 = (1 << 31) - 1 // Maximum TTL from RFC 2181
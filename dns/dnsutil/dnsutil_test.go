@@ -1,6 +1,7 @@
 package dnsutil
 
 import (
+	"context"
 	"errors"
 	"net"
 	"reflect"
@@ -13,6 +14,7 @@ import (
 
 type response struct {
 	answer *dns.Msg
+	rtt    time.Duration
 	fail   bool
 	mu     sync.Mutex
 }
@@ -28,7 +30,7 @@ func (e *testResolver) setResponse(r *response) {
 	e.response = r
 }
 
-func (e *testResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+func (e *testResolver) Exchange(msg *dns.Msg) (*Response, error) {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 	r := e.response
@@ -40,7 +42,11 @@ func (e *testResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
 	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.answer, nil
+	return &Response{Msg: r.answer, RTT: r.rtt}, nil
+}
+
+func (e *testResolver) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	return e.Exchange(msg)
 }
 
 func newA(name string, ttl uint32, ipAddr ...string) *dns.Msg {
@@ -118,6 +124,15 @@ func TestAnswers(t *testing.T) {
 			&dns.A{A: net.ParseIP("192.0.2.2")},
 		}, []string{"192.0.2.1", "192.0.2.2"}},
 		{[]dns.RR{&dns.AAAA{AAAA: net.ParseIP("2001:db8::1")}}, []string{"2001:db8::1"}},
+		{[]dns.RR{&dns.DS{KeyTag: 12345, Algorithm: dns.RSASHA256, DigestType: dns.SHA256, Digest: "ABCDEF"}},
+			[]string{"12345 8 2 ABCDEF"}},
+		{[]dns.RR{&dns.DNSKEY{Flags: 257, Protocol: 3, Algorithm: dns.RSASHA256, PublicKey: "AwEAAQ=="}},
+			[]string{"257 3 8 AwEAAQ=="}},
+		{[]dns.RR{&dns.HTTPS{SVCB: dns.SVCB{Priority: 1, Target: ".", Value: []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: []string{"h3", "h2"}},
+			&dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("192.0.2.1")}},
+		}}}}, []string{"1 . alpn=h3,h2 ipv4hint=192.0.2.1"}},
+		{[]dns.RR{&dns.SVCB{Priority: 0, Target: "svc.example.com."}}, []string{"0 svc.example.com."}},
 	}
 	for i, tt := range tests {
 		msg := dns.Msg{Answer: tt.rr}
@@ -127,6 +142,48 @@ func TestAnswers(t *testing.T) {
 	}
 }
 
+func TestExpandWildcard(t *testing.T) {
+	var tests = []struct {
+		qname    string
+		answers  []dns.RR
+		owners   []string
+		wildcard bool
+	}{
+		{"foo.example.com.", []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "foo.example.com.", Rrtype: dns.TypeA}},
+		}, []string{"foo.example.com."}, false},
+		{"foo.example.com.", []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "*.example.com.", Rrtype: dns.TypeA}},
+		}, []string{"foo.example.com."}, true},
+		{"foo.example.com.", []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "*.example.org.", Rrtype: dns.TypeA}},
+		}, []string{"*.example.org."}, false},
+		{"foo.example.com.", []dns.RR{
+			&dns.CNAME{Hdr: dns.RR_Header{Name: "foo.example.com.", Rrtype: dns.TypeCNAME}, Target: "bar.example.org."},
+			&dns.A{Hdr: dns.RR_Header{Name: "*.example.org.", Rrtype: dns.TypeA}},
+		}, []string{"foo.example.com.", "bar.example.org."}, true},
+		{"foo.example.com.", []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "foo.example.com.", Rrtype: dns.TypeA}},
+			&dns.RRSIG{Hdr: dns.RR_Header{Name: "foo.example.com.", Rrtype: dns.TypeRRSIG}, Labels: 2},
+		}, []string{"foo.example.com.", "foo.example.com."}, true},
+	}
+	for i, tt := range tests {
+		msg := dns.Msg{}
+		msg.SetQuestion(tt.qname, dns.TypeA)
+		msg.Answer = tt.answers
+		if got := ExpandWildcard(&msg); got != tt.wildcard {
+			t.Errorf("#%d: ExpandWildcard() = %t, want %t", i, got, tt.wildcard)
+		}
+		var owners []string
+		for _, rr := range msg.Answer {
+			owners = append(owners, rr.Header().Name)
+		}
+		if !reflect.DeepEqual(owners, tt.owners) {
+			t.Errorf("#%d: owners = %q, want %q", i, owners, tt.owners)
+		}
+	}
+}
+
 func TestExchange(t *testing.T) {
 	resolver1 := &testResolver{}
 	resolver2 := &testResolver{}
@@ -134,19 +191,22 @@ func TestExchange(t *testing.T) {
 	// First responding resolver returns answer
 	answer1 := newA("example.com.", 60, "192.0.2.1")
 	answer2 := newA("example.com.", 60, "192.0.2.2")
-	r1 := response{answer: answer1}
+	r1 := response{answer: answer1, rtt: time.Second}
 	r1.mu.Lock() // Locking first resolver so that second wins
 	resolver1.setResponse(&r1)
-	resolver2.setResponse(&response{answer: answer2})
+	resolver2.setResponse(&response{answer: answer2, rtt: time.Millisecond})
 
 	mux := NewMux(resolver1, resolver2)
 	r, err := mux.Exchange(&dns.Msg{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got, want := r.Answer[0].(*dns.A), answer2.Answer[0].(*dns.A); got != want {
+	if got, want := r.Msg.Answer[0].(*dns.A), answer2.Answer[0].(*dns.A); got != want {
 		t.Errorf("got Answer[0] = %s, want %s", got, want)
 	}
+	if got, want := r.RTT, time.Millisecond; got != want {
+		t.Errorf("got RTT = %s, want %s", got, want)
+	}
 	r1.mu.Unlock()
 
 	// All resolvers fail
@@ -157,3 +217,185 @@ func TestExchange(t *testing.T) {
 		t.Errorf("got %s, want error", err)
 	}
 }
+
+// waitingResolver blocks until the context of an exchange is done.
+type waitingResolver struct {
+	started   chan bool
+	cancelled chan bool
+}
+
+func newWaitingResolver() *waitingResolver {
+	return &waitingResolver{started: make(chan bool, 1), cancelled: make(chan bool, 1)}
+}
+
+func (r *waitingResolver) ExchangeContext(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	r.started <- true
+	<-ctx.Done()
+	r.cancelled <- true
+	return nil, 0, ctx.Err()
+}
+
+func TestExchangeContext(t *testing.T) {
+	// Exchange with a resolver that never answers is aborted when context is cancelled
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	received := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, dns.MinMsgSize)
+		if _, _, err := conn.ReadFrom(buf); err == nil {
+			received <- true
+		}
+	}()
+	c := NewClient(conn.LocalAddr().String(), Config{Network: "udp", Timeout: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	if _, err := c.ExchangeContext(ctx, &msg); !errors.Is(err, context.Canceled) {
+		t.Errorf("got err = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("exchange took %s, want it to be aborted", elapsed)
+	}
+
+	// Cancellation propagates to all exchanges of a multiplexed client
+	r1, r2 := newWaitingResolver(), newWaitingResolver()
+	b := NewBreaker(&client{resolver: r2, address: "192.0.2.2:53"}, 1, 0, time.Minute).(*breaker)
+	mux := NewMux(&client{resolver: r1, address: "192.0.2.1:53"}, b)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-r1.started
+		<-r2.started
+		cancel()
+	}()
+	if _, err := mux.ExchangeContext(ctx, &dns.Msg{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got err = %v, want %v", err, context.Canceled)
+	}
+	for i, r := range []*waitingResolver{r1, r2} {
+		select {
+		case <-r.cancelled:
+		case <-time.After(time.Second):
+			t.Errorf("#%d: want exchange to be cancelled", i)
+		}
+	}
+	if got, want := b.state(), StateClosed; got != want {
+		t.Errorf("state = %s, want %s", got, want)
+	}
+
+	// Remaining exchanges are cancelled when the first response is returned
+	r3 := newWaitingResolver()
+	fast := &testResolver{}
+	fast.setResponse(&response{answer: newA("example.com.", 60, "192.0.2.1")})
+	mux = NewMux(fast, &client{resolver: r3, address: "192.0.2.3:53"})
+	if _, err := mux.ExchangeContext(context.Background(), &dns.Msg{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-r3.cancelled:
+	case <-time.After(time.Second):
+		t.Error("want slow exchange to be cancelled")
+	}
+}
+
+func TestNewClientTimeout(t *testing.T) {
+	var tests = []struct {
+		config  Config
+		timeout time.Duration
+		dial    time.Duration
+		read    time.Duration
+	}{
+		{Config{Timeout: 5 * time.Second}, 5 * time.Second, 5 * time.Second, 5 * time.Second},
+		{Config{Timeout: 5 * time.Second, DialTimeout: time.Second}, 0, time.Second, 5 * time.Second},
+		{Config{Timeout: 5 * time.Second, ReadTimeout: 2 * time.Second}, 0, 5 * time.Second, 2 * time.Second},
+	}
+	for i, tt := range tests {
+		r := NewClient("192.0.2.1:53", tt.config).(*client).resolver.(*dnsResolver)
+		if r.timeout != tt.timeout {
+			t.Errorf("#%d: timeout = %s, want %s", i, r.timeout, tt.timeout)
+		}
+		c := r.client
+		if c.DialTimeout != tt.dial {
+			t.Errorf("#%d: DialTimeout = %s, want %s", i, c.DialTimeout, tt.dial)
+		}
+		if c.ReadTimeout != tt.read {
+			t.Errorf("#%d: ReadTimeout = %s, want %s", i, c.ReadTimeout, tt.read)
+		}
+	}
+
+	// Complete exchange is bounded by the timeout, regardless of the timeouts of each step
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := &dnsResolver{client: &dns.Client{Net: "udp", ReadTimeout: time.Minute}, timeout: 50 * time.Millisecond}
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	if _, _, err := r.ExchangeContext(context.Background(), &msg, conn.LocalAddr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("exchange took %s, want at most %s", elapsed, time.Second)
+	}
+}
+
+type ednsResolver struct{ queries []*dns.Msg }
+
+func (r *ednsResolver) ExchangeContext(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	r.queries = append(r.queries, msg)
+	reply := newA(msg.Question[0].Name, 60, "192.0.2.1")
+	if msg.IsEdns0() != nil {
+		reply = &dns.Msg{}
+		reply.SetRcode(msg, dns.RcodeBadVers)
+	}
+	return reply, 0, nil
+}
+
+func TestExchangeEDNSFallback(t *testing.T) {
+	var tests = []struct {
+		edns         bool
+		ednsFallback bool
+		queries      int
+		rcode        int
+	}{
+		{false, true, 1, dns.RcodeSuccess},
+		{true, true, 2, dns.RcodeSuccess},
+		{true, false, 1, dns.RcodeBadVers},
+	}
+	for i, tt := range tests {
+		r := &ednsResolver{}
+		c := &client{resolver: r, address: "192.0.2.1:53", ednsFallback: tt.ednsFallback}
+		msg := dns.Msg{}
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if tt.edns {
+			msg.SetEdns0(4096, false)
+		}
+		reply, err := c.Exchange(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(r.queries); got != tt.queries {
+			t.Errorf("#%d: len(queries) = %d, want %d", i, got, tt.queries)
+		}
+		if got, want := reply.Resolver, "192.0.2.1:53"; got != want {
+			t.Errorf("#%d: Resolver = %q, want %q", i, got, want)
+		}
+		if got := reply.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if last := r.queries[len(r.queries)-1]; tt.ednsFallback && last.IsEdns0() != nil {
+			t.Errorf("#%d: last query has EDNS, want none", i)
+		}
+		if tt.edns && msg.IsEdns0() == nil {
+			t.Errorf("#%d: original query was modified", i)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package dnsutil
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyReservoir keeps the most recently recorded latencies, up to a fixed number of samples.
+type LatencyReservoir struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// LatencyStats contains percentiles of the latencies in a LatencyReservoir.
+type LatencyStats struct {
+	Samples int
+	P50     time.Duration
+	P95     time.Duration
+	P99     time.Duration
+}
+
+// NewLatencyReservoir creates a new LatencyReservoir keeping the given number of samples.
+func NewLatencyReservoir(size int) *LatencyReservoir {
+	if size < 1 {
+		size = 1
+	}
+	return &LatencyReservoir{samples: make([]time.Duration, size)}
+}
+
+// Record records latency d, replacing the oldest sample if the reservoir is full.
+func (r *LatencyReservoir) Record(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[r.next] = d
+	r.next++
+	if r.next == len(r.samples) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Stats returns percentiles of the latencies currently in the reservoir.
+func (r *LatencyReservoir) Stats() LatencyStats {
+	r.mu.Lock()
+	n := r.next
+	if r.full {
+		n = len(r.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, r.samples[:n])
+	r.mu.Unlock()
+	if n == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return LatencyStats{
+		Samples: n,
+		P50:     percentile(sorted, 50),
+		P95:     percentile(sorted, 95),
+		P99:     percentile(sorted, 99),
+	}
+}
+
+// percentile returns the p-th percentile of sorted using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100 // Rounds up
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
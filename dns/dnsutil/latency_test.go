@@ -0,0 +1,29 @@
+package dnsutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyReservoir(t *testing.T) {
+	r := NewLatencyReservoir(100)
+	if got, want := r.Stats(), (LatencyStats{}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	for i := 1; i <= 100; i++ {
+		r.Record(time.Duration(i) * time.Millisecond)
+	}
+	want := LatencyStats{Samples: 100, P50: 50 * time.Millisecond, P95: 95 * time.Millisecond, P99: 99 * time.Millisecond}
+	if got := r.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	// Oldest samples are replaced
+	for i := 0; i < 50; i++ {
+		r.Record(time.Second)
+	}
+	want = LatencyStats{Samples: 100, P50: 100 * time.Millisecond, P95: time.Second, P99: time.Second}
+	if got := r.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,119 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// latencyWeight is the weight of the latest sample in the moving average of the latency of a client.
+	latencyWeight = 0.2
+	// failureLatency is the latency recorded for a failed query.
+	failureLatency = 5 * time.Second
+)
+
+// latencyMux is a multiplexed client which queries the client having the lowest average latency first.
+type latencyMux struct {
+	clients []Client
+	mu      sync.Mutex
+	latency map[Client]time.Duration
+}
+
+// measuredClient is a client whose latency is recorded by a latencyMux.
+type measuredClient struct {
+	client Client
+	mux    *latencyMux
+}
+
+// NewLatencyMux creates a new multiplexed client which sends each query to the client having the lowest
+// exponentially weighted moving average of its latency. Clients that have not been queried yet are tried first, in the
+// given order. If the query fails, the remaining clients are queried in parallel and the first successful response is
+// returned. Clients wrapped by NewBreaker are not queried while their circuit is open.
+func NewLatencyMux(client ...Client) Client {
+	return &latencyMux{clients: client, latency: make(map[Client]time.Duration)}
+}
+
+func (m *latencyMux) statuses() []Status { return statusesOf(m.clients) }
+
+func (m *latencyMux) Exchange(msg *dns.Msg) (*Response, error) {
+	return m.ExchangeContext(context.Background(), msg)
+}
+
+func (m *latencyMux) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	if len(m.clients) == 0 {
+		return nil, fmt.Errorf("no clients to query")
+	}
+	clients := m.byLatency(ready(m.clients))
+	if len(clients) == 0 {
+		return nil, ErrBreakerOpen
+	}
+	r, err := clients[0].ExchangeContext(ctx, msg)
+	if err == nil || len(clients) == 1 || ctx.Err() != nil {
+		return r, err
+	}
+	return NewMux(clients[1:]...).ExchangeContext(ctx, msg)
+}
+
+// byLatency returns clients ordered by their average latency, lowest first.
+func (m *latencyMux) byLatency(clients []Client) []Client {
+	m.mu.Lock()
+	latency := make([]time.Duration, len(clients))
+	for i, c := range clients {
+		latency[i] = m.latency[c] // Zero if not queried yet
+	}
+	m.mu.Unlock()
+	sorted := make([]Client, len(clients))
+	for i, c := range clients {
+		sorted[i] = &measuredClient{client: c, mux: m}
+	}
+	sort.Stable(byLatency{clients: sorted, latency: latency})
+	return sorted
+}
+
+// record adds the latency d of client c to its moving average.
+func (m *latencyMux) record(c Client, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	avg, ok := m.latency[c]
+	if !ok {
+		m.latency[c] = d
+		return
+	}
+	m.latency[c] = avg + time.Duration(latencyWeight*float64(d-avg))
+}
+
+func (c *measuredClient) Exchange(msg *dns.Msg) (*Response, error) {
+	return c.ExchangeContext(context.Background(), msg)
+}
+
+func (c *measuredClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	start := time.Now()
+	r, err := c.client.ExchangeContext(ctx, msg)
+	if errors.Is(err, context.Canceled) {
+		return r, err // Latency is unknown
+	}
+	d := time.Since(start)
+	if err != nil {
+		d = failureLatency
+	}
+	c.mux.record(c.client, d)
+	return r, err
+}
+
+type byLatency struct {
+	clients []Client
+	latency []time.Duration
+}
+
+func (s byLatency) Len() int           { return len(s.clients) }
+func (s byLatency) Less(i, j int) bool { return s.latency[i] < s.latency[j] }
+func (s byLatency) Swap(i, j int) {
+	s.clients[i], s.clients[j] = s.clients[j], s.clients[i]
+	s.latency[i], s.latency[j] = s.latency[j], s.latency[i]
+}
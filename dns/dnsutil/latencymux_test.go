@@ -0,0 +1,75 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type delayClient struct {
+	delay     time.Duration
+	fail      atomic.Bool
+	exchanges atomic.Int64
+}
+
+func (c *delayClient) Exchange(msg *dns.Msg) (*Response, error) {
+	c.exchanges.Add(1)
+	time.Sleep(c.delay)
+	if c.fail.Load() {
+		return nil, errors.New("timeout")
+	}
+	return &Response{Msg: newA("example.com.", 60, "192.0.2.1")}, nil
+}
+
+func (c *delayClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	return c.Exchange(msg)
+}
+
+func TestLatencyMux(t *testing.T) {
+	slow := &delayClient{delay: 20 * time.Millisecond}
+	fast := &delayClient{}
+	mux := NewLatencyMux(slow, fast)
+
+	// Every client is queried once, and the fastest client after that
+	for i := 0; i < 10; i++ {
+		if _, err := mux.Exchange(&dns.Msg{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := slow.exchanges.Load(), int64(1); got != want {
+		t.Errorf("got %d exchanges with slow client, want %d", got, want)
+	}
+	if got, want := fast.exchanges.Load(), int64(9); got != want {
+		t.Errorf("got %d exchanges with fast client, want %d", got, want)
+	}
+
+	// Remaining clients are queried when the fastest client fails
+	fast.fail.Store(true)
+	if _, err := mux.Exchange(&dns.Msg{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := slow.exchanges.Load(), int64(2); got != want {
+		t.Errorf("got %d exchanges with slow client, want %d", got, want)
+	}
+
+	// Failed client is no longer preferred
+	if _, err := mux.Exchange(&dns.Msg{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fast.exchanges.Load(), int64(10); got != want {
+		t.Errorf("got %d exchanges with fast client, want %d", got, want)
+	}
+	if got, want := slow.exchanges.Load(), int64(3); got != want {
+		t.Errorf("got %d exchanges with slow client, want %d", got, want)
+	}
+
+	// All clients fail
+	slow.fail.Store(true)
+	if _, err := mux.Exchange(&dns.Msg{}); err == nil {
+		t.Error("want error")
+	}
+}
@@ -0,0 +1,73 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrLimitReached is returned by a Client wrapped by a Limiter when the limit of concurrent exchanges is reached.
+var ErrLimitReached = errors.New("too many concurrent queries")
+
+// limitWait is the duration a query waits for an exchange to complete when the limit of concurrent exchanges is reached.
+const limitWait = 100 * time.Millisecond
+
+// Limiter bounds the number of concurrent exchanges of the clients it wraps. The limit is shared by all wrapped clients,
+// so a query sent to several clients by a multiplexed client counts once per client.
+type Limiter struct {
+	sem  chan struct{}
+	wait time.Duration
+}
+
+// limited is a Client whose exchanges are bounded by a Limiter.
+type limited struct {
+	client  Client
+	limiter *Limiter
+}
+
+// NewLimiter creates a new limiter allowing up to limit concurrent exchanges. When the limit is reached, a query waits
+// briefly for another exchange to complete before failing with ErrLimitReached.
+func NewLimiter(limit int) *Limiter {
+	return &Limiter{sem: make(chan struct{}, limit), wait: limitWait}
+}
+
+// Limit wraps client so that its exchanges are bounded by limiter l.
+func (l *Limiter) Limit(client Client) Client { return &limited{client: client, limiter: l} }
+
+// acquire reserves an exchange. It fails with ErrLimitReached if no exchange could be reserved within the wait duration
+// of l, or with the error of ctx if ctx is done first.
+func (l *Limiter) acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrLimitReached
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Limiter) release() { <-l.sem }
+
+func (c *limited) statuses() []Status { return Statuses(c.client) }
+
+func (c *limited) Exchange(msg *dns.Msg) (*Response, error) {
+	return c.ExchangeContext(context.Background(), msg)
+}
+
+func (c *limited) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.limiter.release()
+	return c.client.ExchangeContext(ctx, msg)
+}
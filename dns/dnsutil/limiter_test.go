@@ -0,0 +1,103 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// concurrencyTracker records the maximum number of concurrent exchanges of the clients sharing it.
+type concurrencyTracker struct {
+	current atomic.Int64
+	max     atomic.Int64
+}
+
+type blockingClient struct {
+	tracker *concurrencyTracker
+	release chan bool
+}
+
+func (c *blockingClient) Exchange(msg *dns.Msg) (*Response, error) {
+	n := c.tracker.current.Add(1)
+	defer c.tracker.current.Add(-1)
+	for {
+		max := c.tracker.max.Load()
+		if n <= max || c.tracker.max.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	<-c.release
+	return &Response{Msg: newA("example.com.", 60, "192.0.2.1")}, nil
+}
+
+func (c *blockingClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	return c.Exchange(msg)
+}
+
+func TestLimiter(t *testing.T) {
+	tracker := &concurrencyTracker{}
+	release := make(chan bool)
+	limiter := NewLimiter(3)
+	limiter.wait = time.Hour
+	mux := NewMux(limiter.Limit(&blockingClient{tracker, release}), limiter.Limit(&blockingClient{tracker, release}))
+
+	// Queries wait while the limit is reached
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := mux.Exchange(&dns.Msg{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for tracker.current.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if got, want := tracker.max.Load(), int64(3); got != want {
+		t.Errorf("got %d concurrent exchanges, want %d", got, want)
+	}
+
+	// Queries fail when the limit is reached for longer than the wait duration
+	release = make(chan bool)
+	limiter = NewLimiter(1)
+	limiter.wait = time.Millisecond
+	client := limiter.Limit(&blockingClient{&concurrencyTracker{}, release})
+	done := make(chan bool)
+	go func() {
+		client.Exchange(&dns.Msg{})
+		close(done)
+	}()
+	for len(limiter.sem) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := client.Exchange(&dns.Msg{}); !errors.Is(err, ErrLimitReached) {
+		t.Errorf("got err = %v, want %v", err, ErrLimitReached)
+	}
+	close(release)
+	<-done
+	if _, err := client.Exchange(&dns.Msg{}); err != nil {
+		t.Errorf("got err = %v, want nil", err)
+	}
+}
+
+func TestBreakerIgnoresLimit(t *testing.T) {
+	limiter := NewLimiter(0)
+	limiter.wait = 0
+	b := NewBreaker(limiter.Limit(&countingClient{}), 1, 0, time.Minute).(*breaker)
+	if _, err := b.Exchange(&dns.Msg{}); !errors.Is(err, ErrLimitReached) {
+		t.Fatalf("got err = %v, want %v", err, ErrLimitReached)
+	}
+	if got, want := b.failures, 0; got != want {
+		t.Errorf("got %d failures, want %d", got, want)
+	}
+}
@@ -0,0 +1,177 @@
+package dnsutil
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxMinimizeProbes is the maximum number of queries sent before the query for the full name. Names having more labels
+// are revealed several labels at a time, as recommended by RFC 9156.
+const maxMinimizeProbes = 10
+
+// maxCachedProbes is the maximum number of probe results cached by a minimizer.
+const maxCachedProbes = 4096
+
+// minimizer is a client which minimizes the names sent to the client it wraps.
+type minimizer struct {
+	client Client
+	mu     sync.Mutex
+	probes map[string]probeResult // Cached probe results by lowercase name
+	now    func() time.Time
+}
+
+// probeResult is the cached result of a probe. A name which exists is either a zone cut or an empty non-terminal, and
+// does not need to be probed again until the result expires. A name which does not exist has no names below it.
+type probeResult struct {
+	nxdomain           bool
+	ns                 []dns.RR // Authority section of a NXDOMAIN response
+	recursionAvailable bool
+	expiresAt          time.Time
+}
+
+// NewMinimizer wraps client so that the name of each query is revealed one label at a time, as described in RFC 9156.
+// Before sending a query for a.b.example.com, the minimizer sends NS queries for com, example.com and b.example.com.
+// If any of them answers NXDOMAIN, nothing exists below that name, and NXDOMAIN is returned without sending the
+// remaining queries. The results of these queries are cached for their TTL, so that names sharing ancestors are only
+// probed once.
+//
+// This only reduces the data revealed to authoritative servers. A recursive resolver receives every query regardless,
+// and resolves the full name itself.
+func NewMinimizer(client Client) Client {
+	return &minimizer{client: client, probes: make(map[string]probeResult), now: time.Now}
+}
+
+func (m *minimizer) statuses() []Status { return Statuses(m.client) }
+
+func (m *minimizer) Exchange(msg *dns.Msg) (*Response, error) {
+	return m.ExchangeContext(context.Background(), msg)
+}
+
+func (m *minimizer) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	if len(msg.Question) != 1 {
+		return m.client.ExchangeContext(ctx, msg)
+	}
+	var rtt time.Duration
+	for _, name := range minimizedNames(msg.Question[0].Name) {
+		if p, ok := m.cached(name); ok {
+			if p.nxdomain {
+				return &Response{Msg: nxdomainReply(msg, copyRRs(p.ns), p.recursionAvailable), RTT: rtt}, nil
+			}
+			continue // Name exists
+		}
+		probe := dns.Msg{}
+		probe.SetQuestion(name, dns.TypeNS)
+		probe.RecursionDesired = msg.RecursionDesired
+		probe.CheckingDisabled = msg.CheckingDisabled
+		if opt := msg.IsEdns0(); opt != nil {
+			probe.Extra = append(probe.Extra, dns.Copy(opt))
+		}
+		r, err := m.client.ExchangeContext(ctx, &probe)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			break // Fall back to the full name
+		}
+		rtt += r.RTT
+		m.store(name, r.Msg)
+		if r.Msg.Rcode == dns.RcodeNameError {
+			return &Response{Msg: nxdomainReply(msg, r.Msg.Ns, r.Msg.RecursionAvailable), RTT: rtt, Resolver: r.Resolver}, nil
+		}
+	}
+	r, err := m.client.ExchangeContext(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	r.RTT += rtt
+	return r, nil
+}
+
+// nxdomainReply creates a NXDOMAIN reply to msg, having the authority section ns.
+func nxdomainReply(msg *dns.Msg, ns []dns.RR, recursionAvailable bool) *dns.Msg {
+	reply := dns.Msg{}
+	reply.SetRcode(msg, dns.RcodeNameError)
+	reply.RecursionAvailable = recursionAvailable
+	reply.Ns = ns
+	return &reply
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	copied := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		copied = append(copied, dns.Copy(rr))
+	}
+	return copied
+}
+
+// cached returns the cached result of probing name, if it has not expired.
+func (m *minimizer) cached(name string) (probeResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.probes[strings.ToLower(name)]
+	if !ok || !m.now().Before(p.expiresAt) {
+		return probeResult{}, false
+	}
+	return p, true
+}
+
+// store caches the response r to a probe of name for the lowest TTL of r. Only NOERROR and NXDOMAIN responses are
+// cached, and responses without records are not cached as their TTL is unknown.
+func (m *minimizer) store(name string, r *dns.Msg) {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return
+	}
+	if len(r.Answer) == 0 && len(r.Ns) == 0 {
+		return
+	}
+	ttl := MinTTL(r)
+	if ttl == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if len(m.probes) >= maxCachedProbes {
+		for k, p := range m.probes {
+			if !now.Before(p.expiresAt) {
+				delete(m.probes, k)
+			}
+		}
+		if len(m.probes) >= maxCachedProbes {
+			return
+		}
+	}
+	m.probes[strings.ToLower(name)] = probeResult{
+		nxdomain:           r.Rcode == dns.RcodeNameError,
+		ns:                 copyRRs(r.Ns),
+		recursionAvailable: r.RecursionAvailable,
+		expiresAt:          now.Add(ttl),
+	}
+}
+
+// minimizedNames returns the names queried before the full name, ordered from the least to the most specific. The
+// root and the full name itself are not included.
+func minimizedNames(name string) []string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 2 {
+		return nil
+	}
+	n := len(labels) - 1 // Every ancestor except the root
+	probes := n
+	if probes > maxMinimizeProbes {
+		probes = maxMinimizeProbes
+	}
+	names := make([]string, 0, probes)
+	for i := 0; i < probes; i++ {
+		depth := i + 1
+		if n > probes {
+			depth = (i + 1) * n / probes // Spread labels evenly across probes
+		}
+		names = append(names, dns.Fqdn(strings.Join(labels[len(labels)-depth:], ".")))
+	}
+	return names
+}
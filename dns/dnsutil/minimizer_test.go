@@ -0,0 +1,142 @@
+package dnsutil
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordingClient records the questions and messages it receives, and answers NXDOMAIN for the names in nxdomain.
+type recordingClient struct {
+	questions []string
+	msgs      []*dns.Msg
+	nxdomain  map[string]bool
+}
+
+func (c *recordingClient) Exchange(msg *dns.Msg) (*Response, error) {
+	q := msg.Question[0]
+	c.questions = append(c.questions, dns.TypeToString[q.Qtype]+" "+q.Name)
+	c.msgs = append(c.msgs, msg)
+	reply := newA(q.Name, 60, "192.0.2.1")
+	if c.nxdomain[q.Name] {
+		reply = &dns.Msg{}
+		reply.SetRcode(msg, dns.RcodeNameError)
+		reply.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: 60,
+		}}
+	}
+	return &Response{Msg: reply}, nil
+}
+
+func (c *recordingClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*Response, error) {
+	return c.Exchange(msg)
+}
+
+func TestMinimizer(t *testing.T) {
+	var tests = []struct {
+		name      string
+		nxdomain  string
+		questions []string
+		rcode     int
+	}{
+		{"com.", "", []string{"A com."}, dns.RcodeSuccess},
+		{"example.com.", "", []string{"NS com.", "A example.com."}, dns.RcodeSuccess},
+		{"a.b.example.com.", "", []string{"NS com.", "NS example.com.", "NS b.example.com.", "A a.b.example.com."}, dns.RcodeSuccess},
+		{"a.b.example.com.", "b.example.com.", []string{"NS com.", "NS example.com.", "NS b.example.com."}, dns.RcodeNameError},
+	}
+	for i, tt := range tests {
+		c := &recordingClient{nxdomain: map[string]bool{tt.nxdomain: true}}
+		msg := dns.Msg{}
+		msg.SetQuestion(tt.name, dns.TypeA)
+		r, err := NewMinimizer(c).Exchange(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.questions, tt.questions) {
+			t.Errorf("#%d: questions = %q, want %q", i, c.questions, tt.questions)
+		}
+		if got := r.Msg.Rcode; got != tt.rcode {
+			t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+		if got, want := r.Msg.Question[0].Name, tt.name; got != want {
+			t.Errorf("#%d: Question = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestMinimizerCache(t *testing.T) {
+	c := &recordingClient{nxdomain: map[string]bool{"b.example.com.": true}}
+	now := time.Now()
+	m := NewMinimizer(c).(*minimizer)
+	m.now = func() time.Time { return now }
+	exchange := func(name string) *dns.Msg {
+		msg := dns.Msg{}
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(1232, true)
+		r, err := m.Exchange(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Msg
+	}
+	exchange("a.example.com.")
+	c.questions = nil
+
+	// Existing ancestors are not probed again
+	exchange("c.example.com.")
+	if got, want := c.questions, []string{"A c.example.com."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("questions = %q, want %q", got, want)
+	}
+	c.questions = nil
+
+	// Names below a name that does not exist are answered from cache
+	exchange("a.b.example.com.")
+	if r := exchange("c.b.example.com."); r.Rcode != dns.RcodeNameError {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[dns.RcodeNameError])
+	}
+	if got, want := c.questions, []string{"NS b.example.com."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("questions = %q, want %q", got, want)
+	}
+	c.questions = nil
+
+	// Expired results are probed again
+	now = now.Add(time.Minute)
+	exchange("c.example.com.")
+	if got, want := c.questions, []string{"NS com.", "NS example.com.", "A c.example.com."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("questions = %q, want %q", got, want)
+	}
+
+	// Probes have the OPT record of the query
+	for _, msg := range c.msgs {
+		if opt := msg.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 1232 {
+			t.Errorf("%s: OPT = %v, want DO bit and UDP size %d", msg.Question[0].Name, opt, 1232)
+		}
+	}
+}
+
+func TestMinimizedNames(t *testing.T) {
+	labels := make([]string, 0, 21)
+	for i := 20; i > 0; i-- {
+		labels = append(labels, fmt.Sprintf("l%d", i))
+	}
+	labels = append(labels, "com")
+	names := minimizedNames(dns.Fqdn(strings.Join(labels, ".")))
+	if got, want := len(names), maxMinimizeProbes; got != want {
+		t.Fatalf("got %d names, want %d", got, want)
+	}
+	// Labels are revealed two at a time
+	if got, want := names[0], "l1.com."; got != want {
+		t.Errorf("names[0] = %s, want %s", got, want)
+	}
+	if got, want := names[len(names)-1], dns.Fqdn(strings.Join(labels[1:], ".")); got != want {
+		t.Errorf("names[%d] = %s, want %s", len(names)-1, got, want)
+	}
+}
@@ -0,0 +1,49 @@
+package dnsutil
+
+import "time"
+
+const (
+	// StateClosed is the state of a circuit breaker that allows all queries.
+	StateClosed = "closed"
+	// StateOpen is the state of a circuit breaker that rejects all queries.
+	StateOpen = "open"
+	// StateHalfOpen is the state of a circuit breaker that allows a single query, to probe whether the client has
+	// recovered.
+	StateHalfOpen = "half-open"
+)
+
+// Status contains the configuration and current status of the resolver queried by a client.
+type Status struct {
+	Address  string
+	Protocol string
+	// State is the state of the circuit breaker wrapping the client. Empty if the client is not wrapped by NewBreaker.
+	State string
+	// Failures is the number of consecutive failures recorded by the circuit breaker wrapping the client.
+	Failures int
+	// LastSuccess is the time of the last successful query. Zero if the client has not answered any query.
+	LastSuccess time.Time
+}
+
+// statusReporter is implemented by clients that report the status of the resolvers they query. Clients wrapping other
+// clients report the statuses of the wrapped clients.
+type statusReporter interface {
+	statuses() []Status
+}
+
+// Statuses returns the status of the resolvers queried by c. A multiplexed client returns the status of each of its
+// clients, in the order they were given to NewMux or NewLatencyMux.
+func Statuses(c Client) []Status {
+	if r, ok := c.(statusReporter); ok {
+		return r.statuses()
+	}
+	return nil
+}
+
+// statusesOf returns the statuses of all clients, in order.
+func statusesOf(clients []Client) []Status {
+	var statuses []Status
+	for _, client := range clients {
+		statuses = append(statuses, Statuses(client)...)
+	}
+	return statuses
+}
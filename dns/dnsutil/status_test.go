@@ -0,0 +1,66 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type failingResolver struct{}
+
+func (r *failingResolver) ExchangeContext(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	return nil, 0, errors.New("timeout")
+}
+
+func TestStatuses(t *testing.T) {
+	c1 := &client{resolver: &ednsResolver{}, address: "192.0.2.1:53"}
+	c2 := &client{resolver: &failingResolver{}, address: "192.0.2.2:853", network: "tcp-tls"}
+	b := NewBreaker(c2, 1, 0, time.Minute).(*breaker)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	mux := NewMux(c1, b)
+
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := c1.Exchange(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Exchange(&msg); err == nil {
+		t.Fatal("want error")
+	}
+	statuses := Statuses(mux)
+	if got, want := len(statuses), 2; got != want {
+		t.Fatalf("len(statuses) = %d, want %d", got, want)
+	}
+	s1, s2 := statuses[0], statuses[1]
+	if s1.Address != "192.0.2.1:53" || s1.Protocol != "udp" || s1.State != "" || s1.LastSuccess.IsZero() {
+		t.Errorf("got %+v, want udp resolver without breaker and with last success", s1)
+	}
+	if s2.Address != "192.0.2.2:853" || s2.Protocol != "tcp-tls" || s2.State != StateOpen || s2.Failures != 1 || !s2.LastSuccess.IsZero() {
+		t.Errorf("got %+v, want tcp-tls resolver with open breaker and no last success", s2)
+	}
+
+	// Circuit is half-open after cooldown
+	now = now.Add(time.Minute)
+	if got, want := Statuses(b)[0].State, StateHalfOpen; got != want {
+		t.Errorf("State = %q, want %q", got, want)
+	}
+}
+
+func TestStatusesWrapped(t *testing.T) {
+	c := &client{resolver: &ednsResolver{}, address: "192.0.2.1:53"}
+	wrapped := NewMinimizer(NewLatencyMux(NewBreaker(NewLimiter(1).Limit(c), 1, 0, time.Minute)))
+	statuses := Statuses(wrapped)
+	if got, want := len(statuses), 1; got != want {
+		t.Fatalf("len(statuses) = %d, want %d", got, want)
+	}
+	if got, want := statuses[0].Address, "192.0.2.1:53"; got != want {
+		t.Errorf("Address = %q, want %q", got, want)
+	}
+	if got, want := statuses[0].State, StateClosed; got != want {
+		t.Errorf("State = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
+)
+
+// call is an upstream exchange in progress, which is shared by concurrent requests for the same key.
+type call struct {
+	wg     sync.WaitGroup
+	resp   *dnsutil.Response
+	err    error
+	shared int
+}
+
+// flight coalesces concurrent upstream exchanges having the same key into a single exchange.
+type flight struct {
+	mu    sync.Mutex
+	calls map[uint32]*call
+}
+
+// exchange sends msg using client, unless an exchange for key is already in progress, in which case the response of
+// that exchange is used instead. The returned bool is true if the response was produced by another caller. The exchange
+// is cancelled when ctx is done.
+//
+// Every caller receives its own copy of the response message, with the ID, flags and EDNS options set to match msg.
+func (f *flight) exchange(ctx context.Context, key uint32, client dnsutil.Client, msg *dns.Msg) (*dnsutil.Response, bool, error) {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[uint32]*call)
+	}
+	if c, ok := f.calls[key]; ok {
+		c.shared++
+		f.mu.Unlock()
+		c.wg.Wait()
+		return c.response(msg), true, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	c.resp, c.err = client.ExchangeContext(ctx, msg)
+
+	f.mu.Lock()
+	delete(f.calls, key)
+	shared := c.shared
+	f.mu.Unlock()
+	c.wg.Done()
+	if shared == 0 {
+		return c.resp, false, c.err
+	}
+	return c.response(msg), false, c.err
+}
+
+// response returns a copy of the response of call c, as a reply to msg. The copy has the ID, the RD and CD bits, and the
+// DO bit of msg, and it has no OPT record if msg does not have one.
+func (c *call) response(msg *dns.Msg) *dnsutil.Response {
+	if c.resp == nil {
+		return nil
+	}
+	resp := *c.resp
+	resp.Msg = c.resp.Msg.Copy()
+	resp.Msg.Id = msg.Id
+	resp.Msg.RecursionDesired = msg.RecursionDesired
+	resp.Msg.CheckingDisabled = msg.CheckingDisabled
+	if opt := msg.IsEdns0(); opt == nil {
+		resp.Msg = withoutOPT(resp.Msg)
+	} else if respOpt := resp.Msg.IsEdns0(); respOpt != nil {
+		respOpt.SetDo(opt.Do())
+	}
+	return &resp
+}
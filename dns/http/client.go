@@ -2,8 +2,12 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
@@ -11,25 +15,111 @@ import (
 	"github.com/miekg/dns"
 )
 
-// RFC8484 (https://tools.ietf.org/html/rfc8484) claims that application/dns-message should be used, as does
-// https://developers.cloudflare.com/1.1.1.1/dns-over-https/wireformat/.
-//
-// However, Cloudflare's service only accept this media type from one of the older RFC drafts
-// (https://tools.ietf.org/html/draft-ietf-doh-dns-over-https-05).
-const mimeType = "application/dns-udpwireformat"
+// mimeType is the media type defined by RFC8484 (https://tools.ietf.org/html/rfc8484).
+const mimeType = "application/dns-message"
+
+// legacyMimeType is the media type from one of the older RFC drafts
+// (https://tools.ietf.org/html/draft-ietf-doh-dns-over-https-05), which some versions of Cloudflare's service
+// require.
+const legacyMimeType = "application/dns-udpwireformat"
+
+// Config is a structure used to configure a DNS-over-HTTPS client.
+type Config struct {
+	// Timeout is the timeout of a request.
+	Timeout time.Duration
+	// DialTimeout is the timeout for establishing a connection, and for its TLS handshake.
+	DialTimeout time.Duration
+	// ReadTimeout is the timeout for reading the response headers after the request has been written.
+	ReadTimeout time.Duration
+	// Method is the HTTP method used to send requests. Either GET or POST. Defaults to POST.
+	Method string
+	// LegacyMimeType controls whether to use the media type from older RFC drafts instead of the one from RFC8484.
+	LegacyMimeType bool
+	// MaxIdleConns is the maximum number of idle connections to keep per host. Defaults to 8.
+	MaxIdleConns int
+	// IdleTimeout is the duration an idle connection is kept before being closed. Defaults to 90 seconds.
+	IdleTimeout time.Duration
+}
 
 // Client is a DNS-over-HTTPS client.
 type Client struct {
 	httpClient *http.Client
+	method     string
+	mimeType   string
 }
 
 // NewClient creates a new DNS-over-HTTPS client.
 func NewClient(timeout time.Duration) *Client {
-	return &Client{httpClient: &http.Client{Timeout: timeout}}
+	return NewClientWithConfig(Config{Timeout: timeout})
+}
+
+// NewClientWithConfig creates a new DNS-over-HTTPS client using config.
+func NewClientWithConfig(config Config) *Client {
+	method := config.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	mt := mimeType
+	if config.LegacyMimeType {
+		mt = legacyMimeType
+	}
+	maxIdleConns := config.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = 8
+	}
+	idleTimeout := config.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 90 * time.Second
+	}
+	handshakeTimeout := config.DialTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = 10 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second}
+	// All queries go to the same host, so allow as many idle connections to it as there are in total
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   handshakeTimeout,
+		ResponseHeaderTimeout: config.ReadTimeout,
+	}
+	return &Client{
+		httpClient: &http.Client{Timeout: config.Timeout, Transport: transport},
+		method:     method,
+		mimeType:   mt,
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, u *url.URL, p []byte) (*http.Request, error) {
+	switch c.method {
+	case http.MethodGet:
+		query := u.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(p))
+		u.RawQuery = query.Encode()
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	case http.MethodPost:
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", c.mimeType)
+		return r, nil
+	}
+	return nil, fmt.Errorf("invalid method: %s", c.method)
 }
 
 // Exchange sends the DNS message msg to the DNS-over-HTTPS endpoint addr and returns the response.
 func (c *Client) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	return c.ExchangeContext(context.Background(), msg, addr)
+}
+
+// ExchangeContext sends the DNS message msg to the DNS-over-HTTPS endpoint addr and returns the response. The request
+// is cancelled when ctx is done.
+func (c *Client) ExchangeContext(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
 	u, err := url.Parse(addr)
 	if err != nil {
 		return nil, 0, fmt.Errorf("invalid url: %w", err)
@@ -40,25 +130,28 @@ func (c *Client) Exchange(msg *dns.Msg, addr string) (*dns.Msg, time.Duration, e
 		return nil, 0, err
 	}
 
-	r, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(p))
+	r, err := c.newRequest(ctx, u, p)
 	if err != nil {
 		return nil, 0, err
 	}
-	r.Header.Set("Content-Type", mimeType)
-	r.Header.Set("Accept", mimeType)
+	r.Header.Set("Accept", c.mimeType)
 
 	t := time.Now()
 	resp, err := c.httpClient.Do(r)
 	if err != nil {
 		return nil, 0, err
 	}
-	defer resp.Body.Close()
+	defer func() {
+		// Drain body so that the connection can be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
 
 	if resp.StatusCode != http.StatusOK {
 		return nil, 0, fmt.Errorf("server returned HTTP %d error: %q", resp.StatusCode, resp.Status)
 	}
-	if contentType := resp.Header.Get("Content-Type"); contentType != mimeType {
-		return nil, 0, fmt.Errorf("server returned unexpected ContentType %q, want %q", contentType, mimeType)
+	if contentType := resp.Header.Get("Content-Type"); contentType != c.mimeType {
+		return nil, 0, fmt.Errorf("server returned unexpected ContentType %q, want %q", contentType, c.mimeType)
 	}
 
 	p, err = ioutil.ReadAll(resp.Body)
@@ -1,11 +1,18 @@
 package http
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,40 +42,62 @@ func hexDecode(s string) []byte {
 	return b
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	contentType := r.Header.Get("Content-Type")
-	accept := r.Header.Get("Accept")
-	const mimeType = "application/dns-udpwireformat"
-
-	if contentType != mimeType {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		io.WriteString(w, "invalid value for header \"Content-Type\"")
-		return
-	}
-	if accept != mimeType {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		io.WriteString(w, "invalid value for header \"Accept\"")
-		return
+func handler(method, mimeType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if accept := r.Header.Get("Accept"); accept != mimeType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			io.WriteString(w, "invalid value for header \"Accept\"")
+			return
+		}
+		var body []byte
+		switch r.Method {
+		case http.MethodGet:
+			b, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = b
+		case http.MethodPost:
+			if contentType := r.Header.Get("Content-Type"); contentType != mimeType {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				io.WriteString(w, "invalid value for header \"Content-Type\"")
+				return
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = b
+		}
+		if !bytes.Equal(body, hexDecode(request)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", mimeType)
+		w.Write(hexDecode(response))
 	}
-	w.Header().Set("Content-Type", mimeType)
-	w.Write(hexDecode(response))
 }
 
 func TestExchange(t *testing.T) {
-	srv := httptest.NewServer(http.HandlerFunc(handler))
-	defer srv.Close()
-
-	msg := dns.Msg{}
-	if err := msg.Unpack(hexDecode(request)); err != nil {
-		t.Fatal(err)
-	}
-
-	client := NewClient(10 * time.Second)
-	reply, _, err := client.Exchange(&msg, srv.URL)
-	if err != nil {
-		t.Fatal(err)
+	var tests = []struct {
+		config  Config
+		handler http.HandlerFunc
+		err     bool
+	}{
+		{Config{}, handler(http.MethodPost, "application/dns-message"), false},
+		{Config{Method: http.MethodGet}, handler(http.MethodGet, "application/dns-message"), false},
+		{Config{LegacyMimeType: true}, handler(http.MethodPost, "application/dns-udpwireformat"), false},
+		{Config{Method: http.MethodGet, LegacyMimeType: true}, handler(http.MethodGet, "application/dns-udpwireformat"), false},
+		{Config{}, handler(http.MethodPost, "application/dns-udpwireformat"), true},
+		{Config{LegacyMimeType: true}, handler(http.MethodPost, "application/dns-message"), true},
+		{Config{Method: http.MethodGet}, handler(http.MethodPost, "application/dns-message"), true},
 	}
-
 	want := `;; opcode: QUERY, status: NOERROR, id: 0
 ;; flags: qr rd ra; QUERY: 1, ANSWER: 1, AUTHORITY: 0, ADDITIONAL: 0
 
@@ -78,7 +107,107 @@ func TestExchange(t *testing.T) {
 ;; ANSWER SECTION:
 www.example.com.	128	IN	A	192.0.2.1
 `
-	if got := reply.String(); got != want {
-		t.Errorf("got %s, want %s", got, want)
+	for i, tt := range tests {
+		srv := httptest.NewServer(tt.handler)
+		msg := dns.Msg{}
+		if err := msg.Unpack(hexDecode(request)); err != nil {
+			t.Fatal(err)
+		}
+		tt.config.Timeout = 10 * time.Second
+		client := NewClientWithConfig(tt.config)
+		reply, _, err := client.Exchange(&msg, srv.URL)
+		srv.Close()
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: want error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if got := reply.String(); got != want {
+			t.Errorf("#%d: got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestExchangeReusesConnection(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+	srv := httptest.NewUnstartedServer(handler(http.MethodPost, "application/dns-message"))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := testTLSClient(srv)
+	for i := 0; i < 10; i++ {
+		msg := dns.Msg{}
+		if err := msg.Unpack(hexDecode(request)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := client.Exchange(&msg, srv.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := 1; conns != want {
+		t.Errorf("got %d connections, want %d", conns, want)
+	}
+}
+
+func TestExchangeContext(t *testing.T) {
+	received := make(chan bool)
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	client := NewClientWithConfig(Config{Timeout: 10 * time.Second})
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := client.ExchangeContext(ctx, &msg, srv.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("got err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func testTLSClient(srv *httptest.Server) *Client {
+	client := NewClientWithConfig(Config{Timeout: 10 * time.Second})
+	// Trust the certificate of the test server
+	transport := client.httpClient.Transport.(*http.Transport)
+	transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+	return client
+}
+
+func BenchmarkExchange(b *testing.B) {
+	srv := httptest.NewUnstartedServer(handler(http.MethodPost, "application/dns-message"))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	client := testTLSClient(srv)
+	msg := dns.Msg{}
+	if err := msg.Unpack(hexDecode(request)); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, _, err := client.Exchange(&msg, srv.URL); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
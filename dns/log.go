@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
+)
+
+const (
+	// LogText logs messages as plain text. Requests are not logged.
+	LogText = iota
+	// LogJSON logs messages and requests as JSON lines.
+	LogJSON
+)
+
+type messageLine struct {
+	Time    string `json:"time"`
+	Message string `json:"message"`
+}
+
+type requestLine struct {
+	Time       string  `json:"time"`
+	RemoteAddr net.IP  `json:"remote_addr"`
+	Question   string  `json:"question"`
+	Qtype      string  `json:"type"`
+	Rcode      string  `json:"rcode"`
+	Hijacked   bool    `json:"hijacked"`
+	Resolver   string  `json:"resolver,omitempty"`
+	Latency    float64 `json:"latency_ms"`
+}
+
+func (p *Proxy) logOutput() io.Writer {
+	if p.logWriter != nil {
+		return p.logWriter
+	}
+	return log.Writer()
+}
+
+func (p *Proxy) writeLine(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	p.logOutput().Write(append(b, '\n'))
+}
+
+// logf logs a message in the configured log format.
+func (p *Proxy) logf(format string, v ...interface{}) {
+	if p.config.LogFormat != LogJSON {
+		log.Printf(format, v...)
+		return
+	}
+	p.writeLine(messageLine{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Message: fmt.Sprintf(format, v...),
+	})
+}
+
+// logRequest logs a request answered with rcode, if the configured log format logs requests.
+func (p *Proxy) logRequest(remoteAddr net.IP, q dns.Question, rcode int, hijacked bool, resolver string, start time.Time) {
+	if p.config.LogFormat != LogJSON {
+		return
+	}
+	now := time.Now()
+	p.writeLine(requestLine{
+		Time:       now.UTC().Format(time.RFC3339Nano),
+		RemoteAddr: remoteAddr,
+		Question:   q.Name,
+		Qtype:      dnsutil.TypeToString[q.Qtype],
+		Rcode:      dnsutil.RcodeToString[rcode],
+		Hijacked:   hijacked,
+		Resolver:   resolver,
+		Latency:    float64(now.Sub(start)) / float64(time.Millisecond),
+	})
+}
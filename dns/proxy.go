@@ -1,53 +1,149 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/mpolden/zdns/cache"
 	"github.com/mpolden/zdns/dns/dnsutil"
 	"github.com/mpolden/zdns/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var staleResponsesCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "zdns_responses_stale",
+	Help: "The number of responses served from cache after their TTL passed, while being refreshed.",
+})
+
 const (
 	// TypeA represents th resource record type A, an IPv4 address.
 	TypeA = dns.TypeA
 	// TypeAAAA represents the resource record type AAAA, an IPv6 address.
 	TypeAAAA = dns.TypeAAAA
+	// TypeCNAME represents the resource record type CNAME, an alias of another name.
+	TypeCNAME = dns.TypeCNAME
+	// TypePTR represents the resource record type PTR, a pointer from an address to a name.
+	TypePTR = dns.TypePTR
+	// TypeTXT represents the resource record type TXT, a set of text strings.
+	TypeTXT = dns.TypeTXT
+	// ClassINET represents the Internet class.
+	ClassINET = dns.ClassINET
+	// ClassCHAOS represents the CHAOS class, used to query information about the server itself.
+	ClassCHAOS = dns.ClassCHAOS
 )
 
 // Request represents a simplified DNS request.
 type Request struct {
-	Type uint16
-	Name string
+	Type       uint16
+	Class      uint16
+	Name       string
+	RemoteAddr net.IP
 }
 
 // Reply represents a simplifed DNS reply.
-type Reply struct{ rr []dns.RR }
+type Reply struct {
+	rr            []dns.RR
+	ns            []dns.RR
+	rcode         int
+	authoritative bool
+	// target is the name at the end of a CNAME chain which should be resolved by the upstream resolver.
+	target string
+}
 
 // Handler represents the handler for a DNS request.
 type Handler func(*Request) *Reply
 
+// Config is a structure used to configure a DNS proxy.
+type Config struct {
+	// LogWildcard controls whether answers synthesized from a wildcard are logged.
+	LogWildcard bool
+	// RefuseNonRecursive controls whether queries without the RD bit are refused. Queries answered by Handler are
+	// never refused.
+	RefuseNonRecursive bool
+	// RefuseANY controls whether queries of type ANY receive a minimal HINFO answer, as described in RFC 8482, instead
+	// of being answered from cache or forwarded to the upstream resolver.
+	RefuseANY bool
+	// LocalOnly controls whether queries not answered by Handler receive NXDOMAIN instead of being forwarded to the
+	// upstream resolver.
+	LocalOnly bool
+	// LogEDNS controls whether the EDNS UDP payload sizes advertised by the client and in the answer are logged.
+	LogEDNS bool
+	// LogFormat is the format of messages logged by the proxy. Either LogText or LogJSON.
+	LogFormat int
+	// EDNSUDPSize is the EDNS UDP payload size advertised in queries sent to the upstream resolver, and the size of the
+	// buffer used to read queries over UDP. The payload size of queries is left unchanged if zero.
+	EDNSUDPSize uint16
+	// ShutdownGrace is the maximum duration Close waits for queries in progress to be answered before shutting down
+	// the server.
+	ShutdownGrace time.Duration
+	// RotateAnswers controls whether the order of A and AAAA records is rotated in successive responses from the cache
+	// or the upstream resolver, to distribute load between addresses.
+	RotateAnswers bool
+	// MinimalResponses controls whether the authority and additional sections are removed from answers from the cache
+	// or the upstream resolver. The OPT record is kept, and so is the SOA record of a negative answer. Cached messages
+	// are kept intact, so that their TTL is derived from all sections.
+	MinimalResponses bool
+	// MaxAnswers is the maximum number of records in the answer section of responses from the cache or the upstream
+	// resolver that are sent over UDP. Larger responses are truncated and have the TC bit set, so that the client can
+	// retry over TCP to get all records. Cached messages are kept intact. Responses are not truncated if zero.
+	MaxAnswers int
+}
+
 // Proxy represents a DNS proxy.
 type Proxy struct {
 	Handler Handler
-	cache   *cache.Cache
-	logger  *sql.Logger
+	// TypeCounter counts written messages per query type. Counting is disabled if nil.
+	TypeCounter *dnsutil.TypeCounter
+	// Latency records the latency of queries answered by the upstream resolver. Recording is disabled if nil.
+	Latency   *dnsutil.LatencyReservoir
+	cache     *cache.Cache
+	logger    *sql.Logger
+	listeners []*listener
+	certs     []*certificate
+	client    dnsutil.Client
+	config    Config
+	logWriter io.Writer
+	flight    flight
+	inflight  sync.WaitGroup
+	rotations atomic.Uint64
+	now       func() time.Time
+	closing   atomic.Bool
+	mu        sync.RWMutex
+	// ctx is done when the proxy is closed, which cancels exchanges with the upstream resolver still in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// listener is a server started by a proxy. A proxy may have several listeners, such as one for UDP and one for TCP,
+// which share the cache and logger of the proxy.
+type listener struct {
 	server  *dns.Server
-	client  dnsutil.Client
-	mu      sync.RWMutex
+	once    sync.Once
+	ready   chan struct{} // Closed when the server has started, or failed to start
+	started bool
 }
 
 // NewProxy creates a new DNS proxy.
-func NewProxy(cache *cache.Cache, client dnsutil.Client, logger *sql.Logger) (*Proxy, error) {
+func NewProxy(cache *cache.Cache, client dnsutil.Client, logger *sql.Logger, config Config) (*Proxy, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Proxy{
 		logger: logger,
 		cache:  cache,
 		client: client,
+		config: config,
+		now:    time.Now,
+		ctx:    ctx,
+		cancel: cancel,
 	}, nil
 }
 
@@ -60,7 +156,7 @@ func ReplyA(name string, ipAddr ...net.IP) *Reply {
 			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
 		})
 	}
-	return &Reply{rr}
+	return &Reply{rr: rr}
 }
 
 // ReplyAAAA creates a resource record of type AAAA.
@@ -72,7 +168,80 @@ func ReplyAAAA(name string, ipAddr ...net.IP) *Reply {
 			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 3600},
 		})
 	}
-	return &Reply{rr}
+	return &Reply{rr: rr}
+}
+
+// WithTTL sets the TTL of the answer records of reply r to ttl, and returns r. The TTL is unchanged if ttl is zero.
+func (r *Reply) WithTTL(ttl time.Duration) *Reply {
+	if ttl > 0 {
+		for _, rr := range r.rr {
+			rr.Header().Ttl = uint32(ttl / time.Second)
+		}
+	}
+	return r
+}
+
+// ReplyPTR creates a resource record of type PTR, pointing name to each target.
+func ReplyPTR(name string, target ...string) *Reply {
+	rr := make([]dns.RR, 0, len(target))
+	for _, t := range target {
+		rr = append(rr, &dns.PTR{
+			Ptr: t,
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 3600},
+		})
+	}
+	return &Reply{rr: rr}
+}
+
+// ReplyTXT creates a resource record of type TXT, holding each string in txt.
+func ReplyTXT(name string, txt ...string) *Reply {
+	return &Reply{rr: []dns.RR{&dns.TXT{
+		Txt: txt,
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+	}}}
+}
+
+// ReplyNODATA creates a reply stating that name exists, but has no records of the requested type. The reply has a
+// synthetic SOA record in its authority section, which clients use to cache the negative answer for ttl seconds.
+func ReplyNODATA(name string, ttl uint32) *Reply { return &Reply{ns: []dns.RR{negativeSOA(name, ttl)}} }
+
+// ReplyNXDOMAIN creates a reply having the response code NXDOMAIN, stating that name does not exist. The reply has a
+// synthetic SOA record in its authority section, which clients use to cache the negative answer for ttl seconds.
+func ReplyNXDOMAIN(name string, ttl uint32) *Reply {
+	return &Reply{rcode: dns.RcodeNameError, ns: []dns.RR{negativeSOA(name, ttl)}}
+}
+
+// ReplySERVFAIL creates a reply having the response code SERVFAIL, stating that the server is unable to answer. Clients
+// typically retry the query using another server.
+func ReplySERVFAIL() *Reply { return &Reply{rcode: dns.RcodeServerFailure} }
+
+// negativeSOA creates a synthetic SOA record for name, which sets the TTL of a negative answer to ttl, as described in
+// RFC 2308.
+func negativeSOA(name string, ttl uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// ReplyCNAME creates a resource record of type CNAME, aliasing name to target. The records in answer are appended
+// after the CNAME record. If answer is nil, records for target are instead resolved by the upstream resolver when the
+// reply is written.
+func ReplyCNAME(name, target string, answer *Reply) *Reply {
+	rr := []dns.RR{&dns.CNAME{
+		Target: target,
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 3600},
+	}}
+	if answer == nil {
+		return &Reply{rr: rr, target: target}
+	}
+	return &Reply{rr: append(rr, answer.rr...), target: answer.target}
 }
 
 func (r *Reply) String() string {
@@ -86,77 +255,489 @@ func (r *Reply) String() string {
 	return b.String()
 }
 
-func (p *Proxy) reply(r *dns.Msg) *dns.Msg {
+func (p *Proxy) reply(remoteAddr net.IP, r *dns.Msg) *dns.Msg {
 	if p.Handler == nil || len(r.Question) != 1 {
 		return nil
 	}
 	reply := p.Handler(&Request{
-		Name: r.Question[0].Name,
-		Type: r.Question[0].Qtype,
+		Name:       r.Question[0].Name,
+		Type:       r.Question[0].Qtype,
+		Class:      r.Question[0].Qclass,
+		RemoteAddr: remoteAddr,
 	})
 	if reply == nil {
 		return nil
 	}
-	m := dns.Msg{Answer: reply.rr}
+	m := dns.Msg{Answer: withClass(reply.rr, r.Question[0].Qclass)}
+	rcode := reply.rcode
+	if reply.target != "" {
+		if target := p.resolveTarget(r, reply.target); target != nil {
+			m.Answer = append(m.Answer, target.Answer...)
+			if target.Rcode != dns.RcodeSuccess {
+				rcode = target.Rcode
+			}
+		}
+	}
 	// Pretend this is an recursive answer
 	m.RecursionAvailable = true
 	m.SetReply(r)
+	m.Ns = withClass(reply.ns, r.Question[0].Qclass)
+	m.Rcode = rcode
+	m.Authoritative = reply.authoritative
+	return &m
+}
+
+// withClass returns records rr having class set to class. Records having a different class are copied.
+func withClass(rr []dns.RR, class uint16) []dns.RR {
+	if len(rr) == 0 {
+		return rr
+	}
+	withClass := make([]dns.RR, len(rr))
+	for i, r := range rr {
+		if r.Header().Class != class {
+			r = dns.Copy(r)
+			r.Header().Class = class
+		}
+		withClass[i] = r
+	}
+	return withClass
+}
+
+// replyANY creates the minimal answer to an ANY query r, as described in RFC 8482.
+func replyANY(r *dns.Msg) *dns.Msg {
+	m := dns.Msg{}
+	m.SetReply(r)
+	m.RecursionAvailable = true
+	m.Answer = []dns.RR{&dns.HINFO{
+		Cpu: "RFC8482",
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 3600},
+	}}
 	return &m
 }
 
-// Close closes the proxy.
+// resolveTarget resolves the CNAME target of query r using the cache or the upstream resolver. The query for target
+// has the same type, flags and EDNS options as r. Nothing is resolved when the query is for the CNAME itself or the
+// proxy only answers locally, in which case nil is returned. If the target cannot be resolved, a SERVFAIL message is
+// returned.
+func (p *Proxy) resolveTarget(r *dns.Msg, target string) *dns.Msg {
+	q := r.Question[0]
+	if q.Qtype == dns.TypeCNAME || p.config.LocalOnly || p.client == nil {
+		return nil
+	}
+	msg := dns.Msg{}
+	msg.SetQuestion(target, q.Qtype)
+	msg.Question[0].Qclass = q.Qclass
+	msg.RecursionDesired = r.RecursionDesired
+	msg.CheckingDisabled = r.CheckingDisabled
+	if opt := r.IsEdns0(); opt != nil {
+		msg.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	key := cache.NewMsgKey(&msg)
+	if v, ok := p.cache.Lookup(key); ok {
+		return v.MsgAt(p.now())
+	}
+	resp, shared, err := p.flight.exchange(p.ctx, key, p.client, p.withUDPSize(&msg))
+	if err == nil && !dnsutil.SameQuestion(&msg, resp.Msg) {
+		err = fmt.Errorf("resolver %s answered a different question than %s %s", resp.Resolver, dnsutil.TypeToString[q.Qtype], target)
+	}
+	if err != nil {
+		p.logf("failed to resolve cname target %s: %s", target, err)
+		failed := dns.Msg{}
+		failed.SetRcode(&msg, dns.RcodeServerFailure)
+		return &failed
+	}
+	rr := dnsutil.DedupAnswers(resp.Msg)
+	dnsutil.ExpandWildcard(rr)
+	if !shared {
+		p.cache.Set(key, rr) // Only the caller that made the exchange caches the response
+	}
+	return rr
+}
+
+// Close closes the proxy. The listeners of the proxy stop accepting queries, and queries in progress are given up to the
+// configured shutdown grace period to be answered. Exchanges with the upstream resolver still in progress after the
+// grace period are cancelled.
 func (p *Proxy) Close() error {
+	p.closing.Store(true)
+	p.mu.RLock()
+	listeners := p.listeners
+	p.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.ShutdownGrace)
+	defer cancel()
+	var firstErr error
+	expired := false
+	for _, l := range listeners {
+		<-l.ready
+		if !l.started {
+			continue // Failure is returned by ListenAndServe
+		}
+		// Shutdown waits for queries being handled by the listener, until ctx is done
+		if err := l.server.ShutdownContext(ctx); errors.Is(err, context.DeadlineExceeded) {
+			expired = true
+		} else if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if !p.drain(ctx) {
+		expired = true
+	}
+	if expired && p.config.ShutdownGrace > 0 {
+		p.logf("shutdown grace period of %s expired with queries in progress", p.config.ShutdownGrace)
+	}
+	p.cancel()
+	return firstErr
+}
+
+// Addrs returns the local network addresses of the listeners of the proxy that have started.
+func (p *Proxy) Addrs() []net.Addr {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	if p.server != nil {
-		return p.server.Shutdown()
+	var addrs []net.Addr
+	for _, l := range p.listeners {
+		select {
+		case <-l.ready:
+		default:
+			continue
+		}
+		if !l.started {
+			continue
+		}
+		if l.server.PacketConn != nil {
+			addrs = append(addrs, l.server.PacketConn.LocalAddr())
+		} else if l.server.Listener != nil {
+			addrs = append(addrs, l.server.Listener.Addr())
+		}
+	}
+	return addrs
+}
+
+// drain waits for queries in progress to be answered, or until ctx is done. It returns false if ctx is done before all
+// queries are answered.
+func (p *Proxy) drain(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// begin registers the start of a query. It returns false if the proxy is closing, in which case the query should be
+// dropped.
+func (p *Proxy) begin() bool {
+	if p.closing.Load() {
+		return false
 	}
-	return nil
+	p.inflight.Add(1)
+	return true
 }
 
-func (p *Proxy) writeMsg(w dns.ResponseWriter, msg *dns.Msg, hijacked bool) {
-	var ip net.IP
+// isUDP returns whether w writes to a client over UDP.
+func isUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+func remoteIP(w dns.ResponseWriter) net.IP {
 	switch v := w.RemoteAddr().(type) {
 	case *net.UDPAddr:
-		ip = v.IP
+		return v.IP
 	case *net.TCPAddr:
-		ip = v.IP
+		return v.IP
 	default:
 		panic(fmt.Sprintf("unexpected remote address type %T", v))
 	}
+}
+
+func udpSize(msg *dns.Msg) uint16 {
+	if opt := msg.IsEdns0(); opt != nil {
+		return opt.UDPSize()
+	}
+	return 0
+}
+
+// withUDPSize returns a copy of r advertising the configured EDNS UDP payload size. An OPT record is added if r does not
+// have one.
+func (p *Proxy) withUDPSize(r *dns.Msg) *dns.Msg {
+	if p.config.EDNSUDPSize == 0 {
+		return r
+	}
+	msg := r.Copy()
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.SetUDPSize(p.config.EDNSUDPSize)
+	} else {
+		msg.SetEdns0(p.config.EDNSUDPSize, false)
+	}
+	return msg
+}
+
+// withoutOPT returns msg without its OPT record. The returned message shares all records with msg.
+func withoutOPT(msg *dns.Msg) *dns.Msg {
+	if msg.IsEdns0() == nil {
+		return msg
+	}
+	plain := *msg
+	plain.Extra = make([]dns.RR, 0, len(msg.Extra))
+	for _, extra := range msg.Extra {
+		if extra.Header().Rrtype != dns.TypeOPT {
+			plain.Extra = append(plain.Extra, extra)
+		}
+	}
+	return &plain
+}
+
+// rotateAnswers returns a copy of msg where the A and AAAA records of its answer section are rotated n positions. Other
+// records keep their position. The returned message shares all records with msg.
+func rotateAnswers(msg *dns.Msg, n uint64) *dns.Msg {
+	rotated := *msg
+	rotated.Answer = make([]dns.RR, len(msg.Answer))
+	copy(rotated.Answer, msg.Answer)
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var positions []int
+		for i, rr := range msg.Answer {
+			if rr.Header().Rrtype == rrtype {
+				positions = append(positions, i)
+			}
+		}
+		if len(positions) < 2 {
+			continue
+		}
+		offset := int(n % uint64(len(positions)))
+		for j, i := range positions {
+			rotated.Answer[i] = msg.Answer[positions[(j+offset)%len(positions)]]
+		}
+	}
+	return &rotated
+}
+
+// minimalMsg returns a copy of msg without the records of its authority and additional sections. The OPT record is
+// kept, and so is the SOA record of a response without answers, which clients need for negative caching. The returned
+// message shares all records with msg.
+func minimalMsg(msg *dns.Msg) *dns.Msg {
+	minimal := *msg
+	minimal.Ns = nil
+	if len(msg.Answer) == 0 {
+		for _, rr := range msg.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				minimal.Ns = append(minimal.Ns, rr)
+			}
+		}
+	}
+	minimal.Extra = nil
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			minimal.Extra = append(minimal.Extra, rr)
+		}
+	}
+	return &minimal
+}
+
+// truncateAnswers returns a copy of msg having at most n records in its answer section, and the TC bit set if any
+// records were removed. If msg has at most n answers, or n is zero, msg is returned unchanged. The returned message
+// shares all records with msg.
+func truncateAnswers(msg *dns.Msg, n int) *dns.Msg {
+	if n <= 0 || len(msg.Answer) <= n {
+		return msg
+	}
+	truncated := *msg
+	truncated.Answer = msg.Answer[:n:n]
+	truncated.Truncated = true
+	return &truncated
+}
+
+// truncateMsg returns a copy of msg which fits in size bytes, having the TC bit set if any records were removed. The
+// returned message shares all records with msg.
+func truncateMsg(msg *dns.Msg, size int) *dns.Msg {
+	truncated := *msg
+	truncated.Extra = append([]dns.RR(nil), msg.Extra...) // Truncate reorders the additional section in place
+	truncated.Truncate(size)
+	return &truncated
+}
+
+// writeMsg writes msg in reply to r. The resolver is the address of the upstream resolver that answered, if any.
+func (p *Proxy) writeMsg(w dns.ResponseWriter, r, msg *dns.Msg, hijacked bool, resolver string, start time.Time) {
+	ip := remoteIP(w)
+	p.logRequest(ip, msg.Question[0], msg.Rcode, hijacked, resolver, start)
 	if p.logger != nil {
-		p.logger.Record(ip, hijacked, msg.Question[0].Qtype, msg.Question[0].Name, dnsutil.Answers(msg)...)
+		entry := sql.LogEntry{
+			RemoteAddr: ip,
+			Hijacked:   hijacked,
+			Resolver:   resolver,
+			Qtype:      msg.Question[0].Qtype,
+			Question:   msg.Question[0].Name,
+			Answers:    dnsutil.Answers(msg),
+		}
+		if len(msg.Answer) > 0 {
+			entry.TTL = dnsutil.MinTTL(msg)
+		}
+		if p.config.LogEDNS {
+			entry.ClientUDPSize = udpSize(r)
+			entry.UpstreamUDPSize = udpSize(msg)
+		}
+		p.logger.RecordEntry(entry)
+	}
+	if p.TypeCounter != nil {
+		p.TypeCounter.Record(msg.Question[0].Qtype, len(msg.Answer))
+	}
+	if r.IsEdns0() == nil {
+		msg = withoutOPT(msg) // A client not using EDNS cannot receive an OPT record (RFC 6891, section 7)
+	}
+	if isUDP(w) {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		msg = truncateMsg(msg, size)
 	}
 	w.WriteMsg(msg)
 }
 
 // ServeDNS implements the dns.Handler interface.
 func (p *Proxy) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	if reply := p.reply(r); reply != nil {
-		p.writeMsg(w, reply, true)
+	if !p.begin() {
+		return
+	}
+	defer p.inflight.Done()
+	if len(r.Question) != 1 {
+		m := dns.Msg{}
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(&m)
+		return
+	}
+	start := time.Now()
+	if reply := p.reply(remoteIP(w), r); reply != nil {
+		p.writeMsg(w, r, reply, true, "", start)
+		return
+	}
+	if p.config.RefuseANY && r.Question[0].Qtype == dns.TypeANY {
+		p.writeMsg(w, r, replyANY(r), false, "", start)
+		return
+	}
+	if p.config.LocalOnly {
+		m := dns.Msg{}
+		m.SetRcode(r, dns.RcodeNameError)
+		m.RecursionAvailable = true
+		p.writeMsg(w, r, &m, false, "", start)
+		return
+	}
+	if p.config.RefuseNonRecursive && !r.RecursionDesired {
+		m := dns.Msg{}
+		m.SetRcode(r, dns.RcodeRefused)
+		p.writeMsg(w, r, &m, false, "", start)
 		return
 	}
 	q := r.Question[0]
-	key := cache.NewKey(q.Name, q.Qtype, q.Qclass)
-	if msg, ok := p.cache.Get(key); ok {
+	key := cache.NewMsgKey(r)
+	if v, ok := p.cache.Lookup(key); ok {
+		now := p.now()
+		if v.Stale(now) {
+			staleResponsesCounter.Inc()
+		}
+		msg := v.MsgAt(now) // Copy with TTLs reflecting the remaining lifetime
+		if p.config.RotateAnswers {
+			msg = rotateAnswers(msg, p.rotations.Add(1))
+		}
+		if p.config.MinimalResponses {
+			msg = minimalMsg(msg)
+		}
+		if isUDP(w) {
+			msg = truncateAnswers(msg, p.config.MaxAnswers)
+		}
+		rcode := msg.Rcode
 		msg.SetReply(r)
-		p.writeMsg(w, msg, false)
+		msg.Rcode = rcode // SetReply resets the response code
+		p.writeMsg(w, r, msg, false, "", start)
 		return
 	}
-	rr, err := p.client.Exchange(r)
+	resp, shared, err := p.flight.exchange(p.ctx, key, p.client, p.withUDPSize(r))
+	if err == nil && !dnsutil.SameQuestion(r, resp.Msg) {
+		err = fmt.Errorf("resolver %s answered a different question than %s %s", resp.Resolver, dnsutil.TypeToString[q.Qtype], q.Name)
+	}
 	if err == nil {
-		p.writeMsg(w, rr, false)
-		p.cache.Set(key, rr)
+		rr := dnsutil.DedupAnswers(resp.Msg)
+		if p.Latency != nil && !shared {
+			p.Latency.Record(resp.RTT)
+		}
+		if dnsutil.ExpandWildcard(rr) && p.config.LogWildcard {
+			p.logf("answer for %s %s synthesized from wildcard", dnsutil.TypeToString[q.Qtype], q.Name)
+		}
+		reply := rr
+		if p.config.RotateAnswers {
+			reply = rotateAnswers(rr, p.rotations.Add(1))
+		}
+		if p.config.MinimalResponses {
+			reply = minimalMsg(reply)
+		}
+		if isUDP(w) {
+			reply = truncateAnswers(reply, p.config.MaxAnswers)
+		}
+		p.writeMsg(w, r, reply, false, resp.Resolver, start)
+		if !shared {
+			p.cache.Set(key, rr) // Only the caller that made the exchange caches the response
+		}
 	} else {
-		log.Print(err)
+		p.logf("%s", err)
 		dns.HandleFailed(w, r)
+		p.logRequest(remoteIP(w), q, dns.RcodeServerFailure, false, "", start)
 	}
 }
 
-// ListenAndServe listens on the network address addr and uses the server to process requests.
+// ListenAndServe listens on the network address addr and uses the server to process requests. It may be called
+// multiple times, and concurrently, to serve requests on several addresses and networks. All listeners share the same
+// cache and logger, and are shut down when the proxy is closed. ListenAndServe returns nil once the proxy is closed.
 func (p *Proxy) ListenAndServe(addr string, network string) error {
+	return p.serve(&dns.Server{Addr: addr, Net: network, Handler: p, UDPSize: int(p.config.EDNSUDPSize)})
+}
+
+// ListenAndServeTLS listens on the TCP network address addr and uses the server to process DNS-over-TLS requests.
+// The certificate and matching private key are read from certFile and keyFile, and are read again when the proxy is
+// reloaded.
+func (p *Proxy) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return err
+	}
 	p.mu.Lock()
-	p.server = &dns.Server{Addr: addr, Net: network, Handler: p}
+	p.certs = append(p.certs, cert)
+	p.mu.Unlock()
+	tlsConfig := &tls.Config{GetCertificate: cert.get}
+	return p.serve(&dns.Server{Addr: addr, Net: "tcp-tls", TLSConfig: tlsConfig, Handler: p})
+}
+
+// Reload reads the TLS certificates of the proxy from their files again, so that renewed certificates are presented on
+// subsequent handshakes. A certificate that fails to load is logged, and the previous certificate is kept.
+func (p *Proxy) Reload() {
+	p.mu.RLock()
+	certs := p.certs
+	p.mu.RUnlock()
+	for _, cert := range certs {
+		if err := cert.reload(); err != nil {
+			p.logf("failed to reload certificate %s: %s", cert.certFile, err)
+		}
+	}
+}
+
+// serve starts server and registers it as a listener, so that it is shut down when the proxy is closed.
+func (p *Proxy) serve(server *dns.Server) error {
+	l := &listener{server: server, ready: make(chan struct{})}
+	server.NotifyStartedFunc = func() {
+		l.once.Do(func() {
+			l.started = true
+			close(l.ready)
+		})
+	}
+	p.mu.Lock()
+	if p.closing.Load() {
+		p.mu.Unlock()
+		return nil
+	}
+	p.listeners = append(p.listeners, l)
 	p.mu.Unlock()
-	return p.server.ListenAndServe()
+	defer l.once.Do(func() { close(l.ready) })
+	return server.ListenAndServe()
 }
@@ -1,16 +1,32 @@
 package dns
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/mpolden/zdns/cache"
+	"github.com/mpolden/zdns/dns/dnsutil"
+	"github.com/mpolden/zdns/sql"
 )
 
 func init() {
@@ -34,14 +50,22 @@ func (w *dnsWriter) WriteMsg(msg *dns.Msg) error {
 	return nil
 }
 
+type tcpWriter struct{ *dnsWriter }
+
+func (w tcpWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 50000}
+}
+
 type response struct {
 	answer *dns.Msg
+	rtt    time.Duration
 	fail   bool
 }
 
 type testResolver struct {
 	mu       sync.RWMutex
 	response *response
+	lastMsg  *dns.Msg
 }
 
 func (e *testResolver) setResponse(response *response) {
@@ -50,18 +74,23 @@ func (e *testResolver) setResponse(response *response) {
 	e.response = response
 }
 
-func (e *testResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
+func (e *testResolver) Exchange(msg *dns.Msg) (*dnsutil.Response, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastMsg = msg
 	r := e.response
 	if r == nil || r.fail {
 		return nil, fmt.Errorf("SERVFAIL")
 	}
-	return r.answer, nil
+	return &dnsutil.Response{Msg: r.answer, RTT: r.rtt, Resolver: "192.0.2.53:53"}, nil
+}
+
+func (e *testResolver) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dnsutil.Response, error) {
+	return e.Exchange(msg)
 }
 
 func testProxy(t *testing.T) *Proxy {
-	proxy, err := NewProxy(cache.New(0, nil), nil, nil)
+	proxy, err := NewProxy(cache.New(0, nil), nil, nil, Config{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -150,6 +179,98 @@ func TestProxy(t *testing.T) {
 	assertRR(t, p, &m, "::")
 }
 
+func TestProxyNoQuestion(t *testing.T) {
+	p := testProxy(t)
+	defer p.Close()
+	w := &dnsWriter{}
+	p.ServeDNS(w, &dns.Msg{})
+	if w.lastReply == nil {
+		t.Fatal("want reply")
+	}
+	if got, want := w.lastReply.Rcode, dns.RcodeFormatError; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+}
+
+func TestProxyNODATA(t *testing.T) {
+	p := testProxy(t)
+	p.Handler = func(r *Request) *Reply { return ReplyNODATA(r.Name, 3600) }
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeAAAA)
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	reply := w.lastReply
+	if got, want := reply.Rcode, dns.RcodeSuccess; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+	if got, want := len(reply.Answer), 0; got != want {
+		t.Errorf("len(Answer) = %d, want %d", got, want)
+	}
+	if got, want := len(reply.Ns), 1; got != want {
+		t.Fatalf("len(Ns) = %d, want %d", got, want)
+	}
+	soa, ok := reply.Ns[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("Ns[0] = %s, want SOA", reply.Ns[0])
+	}
+	if got, want := soa.Hdr.Name, "host1."; got != want {
+		t.Errorf("SOA name = %s, want %s", got, want)
+	}
+}
+
+func TestProxyClass(t *testing.T) {
+	var h Handler = func(r *Request) *Reply {
+		if r.Class != ClassCHAOS {
+			return nil
+		}
+		return ReplyTXT(r.Name, "zdns")
+	}
+	p := testProxy(t)
+	p.Handler = h
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := len(w.lastReply.Answer), 1; got != want {
+		t.Fatalf("len(msg.Answer) = %d, want %d", got, want)
+	}
+	if got, want := w.lastReply.Answer[0].String(), "version.bind.\t0\tCH\tTXT\t\"zdns\""; got != want {
+		t.Errorf("Answer = %q, want %q", got, want)
+	}
+	if got, want := w.lastReply.Question[0].Qclass, uint16(dns.ClassCHAOS); got != want {
+		t.Errorf("Qclass = %d, want %d", got, want)
+	}
+}
+
+func TestProxyTypeCounter(t *testing.T) {
+	p := testProxy(t)
+	p.TypeCounter = dnsutil.NewTypeCounter()
+	p.Handler = func(r *Request) *Reply { return ReplyA(r.Name, net.IPv4zero) }
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("badhost1.", dns.TypeA)
+	assertRR(t, p, &m, "0.0.0.0")
+	stats := p.TypeCounter.Stats()
+	if got, want := len(stats), 1; got != want {
+		t.Fatalf("len(stats) = %d, want %d", got, want)
+	}
+	if got, want := stats[0].Type, "A"; got != want {
+		t.Errorf("Type = %q, want %q", got, want)
+	}
+	if got, want := stats[0].Requests, uint64(1); got != want {
+		t.Errorf("Requests = %d, want %d", got, want)
+	}
+}
+
 func TestProxyWithResolver(t *testing.T) {
 	p := testProxy(t)
 	r := &testResolver{}
@@ -173,6 +294,385 @@ func TestProxyWithResolver(t *testing.T) {
 	assertFailure(t, p, TypeA, "host1")
 }
 
+func TestProxyDedupAnswers(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.1")).rr
+	answer.Answer[2].Header().Ttl = 60 // Differing TTL is still a duplicate
+	r.setResponse(&response{answer: answer})
+
+	want := []string{"192.0.2.1", "192.0.2.2"}
+	for i := 0; i < 2; i++ { // Second query is answered from cache
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		var got []string
+		for _, rr := range w.lastReply.Answer {
+			got = append(got, rr.(*dns.A).A.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("#%d: Answer = %q, want %q", i, got, want)
+		}
+	}
+	if got, want := len(answer.Answer), 3; got != want {
+		t.Errorf("len(Answer) of upstream response = %d, want %d", got, want)
+	}
+}
+
+func TestProxyMismatchedQuestion(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	var tests = []struct {
+		question []dns.Question
+		ok       bool
+	}{
+		{nil, false},
+		{[]dns.Question{{Name: "host2.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, false},
+		{[]dns.Question{{Name: "host1.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}}, false},
+		{[]dns.Question{{Name: "host1.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS}}, false},
+		{[]dns.Question{m.Question[0], m.Question[0]}, false},
+		{[]dns.Question{{Name: "HoSt1.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, true},
+	}
+	for i, tt := range tests {
+		answer := m.Copy()
+		answer.Question = tt.question
+		answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1")).rr
+		r.setResponse(&response{answer: answer})
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		ok := w.lastReply.Rcode == dns.RcodeSuccess
+		if ok != tt.ok {
+			t.Errorf("#%d: got Rcode = %s, want success = %t", i, dns.RcodeToString[w.lastReply.Rcode], tt.ok)
+		}
+		if got, want := p.cache.Stats().Size, 0; !tt.ok && got != want {
+			t.Errorf("#%d: cache size = %d, want %d", i, got, want)
+		}
+	}
+}
+
+type blockingResolver struct {
+	mu        sync.Mutex
+	exchanges int
+	release   chan bool
+	answer    *dns.Msg
+}
+
+func (e *blockingResolver) Exchange(msg *dns.Msg) (*dnsutil.Response, error) {
+	return e.ExchangeContext(context.Background(), msg)
+}
+
+func (e *blockingResolver) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dnsutil.Response, error) {
+	e.mu.Lock()
+	e.exchanges++
+	e.mu.Unlock()
+	select {
+	case <-e.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	answer := e.answer.Copy()
+	answer.Id = msg.Id
+	return &dnsutil.Response{Msg: answer}, nil
+}
+
+// countingBackend is a cache backend which counts the values written to it.
+type countingBackend struct {
+	mu   sync.Mutex
+	sets int
+}
+
+func (b *countingBackend) Set(key uint32, value cache.Value) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sets++
+}
+
+func (b *countingBackend) Evict(key uint32)    {}
+func (b *countingBackend) Read() []cache.Value { return nil }
+func (b *countingBackend) Reset()              {}
+
+func TestProxyCoalescesExchanges(t *testing.T) {
+	p := testProxy(t)
+	backend := &countingBackend{}
+	p.cache = cache.NewWithBackend(10, nil, backend)
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1")).rr
+	r := &blockingResolver{release: make(chan bool), answer: answer}
+	p.client = r
+	defer p.Close()
+
+	const n = 10
+	var wg sync.WaitGroup
+	replies := make([]*dns.Msg, n)
+	ids := make([]uint16, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		ids[i] = dns.Id()
+		go func(i int) {
+			defer wg.Done()
+			m := dns.Msg{}
+			m.SetQuestion("host1.", dns.TypeA)
+			m.Id = ids[i]
+			m.RecursionDesired = i%2 == 0
+			w := &dnsWriter{}
+			p.ServeDNS(w, &m)
+			replies[i] = w.lastReply
+		}(i)
+	}
+	// Wait for all requests to join the exchange in progress
+	key := cache.NewKey("host1.", dns.TypeA, dns.ClassINET)
+	for {
+		p.flight.mu.Lock()
+		c, ok := p.flight.calls[key]
+		joined := ok && c.shared == n-1
+		p.flight.mu.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(r.release)
+	wg.Wait()
+
+	if got, want := r.exchanges, 1; got != want {
+		t.Errorf("got %d exchanges, want %d", got, want)
+	}
+	for i, reply := range replies {
+		if got, want := dnsutil.Answers(reply), []string{"192.0.2.1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%d: answers = %q, want %q", i, got, want)
+		}
+		if got, want := reply.Id, ids[i]; got != want {
+			t.Errorf("#%d: Id = %d, want %d", i, got, want)
+		}
+		if got, want := reply.RecursionDesired, i%2 == 0; got != want {
+			t.Errorf("#%d: RecursionDesired = %t, want %t", i, got, want)
+		}
+	}
+
+	// Response is cached once
+	p.cache.Close()
+	if got, want := backend.sets, 1; got != want {
+		t.Errorf("got %d cache writes, want %d", got, want)
+	}
+}
+
+func TestProxyShutdownGrace(t *testing.T) {
+	var tests = []struct {
+		grace   time.Duration
+		release bool
+	}{
+		{time.Minute, true},            // Query in progress is answered before shutdown
+		{10 * time.Millisecond, false}, // Grace period expires and the query is cancelled
+	}
+	for i, tt := range tests {
+		p := testProxy(t)
+		p.config.ShutdownGrace = tt.grace
+		m := dns.Msg{}
+		m.SetQuestion("host1.", dns.TypeA)
+		answer := m.Copy()
+		answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1")).rr
+		r := &blockingResolver{release: make(chan bool), answer: answer}
+		p.client = r
+
+		w := &dnsWriter{}
+		served := make(chan bool)
+		go func() {
+			p.ServeDNS(w, m.Copy())
+			close(served)
+		}()
+		for {
+			r.mu.Lock()
+			exchanges := r.exchanges
+			r.mu.Unlock()
+			if exchanges > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		closed := make(chan error)
+		go func() { closed <- p.Close() }()
+		for !p.closing.Load() {
+			time.Sleep(time.Millisecond)
+		}
+
+		// New queries are dropped while closing
+		dropped := &dnsWriter{}
+		p.ServeDNS(dropped, m.Copy())
+		if dropped.lastReply != nil {
+			t.Errorf("#%d: got reply %s while closing, want none", i, dropped.lastReply)
+		}
+
+		if tt.release {
+			close(r.release)
+		}
+		if err := <-closed; err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-served:
+		case <-time.After(time.Second):
+			t.Fatalf("#%d: query in progress was not cancelled", i)
+		}
+		if !tt.release {
+			close(r.release)
+		}
+		if tt.release && w.lastReply == nil {
+			t.Errorf("#%d: query in progress was not answered", i)
+		}
+	}
+}
+
+func TestProxyListeners(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+
+	m := dns.Msg{}
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1")).rr
+	r.setResponse(&response{answer: answer})
+
+	networks := []string{"udp", "tcp"}
+	errs := make(chan error, len(networks))
+	for _, network := range networks {
+		go func(network string) { errs <- p.ListenAndServe("127.0.0.1:0", network) }(network)
+	}
+	var addrs []net.Addr
+	for len(addrs) < len(networks) {
+		addrs = p.Addrs()
+		time.Sleep(time.Millisecond)
+	}
+
+	for i, addr := range addrs {
+		client := dns.Client{Net: addr.Network(), Timeout: time.Second}
+		reply, _, err := client.Exchange(m.Copy(), addr.String())
+		if err != nil {
+			t.Fatalf("#%d: query over %s failed: %s", i, addr.Network(), err)
+		}
+		if got, want := reply.Answer[0].(*dns.A).A.String(), "192.0.2.1"; got != want {
+			t.Errorf("#%d: got %s over %s, want %s", i, got, addr.Network(), want)
+		}
+		// Listeners share the cache, so only the first query is sent upstream
+		r.mu.Lock()
+		lastMsg := r.lastMsg
+		r.lastMsg = nil
+		r.mu.Unlock()
+		if i > 0 && lastMsg != nil {
+			t.Errorf("#%d: query over %s was not answered from cache", i, addr.Network())
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range networks {
+		if err := <-errs; err != nil {
+			t.Errorf("got err = %v, want nil", err)
+		}
+	}
+	if err := p.ListenAndServe("127.0.0.1:0", "udp"); err != nil {
+		t.Errorf("got err = %v after close, want nil", err)
+	}
+}
+
+// writeCertificate writes a self-signed certificate for commonName, and its private key, to certFile and keyFile.
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyReloadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "old.example.com")
+
+	p := testProxy(t)
+	errs := make(chan error, 1)
+	go func() { errs <- p.ListenAndServeTLS("127.0.0.1:0", certFile, keyFile) }()
+	var addrs []net.Addr
+	for len(addrs) == 0 {
+		addrs = p.Addrs()
+		time.Sleep(time.Millisecond)
+	}
+	presented := func() string {
+		conn, err := tls.Dial("tcp", addrs[0].String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if got, want := presented(), "old.example.com"; got != want {
+		t.Errorf("got certificate for %s, want %s", got, want)
+	}
+
+	// Renewed certificate is presented after reload
+	writeCertificate(t, certFile, keyFile, "new.example.com")
+	if got, want := presented(), "old.example.com"; got != want {
+		t.Errorf("got certificate for %s before reload, want %s", got, want)
+	}
+	p.Reload()
+	if got, want := presented(), "new.example.com"; got != want {
+		t.Errorf("got certificate for %s, want %s", got, want)
+	}
+
+	// Previous certificate is kept if reload fails
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p.Reload()
+	if got, want := presented(), "new.example.com"; got != want {
+		t.Errorf("got certificate for %s, want %s", got, want)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestProxyWithCache(t *testing.T) {
 	p := testProxy(t)
 	p.cache = cache.New(10, nil)
@@ -195,6 +695,813 @@ func TestProxyWithCache(t *testing.T) {
 	}
 }
 
+func TestProxyCacheTTL(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1", net.ParseIP("192.0.2.1")).rr
+	r.setResponse(&response{answer: answer})
+	p.ServeDNS(&dnsWriter{}, &m)
+	now := time.Now()
+
+	var tests = []struct {
+		elapsed time.Duration
+		ttl     uint32
+	}{
+		{0, 3600},
+		{10 * time.Second, 3590},
+		{time.Hour - time.Second, 1},
+		{time.Hour, 1},
+		{2 * time.Hour, 1},
+	}
+	for i, tt := range tests {
+		p.now = func() time.Time { return now.Add(tt.elapsed) }
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got := w.lastReply.Answer[0].Header().Ttl; got != tt.ttl {
+			t.Errorf("#%d: TTL = %d, want %d", i, got, tt.ttl)
+		}
+	}
+
+	// Cached message is unchanged
+	cached, _ := p.cache.Get(cache.NewKey("host1.", dns.TypeA, dns.ClassINET))
+	if got, want := cached.Answer[0].Header().Ttl, uint32(3600); got != want {
+		t.Errorf("TTL = %d, want %d", got, want)
+	}
+}
+
+func TestProxyCachedRcode(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	p.cache.SetServfailTTL(5 * time.Second)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	for _, rcode := range []int{dns.RcodeServerFailure, dns.RcodeNameError} {
+		m := dns.Msg{}
+		m.Id = dns.Id()
+		m.SetQuestion(fmt.Sprintf("rcode%d.example.com.", rcode), dns.TypeA)
+		answer := dns.Msg{}
+		answer.SetRcode(&m, rcode)
+		answer.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: 60,
+		}}
+		r.setResponse(&response{answer: &answer})
+		for i := 0; i < 2; i++ {
+			w := &dnsWriter{}
+			p.ServeDNS(w, &m)
+			if got := w.lastReply.Rcode; got != rcode {
+				t.Errorf("#%d: Rcode = %s, want %s", i, dns.RcodeToString[got], dns.RcodeToString[rcode])
+			}
+		}
+		if _, ok := p.cache.Get(cache.NewMsgKey(&m)); !ok {
+			t.Errorf("%s: want cached answer", dns.RcodeToString[rcode])
+		}
+	}
+}
+
+func TestProxyRotateAnswers(t *testing.T) {
+	p := testProxy(t)
+	p.config.RotateAnswers = true
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = append(answer.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "host1.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "host2.",
+	})
+	answer.Answer = append(answer.Answer, ReplyA("host2", net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")).rr...)
+	r.setResponse(&response{answer: answer})
+
+	// First response is answered by resolver, and the following from cache
+	want := [][]string{
+		{"host2.", "192.0.2.2", "192.0.2.3", "192.0.2.1"},
+		{"host2.", "192.0.2.3", "192.0.2.1", "192.0.2.2"},
+		{"host2.", "192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		{"host2.", "192.0.2.2", "192.0.2.3", "192.0.2.1"},
+	}
+	for i, answers := range want {
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got := dnsutil.Answers(w.lastReply); !reflect.DeepEqual(got, answers) {
+			t.Errorf("#%d: got %v, want %v", i, got, answers)
+		}
+	}
+
+	// Cached message is not reordered
+	k := cache.NewKey("host1.", dns.TypeA, dns.ClassINET)
+	cached, _ := p.cache.Get(k)
+	if got, want := dnsutil.Answers(cached), []string{"host2.", "192.0.2.1", "192.0.2.2", "192.0.2.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProxyMaxAnswers(t *testing.T) {
+	p := testProxy(t)
+	p.config.MaxAnswers = 2
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3"),
+		net.ParseIP("192.0.2.4"), net.ParseIP("192.0.2.5")).rr
+	r.setResponse(&response{answer: answer})
+
+	// First response is answered by resolver, and the second from cache
+	for i := 0; i < 2; i++ {
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got, want := len(w.lastReply.Answer), 2; got != want {
+			t.Errorf("#%d: len(Answer) = %d, want %d", i, got, want)
+		}
+		if !w.lastReply.Truncated {
+			t.Errorf("#%d: want TC bit to be set", i)
+		}
+	}
+
+	// Cached message is intact
+	v, ok := p.cache.Lookup(cache.NewKey("host1.", dns.TypeA, dns.ClassINET))
+	if !ok {
+		t.Fatal("host1. is not cached")
+	}
+	if got, want := len(v.MsgAt(time.Now()).Answer), 5; got != want {
+		t.Errorf("cached len(Answer) = %d, want %d", got, want)
+	}
+
+	// Responses over TCP are not truncated
+	w := tcpWriter{&dnsWriter{}}
+	p.ServeDNS(w, &m)
+	if got, want := len(w.lastReply.Answer), 5; got != want {
+		t.Errorf("len(Answer) = %d, want %d", got, want)
+	}
+	if w.lastReply.Truncated {
+		t.Error("want TC bit to be unset")
+	}
+}
+
+func TestProxyTruncateUDP(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	var ips []net.IP
+	for i := 1; i <= 100; i++ {
+		ips = append(ips, net.IPv4(192, 0, 2, byte(i)))
+	}
+	answer.Answer = ReplyA("host1.", ips...).rr
+	answer.SetEdns0(4096, false)
+	r.setResponse(&response{answer: answer})
+
+	// Client without EDNS receives at most 512 bytes, both from the resolver and from cache
+	for i := 0; i < 2; i++ {
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if !w.lastReply.Truncated {
+			t.Errorf("#%d: want TC bit to be set", i)
+		}
+		if got := w.lastReply.Len(); got > dns.MinMsgSize {
+			t.Errorf("#%d: Len() = %d, want <= %d", i, got, dns.MinMsgSize)
+		}
+		if n := len(w.lastReply.Answer); n == 0 || n == len(ips) {
+			t.Errorf("#%d: len(Answer) = %d, want between 0 and %d", i, n, len(ips))
+		}
+	}
+
+	// Client advertising a large EDNS UDP payload size receives all records
+	edns := m.Copy()
+	edns.SetEdns0(4096, false)
+	w := &dnsWriter{}
+	p.ServeDNS(w, edns)
+	if got, want := len(w.lastReply.Answer), len(ips); got != want {
+		t.Errorf("len(Answer) = %d, want %d", got, want)
+	}
+	if w.lastReply.Truncated {
+		t.Error("want TC bit to be unset")
+	}
+
+	// Cached message is intact
+	v, ok := p.cache.Lookup(cache.NewKey("host1.", dns.TypeA, dns.ClassINET))
+	if !ok {
+		t.Fatal("host1. is not cached")
+	}
+	if got, want := len(v.MsgAt(time.Now()).Answer), len(ips); got != want {
+		t.Errorf("cached len(Answer) = %d, want %d", got, want)
+	}
+
+	// Responses over TCP are not truncated
+	tw := tcpWriter{&dnsWriter{}}
+	p.ServeDNS(tw, &m)
+	if got, want := len(tw.lastReply.Answer), len(ips); got != want {
+		t.Errorf("len(Answer) = %d, want %d", got, want)
+	}
+}
+
+func TestProxyMinimalResponses(t *testing.T) {
+	p := testProxy(t)
+	p.config.MinimalResponses = true
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	ns := &dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: "ns1.example.com."}
+	glue := &dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP("192.0.2.53")}
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Ns: "ns1.example.com.", Mbox: "hostmaster.example.com.", Minttl: 300}
+	var tests = []struct {
+		qname  string
+		rr     []dns.RR
+		ns     []dns.RR
+		wantNs int
+	}{
+		{"host1.example.com.", ReplyA("host1.example.com.", net.ParseIP("192.0.2.1")).rr, []dns.RR{ns}, 0},
+		{"host2.example.com.", nil, []dns.RR{soa, ns}, 1}, // SOA of negative answer is kept
+	}
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.Id = dns.Id()
+		m.SetQuestion(tt.qname, dns.TypeA)
+		m.SetEdns0(4096, false)
+		answer := m.Copy()
+		answer.Answer = tt.rr
+		answer.Ns = tt.ns
+		answer.Extra = append(answer.Extra, glue)
+		r.setResponse(&response{answer: answer})
+
+		// First response is answered by resolver, and the second from cache
+		for j := 0; j < 2; j++ {
+			w := &dnsWriter{}
+			p.ServeDNS(w, &m)
+			if got := len(w.lastReply.Ns); got != tt.wantNs {
+				t.Errorf("#%d.%d: len(Ns) = %d, want %d", i, j, got, tt.wantNs)
+			}
+			if len(w.lastReply.Extra) != 1 || w.lastReply.IsEdns0() == nil {
+				t.Errorf("#%d.%d: Extra = %v, want only OPT", i, j, w.lastReply.Extra)
+			}
+		}
+
+		// Cached message is intact, and its TTL derived from all sections
+		k := cache.NewKey(tt.qname, dns.TypeA, dns.ClassINET)
+		v, ok := p.cache.Lookup(k)
+		if !ok {
+			t.Fatalf("#%d: %s is not cached", i, tt.qname)
+		}
+		if got, want := len(v.MsgAt(time.Now()).Ns), len(tt.ns); got != want {
+			t.Errorf("#%d: cached len(Ns) = %d, want %d", i, got, want)
+		}
+		if got, want := v.TTL(), dnsutil.MinTTL(answer); got != want {
+			t.Errorf("#%d: cached TTL = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestProxyCacheDNSSEC(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	var tests = []struct {
+		do bool
+		cd bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	}
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.Id = dns.Id()
+		m.SetQuestion("host1.", dns.TypeA)
+		m.SetEdns0(4096, tt.do)
+		m.CheckingDisabled = tt.cd
+		answer := m.Copy()
+		answer.Answer = ReplyA("host1.", net.ParseIP(fmt.Sprintf("192.0.2.%d", i+1))).rr
+		r.setResponse(&response{answer: answer})
+		p.ServeDNS(&dnsWriter{}, &m)
+		if opt := r.lastMsg.IsEdns0(); opt == nil || opt.Do() != tt.do {
+			t.Errorf("#%d: expected DO bit %t to be sent upstream", i, tt.do)
+		}
+		if got := r.lastMsg.CheckingDisabled; got != tt.cd {
+			t.Errorf("#%d: expected CD bit %t to be sent upstream", i, tt.cd)
+		}
+	}
+
+	// Queries with and without DO and CD are cached separately
+	r.setResponse(&response{fail: true})
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.SetQuestion("host1.", dns.TypeA)
+		m.SetEdns0(4096, tt.do)
+		m.CheckingDisabled = tt.cd
+		assertRR(t, p, &m, fmt.Sprintf("192.0.2.%d", i+1))
+	}
+	if got, want := p.cache.Stats().Size, len(tests); got != want {
+		t.Errorf("cache size = %d, want %d", got, want)
+	}
+}
+
+func TestProxyNonRecursive(t *testing.T) {
+	p := testProxy(t)
+	p.config.RefuseNonRecursive = true
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "badhost1." {
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		return nil
+	}
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	// Hijacked name is answered regardless of RD bit
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("badhost1.", dns.TypeA)
+	m.RecursionDesired = false
+	assertRR(t, p, &m, "0.0.0.0")
+
+	// Other names are refused without RD bit
+	m.SetQuestion("host1.", dns.TypeA)
+	m.RecursionDesired = false
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := w.lastReply.Rcode, dns.RcodeRefused; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+
+	// ... and resolved with RD bit
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1")).rr
+	r.setResponse(&response{answer: answer})
+	m.RecursionDesired = true
+	assertRR(t, p, &m, "192.0.2.1")
+}
+
+func TestProxyRefuseANY(t *testing.T) {
+	p := testProxy(t)
+	p.config.RefuseANY = true
+	r := &testResolver{}
+	r.setResponse(&response{fail: true})
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeANY)
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if r.lastMsg != nil {
+		t.Errorf("expected no query to be sent upstream")
+	}
+	reply := w.lastReply
+	if got, want := reply.Rcode, dns.RcodeSuccess; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+	if got, want := reply.Id, m.Id; got != want {
+		t.Errorf("Id = %d, want %d", got, want)
+	}
+	if got, want := len(reply.Answer), 1; got != want {
+		t.Fatalf("len(Answer) = %d, want %d", got, want)
+	}
+	want := "host1.\t3600\tIN\tHINFO\t\"RFC8482\" \"\""
+	if got := reply.Answer[0].String(); got != want {
+		t.Errorf("Answer[0] = %q, want %q", got, want)
+	}
+}
+
+func TestProxyLocalOnly(t *testing.T) {
+	p := testProxy(t)
+	p.config.LocalOnly = true
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "host1." {
+			return ReplyA(r.Name, net.ParseIP("192.0.2.1"))
+		}
+		return nil
+	}
+	r := &testResolver{}
+	r.setResponse(&response{fail: true})
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeA)
+	assertRR(t, p, &m, "192.0.2.1")
+
+	// Unmatched name is answered with NXDOMAIN without querying resolver
+	m.SetQuestion("host2.", dns.TypeA)
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := w.lastReply.Rcode, dns.RcodeNameError; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+	if got, want := w.lastReply.Id, m.Id; got != want {
+		t.Errorf("Id = %d, want %d", got, want)
+	}
+}
+
+func TestProxyNXDOMAIN(t *testing.T) {
+	p := testProxy(t)
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "badhost1." {
+			return ReplyNXDOMAIN(r.Name, 60)
+		}
+		return nil
+	}
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("badhost1.", dns.TypeMX)
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := w.lastReply.Rcode, dns.RcodeNameError; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+	if got := len(w.lastReply.Answer); got != 0 {
+		t.Errorf("len(Answer) = %d, want 0", got)
+	}
+	if got, want := len(w.lastReply.Ns), 1; got != want {
+		t.Fatalf("len(Ns) = %d, want %d", got, want)
+	}
+	soa, ok := w.lastReply.Ns[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("Ns[0] = %s, want SOA", w.lastReply.Ns[0])
+	}
+	if got, want := soa.Hdr.Ttl, uint32(60); got != want {
+		t.Errorf("SOA TTL = %d, want %d", got, want)
+	}
+	if got, want := soa.Minttl, uint32(60); got != want {
+		t.Errorf("SOA Minttl = %d, want %d", got, want)
+	}
+}
+
+func TestProxyCNAME(t *testing.T) {
+	p := testProxy(t)
+	p.Handler = func(r *Request) *Reply {
+		switch r.Name {
+		case "alias1.":
+			return ReplyCNAME(r.Name, "host1.", ReplyA("host1.", net.ParseIP("192.0.2.1")))
+		case "alias2.":
+			return ReplyCNAME(r.Name, "example.com.", nil)
+		}
+		return nil
+	}
+	r := &testResolver{}
+	upstream := dns.Msg{}
+	upstream.SetQuestion("example.com.", dns.TypeA)
+	upstream.Answer = ReplyA("example.com.", net.ParseIP("192.0.2.42")).rr
+	r.setResponse(&response{answer: &upstream})
+	p.client = r
+	defer p.Close()
+
+	var tests = []struct {
+		name      string
+		qtype     uint16
+		localOnly bool
+		answers   []string
+	}{
+		{"alias1.", dns.TypeA, false, []string{"host1.", "192.0.2.1"}},
+		{"alias2.", dns.TypeA, false, []string{"example.com.", "192.0.2.42"}},
+		{"alias2.", dns.TypeCNAME, false, []string{"example.com."}},
+		{"alias2.", dns.TypeA, true, []string{"example.com."}},
+	}
+	for i, tt := range tests {
+		p.config.LocalOnly = tt.localOnly
+		m := dns.Msg{}
+		m.SetQuestion(tt.name, tt.qtype)
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+		if got := dnsutil.Answers(w.lastReply); !reflect.DeepEqual(got, tt.answers) {
+			t.Errorf("#%d: answers = %q, want %q", i, got, tt.answers)
+		}
+	}
+}
+
+func TestProxyCNAMETarget(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "alias2." {
+			return ReplyCNAME(r.Name, "nxdomain.example.com.", nil)
+		}
+		return ReplyCNAME(r.Name, "example.com.", nil)
+	}
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.SetQuestion("alias1.", dns.TypeA)
+	m.CheckingDisabled = true
+	m.SetEdns0(4096, true)
+
+	// Target fails to resolve
+	r.setResponse(&response{fail: true})
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := w.lastReply.Rcode, dns.RcodeServerFailure; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+
+	// Query for target has the flags of the client query
+	upstream := dns.Msg{}
+	upstream.SetQuestion("example.com.", dns.TypeA)
+	upstream.Answer = ReplyA("example.com.", net.ParseIP("192.0.2.42")).rr
+	r.setResponse(&response{answer: &upstream})
+	w = &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := dnsutil.Answers(w.lastReply), []string{"example.com.", "192.0.2.42"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("answers = %q, want %q", got, want)
+	}
+	r.mu.RLock()
+	last := r.lastMsg
+	r.mu.RUnlock()
+	if !last.CheckingDisabled {
+		t.Error("want CD bit to be set")
+	}
+	if opt := last.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 4096 {
+		t.Errorf("OPT = %v, want DO bit and UDP size %d", opt, 4096)
+	}
+
+	// Target is answered from cache
+	r.setResponse(&response{fail: true})
+	w = &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := dnsutil.Answers(w.lastReply), []string{"example.com.", "192.0.2.42"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("answers = %q, want %q", got, want)
+	}
+
+	// Target does not exist
+	nxdomain := dns.Msg{}
+	nxdomain.SetQuestion("nxdomain.example.com.", dns.TypeA)
+	nxdomain.Rcode = dns.RcodeNameError
+	r.setResponse(&response{answer: &nxdomain})
+	m.Question[0].Name = "alias2."
+	w = &dnsWriter{}
+	p.ServeDNS(w, &m)
+	if got, want := w.lastReply.Rcode, dns.RcodeNameError; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+}
+
+func TestProxyZone(t *testing.T) {
+	z, err := ParseZone(strings.NewReader(testZone), "example.internal.", "test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := testProxy(t)
+	p.Handler = z.Reply
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("foo.example.internal.", dns.TypeA)
+	w := &dnsWriter{}
+	p.ServeDNS(w, &m)
+	reply := w.lastReply
+	if got, want := reply.Rcode, dns.RcodeNameError; got != want {
+		t.Errorf("Rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[want])
+	}
+	if !reply.Authoritative {
+		t.Errorf("Authoritative = %t, want %t", reply.Authoritative, true)
+	}
+	if got, want := len(reply.Ns), 1; got != want {
+		t.Errorf("len(Ns) = %d, want %d", got, want)
+	}
+}
+
+func TestProxyWithWildcard(t *testing.T) {
+	p := testProxy(t)
+	p.cache = cache.New(10, nil)
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("foo.example.com.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = ReplyA("*.example.com.", net.ParseIP("192.0.2.1")).rr
+	r.setResponse(&response{answer: answer})
+
+	// Answer from resolver and cache is served under the queried name
+	for i := 0; i < 2; i++ {
+		assertRR(t, p, &m, "192.0.2.1")
+		r.setResponse(nil)
+	}
+	k := cache.NewKey("foo.example.com.", dns.TypeA, dns.ClassINET)
+	got, ok := p.cache.Get(k)
+	if !ok {
+		t.Fatalf("cache.Get(%d) = (%+v, %t), want (_, %t)", k, got, ok, !ok)
+	}
+	if owner := got.Answer[0].Header().Name; owner != "foo.example.com." {
+		t.Errorf("owner = %q, want %q", owner, "foo.example.com.")
+	}
+}
+
+func TestProxyEDNSUDPSize(t *testing.T) {
+	r := &testResolver{}
+	p, err := NewProxy(cache.New(0, nil), r, nil, Config{EDNSUDPSize: 1232})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var tests = []struct {
+		name       string
+		clientSize uint16
+		do         bool
+	}{
+		{"host1.", 0, false},   // Client without EDNS
+		{"host2.", 4096, true}, // Client advertising a larger size
+		{"host3.", 512, false}, // Client advertising a smaller size
+	}
+	for i, tt := range tests {
+		m := dns.Msg{}
+		m.Id = dns.Id()
+		m.SetQuestion(tt.name, dns.TypeA)
+		if tt.clientSize > 0 {
+			m.SetEdns0(tt.clientSize, tt.do)
+		}
+		answer := m.Copy()
+		answer.Answer = ReplyA(tt.name, net.ParseIP("192.0.2.1")).rr
+		answer.Extra = nil
+		answer.SetEdns0(1232, false)
+		r.setResponse(&response{answer: answer})
+		w := &dnsWriter{}
+		p.ServeDNS(w, &m)
+
+		r.mu.RLock()
+		opt := r.lastMsg.IsEdns0()
+		r.mu.RUnlock()
+		if opt == nil {
+			t.Fatalf("#%d: query sent upstream has no OPT record", i)
+		}
+		if got, want := opt.UDPSize(), uint16(1232); got != want {
+			t.Errorf("#%d: UDPSize() = %d, want %d", i, got, want)
+		}
+		if got := opt.Do(); got != tt.do {
+			t.Errorf("#%d: Do() = %t, want %t", i, got, tt.do)
+		}
+		if opt := m.IsEdns0(); (opt == nil && tt.clientSize > 0) || (opt != nil && opt.UDPSize() != tt.clientSize) {
+			t.Errorf("#%d: query from client was modified", i)
+		}
+		if hasOPT := w.lastReply.IsEdns0() != nil; hasOPT != (tt.clientSize > 0) {
+			t.Errorf("#%d: reply has OPT record = %t, want %t", i, hasOPT, tt.clientSize > 0)
+		}
+	}
+}
+
+func TestProxyLogEDNS(t *testing.T) {
+	client, err := sql.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	logger := sql.NewLogger(client, sql.LogAll, 0)
+	r := &testResolver{}
+	p, err := NewProxy(cache.New(0, nil), r, logger, Config{LogEDNS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1")).rr
+	answer.Extra = nil
+	answer.SetEdns0(4096, false)
+	r.setResponse(&response{answer: answer})
+	assertRR(t, p, &m, "192.0.2.1")
+	logger.Close() // Flush
+
+	entries, err := logger.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Fatalf("len(entries) = %d, want %d", got, want)
+	}
+	if got, want := entries[0].ClientUDPSize, uint16(1232); got != want {
+		t.Errorf("ClientUDPSize = %d, want %d", got, want)
+	}
+	if got, want := entries[0].UpstreamUDPSize, uint16(4096); got != want {
+		t.Errorf("UpstreamUDPSize = %d, want %d", got, want)
+	}
+	if got, want := entries[0].Resolver, "192.0.2.53:53"; got != want {
+		t.Errorf("Resolver = %q, want %q", got, want)
+	}
+}
+
+func TestProxyLogJSON(t *testing.T) {
+	p := testProxy(t)
+	p.config.LogFormat = LogJSON
+	var buf bytes.Buffer
+	p.logWriter = &buf
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "badhost1." {
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		return nil
+	}
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("badhost1.", dns.TypeA)
+	assertRR(t, p, &m, "0.0.0.0")
+	assertFailure(t, p, TypeA, "host1")
+
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line map[string]interface{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		delete(line, "time")
+		if _, ok := line["latency_ms"].(float64); ok {
+			delete(line, "latency_ms")
+		}
+		lines = append(lines, line)
+	}
+	want := []map[string]interface{}{
+		{"remote_addr": "192.0.2.100", "question": "badhost1.", "type": "A", "rcode": "NOERROR", "hijacked": true},
+		{"message": "SERVFAIL"},
+		{"remote_addr": "192.0.2.100", "question": "host1.", "type": "A", "rcode": "SERVFAIL", "hijacked": false},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %+v, want %+v", lines, want)
+	}
+}
+
+func TestProxyLatency(t *testing.T) {
+	p := testProxy(t)
+	p.Latency = dnsutil.NewLatencyReservoir(10)
+	p.Handler = func(r *Request) *Reply {
+		if r.Name == "badhost1." {
+			return ReplyA(r.Name, net.IPv4zero)
+		}
+		return nil
+	}
+	r := &testResolver{}
+	p.client = r
+	defer p.Close()
+
+	m := dns.Msg{}
+	m.Id = dns.Id()
+	m.SetQuestion("host1.", dns.TypeA)
+	answer := m.Copy()
+	answer.Answer = ReplyA("host1.", net.ParseIP("192.0.2.1")).rr
+	r.setResponse(&response{answer: answer, rtt: 42 * time.Millisecond})
+	assertRR(t, p, &m, "192.0.2.1")
+
+	// Hijacked request is not recorded
+	m.SetQuestion("badhost1.", dns.TypeA)
+	assertRR(t, p, &m, "0.0.0.0")
+
+	want := dnsutil.LatencyStats{Samples: 1, P50: 42 * time.Millisecond, P95: 42 * time.Millisecond, P99: 42 * time.Millisecond}
+	if got := p.Latency.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
 func TestReplyString(t *testing.T) {
 	var tests = []struct {
 		fn      func(string, ...net.IP) *Reply
@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"io"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEDepth is the maximum number of CNAME records followed when answering from a zone.
+const maxCNAMEDepth = 8
+
+// Zone represents a DNS zone for which answers are authoritative.
+type Zone struct {
+	origin  string
+	records map[string][]dns.RR
+	soa     dns.RR
+}
+
+// ParseZone parses a zone in master file format, as described in RFC 1035, from reader r. Relative names in the zone
+// are relative to origin. The file name is only used in error messages.
+func ParseZone(r io.Reader, origin, file string) (*Zone, error) {
+	origin = dns.CanonicalName(origin)
+	z := &Zone{origin: origin, records: map[string][]dns.RR{origin: nil}}
+	zp := dns.NewZoneParser(r, origin, file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			continue // Out of zone
+		}
+		if rr.Header().Rrtype == dns.TypeSOA && name == origin {
+			z.soa = rr
+		}
+		z.records[name] = append(z.records[name], rr)
+		// Names between the origin and the owner name exist, even if they have no records
+		for parent := name; parent != origin; {
+			i, _ := dns.NextLabel(parent, 0)
+			parent = parent[i:]
+			if _, ok := z.records[parent]; !ok {
+				z.records[parent] = nil
+			}
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// Origin returns the origin of zone z.
+func (z *Zone) Origin() string { return z.origin }
+
+// Contains returns whether name is contained in zone z.
+func (z *Zone) Contains(name string) bool { return dns.IsSubDomain(z.origin, dns.CanonicalName(name)) }
+
+// Len returns the number of records in zone z.
+func (z *Zone) Len() int {
+	n := 0
+	for _, rrs := range z.records {
+		n += len(rrs)
+	}
+	return n
+}
+
+// Reply answers request r from zone z. Names in the zone having no records of the requested type receive an empty
+// answer, and names not in the zone receive NXDOMAIN. CNAME records are followed within the zone, and targets outside
+// the zone are resolved by the upstream resolver. It returns nil if the name of r is not contained in the zone.
+func (z *Zone) Reply(r *Request) *Reply {
+	name := dns.CanonicalName(r.Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return nil
+	}
+	reply := &Reply{authoritative: true}
+	for depth := 0; depth <= maxCNAMEDepth; depth++ {
+		rrs, ok := z.records[name]
+		if !ok {
+			reply.rcode = dns.RcodeNameError
+			break
+		}
+		matched := false
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == r.Type || r.Type == dns.TypeANY {
+				reply.rr = append(reply.rr, rr)
+				matched = true
+			} else if rr, ok := rr.(*dns.CNAME); ok {
+				cname = rr
+			}
+		}
+		if matched || cname == nil {
+			break
+		}
+		reply.rr = append(reply.rr, cname)
+		name = dns.CanonicalName(cname.Target)
+		if !dns.IsSubDomain(z.origin, name) {
+			reply.target = cname.Target
+			break
+		}
+	}
+	if len(reply.rr) == 0 && z.soa != nil {
+		reply.ns = []dns.RR{z.soa}
+	}
+	return reply
+}
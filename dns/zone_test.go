@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `
+$TTL 3600
+@         IN SOA   ns1 hostmaster 1 7200 3600 1209600 3600
+@         IN MX    10 mail
+@         IN TXT   "v=spf1 mx -all"
+mail      IN A     192.0.2.25
+www       IN CNAME mail
+ext       IN CNAME example.com.
+a.b       IN A     192.0.2.1
+`
+
+func TestZone(t *testing.T) {
+	z, err := ParseZone(strings.NewReader(testZone), "example.internal.", "test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := z.Len(), 7; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	soa := "example.internal.\t3600\tIN\tSOA\tns1.example.internal. hostmaster.example.internal. 1 7200 3600 1209600 3600"
+	var tests = []struct {
+		qtype  uint16
+		name   string
+		out    string
+		ns     string
+		rcode  int
+		target string
+	}{
+		{dns.TypeMX, "example.internal.", "example.internal.\t3600\tIN\tMX\t10 mail.example.internal.", "", dns.RcodeSuccess, ""},
+		{dns.TypeTXT, "Example.Internal.", "example.internal.\t3600\tIN\tTXT\t\"v=spf1 mx -all\"", "", dns.RcodeSuccess, ""},
+		{dns.TypeA, "www.example.internal.", "www.example.internal.\t3600\tIN\tCNAME\tmail.example.internal.\nmail.example.internal.\t3600\tIN\tA\t192.0.2.25", "", dns.RcodeSuccess, ""},
+		{dns.TypeA, "ext.example.internal.", "ext.example.internal.\t3600\tIN\tCNAME\texample.com.", "", dns.RcodeSuccess, "example.com."},
+		{dns.TypeAAAA, "mail.example.internal.", "", soa, dns.RcodeSuccess, ""}, // No records of this type
+		{dns.TypeA, "b.example.internal.", "", soa, dns.RcodeSuccess, ""},       // Empty non-terminal
+		{dns.TypeA, "foo.example.internal.", "", soa, dns.RcodeNameError, ""},   // Name does not exist
+	}
+	for i, tt := range tests {
+		reply := z.Reply(&Request{Type: tt.qtype, Name: tt.name})
+		if reply == nil {
+			t.Fatalf("#%d: Reply(%q) = nil", i, tt.name)
+		}
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: Reply(%q) = %q, want %q", i, tt.name, got, tt.out)
+		}
+		ns := ""
+		if len(reply.ns) > 0 {
+			ns = reply.ns[0].String()
+		}
+		if ns != tt.ns {
+			t.Errorf("#%d: Reply(%q).ns = %q, want %q", i, tt.name, ns, tt.ns)
+		}
+		if reply.rcode != tt.rcode {
+			t.Errorf("#%d: Reply(%q).rcode = %s, want %s", i, tt.name, dns.RcodeToString[reply.rcode], dns.RcodeToString[tt.rcode])
+		}
+		if reply.target != tt.target {
+			t.Errorf("#%d: Reply(%q).target = %q, want %q", i, tt.name, reply.target, tt.target)
+		}
+		if !reply.authoritative {
+			t.Errorf("#%d: Reply(%q) is not authoritative", i, tt.name)
+		}
+	}
+	if reply := z.Reply(&Request{Type: dns.TypeA, Name: "example.com."}); reply != nil {
+		t.Errorf("Reply(%q) = %q, want nil", "example.com.", reply.String())
+	}
+}
+
+func TestParseZoneError(t *testing.T) {
+	if _, err := ParseZone(strings.NewReader("@ IN MX foo"), "example.internal.", "test.zone"); err == nil {
+		t.Error("expected error")
+	}
+}
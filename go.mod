@@ -9,6 +9,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/miekg/dns v1.1.51
 	github.com/prometheus/client_golang v1.14.0
+	golang.org/x/net v0.23.0
 	honnef.co/go/tools v0.4.2
 )
 
@@ -22,8 +23,8 @@ require (
 	github.com/prometheus/procfs v0.8.0 // indirect
 	golang.org/x/exp/typeparams v0.0.0-20221208152030-732eee02a75a // indirect
 	golang.org/x/mod v0.8.0 // indirect
-	golang.org/x/net v0.23.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/tools v0.6.0 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
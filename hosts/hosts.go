@@ -5,7 +5,14 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
 )
 
 // LocalNames represent host names that are considered local.
@@ -24,6 +31,10 @@ var LocalNames = []string{
 	"0.0.0.0",
 }
 
+// MaxPatterns is the maximum number of regular expressions that can be parsed from a single source. Every pattern is
+// evaluated against names not found in hosts, which makes a large number of patterns expensive.
+const MaxPatterns = 1000
+
 // DefaultParser is the default parser
 var DefaultParser = &Parser{IgnoredHosts: LocalNames}
 
@@ -33,17 +44,63 @@ type Parser struct {
 }
 
 // Hosts represents a hosts file.
-type Hosts map[string][]net.IPAddr
+type Hosts map[string]Host
+
+// SourceStatus is the status of a source of hosts, such as a hosts file.
+type SourceStatus struct {
+	// Source is the URL of the source, or "inline hosts" for hosts configured inline.
+	Source string
+	// Count is the number of hosts and regular expressions loaded from the source.
+	Count int
+	// LastLoaded is the time the source was last loaded successfully.
+	LastLoaded time.Time
+	// LastError is the time the source last failed to load.
+	LastError time.Time
+}
+
+// Host represents the entries of a host name. A host name is either mapped to IP addresses or aliased to another name.
+type Host struct {
+	IPAddrs []net.IPAddr
+	// Target is the canonical name of an alias. It is empty unless the host name is mapped to another name.
+	Target string
+	// TTL is the TTL of answers for the host name. Zero means that the default TTL is used.
+	TTL time.Duration
+}
 
 // Parse uses DefaultParser to parse hosts from reader r.
 func Parse(r io.Reader) (Hosts, error) {
 	return DefaultParser.Parse(r)
 }
 
-// Get returns the IP addresses of name.
-func (h Hosts) Get(name string) ([]net.IPAddr, bool) {
-	ipAddrs, ok := h[name]
-	return ipAddrs, ok
+// ParseDomains uses DefaultParser to parse a list of host names from reader r.
+func ParseDomains(r io.Reader) (Hosts, error) {
+	return DefaultParser.ParseDomains(r)
+}
+
+// ParsePatterns uses DefaultParser to parse a list of regular expressions from reader r.
+func ParsePatterns(r io.Reader) (Patterns, error) {
+	return DefaultParser.ParsePatterns(r)
+}
+
+// Normalize converts an internationalized domain name to its ASCII form, as it appears in DNS queries. Names that are
+// already ASCII, or that are not valid internationalized names, are returned unchanged.
+func Normalize(name string) string {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			ascii, err := idna.Lookup.ToASCII(name)
+			if err != nil {
+				return name
+			}
+			return ascii
+		}
+	}
+	return name
+}
+
+// Get returns the entries of name.
+func (h Hosts) Get(name string) (Host, bool) {
+	host, ok := h[name]
+	return host, ok
 }
 
 // Del deletes the hosts entry of name.
@@ -51,6 +108,47 @@ func (h Hosts) Del(name string) {
 	delete(h, name)
 }
 
+// Reverse represents a reverse index of hosts, mapping IP addresses to host names.
+type Reverse map[string][]string
+
+// Reverse returns the reverse index of hosts h. Unspecified addresses, such as 0.0.0.0, are not indexed as they're
+// commonly used for blocking a large number of names.
+func (h Hosts) Reverse() Reverse {
+	r := make(Reverse)
+	for name, host := range h {
+		for _, ipAddr := range host.IPAddrs {
+			if ipAddr.IP.IsUnspecified() {
+				continue
+			}
+			ip := ipAddr.IP.String()
+			r[ip] = append(r[ip], name)
+		}
+	}
+	for _, names := range r {
+		sort.Strings(names)
+	}
+	return r
+}
+
+// Patterns represents a list of regular expressions matching host names.
+type Patterns []*regexp.Regexp
+
+// Match returns whether name matches any of the patterns in p.
+func (p Patterns) Match(name string) bool {
+	for _, re := range p {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the host names of IP address ip.
+func (r Reverse) Get(ip net.IP) ([]string, bool) {
+	names, ok := r[ip.String()]
+	return names, ok
+}
+
 func (p *Parser) ignore(name string) bool {
 	for _, ignored := range p.IgnoredHosts {
 		if ignored == name {
@@ -60,9 +158,51 @@ func (p *Parser) ignore(name string) bool {
 	return false
 }
 
+// parseIPAddr parses s as an IP address with an optional zone. Unlike net.ResolveIPAddr, host names are never looked up.
+func parseIPAddr(s string) (net.IPAddr, bool) {
+	addr, zone, _ := strings.Cut(s, "%")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return net.IPAddr{}, false
+	}
+	return net.IPAddr{IP: ip, Zone: zone}, true
+}
+
+// isName returns whether s is a syntactically valid host name. At least one letter is required so that a malformed IP
+// address is not mistaken for a name.
+func isName(s string) bool {
+	letter := false
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letter = true
+		case c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return letter && !strings.HasPrefix(s, ".") && !strings.Contains(s, "..")
+}
+
+// parseTTL parses the TTL field of a hosts line, such as ttl=60, where the TTL is given in seconds. It returns false if
+// field is not a TTL field.
+func parseTTL(field string) (time.Duration, bool, error) {
+	if !strings.HasPrefix(field, "ttl=") {
+		return 0, false, nil
+	}
+	ttl, err := strconv.ParseUint(strings.TrimPrefix(field, "ttl="), 10, 32)
+	if err != nil {
+		return 0, true, fmt.Errorf("invalid ttl: %s", field)
+	}
+	return time.Duration(ttl) * time.Second, true, nil
+}
+
 // Parse parses hosts from reader r.
+//
+// The first field of each line is either an IP address or a host name. If it's a host name, the remaining names on
+// the line become aliases of that name. A field of the form ttl=N sets the TTL of the names on the line to N seconds.
 func (p *Parser) Parse(r io.Reader) (Hosts, error) {
-	entries := make(map[string][]net.IPAddr)
+	entries := make(Hosts)
 	scanner := bufio.NewScanner(r)
 	n := 0
 	for scanner.Scan() {
@@ -76,19 +216,100 @@ func (p *Parser) Parse(r io.Reader) (Hosts, error) {
 		if strings.HasPrefix(ip, "#") {
 			continue
 		}
-		ipAddr, err := net.ResolveIPAddr("", ip)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: invalid ip address: %s - %s", n, fields[0], line)
+		ipAddr, ok := parseIPAddr(ip)
+		target := ""
+		if !ok {
+			ip = Normalize(ip)
+			if !isName(ip) {
+				return nil, fmt.Errorf("line %d: invalid ip address or name: %s - %s", n, fields[0], line)
+			}
+			target = ip
 		}
+		names := make([]string, 0, len(fields)-1)
+		var ttl time.Duration
 		for _, name := range fields[1:] {
 			if strings.HasPrefix(name, "#") {
 				break
 			}
+			t, ok, err := parseTTL(name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w - %s", n, err, line)
+			}
+			if ok {
+				ttl = t
+				continue
+			}
+			names = append(names, name)
+		}
+		for _, name := range names {
+			name = Normalize(name)
 			if p.ignore(name) {
 				continue
 			}
-			entries[name] = append(entries[name], *ipAddr)
+			host := entries[name]
+			if ttl > 0 {
+				host.TTL = ttl
+			}
+			if target == "" {
+				host.IPAddrs = append(host.IPAddrs, ipAddr)
+			} else {
+				host.Target = target
+			}
+			entries[name] = host
 		}
 	}
 	return entries, nil
 }
+
+// ParseDomains parses a list of host names from reader r, containing one name per line. Each name is mapped to the
+// unspecified IPv4 and IPv6 addresses, as if it were blocked in a hosts file. A name may be a wildcard, such as
+// *.example.com, which is only matched by allowed hosts.
+func (p *Parser) ParseDomains(r io.Reader) (Hosts, error) {
+	entries := make(Hosts)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 1 && !strings.HasPrefix(fields[1], "#") {
+			return nil, fmt.Errorf("line %d: expected a single name: %s", n, line)
+		}
+		name := Normalize(fields[0])
+		if !isName(strings.TrimPrefix(name, "*.")) {
+			return nil, fmt.Errorf("line %d: invalid name: %s - %s", n, name, line)
+		}
+		if p.ignore(name) {
+			continue
+		}
+		entries[name] = Host{IPAddrs: []net.IPAddr{{IP: net.IPv4zero}, {IP: net.IPv6zero}}}
+	}
+	return entries, nil
+}
+
+// ParsePatterns parses a list of regular expressions from reader r, containing one expression per line. Lines starting
+// with # are ignored.
+func (p *Parser) ParsePatterns(r io.Reader) (Patterns, error) {
+	var patterns Patterns
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(patterns) == MaxPatterns {
+			return nil, fmt.Errorf("line %d: too many regular expressions: limit is %d", n, MaxPatterns)
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid regular expression: %w", n, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
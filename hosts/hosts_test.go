@@ -1,9 +1,11 @@
 package hosts
 
 import (
+	"net"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 type test struct {
@@ -18,9 +20,9 @@ func testParser(p *Parser, hosts string, tests []test, t *testing.T) {
 		t.Fatal(err)
 	}
 	for i, tt := range tests {
-		ipAddrs, ok := h.Get(tt.in)
+		host, ok := h.Get(tt.in)
 		var got []string
-		for _, ipAddr := range ipAddrs {
+		for _, ipAddr := range host.IPAddrs {
 			got = append(got, ipAddr.String())
 		}
 		if ok != tt.ok || !reflect.DeepEqual(got, tt.out) {
@@ -98,3 +100,218 @@ ff02::3         ip6-allhosts
 	}
 	testParser(&Parser{}, in, tests2, t)
 }
+
+func TestReverse(t *testing.T) {
+	in := `
+192.0.2.1         host1 host2
+2001:db8::1       host1
+0.0.0.0           badhost1
+`
+	h, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := h.Reverse()
+	var tests = []struct {
+		in  string
+		out []string
+		ok  bool
+	}{
+		{"192.0.2.1", []string{"host1", "host2"}, true},
+		{"2001:db8::1", []string{"host1"}, true},
+		{"2001:0db8:0:0:0:0:0:1", []string{"host1"}, true},
+		{"0.0.0.0", nil, false},
+		{"192.0.2.2", nil, false},
+	}
+	for i, tt := range tests {
+		names, ok := r.Get(net.ParseIP(tt.in))
+		if ok != tt.ok || !reflect.DeepEqual(names, tt.out) {
+			t.Errorf("#%d: Get(%q) = (%v, %t), want (%v, %t)", i, tt.in, names, ok, tt.out, tt.ok)
+		}
+	}
+}
+
+func TestParseAlias(t *testing.T) {
+	in := `
+192.0.2.1         host1
+host1             alias1 alias2
+alias1.example    alias3 # comment
+`
+	h, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in     string
+		target string
+		ok     bool
+	}{
+		{"host1", "", true},
+		{"alias1", "host1", true},
+		{"alias2", "host1", true},
+		{"alias3", "alias1.example", true},
+		{"nonexistent", "", false},
+	}
+	for i, tt := range tests {
+		host, ok := h.Get(tt.in)
+		if ok != tt.ok || host.Target != tt.target {
+			t.Errorf("#%d: Get(%q) = (%+v, %t), want target %q", i, tt.in, host, ok, tt.target)
+		}
+	}
+
+	for i, in := range []string{"192.0.2 host1", "192.0.2.256 host1", "host..example host1", "host/1 host2"} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("#%d: expected error for %q", i, in)
+		}
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	in := `
+192.0.2.1         host1 host2 ttl=60
+2001:db8::1       host1
+192.0.2.2         host3 # ttl=60
+host1             alias1 ttl=86400
+`
+	h, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in  string
+		ttl time.Duration
+	}{
+		{"host1", time.Minute},
+		{"host2", time.Minute},
+		{"host3", 0},
+		{"alias1", 24 * time.Hour},
+	}
+	for i, tt := range tests {
+		host, ok := h.Get(tt.in)
+		if !ok || host.TTL != tt.ttl {
+			t.Errorf("#%d: Get(%q) = (%+v, %t), want TTL %s", i, tt.in, host, ok, tt.ttl)
+		}
+	}
+	if _, ok := h.Get("ttl=60"); ok {
+		t.Error("want ttl field to not be parsed as a name")
+	}
+
+	for i, in := range []string{"192.0.2.1 host1 ttl=foo", "192.0.2.1 host1 ttl=-1", "192.0.2.1 host1 ttl="} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("#%d: expected error for %q", i, in)
+		}
+	}
+}
+
+func TestParseDomains(t *testing.T) {
+	in := `
+# comment
+example.com
+ads.example.com # comment
+localhost
+
+  tracker.example.net
+*.example.org
+`
+	h, err := ParseDomains(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []test{
+		{"example.com", []string{"0.0.0.0", "::"}, true},
+		{"ads.example.com", []string{"0.0.0.0", "::"}, true},
+		{"tracker.example.net", []string{"0.0.0.0", "::"}, true},
+		{"*.example.org", []string{"0.0.0.0", "::"}, true},
+		{"localhost", nil, false},
+		{"#", nil, false},
+		{"comment", nil, false},
+	}
+	for i, tt := range tests {
+		host, ok := h.Get(tt.in)
+		var got []string
+		for _, ipAddr := range host.IPAddrs {
+			got = append(got, ipAddr.String())
+		}
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.out) {
+			t.Errorf("#%d: Get(%q) = (%v, %t), want (%v, %t)", i, tt.in, got, ok, tt.out, tt.ok)
+		}
+	}
+
+	for _, in := range []string{"0.0.0.0 example.com", "example.com/foo"} {
+		if _, err := ParseDomains(strings.NewReader(in)); err == nil {
+			t.Errorf("ParseDomains(%q): expected error", in)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	var tests = []struct {
+		in, out string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "Example.COM"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example", "xn--bcher-kva.example"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"ü-.example", "ü-.example"}, // Invalid
+	}
+	for i, tt := range tests {
+		if got := Normalize(tt.in); got != tt.out {
+			t.Errorf("#%d: Normalize(%q) = %q, want %q", i, tt.in, got, tt.out)
+		}
+	}
+
+	// Unicode and punycode entries are equivalent
+	h, err := Parse(strings.NewReader("192.0.2.1 bücher.example\n192.0.2.2 xn--bcher-kva.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, ok := h.Get("xn--bcher-kva.example")
+	if !ok || len(host.IPAddrs) != 2 {
+		t.Errorf("Get(%q) = (%+v, %t), want two addresses", "xn--bcher-kva.example", host, ok)
+	}
+	d, err := ParseDomains(strings.NewReader("bücher.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Get("xn--bcher-kva.example"); !ok {
+		t.Errorf("Get(%q) = (_, %t), want (_, %t)", "xn--bcher-kva.example", ok, true)
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	in := `
+# comment
+^ad[sx]?[0-9]*\.
+  \.tracker\.example\.com$
+`
+	patterns, err := ParsePatterns(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in    string
+		match bool
+	}{
+		{"ads.example.com", true},
+		{"adx1.example.com", true},
+		{"ad42.example.net", true},
+		{"foo.tracker.example.com", true},
+		{"tracker.example.com", false},
+		{"bad.example.com", false},
+		{"example.com", false},
+	}
+	for i, tt := range tests {
+		if got := patterns.Match(tt.in); got != tt.match {
+			t.Errorf("#%d: Match(%q) = %t, want %t", i, tt.in, got, tt.match)
+		}
+	}
+
+	if _, err := ParsePatterns(strings.NewReader("^ad[")); err == nil {
+		t.Error("expected error for invalid regular expression")
+	}
+	tooMany := strings.Repeat("^foo\n", MaxPatterns+1)
+	if _, err := ParsePatterns(strings.NewReader(tooMany)); err == nil {
+		t.Error("expected error for too many regular expressions")
+	}
+}
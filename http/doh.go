@@ -0,0 +1,99 @@
+package http
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
+)
+
+const (
+	dohPath      = "/dns-query"
+	dohMediaType = "application/dns-message"
+	// dohLegacyMediaType is the media type used by older drafts of RFC 8484, and by the DNS-over-HTTPS client in
+	// this module.
+	dohLegacyMediaType = "application/dns-udpwireformat"
+	// dohMaxMsgSize is the maximum size of a DNS message.
+	dohMaxMsgSize = 65535
+)
+
+// dohResponseWriter is a dns.ResponseWriter that captures the reply written by a dns.Handler, allowing DNS requests
+// to be served outside of a network listener.
+type dohResponseWriter struct {
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr         { return &net.TCPAddr{} }
+func (w *dohResponseWriter) RemoteAddr() net.Addr        { return w.remoteAddr }
+func (w *dohResponseWriter) Write(b []byte) (int, error) { return 0, fmt.Errorf("unsupported") }
+func (w *dohResponseWriter) Close() error                { return nil }
+func (w *dohResponseWriter) TsigStatus() error           { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(b bool)       {}
+func (w *dohResponseWriter) Hijack()                     {}
+func (w *dohResponseWriter) WriteMsg(msg *dns.Msg) error { w.msg = msg; return nil }
+
+func remoteTCPAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+func dohRequest(r *http.Request) ([]byte, error) {
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, fmt.Errorf("missing parameter: dns")
+		}
+		b, err := base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for parameter dns: %s", param)
+		}
+		return b, nil
+	case http.MethodPost:
+		if contentType := r.Header.Get("Content-Type"); contentType != dohMediaType && contentType != dohLegacyMediaType {
+			return nil, fmt.Errorf("invalid content type: %s", contentType)
+		}
+		return ioutil.ReadAll(io.LimitReader(r.Body, dohMaxMsgSize))
+	}
+	return nil, fmt.Errorf("invalid method: %s", r.Method)
+}
+
+func (s *Server) dohHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	b, err := dohRequest(r)
+	if err != nil {
+		return newHTTPBadRequest(err)
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(b); err != nil {
+		return newHTTPBadRequest(fmt.Errorf("invalid dns message: %w", err))
+	}
+	if msg.Response || msg.Opcode != dns.OpcodeQuery || len(msg.Question) != 1 {
+		return newHTTPBadRequest(fmt.Errorf("invalid dns message: query must have exactly one question"))
+	}
+	dw := &dohResponseWriter{remoteAddr: remoteTCPAddr(r)}
+	s.config.DNSHandler.ServeDNS(dw, msg)
+	if dw.msg == nil {
+		return newHTTPError(fmt.Errorf("no reply for dns message"))
+	}
+	reply, err := dw.msg.Pack()
+	if err != nil {
+		return newHTTPError(err)
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	if len(dw.msg.Answer) > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(dnsutil.MinTTL(dw.msg).Seconds())))
+	}
+	w.Write(reply)
+	return nil
+}
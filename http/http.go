@@ -2,24 +2,58 @@ package http
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	_ "net/http/pprof" // Registers debug handlers as a side effect.
+	"net/http/pprof"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/mpolden/zdns/cache"
 	"github.com/mpolden/zdns/dns/dnsutil"
+	"github.com/mpolden/zdns/hosts"
 	"github.com/mpolden/zdns/sql"
 )
 
 const (
 	jsonMediaType = "application/json"
+	csvMediaType  = "text/csv; charset=utf-8"
 )
 
+// Config is a structure used to configure an HTTP server.
+type Config struct {
+	// Token is the bearer token required to access the API. Authentication is disabled if empty.
+	Token string
+	// DNSHandler serves DNS-over-HTTPS requests. The DNS-over-HTTPS endpoint is disabled if nil.
+	DNSHandler dns.Handler
+	// TypeCounter provides request metrics per query type. These metrics are omitted if nil.
+	TypeCounter *dnsutil.TypeCounter
+	// Latency provides latency metrics of the upstream resolver. These metrics are omitted if nil.
+	Latency *dnsutil.LatencyReservoir
+	// Resolver is the client querying the upstream resolvers, whose status is reported by the resolver endpoint. The
+	// resolver endpoint is disabled if nil.
+	Resolver dnsutil.Client
+	// Pprof controls whether the profiling endpoints of net/http/pprof are served below /debug/pprof/.
+	Pprof bool
+	// Ready reports whether the DNS server is ready to answer queries. The server is always considered ready if nil.
+	Ready func() bool
+	// Hosts provides the status of each source of hosts. These metrics are omitted if nil.
+	Hosts func() []hosts.SourceStatus
+	// Version is the version of zdns reported by the metrics endpoint. The version is omitted if empty.
+	Version string
+	// Settings returns the effective configuration of zdns, which is served by the config endpoint. Sensitive values
+	// should be redacted by the caller. The config endpoint is disabled if nil.
+	Settings func() interface{}
+}
+
 // A Server defines parameters for running an HTTP server. The HTTP server serves an API for inspecting cache contents
 // and request log.
 type Server struct {
@@ -27,27 +61,77 @@ type Server struct {
 	logger   *sql.Logger
 	sqlCache *sql.Cache
 	server   *http.Server
+	config   Config
+	memStats *memStats
 }
 
 type entry struct {
-	Time       string   `json:"time"`
-	TTL        int64    `json:"ttl,omitempty"`
-	RemoteAddr net.IP   `json:"remote_addr,omitempty"`
-	Hijacked   *bool    `json:"hijacked,omitempty"`
-	Qtype      string   `json:"type"`
-	Question   string   `json:"question"`
-	Answers    []string `json:"answers,omitempty"`
-	Rcode      string   `json:"rcode,omitempty"`
+	Time            string   `json:"time"`
+	TTL             int64    `json:"ttl,omitempty"`
+	RemoteAddr      net.IP   `json:"remote_addr,omitempty"`
+	Hijacked        *bool    `json:"hijacked,omitempty"`
+	Qtype           string   `json:"type"`
+	Question        string   `json:"question"`
+	Answers         []string `json:"answers,omitempty"`
+	Rcode           string   `json:"rcode,omitempty"`
+	ClientUDPSize   uint16   `json:"client_udp_size,omitempty"`
+	UpstreamUDPSize uint16   `json:"upstream_udp_size,omitempty"`
+	Resolver        string   `json:"resolver,omitempty"`
+	Hits            uint64   `json:"hits,omitempty"`
+	Stale           *bool    `json:"is_stale,omitempty"`
+	RemainingTTL    *int64   `json:"remaining_ttl,omitempty"`
+}
+
+type resolverStatus struct {
+	Address     string `json:"address"`
+	Protocol    string `json:"protocol"`
+	State       string `json:"state,omitempty"`
+	Failures    int    `json:"failures,omitempty"`
+	LastSuccess string `json:"last_success,omitempty"`
+}
+
+type questionCount struct {
+	Question string `json:"question"`
+	Count    int64  `json:"count"`
 }
 
 type stats struct {
-	Summary  summary   `json:"summary"`
-	Requests []request `json:"requests"`
+	Summary  summary      `json:"summary"`
+	Requests []request    `json:"requests"`
+	ByType   []typeStats  `json:"by_type,omitempty"`
+	Hosts    []hostsStats `json:"hosts,omitempty"`
+}
+
+type hostsStats struct {
+	Source     string `json:"source"`
+	Count      int    `json:"count"`
+	LastLoaded string `json:"last_loaded,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+type typeStats struct {
+	Type     string         `json:"type"`
+	Requests uint64         `json:"requests"`
+	Answers  []answerBucket `json:"answers"`
+}
+
+type answerBucket struct {
+	UpperBound int    `json:"le"`
+	Count      uint64 `json:"count"`
 }
 
 type summary struct {
-	Log   logStats   `json:"log"`
-	Cache cacheStats `json:"cache"`
+	Log      logStats       `json:"log"`
+	Cache    cacheStats     `json:"cache"`
+	Runtime  runtimeStats   `json:"runtime"`
+	Upstream *upstreamStats `json:"upstream,omitempty"`
+}
+
+type upstreamStats struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"latency_p50_ms"`
+	P95     float64 `json:"latency_p95_ms"`
+	P99     float64 `json:"latency_p99_ms"`
 }
 
 type request struct {
@@ -60,23 +144,59 @@ type logStats struct {
 	Total        int64  `json:"total"`
 	Hijacked     int64  `json:"hijacked"`
 	PendingTasks int    `json:"pending_tasks"`
+	DBBytes      int64  `json:"db_bytes"`
+	Oldest       string `json:"oldest,omitempty"`
+	Newest       string `json:"newest,omitempty"`
 }
 
 type cacheStats struct {
-	Size         int           `json:"size"`
-	Capacity     int           `json:"capacity"`
-	PendingTasks int           `json:"pending_tasks"`
-	BackendStats *backendStats `json:"backend,omitempty"`
+	Size                int           `json:"size"`
+	Capacity            int           `json:"capacity"`
+	NegativeSize        int           `json:"negative_size,omitempty"`
+	NegativeCapacity    int           `json:"negative_capacity,omitempty"`
+	RecommendedCapacity int           `json:"recommended_capacity,omitempty"`
+	PendingTasks        int           `json:"pending_tasks"`
+	BackendStats        *backendStats `json:"backend,omitempty"`
 }
 
 type backendStats struct {
-	PendingTasks int `json:"pending_tasks"`
+	PendingTasks  int    `json:"pending_tasks"`
+	DroppedWrites uint64 `json:"dropped_writes"`
+}
+
+type runtimeStats struct {
+	Version    string `json:"version,omitempty"`
+	GoVersion  string `json:"go_version"`
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc"`
+}
+
+// memStats samples runtime.MemStats at most once per interval, as reading them stops the world.
+type memStats struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	sampledAt time.Time
+	heapAlloc uint64
+}
+
+func (m *memStats) HeapAlloc() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.sampledAt.IsZero() || now.Sub(m.sampledAt) >= m.interval {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		m.heapAlloc = ms.HeapAlloc
+		m.sampledAt = now
+	}
+	return m.heapAlloc
 }
 
 type httpError struct {
-	err     error
-	Status  int    `json:"status"`
-	Message string `json:"message"`
+	err       error
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
 func newHTTPError(err error) *httpError {
@@ -94,13 +214,15 @@ func newHTTPBadRequest(err error) *httpError {
 }
 
 // NewServer creates a new HTTP server, serving logs from the given logger and listening on addr.
-func NewServer(cache *cache.Cache, logger *sql.Logger, sqlCache *sql.Cache, addr string) *Server {
+func NewServer(cache *cache.Cache, logger *sql.Logger, sqlCache *sql.Cache, addr string, config Config) *Server {
 	server := &http.Server{Addr: addr}
 	s := &Server{
 		server:   server,
 		cache:    cache,
 		logger:   logger,
 		sqlCache: sqlCache,
+		config:   config,
+		memStats: &memStats{interval: 10 * time.Second},
 	}
 	s.server.Handler = s.handler()
 	return s
@@ -108,13 +230,62 @@ func NewServer(cache *cache.Cache, logger *sql.Logger, sqlCache *sql.Cache, addr
 
 func (s *Server) handler() http.Handler {
 	r := &router{}
+	r.route(http.MethodGet, "/health/v1/", s.healthHandler)
+	r.route(http.MethodGet, "/ready/v1/", s.readyHandler)
 	r.route(http.MethodGet, "/cache/v1/", s.cacheHandler)
+	r.route(http.MethodGet, "/cache/v1/lookup", s.cacheLookupHandler)
 	r.route(http.MethodDelete, "/cache/v1/", s.cacheResetHandler)
 	if s.logger != nil {
 		r.route(http.MethodGet, "/log/v1/", s.logHandler)
+		r.route(http.MethodGet, "/client/v1/", s.clientHandler)
 		r.route(http.MethodGet, "/metric/v1/", s.metricHandler)
 	}
-	return r.handler()
+	if s.config.Resolver != nil {
+		r.route(http.MethodGet, "/resolver/v1/", s.resolverHandler)
+	}
+	if s.config.Settings != nil {
+		r.route(http.MethodGet, "/config/v1/", s.configHandler)
+	}
+	if s.config.DNSHandler != nil {
+		r.route(http.MethodGet, dohPath, s.dohHandler)
+		r.route(http.MethodPost, dohPath, s.dohHandler)
+	}
+	if s.config.Pprof {
+		r.route(http.MethodGet, "/debug/pprof/cmdline", handlerFunc(pprof.Cmdline))
+		r.route(http.MethodGet, "/debug/pprof/profile", handlerFunc(pprof.Profile))
+		r.route(http.MethodGet, "/debug/pprof/symbol", handlerFunc(pprof.Symbol))
+		r.route(http.MethodGet, "/debug/pprof/trace", handlerFunc(pprof.Trace))
+		// The index also serves named profiles, such as /debug/pprof/heap
+		r.routePrefix(http.MethodGet, "/debug/pprof/", handlerFunc(pprof.Index))
+	}
+	h := r.handler()
+	if s.config.Token != "" {
+		h = s.authHandler(h)
+	}
+	return gzipHandler(requestIDHandler(h))
+}
+
+func (s *Server) authHandler(h http.Handler) http.Handler {
+	return appHandler(func(w http.ResponseWriter, r *http.Request) *httpError {
+		switch r.URL.Path {
+		case dohPath, "/health/v1/", "/ready/v1/":
+			// DNS-over-HTTPS clients and health checks cannot be expected to send credentials
+			h.ServeHTTP(w, r)
+			return nil
+		}
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+			writeJSONHeader(w)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return &httpError{
+				Status:  http.StatusUnauthorized,
+				Message: "Unauthorized",
+			}
+		}
+		h.ServeHTTP(w, r)
+		return nil
+	})
 }
 
 func countFrom(r *http.Request) (int, error) {
@@ -129,6 +300,55 @@ func countFrom(r *http.Request) (int, error) {
 	return n, nil
 }
 
+// timeRangeFrom returns the time range given by the from and to parameters of r. A missing parameter is returned as the
+// zero time.
+func timeRangeFrom(r *http.Request) (time.Time, time.Time, error) {
+	var times [2]time.Time
+	for i, name := range []string{"from", "to"} {
+		param := r.URL.Query().Get(name)
+		if param == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid value for parameter %s: %s", name, param)
+		}
+		times[i] = t
+	}
+	from, to := times[0], times[1]
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("parameter from must not be after to")
+	}
+	return from, to, nil
+}
+
+// cacheFilterFrom returns a function that reports whether a cache value matches the type and rcode parameters of r. The
+// function is nil if neither parameter is set.
+func cacheFilterFrom(r *http.Request) (func(*cache.Value) bool, error) {
+	var qtype uint16
+	if param := r.URL.Query().Get("type"); param != "" {
+		t, ok := dns.StringToType[strings.ToUpper(param)]
+		if !ok {
+			return nil, fmt.Errorf("invalid value for parameter type: %s", param)
+		}
+		qtype = t
+	}
+	rcode := -1
+	if param := r.URL.Query().Get("rcode"); param != "" {
+		rc, ok := dns.StringToRcode[strings.ToUpper(param)]
+		if !ok {
+			return nil, fmt.Errorf("invalid value for parameter rcode: %s", param)
+		}
+		rcode = rc
+	}
+	if qtype == 0 && rcode == -1 {
+		return nil, nil
+	}
+	return func(v *cache.Value) bool {
+		return (qtype == 0 || v.Qtype() == qtype) && (rcode == -1 || v.Rcode() == rcode)
+	}, nil
+}
+
 func resolutionFrom(r *http.Request) (time.Duration, error) {
 	param := r.URL.Query().Get("resolution")
 	if param == "" {
@@ -154,23 +374,130 @@ func (s *Server) cacheHandler(w http.ResponseWriter, r *http.Request) *httpError
 		writeJSONHeader(w)
 		return newHTTPBadRequest(err)
 	}
-	cacheValues := s.cache.List(count)
+	match, err := cacheFilterFrom(r)
+	if err != nil {
+		writeJSONHeader(w)
+		return newHTTPBadRequest(err)
+	}
+	n := count
+	if match != nil {
+		stats := s.cache.Stats()
+		n = stats.Size + stats.NegativeSize // Filter all values so that up to count matching values are returned
+	}
+	cacheValues := s.cache.List(n)
 	entries := make([]entry, 0, len(cacheValues))
+	now := time.Now()
 	for _, v := range cacheValues {
-		entries = append(entries, entry{
-			Time:     v.CreatedAt.UTC().Format(time.RFC3339),
-			TTL:      int64(v.TTL().Truncate(time.Second).Seconds()),
-			Qtype:    dnsutil.TypeToString[v.Qtype()],
-			Question: v.Question(),
-			Answers:  v.Answers(),
-			Rcode:    dnsutil.RcodeToString[v.Rcode()],
-		})
+		if len(entries) == count {
+			break
+		}
+		if match != nil && !match(&v) {
+			continue
+		}
+		entries = append(entries, cacheEntry(&v, now))
 	}
 	writeJSON(w, entries)
 	return nil
 }
 
+func (s *Server) cacheLookupHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	writeJSONHeader(w)
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return newHTTPBadRequest(fmt.Errorf("missing parameter name"))
+	}
+	qtype := dns.TypeA
+	if param := r.URL.Query().Get("type"); param != "" {
+		t, ok := dns.StringToType[strings.ToUpper(param)]
+		if !ok {
+			return newHTTPBadRequest(fmt.Errorf("invalid value for parameter type: %s", param))
+		}
+		qtype = t
+	}
+	v, ok := s.cache.GetValue(cache.NewKey(dns.Fqdn(name), qtype, dns.ClassINET))
+	if !ok {
+		return &httpError{
+			Status:  http.StatusNotFound,
+			Message: fmt.Sprintf("%s %s is not cached", dns.Fqdn(name), dnsutil.TypeToString[qtype]),
+		}
+	}
+	now := time.Now()
+	e := cacheEntry(&v, now)
+	remaining := int64(v.CreatedAt.Add(v.TTL()).Sub(now).Truncate(time.Second).Seconds())
+	if remaining < 0 {
+		remaining = 0
+	}
+	e.RemainingTTL = &remaining
+	writeJSON(w, e)
+	return nil
+}
+
+// cacheEntry converts cache value v to an entry, where staleness is determined at time now.
+func cacheEntry(v *cache.Value, now time.Time) entry {
+	stale := v.Stale(now)
+	return entry{
+		Time:     v.CreatedAt.UTC().Format(time.RFC3339),
+		TTL:      int64(v.TTL().Truncate(time.Second).Seconds()),
+		Qtype:    dnsutil.TypeToString[v.Qtype()],
+		Question: v.Question(),
+		Answers:  v.Answers(),
+		Rcode:    dnsutil.RcodeToString[v.Rcode()],
+		Hits:     v.Hits(),
+		Stale:    &stale,
+	}
+}
+
+func (s *Server) resolverHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	statuses := dnsutil.Statuses(s.config.Resolver)
+	resolvers := make([]resolverStatus, 0, len(statuses))
+	for _, st := range statuses {
+		rs := resolverStatus{
+			Address:  st.Address,
+			Protocol: st.Protocol,
+			State:    st.State,
+			Failures: st.Failures,
+		}
+		if !st.LastSuccess.IsZero() {
+			rs.LastSuccess = st.LastSuccess.UTC().Format(time.RFC3339)
+		}
+		resolvers = append(resolvers, rs)
+	}
+	writeJSON(w, resolvers)
+	return nil
+}
+
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	writeJSON(w, s.config.Settings())
+	return nil
+}
+
+func (s *Server) clientHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	writeJSONHeader(w)
+	param := r.URL.Query().Get("addr")
+	addr := net.ParseIP(param)
+	if addr == nil {
+		return newHTTPBadRequest(fmt.Errorf("invalid value for parameter addr: %s", param))
+	}
+	count, err := countFrom(r)
+	if err != nil {
+		return newHTTPBadRequest(err)
+	}
+	questions, err := s.logger.Questions(addr, count)
+	if err != nil {
+		return newHTTPError(err)
+	}
+	counts := make([]questionCount, 0, len(questions))
+	for _, q := range questions {
+		counts = append(counts, questionCount{Question: q.Question, Count: q.Count})
+	}
+	writeJSON(w, counts)
+	return nil
+}
+
 func (s *Server) cacheResetHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	if _, ok := r.URL.Query()["suffix"]; ok {
+		return s.cacheEvictSuffixHandler(w, r)
+	}
 	s.cache.Reset()
 	writeJSON(w, struct {
 		Message string `json:"message"`
@@ -178,33 +505,93 @@ func (s *Server) cacheResetHandler(w http.ResponseWriter, r *http.Request) *http
 	return nil
 }
 
+func (s *Server) cacheEvictSuffixHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	writeJSONHeader(w)
+	suffix := r.URL.Query().Get("suffix")
+	if _, ok := dns.IsDomainName(suffix); !ok || dns.CountLabel(suffix) == 0 {
+		return newHTTPBadRequest(fmt.Errorf("invalid value for parameter suffix: %s", suffix))
+	}
+	suffix = dns.Fqdn(suffix)
+	n := s.cache.EvictSuffix(suffix)
+	writeJSON(w, struct {
+		Message string `json:"message"`
+		Count   int    `json:"count"`
+	}{fmt.Sprintf("Removed %d cached entries matching %s", n, suffix), n})
+	return nil
+}
+
 func (s *Server) logHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json", "csv":
+	default:
+		writeJSONHeader(w)
+		return newHTTPBadRequest(fmt.Errorf("invalid log format: %s", format))
+	}
 	count, err := countFrom(r)
 	if err != nil {
 		writeJSONHeader(w)
 		return newHTTPBadRequest(err)
 	}
-	logEntries, err := s.logger.Read(count)
+	from, to, err := timeRangeFrom(r)
+	if err != nil {
+		writeJSONHeader(w)
+		return newHTTPBadRequest(err)
+	}
+	logEntries, err := s.logger.ReadBetween(from, to, count)
 	if err != nil {
 		writeJSONHeader(w)
 		return newHTTPError(err)
 	}
+	if format == "csv" {
+		return writeLogCSV(w, logEntries)
+	}
 	entries := make([]entry, 0, len(logEntries))
 	for _, le := range logEntries {
 		hijacked := le.Hijacked
 		entries = append(entries, entry{
-			Time:       le.Time.UTC().Format(time.RFC3339),
-			RemoteAddr: le.RemoteAddr,
-			Hijacked:   &hijacked,
-			Qtype:      dnsutil.TypeToString[le.Qtype],
-			Question:   le.Question,
-			Answers:    le.Answers,
+			Time:            le.Time.UTC().Format(time.RFC3339),
+			TTL:             int64(le.TTL.Truncate(time.Second).Seconds()),
+			RemoteAddr:      le.RemoteAddr,
+			Hijacked:        &hijacked,
+			Qtype:           dnsutil.TypeToString[le.Qtype],
+			Question:        le.Question,
+			Answers:         le.Answers,
+			ClientUDPSize:   le.ClientUDPSize,
+			UpstreamUDPSize: le.UpstreamUDPSize,
+			Resolver:        le.Resolver,
 		})
 	}
 	writeJSON(w, entries)
 	return nil
 }
 
+// writeLogCSV writes log entries as CSV, with a header row. Multiple answers are separated by semicolons.
+func writeLogCSV(w http.ResponseWriter, logEntries []sql.LogEntry) *httpError {
+	w.Header().Set("Content-Type", csvMediaType)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "remote_addr", "hijacked", "type", "question", "answers"})
+	for _, le := range logEntries {
+		remoteAddr := ""
+		if le.RemoteAddr != nil {
+			remoteAddr = le.RemoteAddr.String()
+		}
+		cw.Write([]string{
+			le.Time.UTC().Format(time.RFC3339),
+			remoteAddr,
+			strconv.FormatBool(le.Hijacked),
+			dnsutil.TypeToString[le.Qtype],
+			le.Question,
+			strings.Join(le.Answers, ";"),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("failed to write csv: %s", err)
+	}
+	return nil
+}
+
 func (s *Server) basicMetricHandler(w http.ResponseWriter, r *http.Request) *httpError {
 	resolution, err := resolutionFrom(r)
 	if err != nil {
@@ -226,7 +613,8 @@ func (s *Server) basicMetricHandler(w http.ResponseWriter, r *http.Request) *htt
 	cstats := s.cache.Stats()
 	var bstats *backendStats
 	if s.sqlCache != nil {
-		bstats = &backendStats{PendingTasks: s.sqlCache.Stats().PendingTasks}
+		sqlStats := s.sqlCache.Stats()
+		bstats = &backendStats{PendingTasks: sqlStats.PendingTasks, DroppedWrites: sqlStats.DroppedWrites}
 	}
 	stats := stats{
 		Summary: summary{
@@ -234,20 +622,90 @@ func (s *Server) basicMetricHandler(w http.ResponseWriter, r *http.Request) *htt
 				Since:    lstats.Since.Format(time.RFC3339),
 				Total:    lstats.Total,
 				Hijacked: lstats.Hijacked,
+				DBBytes:  lstats.DatabaseBytes,
 			},
 			Cache: cacheStats{
-				Capacity:     cstats.Capacity,
-				Size:         cstats.Size,
-				PendingTasks: cstats.PendingTasks,
-				BackendStats: bstats,
+				Capacity:            cstats.Capacity,
+				RecommendedCapacity: cstats.RecommendedCapacity,
+				Size:                cstats.Size,
+				NegativeSize:        cstats.NegativeSize,
+				NegativeCapacity:    cstats.NegativeCapacity,
+				PendingTasks:        cstats.PendingTasks,
+				BackendStats:        bstats,
+			},
+			Runtime: runtimeStats{
+				Version:    s.config.Version,
+				GoVersion:  runtime.Version(),
+				Goroutines: runtime.NumGoroutine(),
+				HeapAlloc:  s.memStats.HeapAlloc(),
 			},
 		},
 		Requests: requests,
 	}
+	if !lstats.Oldest.IsZero() {
+		stats.Summary.Log.Oldest = lstats.Oldest.Format(time.RFC3339)
+		stats.Summary.Log.Newest = lstats.Newest.Format(time.RFC3339)
+	}
+	if s.config.Latency != nil {
+		lstats := s.config.Latency.Stats()
+		stats.Summary.Upstream = &upstreamStats{
+			Samples: lstats.Samples,
+			P50:     milliseconds(lstats.P50),
+			P95:     milliseconds(lstats.P95),
+			P99:     milliseconds(lstats.P99),
+		}
+	}
+	if s.config.TypeCounter != nil {
+		for _, ts := range s.config.TypeCounter.Stats() {
+			answers := make([]answerBucket, 0, len(ts.Answers))
+			for _, b := range ts.Answers {
+				answers = append(answers, answerBucket{UpperBound: b.UpperBound, Count: b.Count})
+			}
+			stats.ByType = append(stats.ByType, typeStats{Type: ts.Type, Requests: ts.Requests, Answers: answers})
+		}
+	}
+	if s.config.Hosts != nil {
+		for _, hs := range s.config.Hosts() {
+			stats.Hosts = append(stats.Hosts, hostsStats{
+				Source:     hs.Source,
+				Count:      hs.Count,
+				LastLoaded: formatTime(hs.LastLoaded),
+				LastError:  formatTime(hs.LastError),
+			})
+		}
+	}
 	writeJSON(w, stats)
 	return nil
 }
 
+// formatTime formats t as RFC 3339, or returns the empty string if t is zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func milliseconds(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	writeJSON(w, struct {
+		Status string `json:"status"`
+	}{"ok"})
+	return nil
+}
+
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	if s.config.Ready != nil && !s.config.Ready() {
+		writeJSONHeader(w)
+		return &httpError{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Not ready",
+		}
+	}
+	return s.healthHandler(w, r)
+}
+
 func (s *Server) prometheusMetricHandler(w http.ResponseWriter, r *http.Request) *httpError {
 	lstats, err := s.logger.Stats(time.Minute)
 	if err != nil {
@@ -255,6 +713,18 @@ func (s *Server) prometheusMetricHandler(w http.ResponseWriter, r *http.Request)
 	}
 	totalRequestsGauge.Set(float64(lstats.Total))
 	hijackedRequestsGauge.Set(float64(lstats.Hijacked))
+	cacheCounters.set(s.cache.Stats())
+	goroutinesGauge.Set(float64(runtime.NumGoroutine()))
+	memoryGauge.Set(float64(s.memStats.HeapAlloc()))
+	buildInfoGauge.WithLabelValues(s.config.Version, runtime.Version()).Set(1)
+	if s.config.TypeCounter != nil {
+		for _, ts := range s.config.TypeCounter.Stats() {
+			typeRequestsGauge.WithLabelValues(ts.Type).Set(float64(ts.Requests))
+			for _, b := range ts.Answers {
+				typeAnswersGauge.WithLabelValues(ts.Type, strconv.Itoa(b.UpperBound)).Set(float64(b.Count))
+			}
+		}
+	}
 	prometheusHandler.ServeHTTP(w, r)
 	return nil
 }
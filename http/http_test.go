@@ -1,16 +1,27 @@
 package http
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/mpolden/zdns/cache"
+	"github.com/mpolden/zdns/dns/dnsutil"
+	"github.com/mpolden/zdns/hosts"
 	"github.com/mpolden/zdns/sql"
 )
 
@@ -30,6 +41,10 @@ func newA(name string, ttl uint32, ipAddr ...net.IP) *dns.Msg {
 }
 
 func testServer() (*httptest.Server, *Server) {
+	return testServerWithConfig(Config{})
+}
+
+func testServerWithConfig(config Config) (*httptest.Server, *Server) {
 	sqlClient, err := sql.New(":memory:")
 	if err != nil {
 		panic(err)
@@ -37,7 +52,7 @@ func testServer() (*httptest.Server, *Server) {
 	logger := sql.NewLogger(sqlClient, sql.LogAll, 0)
 	sqlCache := sql.NewCache(sqlClient)
 	cache := cache.New(10, nil)
-	server := NewServer(cache, logger, sqlCache, "")
+	server := NewServer(cache, logger, sqlCache, "", config)
 	return httptest.NewServer(server.handler()), server
 }
 
@@ -78,19 +93,19 @@ func httpDelete(url, body string) (*http.Response, string, error) {
 func TestRequests(t *testing.T) {
 	httpSrv, srv := testServer()
 	defer httpSrv.Close()
-	srv.logger.Record(net.IPv4(127, 0, 0, 42), false, 1, "example.com.", "192.0.2.100", "192.0.2.101")
-	srv.logger.Record(net.IPv4(127, 0, 0, 254), true, 28, "example.com.", "2001:db8::1")
+	srv.logger.Record(net.IPv4(127, 0, 0, 42), false, 1, "example.com.", time.Minute, "192.0.2.100", "192.0.2.101")
+	srv.logger.Record(net.IPv4(127, 0, 0, 254), true, 28, "example.com.", time.Minute, "2001:db8::1")
 	srv.logger.Close() // Flush
 	srv.cache.Set(1, newA("1.example.com.", 60, net.IPv4(192, 0, 2, 200)))
 	srv.cache.Set(2, newA("2.example.com.", 30, net.IPv4(192, 0, 2, 201)))
 
-	cr1 := `[{"time":"RFC3339","ttl":30,"type":"A","question":"2.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR"},` +
-		`{"time":"RFC3339","ttl":60,"type":"A","question":"1.example.com.","answers":["192.0.2.200"],"rcode":"NOERROR"}]`
-	cr2 := `[{"time":"RFC3339","ttl":30,"type":"A","question":"2.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR"}]`
-	lr1 := `[{"time":"RFC3339","remote_addr":"127.0.0.254","hijacked":true,"type":"AAAA","question":"example.com.","answers":["2001:db8::1"]},` +
-		`{"time":"RFC3339","remote_addr":"127.0.0.42","hijacked":false,"type":"A","question":"example.com.","answers":["192.0.2.101","192.0.2.100"]}]`
-	lr2 := `[{"time":"RFC3339","remote_addr":"127.0.0.254","hijacked":true,"type":"AAAA","question":"example.com.","answers":["2001:db8::1"]}]`
-	mr1 := `{"summary":{"log":{"since":"RFC3339","total":2,"hijacked":1,"pending_tasks":0},"cache":{"size":2,"capacity":10,"pending_tasks":0,"backend":{"pending_tasks":0}}},"requests":[{"time":"RFC3339","count":2}]}`
+	cr1 := `[{"time":"RFC3339","ttl":30,"type":"A","question":"2.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR","is_stale":false},` +
+		`{"time":"RFC3339","ttl":60,"type":"A","question":"1.example.com.","answers":["192.0.2.200"],"rcode":"NOERROR","is_stale":false}]`
+	cr2 := `[{"time":"RFC3339","ttl":30,"type":"A","question":"2.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR","is_stale":false}]`
+	lr1 := `[{"time":"RFC3339","ttl":60,"remote_addr":"127.0.0.254","hijacked":true,"type":"AAAA","question":"example.com.","answers":["2001:db8::1"]},` +
+		`{"time":"RFC3339","ttl":60,"remote_addr":"127.0.0.42","hijacked":false,"type":"A","question":"example.com.","answers":["192.0.2.101","192.0.2.100"]}]`
+	lr2 := `[{"time":"RFC3339","ttl":60,"remote_addr":"127.0.0.254","hijacked":true,"type":"AAAA","question":"example.com.","answers":["2001:db8::1"]}]`
+	mr1 := `{"summary":{"log":{"since":"RFC3339","total":2,"hijacked":1,"pending_tasks":0,"db_bytes":NUMBER,"oldest":"RFC3339","newest":"RFC3339"},"cache":{"size":2,"capacity":10,"pending_tasks":0,"backend":{"pending_tasks":0,"dropped_writes":0}},"runtime":{"go_version":"` + runtime.Version() + `","goroutines":NUMBER,"heap_alloc":NUMBER}},"requests":[{"time":"RFC3339","count":2}]}`
 	mr2 := `
 <ANY>
 # HELP zdns_requests_hijacked The number of hijacked DNS requests.
@@ -153,6 +168,7 @@ zdns_requests_total 2
 		want := regexp.QuoteMeta(tt.response)
 		want = strings.ReplaceAll(want, "RFC3339", `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`)
 		want = strings.ReplaceAll(want, "<ANY>", ".*")
+		want = strings.ReplaceAll(want, "NUMBER", `[1-9]\d*`)
 		matched, err := regexp.MatchString(want, got)
 		if err != nil {
 			t.Fatal(err)
@@ -162,3 +178,747 @@ zdns_requests_total 2
 		}
 	}
 }
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	sqlClient, err := sql.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := sql.NewLogger(sqlClient, sql.LogAll, 0)
+	server := NewServer(cache.New(10, nil), logger, sql.NewCache(sqlClient), "", Config{})
+	httpSrv := httptest.NewServer(server.handler())
+	defer httpSrv.Close()
+	sqlClient.Close() // Fail queries
+
+	res, body, err := httpGet(httpSrv.URL + "/client/v1/?addr=192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 500; got != want {
+		t.Fatalf("StatusCode = %d, want %d", got, want)
+	}
+	var e httpError
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.RequestID == "" {
+		t.Fatalf("response %s has no request_id", body)
+	}
+	if got, want := res.Header.Get("X-Request-Id"), e.RequestID; got != want {
+		t.Errorf("X-Request-Id = %q, want %q", got, want)
+	}
+	if got, want := buf.String(), "request "+e.RequestID+": GET /client/v1/ failed: "; !strings.Contains(got, want) {
+		t.Errorf("log = %q, want line containing %q", got, want)
+	}
+
+	// Client errors are not logged
+	buf.Reset()
+	_, body, err = httpGet(httpSrv.URL + "/client/v1/?addr=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body, "request_id") {
+		t.Errorf("response %s has request_id", body)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("log = %q, want empty", buf.String())
+	}
+}
+
+func TestClientQuestions(t *testing.T) {
+	httpSrv, srv := testServer()
+	defer httpSrv.Close()
+	srv.logger.Record(net.IPv4(192, 0, 2, 5), false, 1, "example.com.", time.Minute, "192.0.2.100")
+	srv.logger.Record(net.IPv4(192, 0, 2, 5), false, 28, "example.com.", time.Minute, "2001:db8::1")
+	srv.logger.Record(net.IPv4(192, 0, 2, 5), true, 1, "badhost1.", time.Minute, "0.0.0.0")
+	srv.logger.Record(net.IPv4(192, 0, 2, 6), false, 1, "example.org.", time.Minute, "192.0.2.101")
+	srv.logger.Close() // Flush
+
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/client/v1/?addr=192.0.2.5", `[{"question":"example.com.","count":2},{"question":"badhost1.","count":1}]`, 200},
+		{"/client/v1/?addr=192.0.2.5&n=1", `[{"question":"example.com.","count":2}]`, 200},
+		{"/client/v1/?addr=192.0.2.6", `[{"question":"example.org.","count":1}]`, 200},
+		{"/client/v1/?addr=192.0.2.7", `[]`, 200},
+		{"/client/v1/?addr=foo", `{"status":400,"message":"invalid value for parameter addr: foo"}`, 400},
+		{"/client/v1/", `{"status":400,"message":"invalid value for parameter addr: "}`, 400},
+	}
+	for i, tt := range tests {
+		res, data, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: GET %s returned status %d, want %d", i, tt.url, got, tt.status)
+		}
+		if data != tt.response {
+			t.Errorf("#%d: GET %s returned response %s, want %s", i, tt.url, data, tt.response)
+		}
+	}
+}
+
+func TestLogCSV(t *testing.T) {
+	httpSrv, srv := testServer()
+	defer httpSrv.Close()
+	srv.logger.Record(net.IPv4(127, 0, 0, 42), false, 1, "example.com.", time.Minute, "192.0.2.100", "192.0.2.101")
+	srv.logger.Record(net.IPv4(127, 0, 0, 254), true, 28, "example.com.", time.Minute, "2001:db8::1")
+	srv.logger.Close() // Flush
+
+	res, data, err := httpGet(httpSrv.URL + "/log/v1/?format=csv&n=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("status = %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Content-Type"), "text/csv; charset=utf-8"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	lines := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	if got, want := len(lines), 2; got != want {
+		t.Fatalf("got %d lines, want %d", got, want)
+	}
+	if got, want := lines[0], "time,remote_addr,hijacked,type,question,answers"; got != want {
+		t.Errorf("header = %q, want %q", got, want)
+	}
+	row := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z,127\.0\.0\.254,true,AAAA,example\.com\.,2001:db8::1$`)
+	if !row.MatchString(lines[1]) {
+		t.Errorf("row = %q, want match for %s", lines[1], row)
+	}
+
+	_, data, err = httpGet(httpSrv.URL + "/log/v1/?format=csv&n=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(data, "192.0.2.101;192.0.2.100") && !strings.Contains(data, "192.0.2.100;192.0.2.101") {
+		t.Errorf("got %q, want answers separated by semicolon", data)
+	}
+
+	res, _, err = httpGet(httpSrv.URL + "/log/v1/?format=xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 400; got != want {
+		t.Errorf("status = %d, want %d", got, want)
+	}
+}
+
+func TestCacheFilter(t *testing.T) {
+	httpSrv, srv := testServer()
+	defer httpSrv.Close()
+	srv.cache.Set(1, newA("1.example.com.", 60, net.IPv4(192, 0, 2, 200)))
+	nxdomain := &dns.Msg{}
+	nxdomain.SetQuestion("2.example.com.", dns.TypeAAAA)
+	nxdomain.Rcode = dns.RcodeNameError
+	nxdomain.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 30}}}
+	srv.cache.Set(2, nxdomain)
+	srv.cache.Set(3, newA("3.example.com.", 60, net.IPv4(192, 0, 2, 201)))
+
+	a1 := `{"time":"RFC3339","ttl":60,"type":"A","question":"1.example.com.","answers":["192.0.2.200"],"rcode":"NOERROR","is_stale":false}`
+	a3 := `{"time":"RFC3339","ttl":60,"type":"A","question":"3.example.com.","answers":["192.0.2.201"],"rcode":"NOERROR","is_stale":false}`
+	nx := `{"time":"RFC3339","ttl":30,"type":"AAAA","question":"2.example.com.","rcode":"NXDOMAIN","is_stale":false}`
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/cache/v1/?type=A", "[" + a3 + "," + a1 + "]", 200},
+		{"/cache/v1/?type=a&n=1", "[" + a3 + "]", 200},
+		{"/cache/v1/?type=AAAA", "[" + nx + "]", 200},
+		{"/cache/v1/?rcode=NXDOMAIN", "[" + nx + "]", 200},
+		{"/cache/v1/?type=A&rcode=NXDOMAIN", "[]", 200},
+		{"/cache/v1/?type=foo", `{"status":400,"message":"invalid value for parameter type: foo"}`, 400},
+		{"/cache/v1/?rcode=foo", `{"status":400,"message":"invalid value for parameter rcode: foo"}`, 400},
+	}
+	for i, tt := range tests {
+		res, data, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: GET %s returned status %d, want %d", i, tt.url, got, tt.status)
+		}
+		want := strings.ReplaceAll(regexp.QuoteMeta(tt.response), "RFC3339", `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`)
+		if matched, err := regexp.MatchString("^"+want+"$", data); err != nil {
+			t.Fatal(err)
+		} else if !matched {
+			t.Errorf("#%d: GET %s returned response %s, want %s", i, tt.url, data, tt.response)
+		}
+	}
+}
+
+func TestCacheEvictSuffix(t *testing.T) {
+	httpSrv, srv := testServer()
+	defer httpSrv.Close()
+	srv.cache.Set(1, newA("1.example.com.", 60, net.IPv4(192, 0, 2, 200)))
+	srv.cache.Set(2, newA("2.example.com.", 60, net.IPv4(192, 0, 2, 201)))
+	srv.cache.Set(3, newA("example.org.", 60, net.IPv4(192, 0, 2, 202)))
+
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+		size     int
+	}{
+		{"/cache/v1/?suffix=example.net", `{"message":"Removed 0 cached entries matching example.net.","count":0}`, 200, 3},
+		{"/cache/v1/?suffix=example.com", `{"message":"Removed 2 cached entries matching example.com.","count":2}`, 200, 1},
+		{"/cache/v1/?suffix=", `{"status":400,"message":"invalid value for parameter suffix: "}`, 400, 1},
+		{"/cache/v1/?suffix=.", `{"status":400,"message":"invalid value for parameter suffix: ."}`, 400, 1},
+	}
+	for i, tt := range tests {
+		res, data, err := httpDelete(httpSrv.URL+tt.url, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: DELETE %s returned status %d, want %d", i, tt.url, got, tt.status)
+		}
+		if data != tt.response {
+			t.Errorf("#%d: DELETE %s returned response %s, want %s", i, tt.url, data, tt.response)
+		}
+		if got := srv.cache.Stats().Size; got != tt.size {
+			t.Errorf("#%d: cache size = %d, want %d", i, got, tt.size)
+		}
+	}
+}
+
+func TestLogTimeRange(t *testing.T) {
+	httpSrv, srv := testServer()
+	defer httpSrv.Close()
+	srv.logger.Record(net.IPv4(127, 0, 0, 42), false, 1, "example.com.", time.Minute, "192.0.2.100")
+	srv.logger.Close() // Flush
+
+	now := time.Now().UTC()
+	hourAgo := now.Add(-time.Hour).Format(time.RFC3339)
+	hourAhead := now.Add(time.Hour).Format(time.RFC3339)
+	lr := `[{"time":"RFC3339","ttl":60,"remote_addr":"127.0.0.42","hijacked":false,"type":"A","question":"example.com.","answers":["192.0.2.100"]}]`
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/log/v1/?from=" + hourAgo + "&to=" + hourAhead, lr, 200},
+		{"/log/v1/?from=" + hourAgo, lr, 200},
+		{"/log/v1/?from=" + hourAhead, "[]", 200},
+		{"/log/v1/?to=" + hourAgo, "[]", 200},
+		{"/log/v1/?from=foo", `{"status":400,"message":"invalid value for parameter from: foo"}`, 400},
+		{"/log/v1/?to=2006-01-02", `{"status":400,"message":"invalid value for parameter to: 2006-01-02"}`, 400},
+		{"/log/v1/?from=" + hourAhead + "&to=" + hourAgo, `{"status":400,"message":"parameter from must not be after to"}`, 400},
+	}
+	for i, tt := range tests {
+		res, data, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: GET %s returned status %d, want %d", i, tt.url, got, tt.status)
+		}
+		want := strings.ReplaceAll(regexp.QuoteMeta(tt.response), "RFC3339", `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`)
+		if matched, err := regexp.MatchString("^"+want+"$", data); err != nil {
+			t.Fatal(err)
+		} else if !matched {
+			t.Errorf("#%d: GET %s returned response %s, want %s", i, tt.url, data, tt.response)
+		}
+	}
+}
+
+func TestCacheLookup(t *testing.T) {
+	httpSrv, srv := testServer()
+	defer httpSrv.Close()
+	srv.cache.Set(cache.NewKey("1.example.com.", dns.TypeA, dns.ClassINET), newA("1.example.com.", 60, net.IPv4(192, 0, 2, 200)))
+
+	a1 := `{"time":"RFC3339","ttl":60,"type":"A","question":"1.example.com.","answers":["192.0.2.200"],"rcode":"NOERROR","is_stale":false,"remaining_ttl":REMAINING}`
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/cache/v1/lookup?name=1.example.com&type=A", a1, 200},
+		{"/cache/v1/lookup?name=1.example.com.", a1, 200},
+		{"/cache/v1/lookup?name=1.example.com&type=AAAA", `{"status":404,"message":"1.example.com. AAAA is not cached"}`, 404},
+		{"/cache/v1/lookup?name=2.example.com", `{"status":404,"message":"2.example.com. A is not cached"}`, 404},
+		{"/cache/v1/lookup?type=A", `{"status":400,"message":"missing parameter name"}`, 400},
+		{"/cache/v1/lookup?name=1.example.com&type=foo", `{"status":400,"message":"invalid value for parameter type: foo"}`, 400},
+	}
+	for i, tt := range tests {
+		res, data, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: GET %s returned status %d, want %d", i, tt.url, got, tt.status)
+		}
+		want := strings.ReplaceAll(regexp.QuoteMeta(tt.response), "RFC3339", `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`)
+		want = strings.ReplaceAll(want, "REMAINING", "(59|60)")
+		if matched, err := regexp.MatchString("^"+want+"$", data); err != nil {
+			t.Fatal(err)
+		} else if !matched {
+			t.Errorf("#%d: GET %s returned response %s, want %s", i, tt.url, data, tt.response)
+		}
+	}
+
+	// Looking up a value does not count as a hit
+	if got := srv.cache.Stats().Hits; got != 0 {
+		t.Errorf("Hits = %d, want 0", got)
+	}
+}
+
+func TestTypeStats(t *testing.T) {
+	counter := dnsutil.NewTypeCounter()
+	counter.Record(dns.TypeA, 1)
+	counter.Record(dns.TypeA, 3)
+	counter.Record(dns.TypeNULL, 0)
+	httpSrv, srv := testServerWithConfig(Config{TypeCounter: counter})
+	defer httpSrv.Close()
+	srv.logger.Close()
+
+	byType := `"by_type":[{"type":"A","requests":2,"answers":[{"le":0,"count":0},{"le":1,"count":1},{"le":2,"count":1},{"le":4,"count":2},{"le":8,"count":2},{"le":16,"count":2}]},` +
+		`{"type":"other","requests":1,"answers":[{"le":0,"count":1},{"le":1,"count":1},{"le":2,"count":1},{"le":4,"count":1},{"le":8,"count":1},{"le":16,"count":1}]}]`
+	_, data, err := httpGet(httpSrv.URL + "/metric/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(data, byType) {
+		t.Errorf("got %s, want response containing %s", data, byType)
+	}
+
+	prometheusLines := []string{
+		`zdns_requests_by_type{type="A"} 2`,
+		`zdns_requests_by_type{type="other"} 1`,
+		`zdns_requests_by_answers{le="1",type="A"} 1`,
+		`zdns_requests_by_answers{le="16",type="A"} 2`,
+		`zdns_cache_evictions_total{reason="capacity"} 0`,
+		`zdns_cache_refresh_total{result="success"} 0`,
+		`# TYPE zdns_cache_evictions_total counter`,
+		`# TYPE zdns_cache_refresh_total counter`,
+	}
+	_, data, err = httpGet(httpSrv.URL + "/metric/v1/?format=prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range prometheusLines {
+		if !strings.Contains(data, line) {
+			t.Errorf("got %s, want response containing %s", data, line)
+		}
+	}
+}
+
+func TestHostsStats(t *testing.T) {
+	loadedAt := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	statuses := func() []hosts.SourceStatus {
+		return []hosts.SourceStatus{
+			{Source: "https://example.com/hosts", Count: 42, LastLoaded: loadedAt, LastError: loadedAt.Add(time.Hour)},
+			{Source: "inline hosts", Count: 2, LastLoaded: loadedAt},
+		}
+	}
+	httpSrv, srv := testServerWithConfig(Config{Hosts: statuses})
+	defer httpSrv.Close()
+	srv.logger.Close()
+
+	want := `"hosts":[{"source":"https://example.com/hosts","count":42,"last_loaded":"2023-01-01T12:00:00Z","last_error":"2023-01-01T13:00:00Z"},` +
+		`{"source":"inline hosts","count":2,"last_loaded":"2023-01-01T12:00:00Z"}]`
+	_, data, err := httpGet(httpSrv.URL + "/metric/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(data, want) {
+		t.Errorf("got %s, want response containing %s", data, want)
+	}
+}
+
+func TestUpstreamStats(t *testing.T) {
+	latency := dnsutil.NewLatencyReservoir(10)
+	latency.Record(10 * time.Millisecond)
+	latency.Record(1500 * time.Microsecond)
+	httpSrv, srv := testServerWithConfig(Config{Latency: latency})
+	defer httpSrv.Close()
+	srv.logger.Close()
+
+	_, data, err := httpGet(httpSrv.URL + "/metric/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"upstream":{"samples":2,"latency_p50_ms":1.5,"latency_p95_ms":10,"latency_p99_ms":10}`
+	if !strings.Contains(data, want) {
+		t.Errorf("got %s, want response containing %s", data, want)
+	}
+}
+
+func TestRuntimeStats(t *testing.T) {
+	httpSrv, srv := testServer()
+	defer httpSrv.Close()
+	res, data, err := httpGet(httpSrv.URL + "/metric/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+	var s stats
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Summary.Runtime.Goroutines; got < 1 {
+		t.Errorf("goroutines = %d, want >= 1", got)
+	}
+	if got := s.Summary.Runtime.HeapAlloc; got == 0 {
+		t.Errorf("heap_alloc = %d, want > 0", got)
+	}
+
+	// Memory statistics are sampled sparingly
+	sampledAt := srv.memStats.sampledAt
+	srv.memStats.HeapAlloc()
+	if got := srv.memStats.sampledAt; !got.Equal(sampledAt) {
+		t.Errorf("sampledAt = %s, want %s", got, sampledAt)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	httpSrv, srv := testServerWithConfig(Config{Version: "1.2.3"})
+	defer httpSrv.Close()
+	srv.logger.Close()
+
+	_, data, err := httpGet(httpSrv.URL + "/metric/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"runtime":{"version":"1.2.3","go_version":"` + runtime.Version() + `",`
+	if !strings.Contains(data, want) {
+		t.Errorf("got %s, want response containing %s", data, want)
+	}
+
+	prometheusLines := []string{
+		`zdns_build_info{go_version="` + runtime.Version() + `",version="1.2.3"} 1`,
+		`zdns_goroutines `,
+		`zdns_memory_bytes `,
+	}
+	_, data, err = httpGet(httpSrv.URL + "/metric/v1/?format=prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range prometheusLines {
+		if !strings.Contains(data, line) {
+			t.Errorf("got %s, want response containing %s", data, line)
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+	httpSrv, srv := testServer()
+	defer httpSrv.Close()
+	srv.cache.Set(1, newA("1.example.com.", 60, net.IPv4(192, 0, 2, 200)))
+
+	var tests = []struct {
+		url      string
+		status   int
+		response string
+	}{
+		{"/cache/v1/", 200, `[{"time":"RFC3339","ttl":60,"type":"A","question":"1.example.com.","answers":["192.0.2.200"],"rcode":"NOERROR","is_stale":false}]`},
+		{"/cache/v1/?n=foo", 400, `{"status":400,"message":"invalid value for parameter n: foo"}`},
+		{"/not-found", 404, `{"status":404,"message":"Resource not found"}`},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, httpSrv.URL+tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Setting this header explicitly disables transparent decompression in http.Client
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: status = %d, want %d", i, got, tt.status)
+		}
+		if got, want := res.Header.Get("Content-Type"), jsonMediaType; got != want {
+			t.Errorf("#%d: Content-Type = %q, want %q", i, got, want)
+		}
+		if got, want := res.Header.Get("Content-Encoding"), "gzip"; got != want {
+			t.Errorf("#%d: Content-Encoding = %q, want %q", i, got, want)
+		}
+		r, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strings.ReplaceAll(regexp.QuoteMeta(tt.response), "RFC3339", `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`)
+		if matched, err := regexp.MatchString(want, string(data)); err != nil || !matched {
+			t.Errorf("#%d: response = %s, want %s", i, data, want)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	httpSrv, _ := testServerWithConfig(Config{Token: "secret"})
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		authorization string
+		status        int
+		response      string
+	}{
+		{"", 401, `{"status":401,"message":"Unauthorized"}`},
+		{"secret", 401, `{"status":401,"message":"Unauthorized"}`},
+		{"Bearer foo", 401, `{"status":401,"message":"Unauthorized"}`},
+		{"Bearer secret", 200, `[]`},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, httpSrv.URL+"/cache/v1/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: status = %d, want %d", i, got, tt.status)
+		}
+		if got, want := res.Header.Get("Content-Type"), jsonMediaType; got != want {
+			t.Errorf("#%d: Content-Type = %q, want %q", i, got, want)
+		}
+		if got := string(data); got != tt.response {
+			t.Errorf("#%d: response = %s, want %s", i, got, tt.response)
+		}
+	}
+}
+
+func TestResolvers(t *testing.T) {
+	resolver := dnsutil.NewMux(
+		dnsutil.NewClient("192.0.2.1:53", dnsutil.Config{}),
+		dnsutil.NewBreaker(dnsutil.NewClient("https://dns.example.com/dns-query", dnsutil.Config{Network: "https"}), 3, 0, time.Minute),
+	)
+	httpSrv, _ := testServerWithConfig(Config{Resolver: resolver})
+	defer httpSrv.Close()
+	res, data, err := httpGet(httpSrv.URL + "/resolver/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("status = %d, want %d", got, want)
+	}
+	want := `[{"address":"192.0.2.1:53","protocol":"udp"},{"address":"https://dns.example.com/dns-query","protocol":"https","state":"closed"}]`
+	if data != want {
+		t.Errorf("response = %s, want %s", data, want)
+	}
+
+	// Endpoint is disabled without a resolver
+	httpSrv, _ = testServer()
+	defer httpSrv.Close()
+	res, _, err = httpGet(httpSrv.URL + "/resolver/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 404; got != want {
+		t.Errorf("status = %d, want %d", got, want)
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	settings := struct {
+		Listen    []string
+		Resolvers []string
+		HTTPToken string
+	}{[]string{"0.0.0.0:53"}, []string{"192.0.2.1:53"}, "<redacted>"}
+	httpSrv, _ := testServerWithConfig(Config{Settings: func() interface{} { return settings }})
+	defer httpSrv.Close()
+	res, data, err := httpGet(httpSrv.URL + "/config/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("status = %d, want %d", got, want)
+	}
+	want := `{"Listen":["0.0.0.0:53"],"Resolvers":["192.0.2.1:53"],"HTTPToken":"\u003credacted\u003e"}`
+	if data != want {
+		t.Errorf("response = %s, want %s", data, want)
+	}
+
+	// Endpoint is disabled without settings
+	httpSrv, _ = testServer()
+	defer httpSrv.Close()
+	res, _, err = httpGet(httpSrv.URL + "/config/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.StatusCode, 404; got != want {
+		t.Errorf("status = %d, want %d", got, want)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	var tests = []struct {
+		pprof  bool
+		path   string
+		status int
+	}{
+		{false, "/debug/pprof/", 404},
+		{false, "/debug/pprof/heap", 404},
+		{false, "/debug/pprof/cmdline", 404},
+		{true, "/debug/pprof/", 200},
+		{true, "/debug/pprof/heap", 200},
+		{true, "/debug/pprof/cmdline", 200},
+	}
+	for i, tt := range tests {
+		httpSrv, _ := testServerWithConfig(Config{Pprof: tt.pprof})
+		res, _, err := httpGet(httpSrv.URL + tt.path)
+		httpSrv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: GET %s returned status %d, want %d", i, tt.path, got, tt.status)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	var ready atomic.Bool
+	httpSrv, _ := testServerWithConfig(Config{Token: "secret", Ready: ready.Load})
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		path     string
+		ready    bool
+		status   int
+		response string
+	}{
+		{"/health/v1/", false, 200, `{"status":"ok"}`},
+		{"/ready/v1/", false, 503, `{"status":503,"message":"Not ready"}`},
+		{"/health/v1/", true, 200, `{"status":"ok"}`},
+		{"/ready/v1/", true, 200, `{"status":"ok"}`},
+	}
+	for i, tt := range tests {
+		ready.Store(tt.ready)
+		res, data, err := httpGet(httpSrv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: status = %d, want %d", i, got, tt.status)
+		}
+		if got := data; got != tt.response {
+			t.Errorf("#%d: response = %s, want %s", i, got, tt.response)
+		}
+	}
+}
+
+func TestDoH(t *testing.T) {
+	var remoteAddr net.Addr
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		remoteAddr = w.RemoteAddr()
+		reply := newA(r.Question[0].Name, 60, net.IPv4(192, 0, 2, 1))
+		reply.SetReply(r)
+		w.WriteMsg(reply)
+	})
+	httpSrv, _ := testServerWithConfig(Config{Token: "secret", DNSHandler: handler})
+	defer httpSrv.Close()
+
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() (*http.Response, error) {
+		return http.Get(httpSrv.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(b))
+	}
+	post := func() (*http.Response, error) {
+		return http.Post(httpSrv.URL+"/dns-query", "application/dns-message", bytes.NewReader(b))
+	}
+	for i, fn := range []func() (*http.Response, error){get, post} {
+		res, err := fn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if got, want := res.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("#%d: status = %d, want %d", i, got, want)
+		}
+		if got, want := res.Header.Get("Content-Type"), "application/dns-message"; got != want {
+			t.Errorf("#%d: Content-Type = %q, want %q", i, got, want)
+		}
+		if got, want := res.Header.Get("Cache-Control"), "max-age=60"; got != want {
+			t.Errorf("#%d: Cache-Control = %q, want %q", i, got, want)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := dns.Msg{}
+		if err := reply.Unpack(data); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply.Id, msg.Id; got != want {
+			t.Errorf("#%d: Id = %d, want %d", i, got, want)
+		}
+		if got, want := reply.Answer[0].(*dns.A).A.String(), "192.0.2.1"; got != want {
+			t.Errorf("#%d: A = %s, want %s", i, got, want)
+		}
+		if ip := remoteAddr.(*net.TCPAddr).IP; !ip.IsLoopback() {
+			t.Errorf("#%d: RemoteAddr = %s, want loopback", i, ip)
+		}
+	}
+
+	pack := func(msg *dns.Msg) string {
+		b, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	response := msg.Copy()
+	response.Response = true
+	notify := msg.Copy()
+	notify.Opcode = dns.OpcodeNotify
+	var tests = []struct {
+		method      string
+		url         string
+		contentType string
+		body        string
+		status      int
+	}{
+		{http.MethodPost, "/dns-query", "application/dns-message", pack(&dns.Msg{}), 400},
+		{http.MethodPost, "/dns-query", "application/dns-message", pack(response), 400},
+		{http.MethodPost, "/dns-query", "application/dns-message", pack(notify), 400},
+		{http.MethodGet, "/dns-query", "", "", 400},
+		{http.MethodGet, "/dns-query?dns=%25", "", "", 400},
+		{http.MethodGet, "/dns-query?dns=AAAA", "", "", 400},
+		{http.MethodPost, "/dns-query", "text/plain", string(b), 400},
+	}
+	for i, tt := range tests {
+		r, err := http.NewRequest(tt.method, httpSrv.URL+tt.url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", tt.contentType)
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("#%d: %s %s returned status %d, want %d", i, tt.method, tt.url, got, tt.status)
+		}
+	}
+}
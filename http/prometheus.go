@@ -1,6 +1,9 @@
 package http
 
 import (
+	"sync"
+
+	"github.com/mpolden/zdns/cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,5 +18,64 @@ var (
 		Name: "zdns_requests_hijacked",
 		Help: "The number of hijacked DNS requests.",
 	})
+	typeRequestsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_requests_by_type",
+		Help: "The number of DNS requests per query type.",
+	}, []string{"type"})
+	typeAnswersGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_requests_by_answers",
+		Help: "The number of DNS requests per query type having at most le answers.",
+	}, []string{"type", "le"})
+	cacheEvictionsDesc = prometheus.NewDesc("zdns_cache_evictions_total",
+		"The number of values evicted from the cache, by reason.", []string{"reason"}, nil)
+	cacheRefreshDesc = prometheus.NewDesc("zdns_cache_refresh_total",
+		"The number of prefetch refreshes of cached values, by result.", []string{"result"}, nil)
+	cacheCounters   = newCacheCollector() // Registered after the descriptions it uses are initialized
+	goroutinesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_goroutines",
+		Help: "The number of goroutines.",
+	})
+	memoryGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zdns_memory_bytes",
+		Help: "The number of bytes allocated on the heap.",
+	})
+	buildInfoGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zdns_build_info",
+		Help: "A constant 1, labeled by the version of zdns and the Go version it was built with.",
+	}, []string{"version", "go_version"})
 	prometheusHandler = promhttp.Handler()
 )
+
+// cacheCollector exports the cumulative statistics of a cache as counters. The statistics are updated by set, before
+// metrics are gathered.
+type cacheCollector struct {
+	mu    sync.Mutex
+	stats cache.Stats
+}
+
+func newCacheCollector() *cacheCollector {
+	c := &cacheCollector{}
+	prometheus.MustRegister(c)
+	return c
+}
+
+func (c *cacheCollector) set(stats cache.Stats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = stats
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheEvictionsDesc
+	ch <- cacheRefreshDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	stats := c.stats
+	c.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions), "capacity")
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Expirations), "expired")
+	ch <- prometheus.MustNewConstMetric(cacheRefreshDesc, prometheus.CounterValue, float64(stats.Refreshes), "success")
+	ch <- prometheus.MustNewConstMetric(cacheRefreshDesc, prometheus.CounterValue, float64(stats.RefreshErrors), "error")
+}
@@ -1,10 +1,19 @@
 package http
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"log"
 	"net/http"
+	"strings"
 )
 
+type contextKey int
+
+const requestIDKey contextKey = iota
+
 type router struct {
 	routes []*route
 }
@@ -12,6 +21,7 @@ type router struct {
 type route struct {
 	method  string
 	path    string
+	prefix  bool
 	handler appHandler
 }
 
@@ -22,6 +32,11 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if e.Message == "" {
 			e.Message = e.err.Error()
 		}
+		if e.err != nil && e.Status >= http.StatusInternalServerError {
+			// Server errors are logged, and the request ID allows the client to find the matching log line
+			e.RequestID = requestID(r)
+			log.Printf("request %s: %s %s failed: %s", e.RequestID, r.Method, r.URL.Path, e.err)
+		}
 		w.WriteHeader(e.Status)
 		if w.Header().Get("Content-Type") == jsonMediaType {
 			out, err := json.Marshal(e)
@@ -35,6 +50,26 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// requestIDHandler assigns a random ID to each request handled by h. The ID is set in the X-Request-Id header of the
+// response, and is included in server errors returned by an appHandler.
+func requestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		id := hex.EncodeToString(b)
+		w.Header().Set("X-Request-Id", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// requestID returns the ID assigned to request r by requestIDHandler, if any.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
 func notFoundHandler(w http.ResponseWriter, r *http.Request) *httpError {
 	writeJSONHeader(w)
 	return &httpError{
@@ -53,6 +88,21 @@ func (r *router) route(method, path string, handler appHandler) *route {
 	return &route
 }
 
+// routePrefix routes requests having a path starting with prefix to handler.
+func (r *router) routePrefix(method, prefix string, handler appHandler) *route {
+	route := r.route(method, prefix, handler)
+	route.prefix = true
+	return route
+}
+
+// handlerFunc adapts an ordinary HTTP handler function to an appHandler.
+func handlerFunc(fn http.HandlerFunc) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *httpError {
+		fn(w, r)
+		return nil
+	}
+}
+
 func (r *router) handler() http.Handler {
 	return appHandler(func(w http.ResponseWriter, req *http.Request) *httpError {
 		for _, route := range r.routes {
@@ -68,8 +118,8 @@ func (r *route) match(req *http.Request) bool {
 	if req.Method != r.method {
 		return false
 	}
-	if r.path != req.URL.Path {
-		return false
+	if r.prefix {
+		return strings.HasPrefix(req.URL.Path, r.path)
 	}
-	return true
+	return r.path == req.URL.Path
 }
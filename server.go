@@ -1,19 +1,29 @@
 package zdns
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/mpolden/zdns/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
 	"github.com/mpolden/zdns/hosts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
@@ -23,82 +33,375 @@ const (
 	HijackEmpty
 	// HijackHosts returns the value of the  hoss entry to matching request.
 	HijackHosts
+	// HijackNXDOMAIN returns NXDOMAIN to matching requests.
+	HijackNXDOMAIN
 )
 
+const (
+	// StaleOpen answers requests using hosts from the last successful refresh when hosts are stale.
+	StaleOpen = iota
+	// StaleClosed hijacks all requests when hosts are stale.
+	StaleClosed
+)
+
+const (
+	// DefaultAllow resolves names that are not hijacked using the upstream resolvers.
+	DefaultAllow = iota
+	// DefaultReject answers NXDOMAIN to requests for names that are neither allowed, nor found in hosts or zones.
+	DefaultReject
+)
+
+// maxAliasDepth is the maximum number of aliases followed when replying from hosts.
+const maxAliasDepth = 8
+
+// maxConcurrentReads is the maximum number of hosts sources read concurrently.
+const maxConcurrentReads = 8
+
+// maxBackoffFactor limits the interval between refreshes of a failing hosts URL to this multiple of the refresh
+// interval.
+const maxBackoffFactor = 16
+
+var hostsStaleGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "zdns_hosts_stale",
+	Help: "Whether hosts have failed to refresh for longer than the configured threshold.",
+})
+
+// hostsSource contains the hosts from the last successful refresh of a hosts URL.
+type hostsSource struct {
+	hosts       hosts.Hosts
+	patterns    hosts.Patterns
+	refreshedAt time.Time
+	// etag and lastModified are the validators of a hosts URL retrieved over HTTP, if any.
+	etag         string
+	lastModified string
+}
+
+// sourceBackoff schedules the retry of a hosts URL that failed to refresh.
+type sourceBackoff struct {
+	policy *backoff.ExponentialBackOff
+	timer  *time.Timer
+}
+
+// hostsState contains the hosts used when answering queries. It's replaced as a whole when hosts are loaded, which
+// allows queries to read it without locking.
+type hostsState struct {
+	hosts   hosts.Hosts
+	reverse hosts.Reverse
+	// patterns match names that are hijacked in addition to hosts, unless the name is allowed.
+	patterns hosts.Patterns
+	allowed  hosts.Hosts
+	// staleAt is the time after which hosts are considered stale. Hosts never become stale if staleAt is zero.
+	staleAt time.Time
+}
+
+func (hs *hostsState) isStale(now time.Time) bool {
+	return !hs.staleAt.IsZero() && now.After(hs.staleAt)
+}
+
+// matchPattern returns whether name matches any pattern of hs, and is not allowed.
+func (hs *hostsState) matchPattern(name string) bool {
+	if len(hs.patterns) == 0 {
+		return false
+	}
+	if hs.isAllowed(name) {
+		return false
+	}
+	return hs.patterns.Match(strings.ToLower(name))
+}
+
+// isAllowed returns whether name is allowed. A name is allowed if it's an allowed host, or a subdomain of an allowed
+// wildcard host, such as *.example.com.
+func (hs *hostsState) isAllowed(name string) bool {
+	if len(hs.allowed) == 0 {
+		return false
+	}
+	name = strings.ToLower(name)
+	if _, ok := hs.allowed.Get(name); ok {
+		return true
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if _, ok := hs.allowed.Get("*." + name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // A Server defines parameters for running a DNS server.
 type Server struct {
 	Config     Config
-	hosts      hosts.Hosts
+	hosts      atomic.Pointer[hostsState]
+	zones      atomic.Pointer[[]*dns.Zone]
 	proxy      *dns.Proxy
 	done       chan bool
 	mu         sync.RWMutex
+	loadMu     sync.Mutex // Serializes loading of hosts
+	closing    bool
 	httpClient *http.Client
+	sources    map[string]*hostsSource
+	backoffs   map[string]*sourceBackoff
+	failedAt   map[string]time.Time
+	statuses   []hosts.SourceStatus
+	startedAt  time.Time
+	stale      bool
+	now        func() time.Time
 }
 
 // NewServer returns a new server configured according to config.
 func NewServer(proxy *dns.Proxy, config Config) (*Server, error) {
+	if config.DNS.ResolverHealthcheck {
+		if err := checkResolvers(config); err != nil {
+			return nil, err
+		}
+	}
 	server := &Server{
 		Config:     config,
 		done:       make(chan bool, 1),
 		proxy:      proxy,
 		httpClient: &http.Client{Timeout: 10 * time.Second},
+		sources:    make(map[string]*hostsSource),
+		startedAt:  time.Now(),
+		now:        time.Now,
 	}
-	proxy.Handler = server.hijack
+	proxy.Handler = server.handle
 
-	// Periodically refresh hosts
+	// Periodically refresh hosts and zones
 	if interval := config.DNS.refreshInterval; interval > 0 {
-		go server.reloadHosts(interval)
+		go server.reloadPeriodically(interval)
 	}
 
-	// Load initial hosts
-	go server.loadHosts()
+	// Load initial hosts and zones
+	go server.Reload()
 	return server, nil
 }
 
-func (s *Server) httpGet(url string) (io.ReadCloser, error) {
-	var body io.ReadCloser
-	policy := backoff.NewExponentialBackOff()
-	policy.MaxInterval = 2 * time.Second
-	policy.MaxElapsedTime = 30 * time.Second
-	err := backoff.Retry(func() error {
-		res, err := s.httpClient.Get(url)
-		if err == nil {
-			body = res.Body
+// NewResolverClient creates a client for the upstream resolver u, configured by the resolver options of config.
+func NewResolverClient(u Upstream, config Config) dnsutil.Client {
+	return dnsutil.NewClient(u.Address, dnsutil.Config{
+		Network:            u.Protocol,
+		Timeout:            config.Resolver.Timeout,
+		DialTimeout:        config.Resolver.DialTimeout,
+		ReadTimeout:        config.Resolver.ReadTimeout,
+		RequestTimeout:     config.Resolver.HTTPRequestTimeout,
+		EDNSFallback:       config.Resolver.EDNSFallback,
+		HTTPMethod:         config.Resolver.HTTPMethod,
+		HTTPLegacyMimeType: config.Resolver.HTTPLegacy,
+		HTTPMaxIdleConns:   config.Resolver.HTTPMaxIdle,
+		HTTPIdleTimeout:    config.Resolver.HTTPIdleTimeout,
+	})
+}
+
+// checkResolvers probes all configured resolvers concurrently and logs whether they are reachable. An error is
+// returned if none of them are.
+func checkResolvers(config Config) error {
+	upstreams := config.Resolver.Upstreams
+	errs := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func(i int, u Upstream) {
+			defer wg.Done()
+			errs[i] = dnsutil.Probe(NewResolverClient(u, config), config.DNS.ResolverProbeName)
+		}(i, u)
+	}
+	wg.Wait()
+	reachable := 0
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("resolver %s is unreachable: %s", upstreams[i].Address, err)
+			continue
+		}
+		log.Printf("resolver %s is reachable", upstreams[i].Address)
+		reachable++
+	}
+	if reachable == 0 {
+		return fmt.Errorf("none of %d resolvers responded to probe for %s", len(upstreams), config.DNS.ResolverProbeName)
+	}
+	return nil
+}
+
+// httpGet retrieves url. If prev is non-nil, the request is conditional on the contents having changed since prev was
+// retrieved. Failed requests are retried with exponential backoff, for up to the configured max elapsed time.
+func (s *Server) httpGet(url string, prev *hostsSource) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+	var res *http.Response
+	var policy backoff.BackOff = &backoff.StopBackOff{}
+	if maxElapsed := s.Config.DNS.hostsFetchElapsed; maxElapsed > 0 {
+		exp := backoff.NewExponentialBackOff()
+		exp.MaxInterval = s.Config.DNS.hostsFetchInterval
+		if exp.MaxInterval == 0 {
+			exp.MaxInterval = maxElapsed
+		}
+		if exp.InitialInterval > exp.MaxInterval {
+			exp.InitialInterval = exp.MaxInterval
 		}
+		exp.MaxElapsedTime = maxElapsed
+		policy = exp
+	}
+	err = backoff.Retry(func() error {
+		var err error
+		res, err = s.httpClient.Do(req)
 		return err
 	}, policy)
 	if err != nil {
 		return nil, err
 	}
-	return body, nil
+	return res, nil
 }
 
-func (s *Server) readHosts(name string) (hosts.Hosts, error) {
-	url, err := url.Parse(name)
+// readHosts reads the hosts of h. If h is retrieved over HTTP and its contents have not changed since prev was read,
+// the hosts of prev are returned.
+func (s *Server) readHosts(h Hosts, prev *hostsSource) (*hostsSource, error) {
+	url, err := url.Parse(h.URL)
 	if err != nil {
 		return nil, err
 	}
+	source := &hostsSource{}
 	var rc io.ReadCloser
 	switch url.Scheme {
 	case "file":
-		f, err := os.Open(url.Path)
+		fi, err := os.Stat(url.Path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			rc, err = readDir(url.Path)
+		} else {
+			rc, err = os.Open(url.Path)
+		}
 		if err != nil {
 			return nil, err
 		}
-		rc = f
 	case "http", "https":
-		rc, err = s.httpGet(url.String())
+		res, err := s.httpGet(url.String(), prev)
 		if err != nil {
 			return nil, err
 		}
+		switch res.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotModified:
+			res.Body.Close()
+			if prev == nil {
+				return nil, fmt.Errorf("%s: unexpected status %d", url, res.StatusCode)
+			}
+			return &hostsSource{hosts: prev.hosts, patterns: prev.patterns, etag: prev.etag, lastModified: prev.lastModified}, nil
+		default:
+			res.Body.Close()
+			return nil, fmt.Errorf("%s: unexpected status %d", url, res.StatusCode)
+		}
+		source.etag = res.Header.Get("ETag")
+		source.lastModified = res.Header.Get("Last-Modified")
+		rc = res.Body
 	default:
 		return nil, fmt.Errorf("%s: invalid scheme: %s", url, url.Scheme)
 	}
-	hosts, err := hosts.Parse(rc)
+	if h.SHA256 != "" {
+		// Verify the complete source before parsing, so that a corrupted source is never partially loaded
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, h.SHA256) {
+			return nil, fmt.Errorf("%s: sha256 checksum mismatch: got %s, want %s", url, got, h.SHA256)
+		}
+		rc = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	source.hosts, source.patterns, err = h.parse(rc)
 	if err1 := rc.Close(); err == nil {
 		err = err1
 	}
-	return hosts, err
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// readDir concatenates all hosts files in directory dir, in the order of their names. Hidden files, backup files and
+// files that do not contain text are skipped.
+func readDir(dir string) (io.ReadCloser, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		fi, err := os.Stat(path) // Follows symlinks
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("skipping %s: %s", path, err)
+			continue
+		}
+		if contentType := http.DetectContentType(b); !strings.HasPrefix(contentType, "text/plain") {
+			log.Printf("skipping %s: unexpected content type %s", path, contentType)
+			continue
+		}
+		buf.Write(b)
+		buf.WriteByte('\n') // Files may lack a trailing newline
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+func fqdn(s string) string {
+	if strings.HasSuffix(s, ".") {
+		return s
+	}
+	return s + "."
+}
+
+// reverseIP returns the IP address of the reverse name, in either in-addr.arpa or ip6.arpa format. It returns nil if
+// name is not a complete reverse name.
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var sb strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			sb.WriteString(nibbles[i])
+			if i > 0 && i%4 == 0 {
+				sb.WriteByte(':')
+			}
+		}
+		return net.ParseIP(sb.String())
+	}
+	return nil
 }
 
 func nonFqdn(s string) string {
@@ -109,34 +412,204 @@ func nonFqdn(s string) string {
 	return s
 }
 
-func (s *Server) reloadHosts(interval time.Duration) {
+func (s *Server) reloadPeriodically(interval time.Duration) {
 	for {
 		select {
 		case <-s.done:
 			return
 		case <-time.After(interval):
-			s.loadHosts()
+			s.reload()
+		}
+	}
+}
+
+func readZone(z Zone) (*dns.Zone, error) {
+	f, err := os.Open(z.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return dns.ParseZone(f, z.Origin, z.File)
+}
+
+func (s *Server) loadZones() {
+	var old []*dns.Zone
+	if zones := s.zones.Load(); zones != nil {
+		old = *zones
+	}
+	zones := make([]*dns.Zone, 0, len(s.Config.Zones))
+	for i, z := range s.Config.Zones {
+		zone, err := readZone(z)
+		if err != nil {
+			if i < len(old) && old[i] != nil {
+				log.Printf("failed to read zone %s from %s: %s: using previously loaded zone", z.Origin, z.File, err)
+				zone = old[i]
+			} else {
+				log.Printf("failed to read zone %s from %s: %s", z.Origin, z.File, err)
+			}
+		} else {
+			log.Printf("loaded %d records in zone %s from %s", zone.Len(), zone.Origin(), z.File)
 		}
+		zones = append(zones, zone)
+	}
+	s.zones.Store(&zones)
+}
+
+// readSource reads the hosts of h. If reading a hosts URL fails, the hosts from its previous successful refresh are
+// returned. It returns nil if there are no hosts to use.
+//
+// If retry is set, only the hosts URL retry is read, and the previous hosts of other URLs are returned. Otherwise, all
+// hosts URLs are read, except those waiting to be retried after failing to refresh.
+func (s *Server) readSource(h Hosts, retry string) *hostsSource {
+	if h.URL == "" {
+		return &hostsSource{hosts: h.hosts, patterns: h.patterns, refreshedAt: s.now()}
+	}
+	s.mu.RLock()
+	prev := s.sources[h.URL]
+	_, backingOff := s.backoffs[h.URL]
+	s.mu.RUnlock()
+	if retry != "" && h.URL != retry {
+		return prev
+	}
+	if retry == "" && backingOff {
+		return prev // Read when its retry is due
+	}
+	source, err := s.readHosts(h, prev)
+	if err != nil {
+		s.mu.Lock()
+		if s.failedAt == nil {
+			s.failedAt = make(map[string]time.Time)
+		}
+		s.failedAt[h.URL] = s.now()
+		s.mu.Unlock()
+		if delay := s.backOff(h.URL); delay > 0 {
+			err = fmt.Errorf("%w: retrying in %s", err, delay.Round(time.Second))
+		}
+		if prev == nil {
+			log.Printf("failed to read hosts from %s: %s", h.URL, err)
+			return nil
+		}
+		log.Printf("failed to read hosts from %s: %s: using hosts from %s", h.URL, err, prev.refreshedAt.Format(time.RFC3339))
+		return prev
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	source.refreshedAt = s.now()
+	s.sources[h.URL] = source
+	delete(s.backoffs, h.URL)
+	return source
+}
+
+// backOff schedules a retry of the hosts URL, which failed to refresh. The delay grows exponentially, with jitter, for
+// each consecutive failure. It returns the delay, which is zero if hosts are not refreshed periodically or the server is
+// closing.
+func (s *Server) backOff(url string) time.Duration {
+	interval := s.Config.DNS.refreshInterval
+	if interval <= 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return 0
+	}
+	if s.backoffs == nil {
+		s.backoffs = make(map[string]*sourceBackoff)
+	}
+	b, ok := s.backoffs[url]
+	if !ok {
+		policy := backoff.NewExponentialBackOff()
+		policy.InitialInterval = interval
+		policy.MaxInterval = maxBackoffFactor * interval
+		policy.MaxElapsedTime = 0 // Never give up
+		policy.Reset()
+		b = &sourceBackoff{policy: policy}
+		s.backoffs[url] = b
+	}
+	delay := b.policy.NextBackOff()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.timer = time.AfterFunc(delay, func() { s.loadSources(url) })
+	return delay
+}
+
+// resetBackoffs cancels the scheduled retries of hosts URLs, so that all hosts URLs are read on the next load.
+func (s *Server) resetBackoffs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.backoffs {
+		b.timer.Stop()
+	}
+	s.backoffs = nil
+}
+
+// readSources reads all configured hosts concurrently, using at most maxConcurrentReads concurrent reads. Sources are
+// returned in configured order. See readSource for the meaning of retry.
+func (s *Server) readSources(retry string) []*hostsSource {
+	sources := make([]*hostsSource, len(s.Config.Hosts))
+	sem := make(chan struct{}, maxConcurrentReads)
+	var wg sync.WaitGroup
+	for i, h := range s.Config.Hosts {
+		wg.Add(1)
+		go func(i int, h Hosts) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			sources[i] = s.readSource(h, retry)
+		}(i, h)
 	}
+	wg.Wait()
+	return sources
 }
 
-func (s *Server) loadHosts() {
+func (s *Server) loadHosts() { s.loadSources("") }
+
+// loadSources reads hosts and replaces the hosts used when answering queries. See readSource for the meaning of retry.
+// Only one load runs at a time, so that hosts from an earlier load never replace those of a later one.
+func (s *Server) loadSources(retry string) {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
 	hs := make(hosts.Hosts)
-	for _, h := range s.Config.Hosts {
+	allowed := make(hosts.Hosts)
+	var patterns hosts.Patterns
+	// Sources are read concurrently, but merged in configured order as removals depend on earlier sources
+	sources := s.readSources(retry)
+	statuses := make([]hosts.SourceStatus, 0, len(sources))
+	for i, source := range sources {
+		h := s.Config.Hosts[i]
 		src := "inline hosts"
-		hs1 := h.hosts
 		if h.URL != "" {
 			src = h.URL
-			var err error
-			hs1, err = s.readHosts(h.URL)
-			if err != nil {
-				log.Printf("failed to read hosts from %s: %s", h.URL, err)
-				continue
-			}
 		}
-		if h.Hijack {
-			for name, ipAddrs := range hs1 {
-				hs[name] = ipAddrs
+		status := hosts.SourceStatus{Source: src}
+		s.mu.RLock()
+		status.LastError = s.failedAt[h.URL]
+		s.mu.RUnlock()
+		if source != nil {
+			status.Count = len(source.hosts) + len(source.patterns)
+			status.LastLoaded = source.refreshedAt
+		}
+		statuses = append(statuses, status)
+		if source == nil {
+			continue
+		}
+		hs1, patterns1 := source.hosts, source.patterns
+		if len(patterns1) > 0 {
+			patterns = append(patterns, patterns1...)
+			log.Printf("loaded %d regular expressions from %s", len(patterns1), src)
+		}
+		if h.Allow {
+			for name, host := range hs1 {
+				allowed[name] = host
+			}
+			log.Printf("loaded %d allowed hosts from %s", len(hs1), src)
+		} else if h.Hijack {
+			for name, host := range hs1 {
+				if host.TTL == 0 {
+					host.TTL = h.ttl
+				}
+				hs[name] = host
 			}
 			log.Printf("loaded %d hosts from %s", len(hs1), src)
 		} else {
@@ -152,63 +625,349 @@ func (s *Server) loadHosts() {
 			}
 		}
 	}
+	// Allowed hosts are removed after all sources are loaded, regardless of their order
+	removed := 0
+	for name := range allowed {
+		if _, ok := hs.Get(name); ok {
+			removed++
+			hs.Del(name)
+		}
+	}
+	if removed > 0 {
+		log.Printf("removed %d allowed hosts", removed)
+	}
+	if len(patterns) > hosts.MaxPatterns {
+		log.Printf("ignoring %d regular expressions exceeding the limit of %d", len(patterns)-hosts.MaxPatterns, hosts.MaxPatterns)
+		patterns = patterns[:hosts.MaxPatterns]
+	}
 	s.mu.Lock()
-	s.hosts = hs
+	s.statuses = statuses
+	staleAt := s.staleAt()
+	wasStale := s.stale
+	s.stale = !staleAt.IsZero() && s.now().After(staleAt)
+	stale := s.stale
 	s.mu.Unlock()
+	s.hosts.Store(&hostsState{hosts: hs, reverse: hs.Reverse(), patterns: patterns, allowed: allowed, staleAt: staleAt})
 	log.Printf("loaded %d hosts in total", len(hs))
+	if stale {
+		hostsStaleGauge.Set(1)
+		if !wasStale {
+			log.Printf("hosts have failed to refresh for more than %s", s.Config.DNS.hostsStaleThreshold)
+		}
+	} else {
+		hostsStaleGauge.Set(0)
+		if wasStale {
+			log.Printf("hosts are no longer stale")
+		}
+	}
+}
+
+// staleAt returns the time at which all hosts URLs will have failed to refresh for longer than the configured
+// threshold. Inline hosts are never stale, and the zero time is returned if there are no hosts URLs. Callers must hold
+// s.mu.
+func (s *Server) staleAt() time.Time {
+	threshold := s.Config.DNS.hostsStaleThreshold
+	if threshold == 0 {
+		return time.Time{}
+	}
+	var lastRefresh time.Time
+	for _, h := range s.Config.Hosts {
+		if h.URL == "" {
+			continue
+		}
+		refreshedAt := s.startedAt
+		if source, ok := s.sources[h.URL]; ok {
+			refreshedAt = source.refreshedAt
+		}
+		if refreshedAt.After(lastRefresh) {
+			lastRefresh = refreshedAt
+		}
+	}
+	if lastRefresh.IsZero() {
+		return time.Time{}
+	}
+	return lastRefresh.Add(threshold)
 }
 
-// Reload updates hosts entries of Server s.
-func (s *Server) Reload() { s.loadHosts() }
+// Ready returns whether Server s has completed its initial load of hosts.
+func (s *Server) Ready() bool { return s.hosts.Load() != nil }
+
+// HostsStatus returns the status of each configured source of hosts, as of the last time hosts were loaded.
+func (s *Server) HostsStatus() []hosts.SourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]hosts.SourceStatus(nil), s.statuses...)
+}
+
+// loadedHosts returns the hosts used when answering queries.
+func (s *Server) loadedHosts() *hostsState {
+	if state := s.hosts.Load(); state != nil {
+		return state
+	}
+	return &hostsState{}
+}
+
+// Reload updates hosts entries and zones of Server s. Hosts URLs waiting to be retried after failing to refresh are
+// read immediately.
+func (s *Server) Reload() {
+	s.resetBackoffs()
+	s.reload()
+}
+
+func (s *Server) reload() {
+	s.loadHosts()
+	s.loadZones()
+}
 
 // Close terminates all active operations and shuts down the DNS server.
 func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.resetBackoffs()
 	s.done <- true
 	return nil
 }
 
+// replyHosts replies to r with the entries of host. Aliases are followed through hs. If an alias chain ends in a name
+// not found in hs, the name is resolved by the upstream resolver. Negative answers are cached by clients for
+// negativeTTL seconds.
+func replyHosts(r *dns.Request, hs hosts.Hosts, host hosts.Host, negativeTTL uint32) *dns.Reply {
+	return replyHost(r.Type, r.Name, hs, host, negativeTTL, 0)
+}
+
+func replyHost(qtype uint16, name string, hs hosts.Hosts, host hosts.Host, negativeTTL uint32, depth int) *dns.Reply {
+	if host.Target != "" {
+		target := fqdn(host.Target)
+		if qtype == dns.TypeCNAME || depth == maxAliasDepth {
+			return dns.ReplyCNAME(name, target, &dns.Reply{})
+		}
+		next, ok := hs.Get(nonFqdn(target))
+		if !ok {
+			return dns.ReplyCNAME(name, target, nil)
+		}
+		answer := replyHost(qtype, target, hs, next, negativeTTL, depth+1)
+		if answer == nil {
+			answer = &dns.Reply{} // Target exists, but has no records of this type
+		}
+		return dns.ReplyCNAME(name, target, answer)
+	}
+	var ipv4Addr []net.IP
+	var ipv6Addr []net.IP
+	for _, ipAddr := range host.IPAddrs {
+		if ipAddr.IP.To4() == nil {
+			ipv6Addr = append(ipv6Addr, ipAddr.IP)
+		} else {
+			ipv4Addr = append(ipv4Addr, ipAddr.IP)
+		}
+	}
+	switch qtype {
+	case dns.TypeA:
+		if len(ipv4Addr) == 0 {
+			return dns.ReplyNODATA(name, negativeTTL)
+		}
+		return dns.ReplyA(name, ipv4Addr...).WithTTL(host.TTL)
+	case dns.TypeAAAA:
+		if len(ipv6Addr) == 0 {
+			return dns.ReplyNODATA(name, negativeTTL)
+		}
+		return dns.ReplyAAAA(name, ipv6Addr...).WithTTL(host.TTL)
+	}
+	return nil
+}
+
+func (s *Server) splitHorizon(r *dns.Request) *dns.Reply {
+	name := hosts.Normalize(nonFqdn(r.Name))
+	for _, sh := range s.Config.SplitHorizon {
+		if !sh.contains(r.RemoteAddr) {
+			continue
+		}
+		host, ok := sh.hosts.Get(name)
+		if !ok {
+			continue
+		}
+		if host.Target == "" && r.Type != dns.TypeA && r.Type != dns.TypeAAAA {
+			return nil // Type not applicable
+		}
+		return replyHosts(r, sh.hosts, host, s.negativeTTL())
+	}
+	return nil
+}
+
+// handle answers r from hosts, or from the zone containing the requested name. If the default action is to reject,
+// requests for names that are not allowed are answered with NXDOMAIN.
+func (s *Server) handle(r *dns.Request) *dns.Reply {
+	if reply := s.hijack(r); reply != nil {
+		return reply
+	}
+	if reply := s.answerZone(r); reply != nil {
+		return reply
+	}
+	if s.reject(r) {
+		if !s.Ready() {
+			return dns.ReplySERVFAIL() // Allowed names are unknown until hosts have loaded
+		}
+		return dns.ReplyNXDOMAIN(r.Name, s.negativeTTL())
+	}
+	return nil
+}
+
+// reject returns whether r should be rejected instead of being resolved by the upstream resolvers.
+func (s *Server) reject(r *dns.Request) bool {
+	if s.Config.DNS.defaultAction != DefaultReject || r.Class == dns.ClassCHAOS {
+		return false
+	}
+	state := s.loadedHosts()
+	name := hosts.Normalize(nonFqdn(r.Name))
+	if _, ok := state.hosts.Get(name); ok {
+		return false // Name exists, but has no records of this type
+	}
+	return !state.isAllowed(name)
+}
+
+// answerZone answers r from the most specific zone containing the requested name.
+func (s *Server) answerZone(r *dns.Request) *dns.Reply {
+	zones := s.zones.Load()
+	if zones == nil {
+		return nil
+	}
+	var zone *dns.Zone
+	for _, z := range *zones {
+		if z == nil || !z.Contains(r.Name) {
+			continue
+		}
+		if zone == nil || len(z.Origin()) > len(zone.Origin()) {
+			zone = z
+		}
+	}
+	if zone == nil {
+		return nil
+	}
+	return zone.Reply(r)
+}
+
 func (s *Server) hijack(r *dns.Request) *dns.Reply {
-	if r.Type != dns.TypeA && r.Type != dns.TypeAAAA {
-		return nil // Type not applicable
+	if r.Class == dns.ClassCHAOS {
+		return s.chaos(r)
 	}
-	s.mu.RLock()
-	ipAddrs, ok := s.hosts.Get(nonFqdn(r.Name))
-	s.mu.RUnlock()
-	if !ok {
+	if reply := s.splitHorizon(r); reply != nil {
+		return reply
+	}
+	state := s.loadedHosts()
+	hs := state.hosts
+	failClosed := s.Config.DNS.hostsStalePolicy == StaleClosed && state.isStale(s.now())
+	if r.Type == dns.TypePTR && s.Config.DNS.hijackMode == HijackHosts {
+		if ip := reverseIP(r.Name); ip != nil {
+			if names, ok := state.reverse.Get(ip); ok {
+				targets := make([]string, 0, len(names))
+				for _, name := range names {
+					targets = append(targets, fqdn(name))
+				}
+				return dns.ReplyPTR(r.Name, targets...)
+			}
+		}
+	}
+	name := hosts.Normalize(nonFqdn(r.Name))
+	host, ok := hs.Get(name)
+	if !ok && state.matchPattern(name) {
+		host, ok = hosts.Host{IPAddrs: []net.IPAddr{{IP: net.IPv4zero}, {IP: net.IPv6zero}}}, true
+	}
+	if !ok && !failClosed {
 		return nil // No match
 	}
+	if host.Target != "" && s.Config.DNS.hijackMode == HijackHosts {
+		return replyHosts(r, hs, host, s.negativeTTL()) // Aliases apply to all types
+	}
+	if s.Config.DNS.hijackMode == HijackNXDOMAIN {
+		return dns.ReplyNXDOMAIN(r.Name, s.negativeTTL()) // Name does not exist for any type
+	}
+	if r.Type != dns.TypeA && r.Type != dns.TypeAAAA {
+		if s.Config.DNS.LocalOnly || !ok {
+			// Name exists, but has no records of this type. Names without a match are blocked for all types when
+			// failing closed
+			return dns.ReplyNODATA(r.Name, s.negativeTTL())
+		}
+		return nil // Type not applicable
+	}
 	switch s.Config.DNS.hijackMode {
 	case HijackZero:
 		switch r.Type {
 		case dns.TypeA:
-			return dns.ReplyA(r.Name, net.IPv4zero)
+			return dns.ReplyA(r.Name, orIP(s.Config.DNS.hijackAddress, net.IPv4zero)).WithTTL(host.TTL)
 		case dns.TypeAAAA:
-			return dns.ReplyAAAA(r.Name, net.IPv6zero)
+			return dns.ReplyAAAA(r.Name, orIP(s.Config.DNS.hijackAddressV6, net.IPv6zero)).WithTTL(host.TTL)
 		}
 	case HijackEmpty:
-		return &dns.Reply{}
+		return dns.ReplyNODATA(r.Name, s.negativeTTL())
 	case HijackHosts:
-		var ipv4Addr []net.IP
-		var ipv6Addr []net.IP
-		for _, ipAddr := range ipAddrs {
-			if ipAddr.IP.To4() == nil {
-				ipv6Addr = append(ipv6Addr, ipAddr.IP)
-			} else {
-				ipv4Addr = append(ipv4Addr, ipAddr.IP)
-			}
-		}
-		switch r.Type {
-		case dns.TypeA:
-			return dns.ReplyA(r.Name, ipv4Addr...)
-		case dns.TypeAAAA:
-			return dns.ReplyAAAA(r.Name, ipv6Addr...)
-		}
+		return replyHosts(r, hs, host, s.negativeTTL())
+	case HijackNXDOMAIN:
+		return dns.ReplyNXDOMAIN(r.Name, s.negativeTTL())
 	}
 	return nil
 }
 
-// ListenAndServe starts a server on configured address and protocol.
+// negativeTTL returns the TTL, in seconds, of negative answers to hijacked requests.
+func (s *Server) negativeTTL() uint32 { return uint32(s.Config.DNS.hijackNegativeTTL / time.Second) }
+
+// orIP returns ip, or fallback if ip is not set.
+func orIP(ip, fallback net.IP) net.IP {
+	if ip == nil {
+		return fallback
+	}
+	return ip
+}
+
+// chaos answers a query in the CHAOS class for the version or hostname of the server, if configured.
+func (s *Server) chaos(r *dns.Request) *dns.Reply {
+	var txt string
+	switch strings.ToLower(r.Name) {
+	case "version.bind.":
+		txt = s.Config.DNS.ChaosVersion
+	case "hostname.bind.":
+		txt = s.Config.DNS.ChaosHostname
+	}
+	if txt == "" {
+		return nil
+	}
+	if r.Type != dns.TypeTXT {
+		return &dns.Reply{} // Name exists, but has no records of this type
+	}
+	return dns.ReplyTXT(r.Name, txt)
+}
+
+// ListenAndServe starts a server on each configured address, using the configured protocol. It returns when all
+// servers have stopped, or as soon as any server fails.
 func (s *Server) ListenAndServe() error {
-	log.Printf("dns server listening on %s [%s]", s.Config.DNS.Listen, s.Config.DNS.Protocol)
-	return s.proxy.ListenAndServe(s.Config.DNS.Listen, s.Config.DNS.Protocol)
+	errs := make(chan error, len(s.Config.DNS.Listen))
+	for _, addr := range s.Config.DNS.Listen {
+		go func(addr string) { errs <- s.listenAndServe(addr) }(addr)
+	}
+	for range s.Config.DNS.Listen {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) listenAndServe(addr string) error {
+	log.Printf("dns server listening on %s [%s]", addr, s.Config.DNS.Protocol)
+	switch s.Config.DNS.Protocol {
+	case "tcp-tls":
+		return s.proxy.ListenAndServeTLS(addr, s.Config.DNS.TLSCert, s.Config.DNS.TLSKey)
+	case "udp+tcp":
+		networks := []string{"udp", "tcp"}
+		errs := make(chan error, len(networks))
+		for _, network := range networks {
+			go func(network string) { errs <- s.proxy.ListenAndServe(addr, network) }(network)
+		}
+		for range networks {
+			if err := <-errs; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.proxy.ListenAndServe(addr, s.Config.DNS.Protocol)
 }
@@ -1,18 +1,26 @@
 package zdns
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/mpolden/zdns/cache"
 	"github.com/mpolden/zdns/dns"
+	"github.com/mpolden/zdns/dns/dnsutil"
 	"github.com/mpolden/zdns/hosts"
 )
 
@@ -33,6 +41,12 @@ const hostsFile2 = `
 192.0.2.6   badhost6
 `
 
+const domainsFile = `
+# domains only
+badhost7
+badhost8
+`
+
 func httpHandler(t *testing.T, response string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, err := w.Write([]byte(response)); err != nil {
@@ -57,17 +71,25 @@ func tempFile(t *testing.T, s string) (string, error) {
 	return f.Name(), nil
 }
 
+func setHosts(s *Server, hs hosts.Hosts) {
+	s.hosts.Store(&hostsState{hosts: hs, reverse: hs.Reverse()})
+}
+
 func testServer(t *testing.T, refreshInterval time.Duration) (*Server, func()) {
 	var (
-		httpSrv *httptest.Server
-		srv     *Server
-		file    string
-		err     error
+		httpSrv    *httptest.Server
+		domainsSrv *httptest.Server
+		srv        *Server
+		file       string
+		err        error
 	)
 	cleanup := func() {
 		if httpSrv != nil {
 			httpSrv.Close()
 		}
+		if domainsSrv != nil {
+			domainsSrv.Close()
+		}
 		if file != "" {
 			if err := os.Remove(file); err != nil {
 				t.Error(err)
@@ -80,13 +102,14 @@ func testServer(t *testing.T, refreshInterval time.Duration) (*Server, func()) {
 		}
 	}
 	httpSrv = httpServer(t, hostsFile1)
+	domainsSrv = httpServer(t, domainsFile)
 	file, err = tempFile(t, hostsFile2)
 	if err != nil {
 		defer cleanup()
 		t.Fatal(err)
 	}
 	config := Config{
-		DNS: DNSOptions{Listen: "0.0.0.0:53",
+		DNS: DNSOptions{Listen: Addrs{"0.0.0.0:53"},
 			hijackMode:      HijackZero,
 			refreshInterval: refreshInterval,
 		},
@@ -94,13 +117,14 @@ func testServer(t *testing.T, refreshInterval time.Duration) (*Server, func()) {
 		Hosts: []Hosts{
 			{URL: httpSrv.URL, Hijack: true},
 			{URL: "file://" + file, Hijack: true},
+			{URL: domainsSrv.URL, Hijack: true, Format: "domains"},
 			{Hosts: []string{"192.0.2.5 badhost5"}},
 		},
 	}
 	if err := config.load(); err != nil {
 		t.Fatal(err)
 	}
-	proxy, err := dns.NewProxy(cache.New(0, nil), nil, nil)
+	proxy, err := dns.NewProxy(cache.New(0, nil), nil, nil, dns.Config{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,10 +135,7 @@ func testServer(t *testing.T, refreshInterval time.Duration) (*Server, func()) {
 	}
 	ts := time.Now()
 	for {
-		srv.mu.RLock()
-		hostsLoaded := srv.hosts != nil
-		srv.mu.RUnlock()
-		if hostsLoaded {
+		if srv.hosts.Load() != nil {
 			break
 		}
 		time.Sleep(10 * time.Millisecond)
@@ -129,27 +150,456 @@ func TestLoadHosts(t *testing.T) {
 	s, cleanup := testServer(t, 10*time.Millisecond)
 	defer cleanup()
 	want := hosts.Hosts{
-		"badhost1": []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}},
-		"badhost2": []net.IPAddr{{IP: net.ParseIP("192.0.2.2")}},
-		"badhost3": []net.IPAddr{{IP: net.ParseIP("192.0.2.3")}},
-		"badhost4": []net.IPAddr{{IP: net.ParseIP("192.0.2.4")}},
-		"badhost6": []net.IPAddr{{IP: net.ParseIP("192.0.2.6")}},
+		"badhost1": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}},
+		"badhost2": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.2")}}},
+		"badhost3": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.3")}}},
+		"badhost4": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.4")}}},
+		"badhost6": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.6")}}},
+		"badhost7": {IPAddrs: []net.IPAddr{{IP: net.IPv4zero}, {IP: net.IPv6zero}}},
+		"badhost8": {IPAddrs: []net.IPAddr{{IP: net.IPv4zero}, {IP: net.IPv6zero}}},
 	}
-	got := s.hosts
+	got := s.loadedHosts().hosts
 	if !reflect.DeepEqual(want, got) {
 		t.Errorf("got %+v, want %+v", got, want)
 	}
 }
 
+func TestReady(t *testing.T) {
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, sources: make(map[string]*hostsSource), now: time.Now}
+	if s.Ready() {
+		t.Error("want server to not be ready before hosts are loaded")
+	}
+	s.loadHosts()
+	if !s.Ready() {
+		t.Error("want server to be ready after hosts are loaded")
+	}
+}
+
+func TestLoadHostsAllow(t *testing.T) {
+	file, err := tempFile(t, hostsFile2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			// Allowed hosts win even when listed before the hosts they remove
+			{Hosts: []string{"badhost4", "badhost5"}, Format: "domains", Allow: true},
+			{URL: "file://" + file, Hijack: true},
+			{Hosts: []string{"192.0.2.7 badhost7"}, Hijack: true},
+			{Hosts: []string{"192.0.2.7 badhost7"}, Allow: true},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, sources: make(map[string]*hostsSource), now: time.Now}
+	s.loadHosts()
+	want := hosts.Hosts{
+		"badhost6": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.6")}}},
+	}
+	if got := s.loadedHosts().hosts; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadHostsParallel(t *testing.T) {
+	delay := 200 * time.Millisecond
+	slowServer := func(delay time.Duration, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			io.WriteString(w, body)
+		}))
+	}
+	// The slowest source completes last, but its hosts are still removed by the sources following it
+	srv1 := slowServer(2*delay, "192.0.2.1 badhost1\n192.0.2.2 badhost2\n")
+	defer srv1.Close()
+	srv2 := slowServer(delay, "192.0.2.3 badhost3\n")
+	defer srv2.Close()
+	srv3 := slowServer(delay, "192.0.2.1 badhost1\n")
+	defer srv3.Close()
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			{URL: srv1.URL, Hijack: true},
+			{URL: srv2.URL, Hijack: true},
+			{URL: srv3.URL, Hijack: false},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, sources: make(map[string]*hostsSource), now: time.Now, httpClient: &http.Client{}}
+	start := time.Now()
+	s.loadHosts()
+	if elapsed, max := time.Since(start), 4*delay-delay/2; elapsed >= max {
+		t.Errorf("loading hosts took %s, want < %s", elapsed, max)
+	}
+	want := hosts.Hosts{
+		"badhost2": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.2")}}},
+		"badhost3": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.3")}}},
+	}
+	if got := s.loadedHosts().hosts; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestHTTPGetMaxElapsed(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close() // Fail request
+	}))
+	defer srv.Close()
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}, HostsFetchElapsed: "200ms", HostsFetchInterval: "10ms"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, httpClient: &http.Client{}}
+	start := time.Now()
+	if _, err := s.httpGet(srv.URL, nil); err == nil {
+		t.Fatal("want error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("httpGet returned after %s, want less than %s", elapsed, 2*time.Second)
+	}
+	if got := requests.Load(); got < 2 {
+		t.Errorf("got %d requests, want at least 2", got)
+	}
+
+	// No retries
+	requests.Store(0)
+	s.Config.DNS.hostsFetchElapsed = 0
+	if _, err := s.httpGet(srv.URL, nil); err == nil {
+		t.Fatal("want error")
+	}
+	if got, want := requests.Load(), int64(1); got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+}
+
+func TestHostsStatus(t *testing.T) {
+	goodSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "192.0.2.1 badhost1\n192.0.2.2 badhost2\n")
+	}))
+	defer goodSrv.Close()
+	badSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer badSrv.Close()
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			{URL: goodSrv.URL, Hijack: true},
+			{Hosts: []string{"192.0.2.3 badhost3"}, Hijack: true},
+			{URL: badSrv.URL, Hijack: true},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s := &Server{Config: config, sources: make(map[string]*hostsSource), now: func() time.Time { return now }, httpClient: &http.Client{}}
+	s.loadHosts()
+	want := []hosts.SourceStatus{
+		{Source: goodSrv.URL, Count: 2, LastLoaded: now},
+		{Source: "inline hosts", Count: 1, LastLoaded: now},
+		{Source: badSrv.URL, LastError: now},
+	}
+	if got := s.HostsStatus(); !reflect.DeepEqual(got, want) {
+		t.Errorf("HostsStatus() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadHostsBackoff(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	var goodRequests, badRequests atomic.Int64
+	goodSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodRequests.Add(1)
+		io.WriteString(w, "192.0.2.1 badhost1\n")
+	}))
+	defer goodSrv.Close()
+	badSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badRequests.Add(1)
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "192.0.2.2 badhost2\n")
+	}))
+	defer badSrv.Close()
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}, RefreshInterval: "10ms"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			{URL: goodSrv.URL, Hijack: true},
+			{URL: badSrv.URL, Hijack: true},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, done: make(chan bool, 1), sources: make(map[string]*hostsSource), now: time.Now, httpClient: &http.Client{}}
+	defer s.resetBackoffs()
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		start := time.Now()
+		for !cond() {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("timed out waiting for condition")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Failing source is retried by its own timer, without reading the other source
+	s.loadHosts()
+	waitFor(func() bool { return badRequests.Load() >= 3 })
+	if got, want := goodRequests.Load(), int64(1); got != want {
+		t.Errorf("got %d requests to good source, want %d", got, want)
+	}
+
+	// Source is loaded by its retry once it recovers
+	fail.Store(false)
+	waitFor(func() bool { return len(s.loadedHosts().hosts) == 2 })
+	s.mu.RLock()
+	backoffs := len(s.backoffs)
+	s.mu.RUnlock()
+	if backoffs != 0 {
+		t.Errorf("got %d sources backing off, want 0", backoffs)
+	}
+
+	// Source waiting to be retried is not read by a periodic reload, but an explicit reload reads it immediately
+	fail.Store(true)
+	s.Config.DNS.refreshInterval = time.Hour
+	s.loadHosts()
+	badRequests.Store(0)
+	s.loadHosts()
+	if got, want := badRequests.Load(), int64(0); got != want {
+		t.Errorf("got %d requests to failing source, want %d", got, want)
+	}
+	s.Reload()
+	if got, want := badRequests.Load(), int64(1); got != want {
+		t.Errorf("got %d requests to failing source, want %d", got, want)
+	}
+
+	// No retries are scheduled once the server is closed
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.loadHosts()
+	s.mu.RLock()
+	backoffs = len(s.backoffs)
+	s.mu.RUnlock()
+	if backoffs != 0 {
+		t.Errorf("got %d sources backing off, want 0", backoffs)
+	}
+}
+
+func TestHijackRegex(t *testing.T) {
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}, HijackMode: "hosts"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			{Hosts: []string{`^ad[sx]?[0-9]*\.`}, Format: "regex", Hijack: true},
+			{Hosts: []string{"ads.example.org"}, Format: "domains", Allow: true},
+			{Hosts: []string{"192.0.2.1 ads.example.net"}, Hijack: true},
+			{Hosts: []string{"192.0.2.2 bücher.example"}, Hijack: true},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, sources: make(map[string]*hostsSource), now: time.Now}
+	s.loadHosts()
+	var tests = []struct {
+		rtype uint16
+		name  string
+		out   string
+	}{
+		{dns.TypeA, "ads.example.com.", "ads.example.com.\t3600\tIN\tA\t0.0.0.0"},
+		{dns.TypeAAAA, "AdX1.example.com.", "AdX1.example.com.\t3600\tIN\tAAAA\t::"},
+		{dns.TypeA, "ads.example.net.", "ads.example.net.\t3600\tIN\tA\t192.0.2.1"}, // Exact match wins
+		{dns.TypeA, "ads.example.org.", ""},                                         // Allowed
+		{dns.TypeA, "xn--bcher-kva.example.", "xn--bcher-kva.example.\t3600\tIN\tA\t192.0.2.2"},
+		{dns.TypeA, "bad.example.com.", ""},
+		{dns.TypeA, "example.com.", ""},
+	}
+	for i, tt := range tests {
+		reply := s.hijack(&dns.Request{Type: tt.rtype, Name: tt.name})
+		if reply == nil {
+			reply = &dns.Reply{}
+		}
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: hijack(%q) = %q, want %q", i, tt.name, got, tt.out)
+		}
+	}
+}
+
+func TestReadHostsChecksum(t *testing.T) {
+	httpSrv := httpServer(t, hostsFile1)
+	defer httpSrv.Close()
+	sum := sha256.Sum256([]byte(hostsFile1))
+	checksum := hex.EncodeToString(sum[:])
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts:    []Hosts{{URL: httpSrv.URL, Hijack: true, SHA256: checksum}},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, httpClient: &http.Client{}, sources: make(map[string]*hostsSource), now: time.Now}
+
+	// Matching checksum
+	s.loadHosts()
+	if got, want := len(s.loadedHosts().hosts), 3; got != want {
+		t.Errorf("got %d hosts, want %d", got, want)
+	}
+
+	// Mismatching checksum keeps hosts from previous refresh
+	s.Config.Hosts[0].SHA256 = strings.Repeat("0", 64)
+	if _, err := s.readHosts(s.Config.Hosts[0], nil); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("got err = %v, want checksum mismatch", err)
+	}
+	s.loadHosts()
+	if got, want := len(s.loadedHosts().hosts), 3; got != want {
+		t.Errorf("got %d hosts, want %d", got, want)
+	}
+
+	// Mismatching checksum without previous refresh loads no hosts
+	s.sources = make(map[string]*hostsSource)
+	s.loadHosts()
+	if got, want := len(s.loadedHosts().hosts), 0; got != want {
+		t.Errorf("got %d hosts, want %d", got, want)
+	}
+}
+
+func TestReadHostsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"01-ads":     "192.0.2.1 badhost1", // No trailing newline
+		"02-tracker": "192.0.2.2 badhost2\n",
+		".hidden":    "192.0.2.3 badhost3\n",
+		"03-ads~":    "192.0.2.4 badhost4\n",
+		"04-archive": "\x1f\x8b\x08\x00\x00\x00\x00\x00",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "05-subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts:    []Hosts{{URL: "file://" + dir, Hijack: true}},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, sources: make(map[string]*hostsSource), now: time.Now}
+	s.loadHosts()
+	want := hosts.Hosts{
+		"badhost1": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}},
+		"badhost2": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.2")}}},
+	}
+	if got := s.loadedHosts().hosts; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadHostsNotModified(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []*http.Request
+	)
+	const etag = `"v1"`
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(hostsFile1))
+	}))
+	defer httpSrv.Close()
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts:    []Hosts{{URL: httpSrv.URL, Hijack: true}},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s := &Server{Config: config, httpClient: &http.Client{}, sources: make(map[string]*hostsSource), now: func() time.Time { return now }}
+
+	s.loadHosts()
+	now = now.Add(time.Hour)
+	s.loadHosts()
+
+	if got, want := len(requests), 2; got != want {
+		t.Fatalf("got %d requests, want %d", got, want)
+	}
+	if got := requests[0].Header.Get("If-None-Match"); got != "" {
+		t.Errorf("first request has If-None-Match = %q, want none", got)
+	}
+	if got := requests[1].Header.Get("If-None-Match"); got != etag {
+		t.Errorf("If-None-Match = %q, want %q", got, etag)
+	}
+	if got := requests[1].Header.Get("If-Modified-Since"); got != lastModified {
+		t.Errorf("If-Modified-Since = %q, want %q", got, lastModified)
+	}
+	// Hosts are kept, and the source counts as refreshed
+	if got, want := len(s.loadedHosts().hosts), 3; got != want {
+		t.Errorf("got %d hosts, want %d", got, want)
+	}
+	if got := s.sources[httpSrv.URL].refreshedAt; !got.Equal(now) {
+		t.Errorf("refreshedAt = %s, want %s", got, now)
+	}
+}
+
 func TestReloadHostsOnTick(t *testing.T) {
 	s, cleanup := testServer(t, 10*time.Millisecond)
 	defer cleanup()
-	oldHosts := s.hosts
+	go s.reloadPeriodically(10 * time.Millisecond)
+	oldHosts := s.hosts.Load()
 	if oldHosts == nil {
-		t.Fatal("expected matcher to be initialized")
+		t.Fatal("expected hosts to be initialized")
 	}
 	ts := time.Now()
-	for &s.hosts == &oldHosts {
+	for s.hosts.Load() == oldHosts {
 		time.Sleep(10 * time.Millisecond)
 		if time.Since(ts) > 2*time.Second {
 			t.Fatal("timed out waiting hosts to load")
@@ -157,6 +607,28 @@ func TestReloadHostsOnTick(t *testing.T) {
 	}
 }
 
+func TestHijackDuringReload(t *testing.T) {
+	s, cleanup := testServer(t, time.Millisecond)
+	defer cleanup()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: "badhost1."}); reply == nil {
+					t.Error("expected badhost1 to be hijacked")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		s.Reload()
+	}
+	wg.Wait()
+}
+
 func TestNonFqdn(t *testing.T) {
 	var tests = []struct {
 		in, out string
@@ -176,13 +648,13 @@ func TestNonFqdn(t *testing.T) {
 func TestHijack(t *testing.T) {
 	s := &Server{
 		Config: Config{},
-		hosts: hosts.Hosts{
-			"badhost1": []net.IPAddr{
-				{IP: net.ParseIP("192.0.2.1")},
-				{IP: net.ParseIP("2001:db8::1")},
-			},
-		},
 	}
+	setHosts(s, hosts.Hosts{
+		"badhost1": {IPAddrs: []net.IPAddr{
+			{IP: net.ParseIP("192.0.2.1")},
+			{IP: net.ParseIP("2001:db8::1")},
+		}},
+	})
 
 	var tests = []struct {
 		rtype uint16
@@ -211,4 +683,656 @@ func TestHijack(t *testing.T) {
 			t.Errorf("#%d: hijack(%+v) = %q, want %q", i, req, reply.String(), tt.out)
 		}
 	}
+
+	// Configured addresses are used instead of the zero addresses
+	s.Config.DNS.hijackMode = HijackZero
+	s.Config.DNS.hijackAddress = net.ParseIP("192.168.1.2").To4()
+	s.Config.DNS.hijackAddressV6 = net.ParseIP("fd00::2")
+	tests = []struct {
+		rtype uint16
+		rname string
+		mode  int
+		out   string
+	}{
+		{dns.TypeA, "badhost1", HijackZero, "badhost1\t3600\tIN\tA\t192.168.1.2"},
+		{dns.TypeAAAA, "badhost1", HijackZero, "badhost1\t3600\tIN\tAAAA\tfd00::2"},
+		{dns.TypeA, "goodhost1", HijackZero, ""},
+	}
+	for i, tt := range tests {
+		req := &dns.Request{Type: tt.rtype, Name: tt.rname}
+		reply := s.hijack(&dns.Request{Type: tt.rtype, Name: tt.rname})
+		if reply == nil && tt.out == "" {
+			reply = &dns.Reply{}
+		}
+		if reply.String() != tt.out {
+			t.Errorf("#%d: hijack(%+v) = %q, want %q", i, req, reply.String(), tt.out)
+		}
+	}
+}
+
+func TestHijackNODATA(t *testing.T) {
+	s := &Server{
+		Config: Config{DNS: DNSOptions{hijackMode: HijackHosts}},
+	}
+	setHosts(s, hosts.Hosts{
+		"host4": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}},
+		"host6": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}}},
+	})
+	var tests = []struct {
+		rtype uint16
+		rname string
+	}{
+		{dns.TypeAAAA, "host4."},
+		{dns.TypeA, "host6."},
+	}
+	for i, tt := range tests {
+		req := &dns.Request{Type: tt.rtype, Name: tt.rname}
+		if got, want := s.hijack(req), dns.ReplyNODATA(tt.rname, 0); !reflect.DeepEqual(got, want) {
+			t.Errorf("#%d: hijack(%+v) = %+v, want %+v", i, req, got, want)
+		}
+	}
+}
+
+func TestHijackNXDOMAIN(t *testing.T) {
+	s := &Server{
+		Config: Config{DNS: DNSOptions{hijackMode: HijackNXDOMAIN}},
+	}
+	setHosts(s, hosts.Hosts{
+		"badhost1": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("0.0.0.0")}}},
+	})
+	var tests = []struct {
+		rtype uint16
+		rname string
+		nx    bool
+	}{
+		{dns.TypeA, "badhost1", true},
+		{dns.TypeAAAA, "badhost1", true},
+		{15 /* MX */, "badhost1", true},
+		{dns.TypeA, "goodhost1", false},
+	}
+	for i, tt := range tests {
+		reply := s.hijack(&dns.Request{Type: tt.rtype, Name: tt.rname})
+		if got := reply != nil; got != tt.nx {
+			t.Errorf("#%d: hijack(%d %q) returned NXDOMAIN = %t, want %t", i, tt.rtype, tt.rname, got, tt.nx)
+		}
+	}
+}
+
+func TestHijackTTL(t *testing.T) {
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}, HijackMode: "hosts"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			{Hosts: []string{"0.0.0.0 badhost1", "0.0.0.0 badhost2 ttl=30"}, Hijack: true, TTL: "1m"},
+			{Hosts: []string{"192.0.2.1 host1 ttl=86400", "192.0.2.2 host2", "2001:db8::2 host2"}, Hijack: true},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, sources: make(map[string]*hostsSource), now: time.Now, httpClient: &http.Client{}}
+	s.loadHosts()
+	var tests = []struct {
+		rtype uint16
+		rname string
+		mode  int
+		out   string
+	}{
+		{dns.TypeA, "badhost1", HijackHosts, "badhost1\t60\tIN\tA\t0.0.0.0"},       // TTL of source
+		{dns.TypeA, "badhost2", HijackHosts, "badhost2\t30\tIN\tA\t0.0.0.0"},       // TTL of line takes precedence
+		{dns.TypeA, "host1", HijackHosts, "host1\t86400\tIN\tA\t192.0.2.1"},        // TTL of line
+		{dns.TypeAAAA, "host2", HijackHosts, "host2\t3600\tIN\tAAAA\t2001:db8::2"}, // Default TTL
+		{dns.TypeA, "badhost1", HijackZero, "badhost1\t60\tIN\tA\t0.0.0.0"},
+		{dns.TypeAAAA, "badhost2", HijackZero, "badhost2\t30\tIN\tAAAA\t::"},
+	}
+	for i, tt := range tests {
+		s.Config.DNS.hijackMode = tt.mode
+		req := &dns.Request{Type: tt.rtype, Name: tt.rname}
+		reply := s.hijack(req)
+		if reply == nil {
+			t.Errorf("#%d: hijack(%+v) = nil, want %q", i, req, tt.out)
+			continue
+		}
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: hijack(%+v) = %q, want %q", i, req, got, tt.out)
+		}
+	}
+}
+
+func TestHijackNegativeTTL(t *testing.T) {
+	s := &Server{
+		Config: Config{DNS: DNSOptions{hijackNegativeTTL: 5 * time.Minute}},
+	}
+	setHosts(s, hosts.Hosts{
+		"badhost1": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("0.0.0.0")}}},
+	})
+	var tests = []struct {
+		mode  int
+		rtype uint16
+		want  *dns.Reply
+	}{
+		{HijackEmpty, dns.TypeA, dns.ReplyNODATA("badhost1.", 300)},
+		{HijackNXDOMAIN, dns.TypeA, dns.ReplyNXDOMAIN("badhost1.", 300)},
+		{HijackNXDOMAIN, 15 /* MX */, dns.ReplyNXDOMAIN("badhost1.", 300)},
+	}
+	for i, tt := range tests {
+		s.Config.DNS.hijackMode = tt.mode
+		req := &dns.Request{Type: tt.rtype, Name: "badhost1."}
+		if got := s.hijack(req); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("#%d: hijack(%+v) = %+v, want %+v", i, req, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultReject(t *testing.T) {
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}, DefaultAction: "reject", HijackNegativeTTL: "5m"},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+		Hosts: []Hosts{
+			{Hosts: []string{"allowed.example.com", "*.example.org"}, Format: "domains", Allow: true},
+			{Hosts: []string{"192.0.2.1 myhost"}, Hijack: true},
+		},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: config, sources: make(map[string]*hostsSource), now: time.Now}
+
+	// Names are not rejected before hosts have loaded
+	if got, want := s.handle(&dns.Request{Type: dns.TypeA, Name: "example.com."}), dns.ReplySERVFAIL(); !reflect.DeepEqual(got, want) {
+		t.Errorf("handle() = %+v, want %+v", got, want)
+	}
+
+	s.loadHosts()
+	var tests = []struct {
+		rtype uint16
+		rname string
+		want  *dns.Reply
+	}{
+		{dns.TypeA, "allowed.example.com.", nil},
+		{dns.TypeA, "ALLOWED.example.com.", nil},
+		{dns.TypeA, "foo.example.org.", nil},     // Wildcard
+		{dns.TypeA, "bar.foo.example.org.", nil}, // Wildcard matches any depth
+		{15 /* MX */, "myhost.", nil},            // Name exists in hosts
+		{dns.TypeA, "example.com.", dns.ReplyNXDOMAIN("example.com.", 300)},
+		{dns.TypeA, "example.org.", dns.ReplyNXDOMAIN("example.org.", 300)}, // Wildcard does not match parent
+		{dns.TypeAAAA, "other.example.com.", dns.ReplyNXDOMAIN("other.example.com.", 300)},
+		{dns.TypeA, "myhost.", dns.ReplyA("myhost.", net.IPv4zero)},
+	}
+	for i, tt := range tests {
+		req := &dns.Request{Type: tt.rtype, Name: tt.rname}
+		if got := s.handle(req); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("#%d: handle(%+v) = %+v, want %+v", i, req, got, tt.want)
+		}
+	}
+
+	// Names are resolved by default
+	s.Config.DNS.defaultAction = DefaultAllow
+	if got := s.handle(&dns.Request{Type: dns.TypeA, Name: "example.com."}); got != nil {
+		t.Errorf("handle() = %+v, want nil", got)
+	}
+}
+
+func TestHijackChaos(t *testing.T) {
+	s := &Server{
+		Config: Config{DNS: DNSOptions{ChaosVersion: "zdns 1.0"}},
+	}
+	setHosts(s, hosts.Hosts{
+		"version.bind": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("0.0.0.0")}}},
+	})
+	var tests = []struct {
+		rtype  uint16
+		rclass uint16
+		rname  string
+		out    string
+	}{
+		{dns.TypeTXT, dns.ClassCHAOS, "version.bind.", "version.bind.\t0\tIN\tTXT\t\"zdns 1.0\""},
+		{dns.TypeTXT, dns.ClassCHAOS, "VERSION.BIND.", "VERSION.BIND.\t0\tIN\tTXT\t\"zdns 1.0\""},
+		{dns.TypeA, dns.ClassCHAOS, "version.bind.", ""},
+		{dns.TypeTXT, dns.ClassCHAOS, "hostname.bind.", ""}, // Not configured
+		{dns.TypeA, dns.ClassINET, "version.bind.", "version.bind.\t3600\tIN\tA\t0.0.0.0"},
+	}
+	for i, tt := range tests {
+		req := &dns.Request{Type: tt.rtype, Class: tt.rclass, Name: tt.rname}
+		reply := s.hijack(req)
+		if reply == nil {
+			if tt.out != "" {
+				t.Errorf("#%d: hijack(%+v) = nil, want %q", i, req, tt.out)
+			}
+			continue
+		}
+		if got := reply.String(); got != tt.out {
+			t.Errorf("#%d: hijack(%+v) = %q, want %q", i, req, got, tt.out)
+		}
+	}
+}
+
+func TestHijackAlias(t *testing.T) {
+	s := &Server{
+		Config: Config{DNS: DNSOptions{hijackMode: HijackHosts}},
+	}
+	setHosts(s, hosts.Hosts{
+		"host1":  {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}},
+		"alias1": {Target: "host1"},
+		"alias2": {Target: "alias1"},
+		"alias3": {Target: "example.com"},
+		"loop1":  {Target: "loop2"},
+		"loop2":  {Target: "loop1"},
+	})
+	var tests = []struct {
+		rtype uint16
+		rname string
+		out   string
+	}{
+		{dns.TypeA, "alias1.", "alias1.\t3600\tIN\tCNAME\thost1.\nhost1.\t3600\tIN\tA\t192.0.2.1"},
+		{dns.TypeA, "alias2.", "alias2.\t3600\tIN\tCNAME\talias1.\nalias1.\t3600\tIN\tCNAME\thost1.\nhost1.\t3600\tIN\tA\t192.0.2.1"},
+		{dns.TypeAAAA, "alias1.", "alias1.\t3600\tIN\tCNAME\thost1."},
+		{dns.TypeCNAME, "alias2.", "alias2.\t3600\tIN\tCNAME\talias1."},
+		{15 /* MX */, "alias1.", "alias1.\t3600\tIN\tCNAME\thost1."},
+		{dns.TypeA, "alias3.", "alias3.\t3600\tIN\tCNAME\texample.com."},
+	}
+	for i, tt := range tests {
+		req := &dns.Request{Type: tt.rtype, Name: tt.rname}
+		reply := s.hijack(req)
+		if reply == nil {
+			t.Fatalf("#%d: hijack(%+v) = nil", i, req)
+		}
+		if reply.String() != tt.out {
+			t.Errorf("#%d: hijack(%+v) = %q, want %q", i, req, reply.String(), tt.out)
+		}
+	}
+
+	// Alias loops are cut off
+	reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: "loop1."})
+	if got, want := strings.Count(reply.String(), "CNAME"), maxAliasDepth+1; got != want {
+		t.Errorf("got %d CNAME records, want %d", got, want)
+	}
+}
+
+func TestReverseIP(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out net.IP
+	}{
+		{"50.2.0.192.in-addr.arpa.", net.ParseIP("192.0.2.50")},
+		{"50.2.0.192.IN-ADDR.ARPA", net.ParseIP("192.0.2.50")},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", net.ParseIP("2001:db8::1")},
+		{"2.0.192.in-addr.arpa.", nil},
+		{"256.2.0.192.in-addr.arpa.", nil},
+		{"0.8.b.d.0.1.0.0.2.ip6.arpa.", nil},
+		{"example.com.", nil},
+	}
+	for i, tt := range tests {
+		if got := reverseIP(tt.in); !got.Equal(tt.out) {
+			t.Errorf("#%d: reverseIP(%q) = %s, want %s", i, tt.in, got, tt.out)
+		}
+	}
+}
+
+func TestHijackPTR(t *testing.T) {
+	hs := hosts.Hosts{
+		"printer": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.50")}, {IP: net.ParseIP("2001:db8::50")}}},
+	}
+	s := &Server{
+		Config: Config{DNS: DNSOptions{hijackMode: HijackHosts}},
+	}
+	setHosts(s, hs)
+	var tests = []struct {
+		rname string
+		out   string
+	}{
+		{"50.2.0.192.in-addr.arpa.", "50.2.0.192.in-addr.arpa.\t3600\tIN\tPTR\tprinter."},
+		{"0.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+			"0.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.\t3600\tIN\tPTR\tprinter."},
+		{"51.2.0.192.in-addr.arpa.", ""}, // Unknown address
+	}
+	for i, tt := range tests {
+		req := &dns.Request{Type: dns.TypePTR, Name: tt.rname}
+		reply := s.hijack(req)
+		if reply == nil {
+			reply = &dns.Reply{}
+		}
+		if reply.String() != tt.out {
+			t.Errorf("#%d: hijack(%+v) = %q, want %q", i, req, reply.String(), tt.out)
+		}
+	}
+}
+
+func TestHijackLocalOnly(t *testing.T) {
+	s := &Server{
+		Config: Config{DNS: DNSOptions{LocalOnly: true, hijackMode: HijackHosts}},
+	}
+	setHosts(s, hosts.Hosts{
+		"host1": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}},
+	})
+	var tests = []struct {
+		rtype uint16
+		rname string
+		reply bool
+	}{
+		{dns.TypeA, "host1", true},
+		{15 /* MX */, "host1", true}, // Existing name without records of this type
+		{dns.TypeA, "host2", false},
+		{15 /* MX */, "host2", false},
+	}
+	for i, tt := range tests {
+		reply := s.hijack(&dns.Request{Type: tt.rtype, Name: tt.rname})
+		if got := reply != nil; got != tt.reply {
+			t.Errorf("#%d: hijack(%d, %q) != nil = %t, want %t", i, tt.rtype, tt.rname, got, tt.reply)
+		}
+	}
+}
+
+func TestHijackSplitHorizon(t *testing.T) {
+	s := &Server{
+		Config: Config{
+			DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}, HijackMode: "zero"},
+			Resolver: ResolverOptions{TimeoutString: "0"},
+			SplitHorizon: []SplitHorizon{
+				{Subnets: []string{"192.168.0.0/16"}, Hosts: []string{"192.168.1.10 nas.example.com", "192.168.1.20 bücher.example.com"}},
+				{Subnets: []string{"0.0.0.0/0", "::/0"}, Hosts: []string{"198.51.100.10 nas.example.com"}},
+			},
+		},
+	}
+	setHosts(s, hosts.Hosts{
+		"badhost1": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}},
+	})
+	if err := s.Config.load(); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		rtype      uint16
+		rname      string
+		remoteAddr string
+		out        string
+	}{
+		{dns.TypeA, "nas.example.com.", "192.168.1.42", "nas.example.com.\t3600\tIN\tA\t192.168.1.10"},
+		{dns.TypeA, "nas.example.com.", "203.0.113.42", "nas.example.com.\t3600\tIN\tA\t198.51.100.10"},
+		{dns.TypeAAAA, "nas.example.com.", "192.168.1.42", ""}, // No address of this type
+		{dns.TypeA, "badhost1.", "192.168.1.42", "badhost1.\t3600\tIN\tA\t0.0.0.0"},
+		{dns.TypeA, "goodhost1.", "192.168.1.42", ""},
+		{dns.TypeA, "xn--bcher-kva.example.com.", "192.168.1.42", "xn--bcher-kva.example.com.\t3600\tIN\tA\t192.168.1.20"},
+		{dns.TypeA, "bücher.example.com.", "192.168.1.42", "b\\195\\188cher.example.com.\t3600\tIN\tA\t192.168.1.20"},
+	}
+	for i, tt := range tests {
+		req := &dns.Request{Type: tt.rtype, Name: tt.rname, RemoteAddr: net.ParseIP(tt.remoteAddr)}
+		reply := s.hijack(req)
+		if reply == nil {
+			reply = &dns.Reply{}
+		}
+		if reply.String() != tt.out {
+			t.Errorf("#%d: hijack(%+v) = %q, want %q", i, req, reply.String(), tt.out)
+		}
+	}
+}
+
+func TestAnswerZone(t *testing.T) {
+	zone1, err := tempFile(t, "$TTL 3600\n@ IN MX 10 mail\nmail IN A 192.0.2.25\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(zone1)
+	zone2, err := tempFile(t, "$TTL 3600\n@ IN TXT \"sub\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(zone2)
+	s := &Server{
+		Config: Config{
+			DNS: DNSOptions{hijackMode: HijackHosts},
+			Zones: []Zone{
+				{Origin: "example.internal.", File: zone1},
+				{Origin: "sub.example.internal.", File: zone2},
+			},
+		},
+	}
+	setHosts(s, hosts.Hosts{
+		"mail.example.internal": {IPAddrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}},
+	})
+	s.loadZones()
+
+	var tests = []struct {
+		rtype uint16
+		rname string
+		out   string
+	}{
+		{15 /* MX */, "example.internal.", "example.internal.\t3600\tIN\tMX\t10 mail.example.internal."},
+		{16 /* TXT */, "sub.example.internal.", "sub.example.internal.\t3600\tIN\tTXT\t\"sub\""},
+		{dns.TypeA, "mail.example.internal.", "mail.example.internal.\t3600\tIN\tA\t192.0.2.1"}, // Hosts take precedence
+		{dns.TypeA, "example.com.", ""},
+	}
+	for i, tt := range tests {
+		req := &dns.Request{Type: tt.rtype, Name: tt.rname}
+		reply := s.handle(req)
+		if reply == nil {
+			reply = &dns.Reply{}
+		}
+		if reply.String() != tt.out {
+			t.Errorf("#%d: handle(%+v) = %q, want %q", i, req, reply.String(), tt.out)
+		}
+	}
+
+	// Previously loaded zone is kept if it can no longer be read
+	os.Remove(zone1)
+	s.loadZones()
+	if reply := s.handle(&dns.Request{Type: 15, Name: "example.internal."}); reply == nil || reply.String() == "" {
+		t.Errorf("expected zone to be kept after failed reload")
+	}
+}
+
+func TestHostsStale(t *testing.T) {
+	var tests = []struct {
+		policy   string
+		goodhost string
+	}{
+		{"open", ""},
+		{"closed", "goodhost1\t3600\tIN\tA\t0.0.0.0"},
+	}
+	for i, tt := range tests {
+		file, err := tempFile(t, hostsFile2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := Config{
+			DNS: DNSOptions{Listen: Addrs{"0.0.0.0:53"},
+				HostsStaleString: "1h",
+				HostsStalePolicy: tt.policy,
+			},
+			Resolver: ResolverOptions{TimeoutString: "0"},
+			Hosts:    []Hosts{{URL: "file://" + file, Hijack: true}},
+		}
+		if err := config.load(); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		s := &Server{
+			Config:    config,
+			sources:   make(map[string]*hostsSource),
+			startedAt: now,
+			now:       func() time.Time { return now },
+		}
+		assertHijack := func(name, want string) {
+			reply := s.hijack(&dns.Request{Type: dns.TypeA, Name: name})
+			if reply == nil {
+				reply = &dns.Reply{}
+			}
+			if got := reply.String(); got != want {
+				t.Errorf("#%d: hijack(%q) = %q, want %q", i, name, got, want)
+			}
+		}
+
+		// Initial refresh succeeds
+		s.loadHosts()
+		assertHijack("badhost4", "badhost4\t3600\tIN\tA\t0.0.0.0")
+		assertHijack("goodhost1", "")
+
+		// Refresh fails, but hosts from previous refresh are kept
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(30 * time.Minute)
+		s.loadHosts()
+		if s.stale {
+			t.Errorf("#%d: stale = %t, want %t", i, s.stale, false)
+		}
+		assertHijack("badhost4", "badhost4\t3600\tIN\tA\t0.0.0.0")
+		assertHijack("goodhost1", "")
+
+		// Refresh keeps failing until threshold is exceeded
+		now = now.Add(time.Hour)
+		s.loadHosts()
+		if !s.stale {
+			t.Errorf("#%d: stale = %t, want %t", i, s.stale, true)
+		}
+		assertHijack("badhost4", "badhost4\t3600\tIN\tA\t0.0.0.0")
+		assertHijack("goodhost1", tt.goodhost)
+	}
+}
+
+func TestHijackStaleClosed(t *testing.T) {
+	now := time.Now()
+	s := &Server{
+		Config: Config{DNS: DNSOptions{hostsStalePolicy: StaleClosed, hijackNegativeTTL: 5 * time.Minute}},
+		now:    func() time.Time { return now },
+	}
+	s.hosts.Store(&hostsState{staleAt: now.Add(-time.Minute)})
+	var tests = []struct {
+		mode  int
+		rtype uint16
+		want  *dns.Reply
+	}{
+		{HijackZero, dns.TypeA, dns.ReplyA("goodhost1.", net.IPv4zero)},
+		{HijackZero, 15 /* MX */, dns.ReplyNODATA("goodhost1.", 300)},
+		{HijackZero, 65 /* HTTPS */, dns.ReplyNODATA("goodhost1.", 300)},
+		{HijackEmpty, dns.TypeTXT, dns.ReplyNODATA("goodhost1.", 300)},
+		{HijackNXDOMAIN, dns.TypeA, dns.ReplyNXDOMAIN("goodhost1.", 300)},
+		{HijackNXDOMAIN, 15 /* MX */, dns.ReplyNXDOMAIN("goodhost1.", 300)},
+	}
+	for i, tt := range tests {
+		s.Config.DNS.hijackMode = tt.mode
+		req := &dns.Request{Type: tt.rtype, Name: "goodhost1."}
+		if got := s.hijack(req); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("#%d: hijack(%+v) = %+v, want %+v", i, req, got, tt.want)
+		}
+	}
+}
+
+// udpResolver starts a resolver which answers every query with an empty response.
+func udpResolver(t *testing.T) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 12 {
+				continue
+			}
+			buf[2] |= 0x80 // Set QR bit
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// unreachableResolver returns the address of a closed UDP port.
+func unreachableResolver(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestCheckResolvers(t *testing.T) {
+	reachable, closeResolver := udpResolver(t)
+	defer closeResolver()
+	unreachable := unreachableResolver(t)
+	var tests = []struct {
+		resolvers []string
+		ok        bool
+	}{
+		{[]string{"udp://" + reachable}, true},
+		{[]string{"udp://" + unreachable, "udp://" + reachable}, true},
+		{[]string{"udp://" + unreachable}, false},
+	}
+	for i, tt := range tests {
+		config := Config{
+			DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}, Resolvers: tt.resolvers, ResolverHealthcheck: true},
+			Resolver: ResolverOptions{TimeoutString: "500ms"},
+		}
+		if err := config.load(); err != nil {
+			t.Fatal(err)
+		}
+		err := checkResolvers(config)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("#%d: checkResolvers() = %v, want ok = %t", i, err, tt.ok)
+		}
+	}
+
+	// Server fails to start when no resolver is reachable
+	config := Config{
+		DNS:      DNSOptions{Listen: Addrs{"0.0.0.0:53"}, Resolvers: []string{"udp://" + unreachable}, ResolverHealthcheck: true},
+		Resolver: ResolverOptions{TimeoutString: "500ms"},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(nil, config); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestListenAndServeMultiple(t *testing.T) {
+	resolver, closeResolver := udpResolver(t)
+	defer closeResolver()
+	addrs := Addrs{unreachableResolver(t), unreachableResolver(t)}
+	config := Config{
+		DNS:      DNSOptions{Listen: addrs},
+		Resolver: ResolverOptions{TimeoutString: "0"},
+	}
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	client := dnsutil.NewClient(resolver, dnsutil.Config{Network: "udp", Timeout: time.Second})
+	proxy, err := dns.NewProxy(cache.New(0, nil), client, nil, dns.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(proxy, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+
+	// Requests are answered on all addresses
+	for _, addr := range addrs {
+		c := dnsutil.NewClient(addr, dnsutil.Config{Network: "udp", Timeout: 100 * time.Millisecond})
+		ts := time.Now()
+		for dnsutil.Probe(c, "example.com") != nil {
+			if time.Since(ts) > 2*time.Second {
+				t.Fatalf("timed out waiting for server to answer on %s", addr)
+			}
+		}
+	}
+
+	// Closing the proxy stops all servers
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for servers to stop")
+	}
 }
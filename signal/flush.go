@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package signal
+
+import (
+	"os"
+	"syscall"
+)
+
+// flushSignal is the signal that triggers flushing.
+var flushSignal os.Signal = syscall.SIGUSR1
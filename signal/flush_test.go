@@ -0,0 +1,28 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package signal
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandlerFlush(t *testing.T) {
+	h := NewHandler(make(chan os.Signal, 1))
+	var flushes atomic.Int32
+	h.OnFlush(func() { flushes.Add(1) })
+	h.OnFlush(func() { flushes.Add(1) })
+
+	h.signal <- syscall.SIGUSR1
+	ts := time.Now()
+	for flushes.Load() < 2 {
+		time.Sleep(10 * time.Millisecond)
+		if time.Since(ts) > 2*time.Second {
+			t.Fatalf("timed out waiting for handler of signal %s", syscall.SIGUSR1)
+		}
+	}
+}
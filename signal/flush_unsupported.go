@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package signal
+
+import "os"
+
+// flushSignal is nil as there is no suitable signal for flushing on this platform.
+var flushSignal os.Signal
@@ -18,6 +18,7 @@ type Reloader interface {
 type Handler struct {
 	signal    chan os.Signal
 	reloaders []Reloader
+	flushers  []func()
 	closers   []io.Closer
 	wg        sync.WaitGroup
 }
@@ -34,6 +35,9 @@ func NewHandler(c chan os.Signal) *Handler {
 // OnReload registers a reloader to call for the signal SIGHUP.
 func (h *Handler) OnReload(r Reloader) { h.reloaders = append(h.reloaders, r) }
 
+// OnFlush registers a function to call for the signal SIGUSR1. Flushing is not supported on Windows.
+func (h *Handler) OnFlush(fn func()) { h.flushers = append(h.flushers, fn) }
+
 // OnClose registers a closer to call for signals SIGTERM and SIGINT.
 func (h *Handler) OnClose(c io.Closer) { h.closers = append(h.closers, c) }
 
@@ -54,6 +58,11 @@ func (h *Handler) readSignal() {
 			for _, r := range h.reloaders {
 				r.Reload()
 			}
+		case flushSignal:
+			log.Printf("received signal %s: flushing", sig)
+			for _, fn := range h.flushers {
+				fn()
+			}
 		case syscall.SIGTERM, syscall.SIGINT:
 			log.Printf("received signal %s: shutting down", sig)
 			for _, c := range h.closers {
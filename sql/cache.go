@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"container/list"
 	"log"
 	"sync"
 
@@ -13,6 +14,9 @@ const (
 	resetOp
 )
 
+// maxPendingWrites is the default maximum number of writes queued by a Cache.
+const maxPendingWrites = 1024
+
 type query struct {
 	op    int
 	key   uint32
@@ -20,30 +24,71 @@ type query struct {
 }
 
 // Cache is a persistent DNS cache. Values added to the cache are written to a SQL database.
+//
+// Writes are queued and never block the caller. Repeated writes of the same key are coalesced, and removals of keys that
+// have not been written are discarded. If the queue is full, new writes of values are dropped until the queue has been
+// drained. Removals are always queued, so that values removed from the cache are never kept in the database.
 type Cache struct {
-	wg     sync.WaitGroup
-	queue  chan query
-	client *Client
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	queue    *list.List
+	sets     map[uint32]*list.Element // Pending writes by key
+	stored   map[uint32]bool          // Keys that are written, or being written, to the database
+	capacity int
+	dropped  uint64
+	notify   chan bool
+	done     chan struct{} // Closed when the cache is closed, which stops the consumer of the queue
+	closed   bool
+	client   *Client
+	compress bool
+}
+
+// CacheConfig is a structure used to configure a Cache.
+type CacheConfig struct {
+	// Compress controls whether messages are compressed when written to the database. Compressed and uncompressed
+	// messages can be read regardless of this setting.
+	Compress bool
 }
 
 // CacheStats containts cache statistics.
 type CacheStats struct {
-	PendingTasks int
+	PendingTasks  int
+	DroppedWrites uint64
 }
 
 // NewCache creates a new cache using client for persistence.
-func NewCache(client *Client) *Cache {
-	c := &Cache{
-		queue:  make(chan query, 1024),
-		client: client,
-	}
+func NewCache(client *Client) *Cache { return NewCacheWithConfig(client, CacheConfig{}) }
+
+// NewCacheWithConfig creates a new cache using client for persistence, configured by config.
+func NewCacheWithConfig(client *Client, config CacheConfig) *Cache {
+	c := newCache(client, maxPendingWrites)
+	c.compress = config.Compress
 	go c.readQueue()
 	return c
 }
 
-// Close consumes any outstanding writes and closes the cache.
+func newCache(client *Client, capacity int) *Cache {
+	return &Cache{
+		queue:    list.New(),
+		sets:     make(map[uint32]*list.Element),
+		stored:   make(map[uint32]bool),
+		capacity: capacity,
+		notify:   make(chan bool, 1),
+		done:     make(chan struct{}),
+		client:   client,
+	}
+}
+
+// Close consumes any outstanding writes and closes the cache. Writes queued after the cache is closed are discarded.
 func (c *Cache) Close() error {
+	c.mu.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mu.Unlock()
 	c.wg.Wait()
+	if !closed {
+		close(c.done)
+	}
 	return nil
 }
 
@@ -68,46 +113,132 @@ func (c *Cache) Read() []cache.Value {
 		return nil
 	}
 	values := make([]cache.Value, 0, len(entries))
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, entry := range entries {
 		unpacked, err := cache.Unpack(entry.Data)
 		if err != nil {
 			panic(err) // Should never happen
 		}
 		values = append(values, unpacked)
+		c.stored[unpacked.Key] = true
 	}
 	return values
 }
 
 // Stats returns cache statistics.
-func (c *Cache) Stats() CacheStats { return CacheStats{PendingTasks: len(c.queue)} }
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{PendingTasks: c.queue.Len(), DroppedWrites: c.dropped}
+}
 
 func (c *Cache) enqueue(q query) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	switch q.op {
+	case setOp:
+		c.discard(q.key) // Replaced by this write
+	case removeOp:
+		c.discard(q.key)
+		if !c.stored[q.key] {
+			c.mu.Unlock()
+			return // Nothing to remove
+		}
+	case resetOp:
+		for el := c.queue.Front(); el != nil; el = el.Next() {
+			c.wg.Done()
+		}
+		c.queue.Init()
+		c.sets = make(map[uint32]*list.Element)
+	}
+	if q.op == setOp && c.queue.Len() >= c.capacity {
+		c.dropped++
+		c.mu.Unlock()
+		return
+	}
 	c.wg.Add(1)
-	c.queue <- q
+	el := c.queue.PushBack(q)
+	if q.op == setOp {
+		c.sets[q.key] = el
+	}
+	c.mu.Unlock()
+	select {
+	case c.notify <- true:
+	default:
+	}
+}
+
+// discard removes any pending write of key from the queue.
+func (c *Cache) discard(key uint32) {
+	if el, ok := c.sets[key]; ok {
+		c.queue.Remove(el)
+		delete(c.sets, key)
+		c.wg.Done()
+	}
+}
+
+// next removes and returns the first query in the queue.
+func (c *Cache) next() (query, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el := c.queue.Front()
+	if el == nil {
+		return query{}, false
+	}
+	q := c.queue.Remove(el).(query)
+	switch q.op {
+	case setOp:
+		delete(c.sets, q.key)
+		c.stored[q.key] = true
+	case removeOp:
+		delete(c.stored, q.key)
+	case resetOp:
+		c.stored = make(map[uint32]bool)
+	}
+	return q, true
 }
 
 func (c *Cache) readQueue() {
-	for q := range c.queue {
-		switch q.op {
-		case setOp:
-			packed, err := q.value.Pack()
-			if err != nil {
-				log.Fatalf("failed to pack value: %s", err)
-			}
-			if err := c.client.writeCacheValue(q.key, packed); err != nil {
-				log.Printf("failed to write key=%d data=%q: %s", q.key, packed, err)
-			}
-		case removeOp:
-			if err := c.client.removeCacheValue(q.key); err != nil {
-				log.Printf("failed to remove key=%d: %s", q.key, err)
+	for {
+		select {
+		case <-c.notify:
+			for q, ok := c.next(); ok; q, ok = c.next() {
+				c.execute(q)
+				c.wg.Done()
 			}
-		case resetOp:
-			if err := c.client.truncateCache(); err != nil {
-				log.Printf("failed to truncate cache: %s", err)
-			}
-		default:
-			log.Printf("unhandled operation %d", q.op)
+		case <-c.done:
+			return
 		}
-		c.wg.Done()
+	}
+}
+
+func (c *Cache) execute(q query) {
+	switch q.op {
+	case setOp:
+		pack := q.value.Pack
+		if c.compress {
+			pack = q.value.PackCompressed
+		}
+		packed, err := pack()
+		if err != nil {
+			log.Fatalf("failed to pack value: %s", err)
+		}
+		if err := c.client.writeCacheValue(q.key, packed); err != nil {
+			log.Printf("failed to write key=%d data=%q: %s", q.key, packed, err)
+		}
+	case removeOp:
+		if err := c.client.removeCacheValue(q.key); err != nil {
+			log.Printf("failed to remove key=%d: %s", q.key, err)
+		}
+	case resetOp:
+		if err := c.client.truncateCache(); err != nil {
+			log.Printf("failed to truncate cache: %s", err)
+		}
+	default:
+		log.Printf("unhandled operation %d", q.op)
 	}
 }
@@ -1,12 +1,28 @@
 package sql
 
 import (
+	"fmt"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/mpolden/zdns/cache"
 )
 
+func newA(i int) *dns.Msg {
+	m := dns.Msg{}
+	name := dns.Fqdn(fmt.Sprintf("r%d.example.com", i))
+	m.SetQuestion(name, dns.TypeA)
+	m.Answer = []dns.RR{&dns.A{
+		A:   net.ParseIP("192.0.2.1"),
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+	}}
+	return &m
+}
+
 func TestCache(t *testing.T) {
 	data1 := "1 1578680472 00000100000100000000000003777777076578616d706c6503636f6d0000010001"
 	v1, err := cache.Unpack(data1)
@@ -60,3 +76,127 @@ func TestCache(t *testing.T) {
 		t.Fatalf("last Key = %d, want %d", got, want)
 	}
 }
+
+func TestCacheCompress(t *testing.T) {
+	client, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCacheWithConfig(client, CacheConfig{Compress: true})
+	v, err := cache.Unpack("1 1578680472 00000100000100000000000003777777076578616d706c6503636f6d0000010001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set(v.Key, v)
+	values := c.Read()
+	if got, want := len(values), 1; got != want {
+		t.Fatalf("len(values) = %d, want %d", got, want)
+	}
+	if got, want := values[0], v; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	entries, err := client.readCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entries[0].Data, "1 1578680472 z1:"; !strings.HasPrefix(got, want) {
+		t.Errorf("Data = %q, want prefix %q", got, want)
+	}
+}
+
+func TestCacheBacklog(t *testing.T) {
+	client, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queue is not consumed until the end of the test
+	c := newCache(client, 10)
+	values := make([]cache.Value, 0, 20)
+	for i := 0; i < 20; i++ {
+		data := "1 1578680472 00000100000100000000000003777777076578616d706c6503636f6d0000010001"
+		v, err := cache.Unpack(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.Key = uint32(i)
+		values = append(values, v)
+	}
+
+	// Repeated writes are coalesced and removals of unwritten keys are discarded
+	for i := 0; i < 5; i++ {
+		c.Set(values[0].Key, values[0])
+	}
+	c.Evict(values[1].Key)
+	if got, want := c.Stats(), (CacheStats{PendingTasks: 1}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	c.Evict(values[0].Key)
+	if got, want := c.Stats(), (CacheStats{PendingTasks: 0}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	// Writes are dropped when the queue is full
+	for _, v := range values {
+		c.Set(v.Key, v)
+	}
+	if got, want := c.Stats(), (CacheStats{PendingTasks: 10, DroppedWrites: 10}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	// Removals are queued when the queue is full
+	c.stored[values[19].Key] = true
+	c.Evict(values[19].Key)
+	if got, want := c.Stats(), (CacheStats{PendingTasks: 11, DroppedWrites: 10}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	// Queued writes are written once the queue is consumed
+	stopped := make(chan bool)
+	go func() {
+		c.readQueue()
+		close(stopped)
+	}()
+	c.notify <- true
+	if got, want := len(c.Read()), 10; got != want {
+		t.Errorf("len(Read()) = %d, want %d", got, want)
+	}
+
+	// Consumer stops when the cache is closed
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue consumer did not stop")
+	}
+	c.Set(values[10].Key, values[10])
+	if got, want := c.Stats().PendingTasks, 0; got != want {
+		t.Errorf("PendingTasks = %d, want %d", got, want)
+	}
+}
+
+func TestCacheBacklogNonBlocking(t *testing.T) {
+	client, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A stalled backend never blocks writes to the DNS cache
+	backend := newCache(client, 10)
+	c := cache.NewWithBackend(100, nil, backend)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10*maxPendingWrites; i++ {
+			c.Set(uint32(i), newA(i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes to cache blocked")
+	}
+	if got, want := backend.Stats().PendingTasks, 10; got != want {
+		t.Errorf("PendingTasks = %d, want %d", got, want)
+	}
+}
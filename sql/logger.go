@@ -20,9 +20,24 @@ const (
 type Logger struct {
 	mode   int
 	queue  chan LogEntry
+	flush  chan bool
 	client *Client
 	wg     sync.WaitGroup
 	now    func() time.Time
+	config LoggerConfig
+}
+
+// LoggerConfig is a structure used to configure batching and maintenance of a Logger.
+type LoggerConfig struct {
+	// BatchSize is the maximum number of entries to write in a single transaction.
+	BatchSize int
+	// BatchInterval is the maximum duration to wait before writing a partial batch. If zero, a partial batch is written
+	// as soon as there are no more pending entries.
+	BatchInterval time.Duration
+	// VacuumInterval is the interval at which the database is vacuumed. If zero, the database is never vacuumed.
+	VacuumInterval time.Duration
+	// ExcludeSubnets contains the subnets of clients whose requests are never logged, regardless of mode.
+	ExcludeSubnets []*net.IPNet
 }
 
 // LogEntry represents a log entry for a DNS request.
@@ -32,7 +47,15 @@ type LogEntry struct {
 	Hijacked   bool
 	Qtype      uint16
 	Question   string
+	TTL        time.Duration
 	Answers    []string
+	// ClientUDPSize is the EDNS UDP payload size advertised by the client. Zero if the client did not use EDNS.
+	ClientUDPSize uint16
+	// UpstreamUDPSize is the EDNS UDP payload size advertised in the answer. Zero if the answer did not use EDNS.
+	UpstreamUDPSize uint16
+	// Resolver is the address of the upstream resolver that answered. Empty if the answer did not come directly from
+	// an upstream resolver.
+	Resolver string
 }
 
 // LogStats contains log statistics.
@@ -42,6 +65,17 @@ type LogStats struct {
 	Hijacked     int64
 	PendingTasks int
 	Events       []LogEvent
+	// DatabaseBytes is the size of the database in bytes.
+	DatabaseBytes int64
+	// Oldest and Newest are the times of the oldest and newest log entries. They are zero if there are no entries.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// QuestionCount contains the number of times a question was asked.
+type QuestionCount struct {
+	Question string
+	Count    int64
 }
 
 // LogEvent contains the number of requests at a point in time.
@@ -52,11 +86,21 @@ type LogEvent struct {
 
 // NewLogger creates a new logger. Persisted entries are kept according to ttl.
 func NewLogger(client *Client, mode int, ttl time.Duration) *Logger {
+	return NewLoggerWithConfig(client, mode, ttl, LoggerConfig{})
+}
+
+// NewLoggerWithConfig creates a new logger which batches writes and maintains the database according to config.
+func NewLoggerWithConfig(client *Client, mode int, ttl time.Duration, config LoggerConfig) *Logger {
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
 	l := &Logger{
 		client: client,
 		queue:  make(chan LogEntry, 1024),
+		flush:  make(chan bool, 1),
 		now:    time.Now,
 		mode:   mode,
+		config: config,
 	}
 	if mode != LogDiscard {
 		go l.readQueue(ttl)
@@ -64,60 +108,105 @@ func NewLogger(client *Client, mode int, ttl time.Duration) *Logger {
 	return l
 }
 
-// Close consumes any outstanding log requests and closes the logger.
+// Close consumes any outstanding log requests, including any partial batch, and closes the logger.
 func (l *Logger) Close() error {
+	select {
+	case l.flush <- true:
+	default: // Flush already pending
+	}
 	l.wg.Wait()
 	return nil
 }
 
-// Record records the given DNS request to the log database.
-func (l *Logger) Record(remoteAddr net.IP, hijacked bool, qtype uint16, question string, answers ...string) {
+// Record records the given DNS request to the log database. The ttl is the lowest TTL of the answers.
+func (l *Logger) Record(remoteAddr net.IP, hijacked bool, qtype uint16, question string, ttl time.Duration, answers ...string) {
+	l.RecordEntry(LogEntry{
+		RemoteAddr: remoteAddr,
+		Hijacked:   hijacked,
+		Qtype:      qtype,
+		Question:   question,
+		TTL:        ttl,
+		Answers:    answers,
+	})
+}
+
+// RecordEntry records the given log entry to the log database. The time of the entry is set to the current time.
+func (l *Logger) RecordEntry(entry LogEntry) {
 	if l.mode == LogDiscard {
 		return
 	}
-	if l.mode == LogHijacked && !hijacked {
+	if l.mode == LogHijacked && !entry.Hijacked {
+		return
+	}
+	if l.excluded(entry.RemoteAddr) {
 		return
 	}
+	entry.Time = l.now()
 	l.wg.Add(1)
-	l.queue <- LogEntry{
-		Time:       l.now(),
-		RemoteAddr: remoteAddr,
-		Hijacked:   hijacked,
-		Qtype:      qtype,
-		Question:   question,
-		Answers:    answers,
+	l.queue <- entry
+}
+
+// excluded returns whether requests from ip are excluded from the log.
+func (l *Logger) excluded(ip net.IP) bool {
+	for _, subnet := range l.config.ExcludeSubnets {
+		if subnet.Contains(ip) {
+			return true
+		}
 	}
+	return false
 }
 
 // Read returns the n most recent log entries.
-func (l *Logger) Read(n int) ([]LogEntry, error) {
-	entries, err := l.client.readLog(n)
+func (l *Logger) Read(n int) ([]LogEntry, error) { return l.ReadBetween(time.Time{}, time.Time{}, n) }
+
+// ReadBetween returns the n most recent log entries logged between from and to, inclusive. A zero from or to leaves the
+// time range unbounded at that end.
+func (l *Logger) ReadBetween(from, to time.Time, n int) ([]LogEntry, error) {
+	entries, err := l.client.readLogBetween(from, to, n)
 	if err != nil {
 		return nil, err
 	}
-	ids := make(map[int64]*LogEntry)
+	// Each answer is a separate row, so rows are merged into one entry per ID
+	indices := make(map[int64]int, len(entries))
 	logEntries := make([]LogEntry, 0, len(entries))
 	for _, le := range entries {
-		entry, ok := ids[le.ID]
+		i, ok := indices[le.ID]
 		if !ok {
-			newEntry := LogEntry{
-				Time:       time.Unix(le.Time, 0).UTC(),
-				RemoteAddr: le.RemoteAddr,
-				Hijacked:   le.Hijacked,
-				Qtype:      le.Qtype,
-				Question:   le.Question,
-			}
-			logEntries = append(logEntries, newEntry)
-			entry = &logEntries[len(logEntries)-1]
-			ids[le.ID] = entry
+			i = len(logEntries)
+			indices[le.ID] = i
+			logEntries = append(logEntries, LogEntry{
+				Time:            time.Unix(le.Time, 0).UTC(),
+				RemoteAddr:      le.RemoteAddr,
+				Hijacked:        le.Hijacked,
+				Qtype:           le.Qtype,
+				Question:        le.Question,
+				TTL:             time.Duration(le.TTL) * time.Second,
+				ClientUDPSize:   le.ClientUDPSize,
+				UpstreamUDPSize: le.UpstreamUDPSize,
+				Resolver:        le.Resolver,
+			})
 		}
 		if le.Answer != "" {
-			entry.Answers = append(entry.Answers, le.Answer)
+			logEntries[i].Answers = append(logEntries[i].Answers, le.Answer)
 		}
 	}
 	return logEntries, nil
 }
 
+// Questions returns the n most frequently asked questions of the client having address addr, and the number of times
+// each question was asked.
+func (l *Logger) Questions(addr net.IP, n int) ([]QuestionCount, error) {
+	questions, err := l.client.questionsByRemoteAddr(addr, n)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]QuestionCount, 0, len(questions))
+	for _, q := range questions {
+		counts = append(counts, QuestionCount{Question: q.Question, Count: q.Count})
+	}
+	return counts, nil
+}
+
 // Stats returns logger statistics. Events will be merged together according to resolution. A zero duration disables
 // merging.
 func (l *Logger) Stats(resolution time.Duration) (LogStats, error) {
@@ -125,6 +214,10 @@ func (l *Logger) Stats(resolution time.Duration) (LogStats, error) {
 	if err != nil {
 		return LogStats{}, err
 	}
+	dbStats, err := l.client.dbStats()
+	if err != nil {
+		return LogStats{}, err
+	}
 	events := make([]LogEvent, 0, len(stats.Events))
 	var last *LogEvent
 	for _, le := range stats.Events {
@@ -139,26 +232,83 @@ func (l *Logger) Stats(resolution time.Duration) (LogStats, error) {
 			last = &events[len(events)-1]
 		}
 	}
-	return LogStats{
-		Since:        time.Unix(stats.Since, 0).UTC(),
-		Total:        stats.Total,
-		Hijacked:     stats.Hijacked,
-		PendingTasks: len(l.queue),
-		Events:       events,
-	}, nil
+	logStats := LogStats{
+		Since:         time.Unix(stats.Since, 0).UTC(),
+		Total:         stats.Total,
+		Hijacked:      stats.Hijacked,
+		PendingTasks:  len(l.queue),
+		Events:        events,
+		DatabaseBytes: dbStats.Bytes,
+	}
+	if stats.Total > 0 {
+		logStats.Oldest = time.Unix(dbStats.Oldest, 0).UTC()
+		logStats.Newest = time.Unix(dbStats.Newest, 0).UTC()
+	}
+	return logStats, nil
 }
 
 func (l *Logger) readQueue(ttl time.Duration) {
-	for e := range l.queue {
-		if err := l.client.writeLog(e.Time, e.RemoteAddr, e.Hijacked, e.Qtype, e.Question, e.Answers...); err != nil {
-			log.Printf("write failed: %+v: %s", e, err)
+	batch := make([]LogEntry, 0, l.config.BatchSize)
+	var timeout <-chan time.Time
+	var vacuum <-chan time.Time
+	if l.config.VacuumInterval > 0 {
+		ticker := time.NewTicker(l.config.VacuumInterval)
+		defer ticker.Stop()
+		vacuum = ticker.C
+	}
+	for {
+		select {
+		case e := <-l.queue:
+			batch = append(batch, e)
+			if len(batch) < l.config.BatchSize && l.config.BatchInterval > 0 {
+				if timeout == nil {
+					timeout = time.After(l.config.BatchInterval)
+				}
+				continue
+			}
+		case <-timeout:
+		case <-l.flush:
+		case <-vacuum:
+			if err := l.client.Vacuum(); err != nil {
+				log.Printf("vacuum failed: %s", err)
+			}
+			continue
 		}
-		if ttl > 0 {
-			t := l.now().Add(-ttl)
-			if err := l.client.deleteLogBefore(t); err != nil {
-				log.Printf("deleting log entries before %v failed: %s", t, err)
+		batch = l.drain(batch, ttl)
+		l.write(batch, ttl)
+		batch = batch[:0]
+		timeout = nil
+	}
+}
+
+// drain reads pending entries without blocking, writing a batch each time batchSize is reached.
+func (l *Logger) drain(batch []LogEntry, ttl time.Duration) []LogEntry {
+	for {
+		select {
+		case e := <-l.queue:
+			batch = append(batch, e)
+			if len(batch) == l.config.BatchSize {
+				l.write(batch, ttl)
+				batch = batch[:0]
 			}
+		default:
+			return batch
+		}
+	}
+}
+
+func (l *Logger) write(batch []LogEntry, ttl time.Duration) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := l.client.writeLogs(batch); err != nil {
+		log.Printf("write of %d entries failed: %s", len(batch), err)
+	}
+	if ttl > 0 {
+		t := l.now().Add(-ttl)
+		if err := l.client.deleteLogBefore(t); err != nil {
+			log.Printf("deleting log entries before %v failed: %s", t, err)
 		}
-		l.wg.Done()
 	}
+	l.wg.Add(-len(batch))
 }
@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"fmt"
 	"net"
 	"reflect"
 	"testing"
@@ -10,7 +11,7 @@ import (
 func TestRecord(t *testing.T) {
 	client := testClient()
 	logger := NewLogger(client, LogAll, 0)
-	logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "example.com.", "192.0.2.1", "192.0.2.2")
+	logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "example.com.", time.Minute, "192.0.2.1", "192.0.2.2")
 	// Flush queue
 	if err := logger.Close(); err != nil {
 		t.Fatal(err)
@@ -24,6 +25,51 @@ func TestRecord(t *testing.T) {
 	}
 }
 
+func TestRecordEntry(t *testing.T) {
+	logger := NewLogger(testClient(), LogAll, 0)
+	logger.RecordEntry(LogEntry{
+		RemoteAddr:      net.IPv4(192, 0, 2, 100),
+		Qtype:           1,
+		Question:        "example.com.",
+		Answers:         []string{"192.0.2.1"},
+		ClientUDPSize:   1232,
+		UpstreamUDPSize: 4096,
+		Resolver:        "192.0.2.53:53",
+	})
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := logger.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Fatalf("len(entries) = %d, want %d", got, want)
+	}
+	e := entries[0]
+	if e.ClientUDPSize != 1232 || e.UpstreamUDPSize != 4096 || e.Resolver != "192.0.2.53:53" {
+		t.Errorf("got %+v, want sizes 1232 and 4096 and resolver 192.0.2.53:53", e)
+	}
+}
+
+func TestRecordDS(t *testing.T) {
+	logger := NewLogger(testClient(), LogAll, 0)
+	logger.Record(net.IPv4(192, 0, 2, 100), false, 43, "example.com.", time.Minute, "12345 8 2 ABCDEF")
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := logger.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Fatalf("len(entries) = %d, want %d", got, want)
+	}
+	if got, want := entries[0].Answers, []string{"12345 8 2 ABCDEF"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Answers = %q, want %q", got, want)
+	}
+}
+
 func TestMode(t *testing.T) {
 	badHost := "badhost1."
 	goodHost := "goodhost1."
@@ -44,7 +90,7 @@ func TestMode(t *testing.T) {
 	for i, tt := range tests {
 		logger := NewLogger(testClient(), tt.mode, 0)
 		logger.mode = tt.mode
-		logger.Record(tt.remoteAddr, tt.hijacked, 1, tt.question)
+		logger.Record(tt.remoteAddr, tt.hijacked, 1, tt.question, 0)
 		if err := logger.Close(); err != nil { // Flush
 			t.Fatal(err)
 		}
@@ -58,12 +104,40 @@ func TestMode(t *testing.T) {
 	}
 }
 
+func TestExcludeSubnets(t *testing.T) {
+	_, lan, err := net.ParseCIDR("192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		remoteAddr net.IP
+		log        bool
+	}{
+		{net.IPv4(192, 0, 2, 100), true},
+		{net.IPv4(192, 168, 1, 100), false},
+	}
+	for i, tt := range tests {
+		logger := NewLoggerWithConfig(testClient(), LogAll, 0, LoggerConfig{ExcludeSubnets: []*net.IPNet{lan}})
+		logger.Record(tt.remoteAddr, true, 1, "badhost1.", 0)
+		if err := logger.Close(); err != nil { // Flush
+			t.Fatal(err)
+		}
+		entries, err := logger.Read(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) > 0 != tt.log {
+			t.Errorf("#%d: request from %s logged = %t, want %t", i, tt.remoteAddr, len(entries) > 0, tt.log)
+		}
+	}
+}
+
 func TestAnswerMerging(t *testing.T) {
 	logger := NewLogger(testClient(), LogAll, 0)
 	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
 	logger.now = func() time.Time { return now }
-	logger.Record(net.IPv4(192, 0, 2, 100), true, 1, "example.com.", "192.0.2.1", "192.0.2.2")
-	logger.Record(net.IPv4(192, 0, 2, 100), true, 1, "2.example.com.")
+	logger.Record(net.IPv4(192, 0, 2, 100), true, 1, "example.com.", time.Minute, "192.0.2.1", "192.0.2.2")
+	logger.Record(net.IPv4(192, 0, 2, 100), true, 1, "2.example.com.", time.Minute)
 	// Flush queue
 	if err := logger.Close(); err != nil {
 		t.Fatal(err)
@@ -80,6 +154,7 @@ func TestAnswerMerging(t *testing.T) {
 			Hijacked:   true,
 			Qtype:      1,
 			Question:   "example.com.",
+			TTL:        time.Minute,
 			Answers:    []string{"192.0.2.2", "192.0.2.1"},
 		},
 		{
@@ -88,18 +163,58 @@ func TestAnswerMerging(t *testing.T) {
 			Hijacked:   true,
 			Qtype:      1,
 			Question:   "2.example.com.",
+			TTL:        time.Minute,
 		}}
 	if !reflect.DeepEqual(want, got) {
 		t.Errorf("Get(1) = %+v, want %+v", got, want)
 	}
 }
 
+func TestBatch(t *testing.T) {
+	var tests = []struct {
+		batchSize     int
+		batchInterval time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{10, 0},
+		{2, time.Hour},
+		{10, time.Hour},
+	}
+	for i, tt := range tests {
+		logger := NewLoggerWithConfig(testClient(), LogAll, 0, LoggerConfig{BatchSize: tt.batchSize, BatchInterval: tt.batchInterval})
+		now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+		logger.now = func() time.Time { return now }
+		logger.Record(net.IPv4(192, 0, 2, 100), true, 1, "example.com.", time.Minute, "192.0.2.1", "192.0.2.2")
+		logger.now = func() time.Time { return now.Add(time.Second) }
+		logger.Record(net.IPv4(192, 0, 2, 100), true, 1, "2.example.com.", time.Minute)
+		logger.now = func() time.Time { return now.Add(2 * time.Second) }
+		logger.Record(net.IPv4(192, 0, 2, 101), false, 28, "3.example.com.", time.Minute, "2001:db8::1")
+		// Flush partial batch
+		if err := logger.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := logger.Read(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []LogEntry{
+			{Time: now.Add(2 * time.Second), RemoteAddr: net.IPv4(192, 0, 2, 101), Qtype: 28, Question: "3.example.com.", TTL: time.Minute, Answers: []string{"2001:db8::1"}},
+			{Time: now.Add(time.Second), RemoteAddr: net.IPv4(192, 0, 2, 100), Hijacked: true, Qtype: 1, Question: "2.example.com.", TTL: time.Minute},
+			{Time: now, RemoteAddr: net.IPv4(192, 0, 2, 100), Hijacked: true, Qtype: 1, Question: "example.com.", TTL: time.Minute, Answers: []string{"192.0.2.2", "192.0.2.1"}},
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("#%d: Read(3) = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
 func TestLogPruning(t *testing.T) {
 	logger := NewLogger(testClient(), LogAll, time.Hour)
 	defer logger.Close()
 	tt := time.Now()
 	logger.now = func() time.Time { return tt }
-	logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "example.com.", "192.0.2.1")
+	logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "example.com.", time.Minute, "192.0.2.1")
 
 	// Wait until queue is flushed
 	ts := time.Now()
@@ -119,7 +234,7 @@ func TestLogPruning(t *testing.T) {
 	// Advance time beyond log TTL
 	tt = tt.Add(time.Hour).Add(time.Second)
 	// Trigger pruning by recording another entry
-	logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "2.example.com.", "192.0.2.2")
+	logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "2.example.com.", time.Minute, "192.0.2.2")
 	for len(entries) > 1 {
 		entries, err = logger.Read(2)
 		if err != nil {
@@ -150,7 +265,7 @@ func TestStats(t *testing.T) {
 		now := time.Now()
 		for i := 0; i < 3; i++ {
 			logger.now = func() time.Time { return now.Add(time.Duration(i) * tt.interval) }
-			logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "example.com.", "192.0.2.1")
+			logger.Record(net.IPv4(192, 0, 2, 100), false, 1, "example.com.", time.Minute, "192.0.2.1")
 			logger.Close()
 		}
 		stats, err := logger.Stats(tt.resolution)
@@ -162,3 +277,29 @@ func TestStats(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkRead(b *testing.B) {
+	client := testClient()
+	logger := NewLogger(client, LogAll, 0)
+	now := time.Now()
+	entries := make([]LogEntry, 0, 5000)
+	for i := 0; i < cap(entries); i++ {
+		entries = append(entries, LogEntry{
+			Time:       now.Add(time.Duration(i) * time.Second),
+			RemoteAddr: net.IPv4(192, 0, 2, byte(i%256)),
+			Qtype:      1,
+			Question:   fmt.Sprintf("%d.example.com.", i%1000),
+			TTL:        time.Minute,
+			Answers:    []string{"192.0.2.1", fmt.Sprintf("192.0.2.%d", i%256)},
+		})
+	}
+	if err := client.writeLogs(entries); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := logger.Read(1000); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
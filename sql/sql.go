@@ -2,6 +2,11 @@ package sql
 
 import (
 	"database/sql"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -41,6 +46,10 @@ CREATE TABLE IF NOT EXISTS log (
   remote_addr_id    INTEGER           NOT NULL,
   rr_type_id        INTEGER           NOT NULL,
   rr_question_id    INTEGER           NOT NULL,
+  ttl               INTEGER           NOT NULL DEFAULT 0,
+  client_udp_size   INTEGER           NOT NULL DEFAULT 0,
+  upstream_udp_size INTEGER           NOT NULL DEFAULT 0,
+  resolver          TEXT              NOT NULL DEFAULT '',
   FOREIGN KEY       (remote_addr_id)  REFERENCES remote_addr(id),
   FOREIGN KEY       (rr_question_id)  REFERENCES rr_question(id),
   FOREIGN KEY       (rr_type_id)      REFERENCES rr_type(id)
@@ -77,13 +86,17 @@ type Client struct {
 }
 
 type logEntry struct {
-	ID         int64  `db:"id"`
-	Time       int64  `db:"time"`
-	RemoteAddr []byte `db:"remote_addr"`
-	Hijacked   bool   `db:"hijacked"`
-	Qtype      uint16 `db:"type"`
-	Question   string `db:"question"`
-	Answer     string `db:"answer"`
+	ID              int64  `db:"id"`
+	Time            int64  `db:"time"`
+	RemoteAddr      []byte `db:"remote_addr"`
+	Hijacked        bool   `db:"hijacked"`
+	Qtype           uint16 `db:"type"`
+	Question        string `db:"question"`
+	TTL             int64  `db:"ttl"`
+	ClientUDPSize   uint16 `db:"client_udp_size"`
+	UpstreamUDPSize uint16 `db:"upstream_udp_size"`
+	Resolver        string `db:"resolver"`
+	Answer          string `db:"answer"`
 }
 
 type logStats struct {
@@ -98,14 +111,39 @@ type logEvent struct {
 	Count int64 `db:"count"`
 }
 
+type dbStats struct {
+	Bytes  int64
+	Oldest int64 `db:"oldest"`
+	Newest int64 `db:"newest"`
+}
+
+type questionCount struct {
+	Question string `db:"question"`
+	Count    int64  `db:"count"`
+}
+
 type cacheEntry struct {
 	Key  uint32 `db:"key"`
 	Data string `db:"data"`
 }
 
+// Config is a structure used to configure a database client. Zero values leave the defaults of the driver unchanged.
+type Config struct {
+	// BusyTimeout is the maximum duration to wait for a lock held by another connection before a query fails.
+	BusyTimeout time.Duration
+	// Synchronous is the synchronous mode of the database. One of OFF, NORMAL, FULL or EXTRA.
+	Synchronous string
+}
+
 // New creates a new database client for given filename.
 func New(filename string) (*Client, error) {
-	db, err := sqlx.Connect("sqlite3", filename)
+	return NewWithConfig(filename, Config{})
+}
+
+// NewWithConfig creates a new database client for given filename, configured according to config. The configuration
+// applies to every connection opened by the client.
+func NewWithConfig(filename string, config Config) (*Client, error) {
+	db, err := sqlx.Connect("sqlite3", dataSourceName(filename, config))
 	if err != nil {
 		return nil, err
 	}
@@ -119,34 +157,110 @@ func New(filename string) (*Client, error) {
 	if _, err := db.Exec(schema); err != nil {
 		return nil, err
 	}
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
 	return &Client{db: db}, nil
 }
 
+// dataSourceName returns the data source name of filename, having options in config set as connection parameters.
+func dataSourceName(filename string, config Config) string {
+	params := url.Values{}
+	if config.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(config.BusyTimeout.Milliseconds(), 10))
+	}
+	if config.Synchronous != "" {
+		params.Set("_synchronous", strings.ToUpper(config.Synchronous))
+	}
+	if len(params) == 0 {
+		return filename
+	}
+	sep := "?"
+	if strings.Contains(filename, "?") {
+		sep = "&"
+	}
+	return filename + sep + params.Encode()
+}
+
+// logColumns contains the columns added to the log table after its initial schema.
+var logColumns = []struct{ name, definition string }{
+	{"ttl", "INTEGER NOT NULL DEFAULT 0"},
+	{"client_udp_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"upstream_udp_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"resolver", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrate adds any columns missing from tables created by an older schema.
+func migrate(db *sqlx.DB) error {
+	for _, column := range logColumns {
+		var n int
+		if err := db.Get(&n, "SELECT COUNT(*) FROM pragma_table_info('log') WHERE name = $1", column.name); err != nil {
+			return err
+		}
+		if n == 0 {
+			if _, err := db.Exec("ALTER TABLE log ADD COLUMN " + column.name + " " + column.definition); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Close waits for all queries to complete and then closes the database.
 func (c *Client) Close() error { return c.db.Close() }
 
+// Vacuum rebuilds the database, reclaiming space left by deleted rows, and updates query planner statistics.
+func (c *Client) Vacuum() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.db.Exec("VACUUM"); err != nil {
+		return err
+	}
+	_, err := c.db.Exec("PRAGMA optimize")
+	return err
+}
+
 func (c *Client) readLog(n int) ([]logEntry, error) {
+	return c.readLogBetween(time.Time{}, time.Time{}, n)
+}
+
+// readLogBetween reads the n most recent log entries logged between from and to, inclusive. A zero from or to leaves
+// the time range unbounded at that end.
+func (c *Client) readLogBetween(from, to time.Time, n int) ([]logEntry, error) {
+	fromUnix := int64(math.MinInt64)
+	if !from.IsZero() {
+		fromUnix = from.Unix()
+	}
+	toUnix := int64(math.MaxInt64)
+	if !to.IsZero() {
+		toUnix = to.Unix()
+	}
 	c.mu.RLock()
 	defer c.mu.RUnlock()
+	// The most recent entries are selected before joining, which avoids joining rows that are later discarded
 	query := `
-SELECT log.id AS id,
+WITH recent AS (SELECT * FROM log WHERE time BETWEEN $1 AND $2 ORDER BY time DESC, id DESC LIMIT $3)
+SELECT recent.id AS id,
        time,
        remote_addr.addr AS remote_addr,
        hijacked,
        type,
        rr_question.name AS question,
+       ttl,
+       client_udp_size,
+       upstream_udp_size,
+       resolver,
        IFNULL(rr_answer.name, "") AS answer
-FROM log
-INNER JOIN remote_addr ON remote_addr.id = log.remote_addr_id
+FROM recent
+INNER JOIN remote_addr ON remote_addr.id = recent.remote_addr_id
 INNER JOIN rr_question ON rr_question.id = rr_question_id
 INNER JOIN rr_type ON rr_type.id = rr_type_id
-LEFT  JOIN log_rr_answer ON log_rr_answer.log_id = log.id
+LEFT  JOIN log_rr_answer ON log_rr_answer.log_id = recent.id
 LEFT  JOIN rr_answer ON rr_answer.id = log_rr_answer.rr_answer_id
-WHERE log.id IN (SELECT id FROM log ORDER BY time DESC, id DESC LIMIT $1)
 ORDER BY time DESC, rr_answer.id DESC
 `
 	var entries []logEntry
-	err := c.db.Select(&entries, query, n)
+	err := c.db.Select(&entries, query, fromUnix, toUnix, n)
 	return entries, err
 }
 
@@ -163,7 +277,19 @@ func getOrInsert(tx *sqlx.Tx, table, column string, value interface{}) (int64, e
 	return id, err
 }
 
-func (c *Client) writeLog(time time.Time, remoteAddr []byte, hijacked bool, qtype uint16, question string, answers ...string) error {
+func (c *Client) writeLog(time time.Time, remoteAddr []byte, hijacked bool, qtype uint16, question string, ttl time.Duration, answers ...string) error {
+	return c.writeLogs([]LogEntry{{
+		Time:       time,
+		RemoteAddr: remoteAddr,
+		Hijacked:   hijacked,
+		Qtype:      qtype,
+		Question:   question,
+		TTL:        ttl,
+		Answers:    answers,
+	}})
+}
+
+func (c *Client) writeLogs(entries []LogEntry) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	tx, err := c.db.Beginx()
@@ -171,20 +297,29 @@ func (c *Client) writeLog(time time.Time, remoteAddr []byte, hijacked bool, qtyp
 		return err
 	}
 	defer tx.Rollback()
-	typeID, err := getOrInsert(tx, "rr_type", "type", qtype)
+	for _, e := range entries {
+		if err := insertLog(tx, e); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func insertLog(tx *sqlx.Tx, entry LogEntry) error {
+	typeID, err := getOrInsert(tx, "rr_type", "type", entry.Qtype)
 	if err != nil {
 		return err
 	}
-	questionID, err := getOrInsert(tx, "rr_question", "name", question)
+	questionID, err := getOrInsert(tx, "rr_question", "name", entry.Question)
 	if err != nil {
 		return err
 	}
-	remoteAddrID, err := getOrInsert(tx, "remote_addr", "addr", remoteAddr)
+	remoteAddrID, err := getOrInsert(tx, "remote_addr", "addr", []byte(normalizeAddr(entry.RemoteAddr)))
 	if err != nil {
 		return err
 	}
-	answerIDs := make([]int64, 0, len(answers))
-	for _, answer := range answers {
+	answerIDs := make([]int64, 0, len(entry.Answers))
+	for _, answer := range entry.Answers {
 		answerID, err := getOrInsert(tx, "rr_answer", "name", answer)
 		if err != nil {
 			return err
@@ -192,10 +327,12 @@ func (c *Client) writeLog(time time.Time, remoteAddr []byte, hijacked bool, qtyp
 		answerIDs = append(answerIDs, answerID)
 	}
 	hijackedInt := 0
-	if hijacked {
+	if entry.Hijacked {
 		hijackedInt = 1
 	}
-	res, err := tx.Exec("INSERT INTO log (time, hijacked, remote_addr_id, rr_type_id, rr_question_id) VALUES ($1, $2, $3, $4, $5)", time.Unix(), hijackedInt, remoteAddrID, typeID, questionID)
+	ttl := int64(entry.TTL / time.Second)
+	res, err := tx.Exec("INSERT INTO log (time, hijacked, remote_addr_id, rr_type_id, rr_question_id, ttl, client_udp_size, upstream_udp_size, resolver) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		entry.Time.Unix(), hijackedInt, remoteAddrID, typeID, questionID, ttl, entry.ClientUDPSize, entry.UpstreamUDPSize, entry.Resolver)
 	if err != nil {
 		return err
 	}
@@ -208,7 +345,7 @@ func (c *Client) writeLog(time time.Time, remoteAddr []byte, hijacked bool, qtyp
 			return err
 		}
 	}
-	return tx.Commit()
+	return nil
 }
 
 func (c *Client) deleteLogBefore(t time.Time) (err error) {
@@ -280,6 +417,63 @@ func (c *Client) readLogStats() (logStats, error) {
 	return stats, nil
 }
 
+// normalizeAddr returns the 16-byte form of IP address ip, so that an IPv4 address is stored in the same form
+// regardless of how it was received. Addresses stored before normalization may still be in 4-byte form.
+func normalizeAddr(ip net.IP) net.IP {
+	if v16 := ip.To16(); v16 != nil {
+		return v16
+	}
+	return ip
+}
+
+// questionsByRemoteAddr returns the distinct questions asked by the client having address addr, and the number of times
+// each question was asked. At most n questions are returned, the most frequently asked first.
+func (c *Client) questionsByRemoteAddr(addr net.IP, n int) ([]questionCount, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	query := `
+SELECT rr_question.name AS question,
+       COUNT(*) AS count
+FROM log
+INNER JOIN remote_addr ON remote_addr.id = log.remote_addr_id
+INNER JOIN rr_question ON rr_question.id = log.rr_question_id
+WHERE remote_addr.addr IN ($1, $2)
+GROUP BY rr_question.id
+ORDER BY count DESC, question ASC
+LIMIT $3
+`
+	// An IPv4 address is stored in its 16-byte form, but may have been stored in 4-byte form before normalization
+	v4, v16 := []byte(addr.To4()), []byte(normalizeAddr(addr))
+	if v4 == nil {
+		v4 = v16
+	}
+	var questions []questionCount
+	err := c.db.Select(&questions, query, v4, v16, n)
+	return questions, err
+}
+
+// dbStats returns the size of the database and the time range of its log entries.
+func (c *Client) dbStats() (dbStats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var stats dbStats
+	q := `SELECT IFNULL(MIN(time), 0) AS oldest,
+                     IFNULL(MAX(time), 0) AS newest
+              FROM log`
+	if err := c.db.Get(&stats, q); err != nil {
+		return dbStats{}, err
+	}
+	var pageCount, pageSize int64
+	if err := c.db.Get(&pageCount, "PRAGMA page_count"); err != nil {
+		return dbStats{}, err
+	}
+	if err := c.db.Get(&pageSize, "PRAGMA page_size"); err != nil {
+		return dbStats{}, err
+	}
+	stats.Bytes = pageCount * pageSize
+	return stats, nil
+}
+
 func (c *Client) writeCacheValue(key uint32, data string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -2,12 +2,16 @@ package sql
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/jmoiron/sqlx"
 )
 
 type rowCount struct {
@@ -22,23 +26,24 @@ var tests = []struct {
 	answers    []string
 	t          time.Time
 	remoteAddr net.IP
+	ttl        time.Duration
 	rowCounts  []rowCount
 }{
-	{"foo.example.com", 1, false, []string{"192.0.2.1"}, time.Date(2019, 6, 15, 22, 15, 10, 0, time.UTC), net.IPv4(192, 0, 2, 100),
+	{"foo.example.com", 1, false, []string{"192.0.2.1"}, time.Date(2019, 6, 15, 22, 15, 10, 0, time.UTC), net.IPv4(192, 0, 2, 100), time.Minute,
 		[]rowCount{{"rr_question", 1}, {"rr_answer", 1}, {"log", 1}, {"rr_type", 1}, {"remote_addr", 1}}},
-	{"foo.example.com", 1, true, []string{"192.0.2.1"}, time.Date(2019, 6, 15, 22, 16, 20, 0, time.UTC), net.IPv4(192, 0, 2, 100),
+	{"foo.example.com", 1, true, []string{"192.0.2.1"}, time.Date(2019, 6, 15, 22, 16, 20, 0, time.UTC), net.IPv4(192, 0, 2, 100), time.Minute,
 		[]rowCount{{"rr_question", 1}, {"rr_answer", 1}, {"log", 2}, {"rr_type", 1}, {"remote_addr", 1}}},
-	{"bar.example.com", 1, false, []string{"192.0.2.2"}, time.Date(2019, 6, 15, 22, 17, 30, 0, time.UTC), net.IPv4(192, 0, 2, 101),
+	{"bar.example.com", 1, false, []string{"192.0.2.2"}, time.Date(2019, 6, 15, 22, 17, 30, 0, time.UTC), net.IPv4(192, 0, 2, 101), time.Minute,
 		[]rowCount{{"rr_question", 2}, {"rr_answer", 2}, {"log", 3}, {"rr_type", 1}, {"remote_addr", 2}}},
-	{"bar.example.com", 1, false, []string{"192.0.2.2"}, time.Date(2019, 6, 15, 22, 18, 40, 0, time.UTC), net.IPv4(192, 0, 2, 102),
+	{"bar.example.com", 1, false, []string{"192.0.2.2"}, time.Date(2019, 6, 15, 22, 18, 40, 0, time.UTC), net.IPv4(192, 0, 2, 102), time.Minute,
 		[]rowCount{{"rr_question", 2}, {"rr_answer", 2}, {"log", 4}, {"rr_type", 1}, {"remote_addr", 3}}},
-	{"bar.example.com", 28, false, []string{"2001:db8::1"}, time.Date(2019, 6, 15, 23, 4, 40, 0, time.UTC), net.IPv4(192, 0, 2, 102),
+	{"bar.example.com", 28, false, []string{"2001:db8::1"}, time.Date(2019, 6, 15, 23, 4, 40, 0, time.UTC), net.IPv4(192, 0, 2, 102), time.Minute,
 		[]rowCount{{"rr_question", 2}, {"rr_answer", 3}, {"log", 5}, {"rr_type", 2}, {"remote_addr", 3}}},
-	{"bar.example.com", 28, false, []string{"2001:db8::2", "2001:db8::3"}, time.Date(2019, 6, 15, 23, 35, 0, 0, time.UTC), net.IPv4(192, 0, 2, 102),
+	{"bar.example.com", 28, false, []string{"2001:db8::2", "2001:db8::3"}, time.Date(2019, 6, 15, 23, 35, 0, 0, time.UTC), net.IPv4(192, 0, 2, 102), time.Minute,
 		[]rowCount{{"rr_question", 2}, {"rr_answer", 5}, {"log", 6}, {"rr_type", 2}, {"remote_addr", 3}}},
-	{"baz.example.com", 28, false, []string{"2001:db8::4"}, time.Date(2019, 6, 15, 23, 35, 0, 0, time.UTC), net.IPv4(192, 0, 2, 102),
+	{"baz.example.com", 28, false, []string{"2001:db8::4"}, time.Date(2019, 6, 15, 23, 35, 0, 0, time.UTC), net.IPv4(192, 0, 2, 102), time.Minute,
 		[]rowCount{{"rr_question", 3}, {"rr_answer", 6}, {"log", 7}, {"rr_type", 2}, {"remote_addr", 3}}},
-	{"baz.example.com", 28, false, nil, time.Date(2019, 6, 16, 1, 5, 0, 0, time.UTC), net.IPv4(192, 0, 2, 102),
+	{"baz.example.com", 28, false, nil, time.Date(2019, 6, 16, 1, 5, 0, 0, time.UTC), net.IPv4(192, 0, 2, 102), time.Minute,
 		[]rowCount{{"rr_question", 3}, {"rr_answer", 6}, {"log", 8}, {"rr_type", 2}, {"remote_addr", 3}}},
 }
 
@@ -60,8 +65,38 @@ func count(t *testing.T, client *Client, query string, args ...interface{}) int
 
 func writeTests(c *Client, t *testing.T) {
 	for i, tt := range tests {
-		if err := c.writeLog(tt.t, tt.remoteAddr, tt.hijacked, tt.qtype, tt.question, tt.answers...); err != nil {
-			t.Errorf("#%d: WriteLog(%q, %s, %t, %d, %q, %q) = %s, want nil", i, tt.t, tt.remoteAddr.String(), tt.hijacked, tt.qtype, tt.question, tt.answers, err)
+		if err := c.writeLog(tt.t, tt.remoteAddr, tt.hijacked, tt.qtype, tt.question, tt.ttl, tt.answers...); err != nil {
+			t.Errorf("#%d: WriteLog(%q, %s, %t, %d, %q, %s, %q) = %s, want nil", i, tt.t, tt.remoteAddr.String(), tt.hijacked, tt.qtype, tt.question, tt.ttl, tt.answers, err)
+		}
+	}
+}
+
+func TestNewWithConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	c, err := NewWithConfig(f.Name(), Config{BusyTimeout: 1234 * time.Millisecond, Synchronous: "normal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Options apply to every connection in the pool
+	c.db.SetMaxIdleConns(0)
+	for i := 0; i < 2; i++ {
+		var busyTimeout, synchronous int
+		if err := c.db.Get(&busyTimeout, "PRAGMA busy_timeout"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := busyTimeout, 1234; got != want {
+			t.Errorf("busy_timeout = %d, want %d", got, want)
+		}
+		if err := c.db.Get(&synchronous, "PRAGMA synchronous"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := synchronous, 1; got != want { // NORMAL
+			t.Errorf("synchronous = %d, want %d", got, want)
 		}
 	}
 }
@@ -69,8 +104,8 @@ func writeTests(c *Client, t *testing.T) {
 func TestWriteLog(t *testing.T) {
 	c := testClient()
 	for i, tt := range tests {
-		if err := c.writeLog(tt.t, tt.remoteAddr, tt.hijacked, tt.qtype, tt.question, tt.answers...); err != nil {
-			t.Errorf("#%d: WriteLog(%q, %s, %t, %d, %q, %q) = %s, want nil", i, tt.t, tt.remoteAddr.String(), tt.hijacked, tt.qtype, tt.question, tt.answers, err)
+		if err := c.writeLog(tt.t, tt.remoteAddr, tt.hijacked, tt.qtype, tt.question, tt.ttl, tt.answers...); err != nil {
+			t.Errorf("#%d: WriteLog(%q, %s, %t, %d, %q, %s, %q) = %s, want nil", i, tt.t, tt.remoteAddr.String(), tt.hijacked, tt.qtype, tt.question, tt.ttl, tt.answers, err)
 		}
 		for _, rowCount := range tt.rowCounts {
 			rows := count(t, c, "SELECT COUNT(*) FROM "+rowCount.table+" LIMIT 1")
@@ -85,17 +120,17 @@ func TestReadLog(t *testing.T) {
 	c := testClient()
 	writeTests(c, t)
 	allEntries := [][]logEntry{
-		{{ID: 8, Question: "baz.example.com", Qtype: 28, Time: 1560647100, RemoteAddr: net.IPv4(192, 0, 2, 102)}},
-		{{ID: 7, Question: "baz.example.com", Qtype: 28, Answer: "2001:db8::4", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102)}},
+		{{ID: 8, Question: "baz.example.com", Qtype: 28, Time: 1560647100, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60}},
+		{{ID: 7, Question: "baz.example.com", Qtype: 28, Answer: "2001:db8::4", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60}},
 		{
-			{ID: 6, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::3", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102)},
-			{ID: 6, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::2", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102)},
+			{ID: 6, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::3", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60},
+			{ID: 6, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::2", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60},
 		},
-		{{ID: 5, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::1", Time: 1560639880, RemoteAddr: net.IPv4(192, 0, 2, 102)}},
-		{{ID: 4, Question: "bar.example.com", Qtype: 1, Answer: "192.0.2.2", Time: 1560637120, RemoteAddr: net.IPv4(192, 0, 2, 102)}},
-		{{ID: 3, Question: "bar.example.com", Qtype: 1, Answer: "192.0.2.2", Time: 1560637050, RemoteAddr: net.IPv4(192, 0, 2, 101)}},
-		{{ID: 2, Question: "foo.example.com", Qtype: 1, Answer: "192.0.2.1", Time: 1560636980, RemoteAddr: net.IPv4(192, 0, 2, 100), Hijacked: true}},
-		{{ID: 1, Question: "foo.example.com", Qtype: 1, Answer: "192.0.2.1", Time: 1560636910, RemoteAddr: net.IPv4(192, 0, 2, 100)}},
+		{{ID: 5, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::1", Time: 1560639880, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60}},
+		{{ID: 4, Question: "bar.example.com", Qtype: 1, Answer: "192.0.2.2", Time: 1560637120, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60}},
+		{{ID: 3, Question: "bar.example.com", Qtype: 1, Answer: "192.0.2.2", Time: 1560637050, RemoteAddr: net.IPv4(192, 0, 2, 101), TTL: 60}},
+		{{ID: 2, Question: "foo.example.com", Qtype: 1, Answer: "192.0.2.1", Time: 1560636980, RemoteAddr: net.IPv4(192, 0, 2, 100), Hijacked: true, TTL: 60}},
+		{{ID: 1, Question: "foo.example.com", Qtype: 1, Answer: "192.0.2.1", Time: 1560636910, RemoteAddr: net.IPv4(192, 0, 2, 100), TTL: 60}},
 	}
 	for n := 1; n <= len(allEntries); n++ {
 		var want []logEntry
@@ -120,6 +155,107 @@ func TestReadLog(t *testing.T) {
 	}
 }
 
+func TestReadLogBetween(t *testing.T) {
+	c := testClient()
+	writeTests(c, t)
+	var tests = []struct {
+		from time.Time
+		to   time.Time
+		n    int
+		ids  []int64
+	}{
+		{time.Time{}, time.Time{}, 100, []int64{8, 7, 6, 5, 4, 3, 2, 1}},
+		{time.Date(2019, 6, 15, 22, 16, 20, 0, time.UTC), time.Date(2019, 6, 15, 23, 4, 40, 0, time.UTC), 100, []int64{5, 4, 3, 2}},
+		{time.Date(2019, 6, 15, 22, 16, 20, 0, time.UTC), time.Date(2019, 6, 15, 23, 4, 40, 0, time.UTC), 2, []int64{5, 4}},
+		{time.Date(2019, 6, 15, 23, 35, 0, 0, time.UTC), time.Time{}, 100, []int64{8, 7, 6}},
+		{time.Time{}, time.Date(2019, 6, 15, 22, 16, 19, 0, time.UTC), 100, []int64{1}},
+		{time.Date(2019, 6, 16, 0, 0, 0, 0, time.UTC), time.Date(2019, 6, 16, 1, 0, 0, 0, time.UTC), 100, nil},
+	}
+	for i, tt := range tests {
+		entries, err := c.readLogBetween(tt.from, tt.to, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, e := range entries {
+			if len(ids) == 0 || ids[len(ids)-1] != e.ID {
+				ids = append(ids, e.ID)
+			}
+		}
+		if !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("#%d: readLogBetween(%s, %s, %d) returned IDs %v, want %v", i, tt.from, tt.to, tt.n, ids, tt.ids)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	f, err := ioutil.TempFile("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	// Create log table without columns added later
+	db, err := sqlx.Connect("sqlite3", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSchema := `
+CREATE TABLE log (
+  id                INTEGER           PRIMARY KEY,
+  time              INTEGER           NOT NULL,
+  hijacked          INTEGER           NOT NULL,
+  remote_addr_id    INTEGER           NOT NULL,
+  rr_type_id        INTEGER           NOT NULL,
+  rr_question_id    INTEGER           NOT NULL
+);
+INSERT INTO log (time, hijacked, remote_addr_id, rr_type_id, rr_question_id) VALUES (1560636910, 0, 1, 1, 1);
+`
+	if _, err := db.Exec(oldSchema); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	c, err := New(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, want := count(t, c, "SELECT COUNT(*) FROM log WHERE ttl = 0"), 1; got != want {
+		t.Errorf("got %d rows with ttl = 0, want %d", got, want)
+	}
+	if got, want := count(t, c, "SELECT COUNT(*) FROM log WHERE client_udp_size = 0 AND upstream_udp_size = 0"), 1; got != want {
+		t.Errorf("got %d rows without udp size, want %d", got, want)
+	}
+	if got, want := count(t, c, "SELECT COUNT(*) FROM log WHERE resolver = ''"), 1; got != want {
+		t.Errorf("got %d rows without resolver, want %d", got, want)
+	}
+	if err := c.writeLog(time.Now(), net.IPv4(192, 0, 2, 100), false, 1, "example.com.", time.Minute, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count(t, c, "SELECT COUNT(*) FROM log WHERE ttl = 60"), 1; got != want {
+		t.Errorf("got %d rows with ttl = 60, want %d", got, want)
+	}
+	// Migrating again is a no-op
+	if err := migrate(c.db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	c := testClient()
+	writeTests(c, t)
+	if err := c.deleteLogBefore(tests[len(tests)-1].t); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count(t, c, "SELECT COUNT(*) FROM log"), 1; got != want {
+		t.Errorf("got %d rows in log, want %d", got, want)
+	}
+}
+
 func TestDeleteLogBefore(t *testing.T) {
 	c := testClient()
 	writeTests(c, t)
@@ -129,13 +265,13 @@ func TestDeleteLogBefore(t *testing.T) {
 	}
 
 	want := []logEntry{
-		{ID: 8, Question: "baz.example.com", Qtype: 28, Time: 1560647100, RemoteAddr: net.IPv4(192, 0, 2, 102)},
-		{ID: 7, Question: "baz.example.com", Qtype: 28, Answer: "2001:db8::4", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102)},
-		{ID: 6, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::3", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102)},
-		{ID: 6, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::2", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102)},
-		{ID: 5, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::1", Time: 1560639880, RemoteAddr: net.IPv4(192, 0, 2, 102)},
-		{ID: 4, Question: "bar.example.com", Qtype: 1, Answer: "192.0.2.2", Time: 1560637120, RemoteAddr: net.IPv4(192, 0, 2, 102)},
-		{ID: 3, Question: "bar.example.com", Qtype: 1, Answer: "192.0.2.2", Time: 1560637050, RemoteAddr: net.IPv4(192, 0, 2, 101)},
+		{ID: 8, Question: "baz.example.com", Qtype: 28, Time: 1560647100, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60},
+		{ID: 7, Question: "baz.example.com", Qtype: 28, Answer: "2001:db8::4", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60},
+		{ID: 6, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::3", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60},
+		{ID: 6, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::2", Time: 1560641700, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60},
+		{ID: 5, Question: "bar.example.com", Qtype: 28, Answer: "2001:db8::1", Time: 1560639880, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60},
+		{ID: 4, Question: "bar.example.com", Qtype: 1, Answer: "192.0.2.2", Time: 1560637120, RemoteAddr: net.IPv4(192, 0, 2, 102), TTL: 60},
+		{ID: 3, Question: "bar.example.com", Qtype: 1, Answer: "192.0.2.2", Time: 1560637050, RemoteAddr: net.IPv4(192, 0, 2, 101), TTL: 60},
 	}
 	n := 10
 	got, err := c.readLog(n)
@@ -169,7 +305,7 @@ func TestInterleavedRW(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		for range ch {
-			err = c.writeLog(time.Now(), net.IPv4(127, 0, 0, 1), false, 1, "example.com.", "192.0.2.1")
+			err = c.writeLog(time.Now(), net.IPv4(127, 0, 0, 1), false, 1, "example.com.", time.Minute, "192.0.2.1")
 		}
 	}()
 	ch <- true
@@ -183,6 +319,83 @@ func TestInterleavedRW(t *testing.T) {
 	}
 }
 
+func TestDBStats(t *testing.T) {
+	c := testClient()
+	stats, err := c.dbStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats, (dbStats{Bytes: stats.Bytes}); got != want {
+		t.Errorf("dbStats() = %+v, want %+v", got, want)
+	}
+	writeTests(c, t)
+	stats, err = c.dbStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Bytes <= 0 {
+		t.Errorf("Bytes = %d, want > 0", stats.Bytes)
+	}
+	if got, want := stats.Oldest, int64(1560636910); got != want {
+		t.Errorf("Oldest = %d, want %d", got, want)
+	}
+	if got, want := stats.Newest, int64(1560647100); got != want {
+		t.Errorf("Newest = %d, want %d", got, want)
+	}
+}
+
+func TestWriteLogNormalizesAddr(t *testing.T) {
+	c := testClient()
+	addrs := []net.IP{net.IPv4(192, 0, 2, 5).To4(), net.IPv4(192, 0, 2, 5), net.ParseIP("::ffff:192.0.2.5")}
+	for i, addr := range addrs {
+		if err := c.writeLog(time.Now(), addr, false, 1, "example.com.", time.Minute); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+	}
+	if got, want := count(t, c, "SELECT COUNT(*) FROM remote_addr"), 1; got != want {
+		t.Errorf("got %d rows in remote_addr, want %d", got, want)
+	}
+	questions, err := c.questionsByRemoteAddr(net.IPv4(192, 0, 2, 5).To4(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []questionCount{{Question: "example.com.", Count: 3}}; !reflect.DeepEqual(questions, want) {
+		t.Errorf("questionsByRemoteAddr() = %+v, want %+v", questions, want)
+	}
+}
+
+func TestQuestionsByRemoteAddr(t *testing.T) {
+	c := testClient()
+	// Addresses are matched regardless of whether they are stored in 4-byte or 16-byte form
+	client1, client2 := net.IPv4(192, 0, 2, 5), net.IPv4(192, 0, 2, 6).To4()
+	now := time.Now()
+	for _, q := range []string{"example.com.", "example.com.", "example.net."} {
+		if err := c.writeLog(now, client1, false, 1, q, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.writeLog(now, client2, false, 1, "example.org.", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		addr net.IP
+		want []questionCount
+	}{
+		{client1, []questionCount{{"example.com.", 2}, {"example.net.", 1}}},
+		{client2.To16(), []questionCount{{"example.org.", 1}}},
+		{net.IPv4(192, 0, 2, 7), nil},
+	}
+	for i, tt := range tests {
+		got, err := c.questionsByRemoteAddr(tt.addr, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("#%d: questionsByRemoteAddr(%s) = %+v, want %+v", i, tt.addr, got, tt.want)
+		}
+	}
+}
+
 func TestReadLogStats(t *testing.T) {
 	c := testClient()
 
@@ -222,7 +435,7 @@ func TestReadLogStats(t *testing.T) {
 func BenchmarkReadLog(b *testing.B) {
 	c := testClient()
 	for i := 0; i < 1000; i++ {
-		if err := c.writeLog(time.Now(), net.ParseIP("127.0.0.1"), false, 1, "example.com.", "192.0.2.1"); err != nil {
+		if err := c.writeLog(time.Now(), net.ParseIP("127.0.0.1"), false, 1, "example.com.", time.Minute, "192.0.2.1"); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -239,7 +452,7 @@ func BenchmarkDeleteLogBefore(b *testing.B) {
 		// Generate test data with many unique values for each column
 		for i := 0; i < 16; i++ {
 			for j := 0; j < 256; j++ {
-				if err := c.writeLog(time.Now(), net.ParseIP(fmt.Sprintf("127.0.%d.%d", i, j)), false, 1, fmt.Sprintf("%d-%d.example.com.", i, j), fmt.Sprintf("127.1.%d.%d", i, j)); err != nil {
+				if err := c.writeLog(time.Now(), net.ParseIP(fmt.Sprintf("127.0.%d.%d", i, j)), false, 1, fmt.Sprintf("%d-%d.example.com.", i, j), time.Minute, fmt.Sprintf("127.1.%d.%d", i, j)); err != nil {
 					b.Fatal(err)
 				}
 			}
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package zdns
+
+import (
+	"io"
+	"log/syslog"
+)
+
+const syslogSupported = true
+
+// NewSyslogWriter returns a writer which logs to the system log daemon using the daemon facility and given tag.
+func NewSyslogWriter(tag string) (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package zdns
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+const syslogSupported = false
+
+// NewSyslogWriter returns an error as syslog is not supported on this platform.
+func NewSyslogWriter(tag string) (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on %s", runtime.GOOS)
+}